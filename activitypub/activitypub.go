@@ -0,0 +1,217 @@
+package activitypub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/netguard"
+)
+
+// ContentType is the media type of ActivityPub documents.
+const ContentType = "application/activity+json"
+
+// Context is the JSON-LD context of documents.
+var Context = []interface{}{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+// Public is the special collection addressing an activity to everyone.
+const Public = "https://www.w3.org/ns/activitystreams#Public"
+
+// Actor is a person or service which has an inbox, such as an author of the site or
+// an account on another server.
+type Actor struct {
+	Context           interface{} `json:"@context,omitempty"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Name              string      `json:"name"`
+	Summary           string      `json:"summary,omitempty"`
+	URL               string      `json:"url,omitempty"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox,omitempty"`
+	Followers         string      `json:"followers,omitempty"`
+	Endpoints         *Endpoints  `json:"endpoints,omitempty"`
+	PublicKey         PublicKey   `json:"publicKey"`
+}
+
+// Endpoints lists optional endpoints of an actor.
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+// PublicKey is the key with which an actor signs its requests.
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// SharedInbox returns the shared inbox of actor, or its own inbox if it has none.
+func (actor Actor) SharedInbox() string {
+	if actor.Endpoints != nil && actor.Endpoints.SharedInbox != "" {
+		return actor.Endpoints.SharedInbox
+	}
+	return actor.Inbox
+}
+
+// Activity is an activity received in an inbox. Object is kept as it was sent, since it may be
+// an ID or an embedded object, see ObjectID and Note.
+type Activity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// ObjectID returns the ID of the object of activity, whether it is given as an ID or embedded.
+func (activity Activity) ObjectID() string {
+	var id string
+	if json.Unmarshal(activity.Object, &id) == nil {
+		return id
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(activity.Object, &object)
+	return object.ID
+}
+
+// Embedded returns the object of activity if it is embedded, such as the Follow of an Undo
+// or the Note of a Create. Returns "object not embedded" error if only its ID is given.
+func (activity Activity) Embedded() (Activity, error) {
+	var object Activity
+	if len(activity.Object) == 0 || activity.Object[0] != '{' {
+		return object, errors.New("object not embedded")
+	}
+	err := json.Unmarshal(activity.Object, &object)
+	return object, err
+}
+
+// Note is an object such as a reply posted on another server.
+type Note struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	AttributedTo string `json:"attributedTo"`
+	InReplyTo    string `json:"inReplyTo"`
+	Content      string `json:"content"`
+	URL          string `json:"url"`
+	Published    string `json:"published"`
+}
+
+// Note returns the object of activity as a Note.
+func (activity Activity) Note() (Note, error) {
+	var note Note
+	if len(activity.Object) == 0 || activity.Object[0] != '{' {
+		return note, errors.New("object not embedded")
+	}
+	// url and attributedTo may also be objects or lists, which are left empty
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(activity.Object, &fields)
+	if err != nil {
+		return note, err
+	}
+	for key, target := range map[string]*string{
+		"id": &note.ID, "type": &note.Type, "attributedTo": &note.AttributedTo, "inReplyTo": &note.InReplyTo,
+		"content": &note.Content, "url": &note.URL, "published": &note.Published,
+	} {
+		json.Unmarshal(fields[key], target)
+	}
+	return note, nil
+}
+
+// AllowPrivate allows requests to loopback and private network addresses, which are refused
+// otherwise since actor documents and inboxes are named by other servers.
+var AllowPrivate bool
+
+// Client sends requests to other servers.
+var Client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: netguard.Control(func() bool { return AllowPrivate }),
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+}
+
+// Fetch gets document at address into v. The request is signed with key if it has a KeyID,
+// since servers in secure mode refuse unsigned requests.
+func Fetch(address string, key Key, v interface{}) error {
+	request, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", ContentType+`, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`)
+	request.Header.Set("User-Agent", "Vertigo-ActivityPub")
+	if key.ID != "" {
+		err = key.Sign(request, nil)
+		if err != nil {
+			return err
+		}
+	}
+	response, err := Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == 404 || response.StatusCode == 410 {
+		return errors.New("not found")
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", address, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(v)
+}
+
+// FetchActor gets the actor at address. Returns "actor invalid" error if the document has no
+// inbox or public key of its own, or if its ID is not address, since a server could otherwise
+// serve a document which claims to be an actor of another server.
+func FetchActor(address string, key Key) (Actor, error) {
+	var actor Actor
+	err := Fetch(address, key, &actor)
+	if err != nil {
+		return actor, err
+	}
+	if actor.ID != address || actor.Inbox == "" || actor.PublicKey.PublicKeyPem == "" || actor.PublicKey.Owner != actor.ID {
+		return actor, errors.New("actor invalid")
+	}
+	return actor, nil
+}
+
+// Post sends activity to inbox, signed with key.
+func Post(inbox string, key Key, activity []byte) error {
+	request, err := http.NewRequest("POST", inbox, bytes.NewReader(activity))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", ContentType)
+	request.Header.Set("User-Agent", "Vertigo-ActivityPub")
+	err = key.Sign(request, activity)
+	if err != nil {
+		return err
+	}
+	response, err := Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("inbox responded %s", response.Status)
+	}
+	return nil
+}
+
+// Owner returns the actor a key ID belongs to, which is the key ID without its fragment.
+func Owner(keyID string) string {
+	owner, _, _ := strings.Cut(keyID, "#")
+	return owner
+}
@@ -0,0 +1,4 @@
+// Package activitypub implements the parts of ActivityPub (https://www.w3.org/TR/activitypub/)
+// which federating with Mastodon-style servers needs: activity and actor types, fetching and
+// posting signed requests and verifying HTTP signatures of requests sent to an inbox.
+package activitypub
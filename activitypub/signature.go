@@ -0,0 +1,185 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxClockSkew is how far the Date header of a signed request may be from the current time.
+const MaxClockSkew = 12 * time.Hour
+
+// Key is a private key with which requests are signed on behalf of the actor owning key ID.
+type Key struct {
+	// ID is the ID of the public key of the actor, such as https://example.com/ap/user/1#main-key.
+	ID            string
+	PrivateKeyPem string
+}
+
+// NewKey generates an RSA key pair and returns its private and public keys PEM encoded.
+func NewKey() (string, string, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})), nil
+}
+
+// Digest returns the value of the Digest header of body.
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString returns the string which is signed for headers of request.
+func signingString(request *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, header := range headers {
+		var value string
+		switch header {
+		case "(request-target)":
+			// received requests are checked against the URI as it was sent, since routers
+			// may add parameters to URL
+			uri := request.RequestURI
+			if uri == "" {
+				uri = request.URL.RequestURI()
+			}
+			value = strings.ToLower(request.Method) + " " + uri
+		case "host":
+			value = request.Host
+			if value == "" {
+				value = request.URL.Host
+			}
+		default:
+			values := request.Header.Values(header)
+			if len(values) == 0 {
+				return "", fmt.Errorf("signed header %s missing", header)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines = append(lines, header+": "+value)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Sign sets Date, Digest and Signature headers of request, signing (request-target), host,
+// date and digest of body with key. Body is nil for GET requests, which have no digest.
+func (key Key) Sign(request *http.Request, body []byte) error {
+	block, _ := pem.Decode([]byte(key.PrivateKeyPem))
+	if block == nil {
+		return errors.New("private key invalid")
+	}
+	private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		request.Header.Set("Digest", Digest(body))
+		headers = append(headers, "digest")
+	}
+	s, err := signingString(request, headers)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(s))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		key.ID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// signatureParams parses the Signature header of request.
+func signatureParams(request *http.Request) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(request.Header.Get("Signature"), ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[key] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+// KeyID returns the ID of the key request claims to be signed with, or an empty string
+// if it is not signed.
+func KeyID(request *http.Request) string {
+	return signatureParams(request)["keyId"]
+}
+
+// Verify checks the signature of request and its body with publicKeyPem. The signature has to
+// cover (request-target), host and date, and digest of the body of POST requests, and the date
+// has to be within MaxClockSkew. Returns "signature invalid" error if the request is not signed
+// as required.
+func Verify(request *http.Request, body []byte, publicKeyPem string) error {
+	invalid := errors.New("signature invalid")
+	params := signatureParams(request)
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if request.Method == "POST" {
+		required = append(required, "digest")
+		if request.Header.Get("Digest") != Digest(body) {
+			return invalid
+		}
+	}
+	for _, header := range required {
+		found := false
+		for _, h := range headers {
+			found = found || h == header
+		}
+		if !found {
+			return invalid
+		}
+	}
+	date, err := http.ParseTime(request.Header.Get("Date"))
+	if err != nil || time.Since(date) > MaxClockSkew || time.Until(date) > MaxClockSkew {
+		return invalid
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return invalid
+	}
+	block, _ := pem.Decode([]byte(publicKeyPem))
+	if block == nil {
+		return errors.New("public key invalid")
+	}
+	var public *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		public, _ = parsed.(*rsa.PublicKey)
+	} else {
+		public, _ = x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	if public == nil {
+		return errors.New("public key invalid")
+	}
+	s, err := signingString(request, headers)
+	if err != nil {
+		return invalid
+	}
+	hash := sha256.Sum256([]byte(s))
+	if rsa.VerifyPKCS1v15(public, crypto.SHA256, hash[:], signature) != nil {
+		return invalid
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/render"
+)
+
+// Format identifies Vertigo archives in their manifest.
+const Format = "vertigo-export"
+
+// Version is the archive version written by Export.
+const Version = 2
+
+// MediaDirectory is the directory of files uploaded through Micropub, see Options.Media.
+var MediaDirectory = "media"
+
+// Options controls what is included in an archive.
+type Options struct {
+	// Digests includes password digests of users. Without them users have to recover their passwords after import.
+	Digests bool `json:"digests"`
+	// CookieHash includes the secret used to sign session cookies. Without it a new secret is generated on import,
+	// which logs everyone out.
+	CookieHash bool `json:"cookiehash"`
+	// Secrets includes the SMTP password of the site, private keys of ActivityPub actors, secrets of webhooks
+	// and the outbox, whose messages may contain password reset links. Without them actors and webhooks are
+	// given new keys and secrets on import, which other servers and webhook receivers have to learn again.
+	Secrets bool `json:"secrets"`
+	// Themes includes installed themes.
+	Themes bool `json:"themes"`
+	// Media includes files uploaded through Micropub, which posts may link to.
+	Media bool `json:"media"`
+}
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format  string   `json:"format"`
+	Version int      `json:"version"`
+	Created int64    `json:"created"`
+	Options Options  `json:"options"`
+	Users   int      `json:"users"`
+	Posts   int      `json:"posts"`
+	Themes  []string `json:"themes"`
+	// Media is the number of uploaded files in the archive. It was added in version 2.
+	Media int `json:"media"`
+}
+
+// Export writes an archive of the site to w.
+func Export(w io.Writer, options Options) (*Manifest, error) {
+	data, err := Dump()
+	if err != nil {
+		return nil, err
+	}
+	if !options.Digests {
+		for i := range data.Users {
+			data.Users[i].Digest = nil
+		}
+		// tokens are useless without their digests
+		data.Tokens = []TokenRecord{}
+	}
+	if !options.CookieHash && data.Settings != nil {
+		data.Settings.CookieHash = ""
+	}
+	if !options.Secrets {
+		if data.Settings != nil {
+			data.Settings.MailerPassword = ""
+		}
+		data.ActorKeys = []ActorKeyRecord{}
+		for i := range data.Webhooks {
+			data.Webhooks[i].Secret = ""
+		}
+		data.Outbox = []MailRecord{}
+	}
+
+	manifest := &Manifest{
+		Format:  Format,
+		Version: Version,
+		Created: time.Now().UTC().Unix(),
+		Options: options,
+		Users:   len(data.Users),
+		Posts:   len(data.Posts),
+		Themes:  []string{},
+	}
+	if options.Themes {
+		themes, err := render.Themes()
+		if err != nil {
+			return nil, err
+		}
+		for _, theme := range themes {
+			if theme.Name != render.DefaultTheme {
+				manifest.Themes = append(manifest.Themes, theme.Name)
+			}
+		}
+	}
+
+	var media []string
+	if options.Media {
+		media, err = mediaFiles()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Media = len(media)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	err = writeJSON(archive, "manifest.json", manifest)
+	if err != nil {
+		return nil, err
+	}
+	err = writeJSON(archive, "data.json", data)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range manifest.Themes {
+		err = writeDirectory(archive, filepath.Join(render.ThemesDirectory, name), "themes/"+name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range media {
+		err = writeFile(archive, filepath.Join(MediaDirectory, name), "media/"+name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+func writeJSON(archive *tar.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = archive.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+// writeDirectory adds regular files under dir to archive with given name prefix.
+func writeDirectory(archive *tar.Writer, dir, prefix string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return writeFile(archive, p, path.Join(prefix, filepath.ToSlash(rel)))
+	})
+}
+
+// writeFile adds the file at p to archive with given name.
+func writeFile(archive *tar.Writer, p, name string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, f)
+	return err
+}
+
+// mediaFiles returns names of regular files in MediaDirectory. Uploaded files are stored
+// directly in the directory, so subdirectories are skipped.
+func mediaFiles() ([]string, error) {
+	entries, err := os.ReadDir(MediaDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && validMediaName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// validMediaName reports whether name can be used for a file in MediaDirectory.
+func validMediaName(name string) bool {
+	return name != "" && name == path.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+var themeName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Import restores an archive read from r into the database. Unless replace is set, the database has to be empty.
+// Themes in the archive are installed unless a theme with the same name exists, and uploaded files
+// are copied to MediaDirectory unless a file with the same name exists.
+// Plain JSON written by earlier versions of "vertigo export" is accepted as well.
+func Import(r io.Reader, replace bool) (*Manifest, error) {
+	buf := bufio.NewReader(r)
+	magic, _ := buf.Peek(2)
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		var data Backup
+		err := json.NewDecoder(buf).Decode(&data)
+		if err != nil {
+			return nil, errors.New("archive invalid")
+		}
+		err = Restore(&data, replace)
+		if err != nil {
+			return nil, err
+		}
+		return &Manifest{Format: Format, Version: data.Version, Created: data.Created, Users: len(data.Users), Posts: len(data.Posts)}, nil
+	}
+
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		return nil, errors.New("archive invalid")
+	}
+	archive := tar.NewReader(gz)
+
+	var manifest *Manifest
+	var data *Backup
+	// themes are extracted to a temporary directory first, so nothing is installed from an archive which fails to restore
+	staging, err := os.MkdirTemp("", "vertigo-import")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("archive invalid")
+		}
+		name := path.Clean(header.Name)
+		switch {
+		case name == "manifest.json":
+			manifest = &Manifest{}
+			err = json.NewDecoder(archive).Decode(manifest)
+			if err != nil || manifest.Format != Format {
+				return nil, errors.New("archive manifest invalid")
+			}
+			if manifest.Version > Version {
+				return nil, errors.New("archive version unsupported")
+			}
+		case name == "data.json":
+			data = &Backup{}
+			err = json.NewDecoder(archive).Decode(data)
+			if err != nil {
+				return nil, errors.New("archive data invalid")
+			}
+		case strings.HasPrefix(name, "themes/") && header.Typeflag == tar.TypeReg:
+			err = extract(archive, filepath.Join(staging, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, "media/") && header.Typeflag == tar.TypeReg && validMediaName(strings.TrimPrefix(name, "media/")):
+			err = extract(archive, filepath.Join(staging, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("archive manifest missing")
+	}
+	if data == nil {
+		return nil, errors.New("archive data missing")
+	}
+
+	err = Restore(data, replace)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := manifest.Themes[:0]
+	for _, name := range manifest.Themes {
+		staged := filepath.Join(staging, "themes", name)
+		if !themeName.MatchString(name) || name == render.DefaultTheme {
+			continue
+		}
+		if _, err := os.Stat(staged); err != nil {
+			continue
+		}
+		if _, err := render.GetTheme(name); err == nil {
+			continue
+		}
+		err = os.MkdirAll(render.ThemesDirectory, 0755)
+		if err != nil {
+			return manifest, err
+		}
+		err = os.Rename(staged, filepath.Join(render.ThemesDirectory, name))
+		if err != nil {
+			return manifest, err
+		}
+		installed = append(installed, name)
+	}
+	manifest.Themes = installed
+
+	media, err := os.ReadDir(filepath.Join(staging, "media"))
+	if err != nil && !os.IsNotExist(err) {
+		return manifest, err
+	}
+	manifest.Media = 0
+	for _, entry := range media {
+		dst := filepath.Join(MediaDirectory, entry.Name())
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		err = os.MkdirAll(MediaDirectory, 0755)
+		if err != nil {
+			return manifest, err
+		}
+		err = os.Rename(filepath.Join(staging, "media", entry.Name()), dst)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Media++
+	}
+	return manifest, nil
+}
+
+// extract writes r to file at dst, creating parent directories.
+func extract(r io.Reader, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
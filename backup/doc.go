@@ -0,0 +1,12 @@
+// Package backup writes and reads portable archives of a whole site, which can be restored
+// into a database of any supported driver.
+//
+// An archive is a gzip compressed tar file with the following entries:
+//
+//	manifest.json    format name, version, creation time and options, see Manifest
+//	data.json        settings, users, posts and the rows which belong to them, see sqlx.Backup
+//	themes/<name>/   installed themes, if included
+//	media/<name>     files uploaded through Micropub, if included
+//
+// Readers reject archives with a newer version than they know.
+package backup
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Response is a cached response.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	ETag   string
+}
+
+type entry struct {
+	key      string
+	response *Response
+}
+
+// Cache holds responses up to a total body size, evicting the least recently used ones first.
+type Cache struct {
+	// Session is the name of the session cookie. Requests which have it bypass the cache, see Handler.
+	Session string
+	// MaxAge is how long clients may use a cached page without revalidating it.
+	MaxAge time.Duration
+
+	mu      sync.Mutex
+	max     int
+	size    int
+	version func() uint64
+	// current is the content version of the entries
+	current uint64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// New returns a cache which holds up to max bytes of response bodies. Entries are only valid
+// as long as version returns the same value as when they were added.
+func New(max int, version func() uint64) *Cache {
+	return &Cache{
+		max:     max,
+		version: version,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns response cached under key, if it is up to date.
+func (c *Cache) Get(key string) (*Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sync()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*entry).response, true
+}
+
+// Add caches response under key, unless it is larger than the whole cache.
+// Version is the content version the response was rendered with, read before rendering,
+// so responses rendered while content changes are not cached.
+func (c *Cache) Add(key string, version uint64, response *Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sync()
+	if version != c.current || len(response.Body) > c.max {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&entry{key: key, response: response})
+	c.size += len(response.Body)
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Version returns the current content version.
+func (c *Cache) Version() uint64 {
+	return c.version()
+}
+
+// Len returns the number of cached responses and their total size in bytes.
+func (c *Cache) Len() (entries, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sync()
+	return len(c.entries), c.size
+}
+
+// sync empties the cache if content version has changed.
+func (c *Cache) sync() {
+	version := c.version()
+	if version == c.current {
+		return
+	}
+	c.current = version
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *Cache) remove(element *list.Element) {
+	e := c.lru.Remove(element).(*entry)
+	delete(c.entries, e.key)
+	c.size -= len(e.response.Body)
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// MaxBuffered is the largest response in bytes which Conditional buffers to compute its ETag.
+// Larger responses, such as site exports, are streamed without one.
+const MaxBuffered = 1 << 20
+
+// Conditional gives successful GET and HEAD responses of next a strong ETag computed from their body,
+// unless next sets one itself, and answers conditional requests with 304 Not Modified.
+// If-None-Match is checked against the ETag and If-Modified-Since against Last-Modified set by next.
+func Conditional(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &conditionalWriter{ResponseWriter: w, request: r}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	}
+	return http.HandlerFunc(fn)
+}
+
+// NotModified reports whether response with header is unchanged for the client making request r.
+// As in RFC 7232, If-Modified-Since is only considered when there is no If-None-Match.
+func NotModified(r *http.Request, header http.Header) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := header.Get("ETag")
+		return etag != "" && matches(match, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// writeNotModified writes 304 Not Modified, which has no body or headers describing one.
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// conditionalWriter buffers a successful response until it is complete or too large to buffer.
+type conditionalWriter struct {
+	http.ResponseWriter
+	request   *http.Request
+	status    int
+	buf       []byte
+	streaming bool
+}
+
+func (w *conditionalWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status != http.StatusOK || w.Header().Get("ETag") != "" {
+		w.stream()
+	}
+}
+
+func (w *conditionalWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) > MaxBuffered {
+		err := w.stream()
+		return len(b), err
+	}
+	return len(b), nil
+}
+
+// stream gives up on the ETag and writes the response through.
+func (w *conditionalWriter) stream() error {
+	w.streaming = true
+	if w.status == http.StatusOK && NotModified(w.request, w.Header()) {
+		// Last-Modified or an ETag of next still allow answering with 304
+		w.buf = nil
+		writeNotModified(w.ResponseWriter)
+		w.ResponseWriter = discard{w.ResponseWriter}
+		return nil
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *conditionalWriter) finish() {
+	if w.status == 0 {
+		// nothing was written, net/http writes the default response
+		return
+	}
+	if w.streaming {
+		return
+	}
+	sum := sha256.Sum256(w.buf)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	w.stream()
+}
+
+// Flush sends the response so far, so streamed responses are not held back.
+func (w *conditionalWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.streaming {
+		w.stream()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// discard drops the body of a response answered with 304.
+type discard struct {
+	http.ResponseWriter
+}
+
+func (discard) Write(b []byte) (int, error) {
+	return len(b), nil
+}
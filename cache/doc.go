@@ -0,0 +1,9 @@
+// Package cache keeps rendered responses in memory, so pages which change only when content
+// is edited are not rendered from the database on every request.
+//
+// Entries are tagged with a content version, see New. When the version changes all entries
+// become stale, so the cache never has to know which page depends on which content.
+//
+// Conditional gives responses which are not cached an ETag as well, so clients can revalidate
+// any page or API response.
+package cache
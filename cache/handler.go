@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// Handler serves GET and HEAD requests from the cache, rendering them with next on a miss.
+// Only 200 responses without cookies are cached. Requests with the session cookie are passed
+// to next, since logged in users may see pages differently. If hit is not nil, it is called
+// for every request served from the cache, for example to count views.
+//
+// Cached responses have an ETag and are answered with 304 Not Modified when the client has the
+// same version, or one modified no later than If-Modified-Since. Cache-Control allows clients and proxies to reuse them for MaxAge.
+func (c *Cache) Handler(next http.Handler, hit func(r *http.Request)) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" || c.hasSession(r) {
+			metrics.Cache.Inc("bypass")
+			w.Header().Set("Cache-Control", "private, no-cache")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := r.URL.RequestURI()
+		response, ok := c.Get(key)
+		if ok {
+			metrics.Cache.Inc("hit")
+			w.Header().Set("X-Cache", "HIT")
+			if hit != nil {
+				hit(r)
+			}
+			c.write(w, r, response)
+			return
+		}
+
+		metrics.Cache.Inc("miss")
+		version := c.Version()
+		recorder := &recorder{header: make(http.Header)}
+		next.ServeHTTP(recorder, r)
+		response = &Response{Status: recorder.status, Header: recorder.header, Body: recorder.body.Bytes()}
+		if response.Status == 0 {
+			response.Status = http.StatusOK
+		}
+		if response.Status != http.StatusOK || response.Header.Get("Set-Cookie") != "" || r.Method == "HEAD" {
+			copyHeader(w.Header(), response.Header)
+			w.WriteHeader(response.Status)
+			w.Write(response.Body)
+			return
+		}
+		sum := sha256.Sum256(response.Body)
+		response.ETag = `"` + hex.EncodeToString(sum[:8]) + `"`
+		c.Add(key, version, response)
+		w.Header().Set("X-Cache", "MISS")
+		c.write(w, r, response)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func (c *Cache) hasSession(r *http.Request) bool {
+	if c.Session == "" {
+		return false
+	}
+	_, err := r.Cookie(c.Session)
+	return err == nil
+}
+
+// write writes a cacheable response, or 304 Not Modified if the client has it already.
+func (c *Cache) write(w http.ResponseWriter, r *http.Request, response *Response) {
+	header := w.Header()
+	copyHeader(header, response.Header)
+	header.Set("ETag", response.ETag)
+	header.Add("Vary", "Cookie")
+	if c.MaxAge > 0 {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(c.MaxAge.Seconds())))
+	} else {
+		header.Set("Cache-Control", "public, no-cache")
+	}
+	if NotModified(r, header) {
+		writeNotModified(w)
+		return
+	}
+	w.WriteHeader(response.Status)
+	if r.Method != "HEAD" {
+		w.Write(response.Body)
+	}
+}
+
+// matches reports whether If-None-Match header value lists etag.
+func matches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = values
+	}
+}
+
+// recorder records a response rendered for the cache.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
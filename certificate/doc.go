@@ -0,0 +1,2 @@
+// Package certificate keeps a TLS certificate loaded from disk up to date, so it can be renewed without restarting the server.
+package certificate
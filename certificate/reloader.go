@@ -0,0 +1,104 @@
+package certificate
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader holds a certificate loaded from a PEM encoded certificate and key file pair.
+// Its GetCertificate method is meant to be used as tls.Config.GetCertificate, so
+// reloaded certificates are used for new connections right away.
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+// New loads the key pair from given files.
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the key pair from disk again. If the files can not be loaded,
+// the error is returned and the previous certificate is kept.
+func (r *Reloader) Reload() error {
+	modified, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modified = modified
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch checks the files for changes every interval and reloads the key pair when either of them
+// has been modified. Certificate renewal tools often replace the files one at a time, so a pair which
+// does not match is logged and retried on the next check. Watch returns when ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modified, err := r.lastModified()
+		if err != nil {
+			log.Println("certificate:", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := !modified.Equal(r.modified)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		err = r.Reload()
+		if err != nil {
+			log.Println("certificate: reload:", err)
+			continue
+		}
+		log.Println("certificate: reloaded", r.CertFile)
+	}
+}
+
+// lastModified returns the latest modification time of the certificate and key files.
+func (r *Reloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,1190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/toldjuuso/vertigo/backup"
+	"github.com/toldjuuso/vertigo/cache"
+	"github.com/toldjuuso/vertigo/compress"
+	"github.com/toldjuuso/vertigo/config"
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/importer"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+	"github.com/toldjuuso/vertigo/staticsite"
+	"github.com/toldjuuso/vertigo/webmention"
+)
+
+const usage = `Usage: vertigo [command] [flags]
+
+Commands:
+  serve                          run the web server (default)
+  healthcheck                    check that a running server is alive
+  migrate                        apply pending database migrations
+  user create                    create a user account
+  user list                      list user accounts
+  user reset-password            set password of a user
+  user set-role                  set role of a user (admin, author)
+  user verify                    mark email address of a user as verified
+  settings get [key]             print site settings
+  settings set key value...      change site settings
+  post list                      list posts
+  post publish slug              publish a post
+  post unpublish slug            unpublish a post
+  post import path               import posts from WordPress, Ghost or Markdown files
+  post resanitize                sanitize content of all posts again with configured policies
+  mail list                      list email in the outbox
+  mail retry id                  queue failed email for delivery again
+  mail deliver                   deliver email which is due now
+  invitation create              create an invitation link for registering
+  invitation list                list invitations
+  invitation delete id           revoke an invitation
+  newsletter list                list sent newsletters and their delivery status
+  newsletter subscribers         list newsletter subscribers
+  newsletter digest              queue the weekly digest if it is due
+  token create                   create an API token for Micropub clients
+  token list                     list API tokens of a user
+  token delete id                revoke an API token
+  build [directory]              render the site into static files, public by default
+  export [file]                  write a site archive to file or standard output
+  import [file]                  restore a site archive written by export
+
+Run "vertigo <command> -h" for flags of a command. All commands accept configuration flags.
+`
+
+// commands maps subcommand names to their implementations, which receive the arguments following the name.
+var commands = map[string]func(args []string) error{
+	"serve":       serveCommand,
+	"healthcheck": healthcheckCommand,
+	"migrate":     migrateCommand,
+	"user":        userCommand,
+	"settings":    settingsCommand,
+	"post":        postCommand,
+	"mail":        mailCommand,
+	"invitation":  invitationCommand,
+	"newsletter":  newsletterCommand,
+	"token":       tokenCommand,
+	"build":       buildCommand,
+	"export":      exportCommand,
+	"import":      importCommand,
+}
+
+// stdout is where commands write their output.
+var stdout io.Writer = os.Stdout
+
+// run executes the command named in args[0], or serve if args is empty or starts with a flag.
+func run(args []string) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n\n%s", name, usage)
+	}
+	return command(args)
+}
+
+// newFlags returns a flag set for a subcommand with given argument synopsis.
+func newFlags(name, synopsis string) *flag.FlagSet {
+	flags := flag.NewFlagSet("vertigo "+name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: vertigo %s [flags] %s\n\nFlags:\n", name, synopsis)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// connect sets up logging and the database for administrative commands. Informational
+// log lines are left out unless debug level is configured, to keep command output readable.
+func connect(c *config.Config) error {
+	err := quiet(c)
+	if err != nil {
+		return err
+	}
+	setupSanitize(c.Sanitize)
+	return Connect(c.Database.Driver, c.Database.Source)
+}
+
+// quiet sets up logging for administrative commands, see connect.
+func quiet(c *config.Config) error {
+	if c.Log.Level != "debug" {
+		c.Log.Level = "warn"
+	}
+	return logging.Setup(os.Stderr, c.Log)
+}
+
+func serveCommand(args []string) error {
+	c, err := config.LoadFlags(newFlags("serve", ""), args)
+	if err != nil {
+		return err
+	}
+	err = logging.Setup(os.Stderr, c.Log)
+	if err != nil {
+		return err
+	}
+	err = setup(c)
+	if err != nil {
+		return err
+	}
+	var handler http.Handler = cache.Conditional(NewServer())
+	if c.Server.Compress {
+		handler = compress.Handler(handler)
+	}
+	return serve(c, logging.Middleware(c.Log.Access, handler))
+}
+
+func healthcheckCommand(args []string) error {
+	c, err := config.LoadFlags(newFlags("healthcheck", ""), args)
+	if err != nil {
+		return err
+	}
+	return healthcheck(c)
+}
+
+func migrateCommand(args []string) error {
+	c, err := config.LoadFlags(newFlags("migrate", ""), args)
+	if err != nil {
+		return err
+	}
+	// Connect applies pending migrations
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	pending, err := Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d migrations still pending", len(pending))
+	}
+	fmt.Fprintf(stdout, "database is up to date, version %d\n", Migrations[len(Migrations)-1].Version)
+	return nil
+}
+
+// subcommand runs the subcommand of a command group named in args[0].
+func subcommand(group string, args []string, subcommands map[string]func(args []string) error) error {
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		return fmt.Errorf("usage: vertigo %s <%s>", group, strings.Join(names, "|"))
+	}
+	return subcommands[args[0]](args[1:])
+}
+
+func userCommand(args []string) error {
+	return subcommand("user", args, map[string]func([]string) error{
+		"create":         userCreate,
+		"list":           userList,
+		"reset-password": userResetPassword,
+		"set-role":       userSetRole,
+		"verify":         userVerify,
+	})
+}
+
+func userCreate(args []string) error {
+	var user User
+	flags := newFlags("user create", "")
+	flags.StringVar(&user.Name, "name", "", "name of the user")
+	flags.StringVar(&user.Email, "email", "", "email address used to log in")
+	flags.StringVar(&user.Password, "password", "", "password, read from VERTIGO_PASSWORD if empty")
+	flags.StringVar(&user.Location, "location", "UTC", "time zone of the user")
+	flags.StringVar(&user.Role, "role", "", "role of the user, admin or author (default admin for the first user)")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if user.Password == "" {
+		user.Password = os.Getenv("VERTIGO_PASSWORD")
+	}
+	if user.Email == "" || user.Password == "" {
+		return errors.New("-email and -password are required")
+	}
+	if user.Role != "" && !ValidRole(user.Role) {
+		return errors.New("user role invalid")
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	// accounts created by administrators are trusted
+	user.Verified = true
+	user, err = user.Insert()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "created %s user %s\n", user.Role, user.Email)
+	return Emit(EventUserCreated, WebhookUser(user))
+}
+
+func userList(args []string) error {
+	c, err := config.LoadFlags(newFlags("user list", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	var user User
+	users, err := user.GetAll()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tNAME\tROLE\tVERIFIED\tPOSTS")
+	for _, user := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%t\t%d\n", user.ID, user.Email, user.Name, user.Role, user.Verified, len(user.Posts))
+	}
+	return w.Flush()
+}
+
+// findUser looks up a user by email address.
+func findUser(email string) (User, error) {
+	var user User
+	if email == "" {
+		return user, errors.New("-email is required")
+	}
+	user.Email = email
+	user, err := user.GetByEmail()
+	if err != nil && err.Error() == "not found" {
+		return user, fmt.Errorf("user %s not found", email)
+	}
+	return user, err
+}
+
+func userResetPassword(args []string) error {
+	flags := newFlags("user reset-password", "")
+	email := flags.String("email", "", "email address of the user")
+	password := flags.String("password", "", "new password, read from VERTIGO_PASSWORD if empty")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if *password == "" {
+		*password = os.Getenv("VERTIGO_PASSWORD")
+	}
+	if *password == "" {
+		return errors.New("-password is required")
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	user, err := findUser(*email)
+	if err != nil {
+		return err
+	}
+	_, err = user.PasswordReset(User{Password: *password})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "password of %s changed\n", user.Email)
+	return nil
+}
+
+func userSetRole(args []string) error {
+	flags := newFlags("user set-role", "")
+	email := flags.String("email", "", "email address of the user")
+	role := flags.String("role", "", "new role, admin or author")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if !ValidRole(*role) {
+		return errors.New("-role should be admin or author")
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	user, err := findUser(*email)
+	if err != nil {
+		return err
+	}
+	_, err = user.SetRole(*role)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is now %s\n", user.Email, *role)
+	return nil
+}
+
+func userVerify(args []string) error {
+	flags := newFlags("user verify", "")
+	email := flags.String("email", "", "email address of the user")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	user, err := findUser(*email)
+	if err != nil {
+		return err
+	}
+	_, err = user.Verify()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s is now verified\n", user.Email)
+	return nil
+}
+
+func settingsCommand(args []string) error {
+	return subcommand("settings", args, map[string]func([]string) error{
+		"get": settingsGet,
+		"set": settingsSet,
+	})
+}
+
+// settingsField returns the field of settings with given JSON key. Fields controlled by
+// the application, such as cookiehash, are not accessible.
+func settingsField(settings *Vertigo, key string) (reflect.Value, error) {
+	v := reflect.ValueOf(settings).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == key && t.Field(i).Tag.Get("form") != "" {
+			return v.Field(i), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("unknown setting %q", key)
+}
+
+func settingsGet(args []string) error {
+	flags := newFlags("settings get", "[key]")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	if Settings.Firstrun {
+		return errors.New("site has not been installed yet, see vertigo settings set")
+	}
+	settings := *Settings
+	if len(c.Args) > 0 {
+		field, err := settingsField(&settings, c.Args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, field.Interface())
+		return nil
+	}
+	settings.ID = 0
+	settings.CookieHash = ""
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(settings)
+}
+
+func settingsSet(args []string) error {
+	flags := newFlags("settings set", "key value [key value...]")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(c.Args) == 0 || len(c.Args)%2 != 0 {
+		flags.Usage()
+		return errors.New("settings should be given as key value pairs")
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+
+	settings := *Settings
+	for i := 0; i < len(c.Args); i += 2 {
+		key, value := c.Args[i], c.Args[i+1]
+		field, err := settingsField(&settings, key)
+		if err != nil {
+			return err
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s should be true or false", key)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s should be a number", key)
+			}
+			field.SetInt(int64(n))
+		}
+	}
+	if settings.Theme == "" {
+		settings.Theme = render.DefaultTheme
+	}
+	if _, err := render.GetTheme(settings.Theme); err != nil {
+		return fmt.Errorf("theme %s: %v", settings.Theme, err)
+	}
+	settings.Hostname = strings.TrimRight(settings.Hostname, "/")
+
+	if Settings.Firstrun {
+		if settings.Name == "" || settings.Hostname == "" || settings.Description == "" {
+			return errors.New("name, hostname and description are required to install the site")
+		}
+		if settings.MailerPort == 0 {
+			settings.MailerPort = 587
+		}
+		settings.AllowRegistrations = true
+		_, err = settings.Insert()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "site installed")
+		return nil
+	}
+	_, err = settings.Update()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "settings saved, restart running servers to apply them")
+	return nil
+}
+
+func postCommand(args []string) error {
+	return subcommand("post", args, map[string]func([]string) error{
+		"list":       postList,
+		"publish":    postPublish,
+		"unpublish":  postUnpublish,
+		"import":     postImport,
+		"resanitize": postResanitize,
+	})
+}
+
+func postList(args []string) error {
+	c, err := config.LoadFlags(newFlags("post list", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	var post Post
+	posts, err := post.GetAll()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SLUG\tTITLE\tAUTHOR\tPUBLISHED\tCREATED\tVIEWS")
+	for _, post := range posts {
+		created := time.Unix(post.Created, 0).UTC().Format("2006-01-02")
+		fmt.Fprintf(w, "%s\t%s\t%d\t%t\t%s\t%d\n", post.Slug, post.Title, post.Author, post.Published, created, post.Viewcount)
+	}
+	return w.Flush()
+}
+
+// findPost connects to the database and loads the post whose slug is given as the only argument
+// after flags. The returned function closes the connection.
+func findPost(name string, args []string) (Post, *config.Config, func() error, error) {
+	var post Post
+	c, err := config.LoadFlags(newFlags(name, "slug"), args)
+	if err != nil {
+		return post, nil, nil, err
+	}
+	if len(c.Args) != 1 {
+		return post, nil, nil, errors.New("post slug is required")
+	}
+	err = connect(c)
+	if err != nil {
+		return post, nil, nil, err
+	}
+	post.Slug = c.Args[0]
+	post, err = post.Get()
+	if err != nil {
+		Close()
+		if err.Error() == "not found" {
+			return post, nil, nil, fmt.Errorf("post %s not found", c.Args[0])
+		}
+		return post, nil, nil, err
+	}
+	return post, c, Close, nil
+}
+
+func postPublish(args []string) error {
+	post, c, done, err := findPost("post publish", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+	entry := post
+	entry.Published = true
+	post, err = post.Update(entry)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "published %s\n", post.Slug)
+	// the running server delivers queued webhook events, activities and email
+	setupFeatures(c.Features)
+	webmention.AllowPrivate = c.Development
+	announcement, err := post.Announce(render.Features)
+	if announcement.Webmentions > 0 {
+		fmt.Fprintf(stdout, "sent %d Webmentions\n", announcement.Webmentions)
+	}
+	if announcement.Recipients > 0 {
+		fmt.Fprintf(stdout, "queued newsletter to %d subscribers\n", announcement.Recipients)
+	}
+	return err
+}
+
+func postUnpublish(args []string) error {
+	post, c, done, err := findPost("post unpublish", args)
+	if err != nil {
+		return err
+	}
+	defer done()
+	err = post.Unpublish()
+	if err != nil {
+		return err
+	}
+	post.Published = false
+	err = Emit(EventPostUnpublished, post)
+	if err != nil {
+		return err
+	}
+	if c.Features.ActivityPub {
+		err = Federate(EventPostUnpublished, post)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "unpublished %s\n", post.Slug)
+	return nil
+}
+
+func postResanitize(args []string) error {
+	c, err := config.LoadFlags(newFlags("post resanitize", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	err = ResanitizePosts()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "sanitized all posts")
+	return nil
+}
+
+func postImport(args []string) error {
+	var options importer.Options
+	flags := newFlags("post import", "path")
+	from := flags.String("from", "", "format of path: wordpress (WXR file), ghost (JSON file) or markdown (directory), detected from path if empty")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "report what would be imported without changing anything")
+	flags.StringVar(&options.Author, "author", "", "email address of the user who is given posts of unknown authors")
+	flags.BoolVar(&options.CreateAuthors, "create-authors", false, "create users for authors not found by email address")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(c.Args) != 1 {
+		return errors.New("path to export is required")
+	}
+	path := c.Args[0]
+	if *from == "" {
+		*from = detectFormat(path)
+	}
+
+	var site *importer.Site
+	switch *from {
+	case "markdown":
+		site, err = importer.ReadMarkdown(path)
+	case "wordpress":
+		site, err = readExport(path, importer.ReadWordPress)
+	case "ghost":
+		site, err = readExport(path, importer.ReadGhost)
+	default:
+		return errors.New("-from should be wordpress, ghost or markdown")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	report, err := importer.Import(site, options)
+	if report != nil {
+		printReport(report)
+	}
+	return err
+}
+
+func readExport(path string, read func(io.Reader) (*importer.Site, error)) (*importer.Site, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return read(f)
+}
+
+// detectFormat guesses format of an export from its path.
+func detectFormat(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return "markdown"
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xml":
+		return "wordpress"
+	case ".json":
+		return "ghost"
+	}
+	return ""
+}
+
+func printReport(report *importer.Report) {
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "AUTHOR\tEMAIL\tUSER\tACTION")
+	for _, result := range report.Authors {
+		action := result.Action
+		if action == "" {
+			action = "none"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Author.Name, result.Author.Email, result.User, action)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "SOURCE\tSLUG\tTITLE\tUSER\tPUBLISHED\tCREATED\tACTION\tNOTES")
+	for _, result := range report.Posts {
+		post := result.Post
+		created := ""
+		if !post.Created.IsZero() {
+			created = post.Created.Format("2006-01-02")
+		}
+		notes := result.Reason
+		if len(post.Kept) > 0 {
+			notes = strings.TrimPrefix(notes+"; kept as HTML: "+strings.Join(post.Kept, ", "), "; ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n", post.Source, post.Slug, post.Title, result.User, post.Published, created, result.Action, notes)
+	}
+	w.Flush()
+	created, skipped := report.Counts()
+	if report.DryRun {
+		fmt.Fprintf(stdout, "\ndry run: would import %d posts and skip %d\n", created, skipped)
+		return
+	}
+	fmt.Fprintf(stdout, "\nimported %d posts and skipped %d\n", created, skipped)
+}
+
+func mailCommand(args []string) error {
+	return subcommand("mail", args, map[string]func([]string) error{
+		"list":    mailList,
+		"retry":   mailRetry,
+		"deliver": mailDeliver,
+	})
+}
+
+func mailList(args []string) error {
+	flags := newFlags("mail list", "")
+	status := flags.String("status", "", "list only mail with status pending, sent or failed")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	outbox, err := Outbox(*status)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID	KIND	ADDRESS	STATUS	ATTEMPTS	CREATED	ERROR")
+	for _, mail := range outbox {
+		created := time.Unix(mail.Created, 0).UTC().Format("2006-01-02 15:04")
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n", mail.ID, mail.Kind, mail.Address, mail.Status, mail.Attempts, created, mail.LastError)
+	}
+	return w.Flush()
+}
+
+func mailRetry(args []string) error {
+	c, err := config.LoadFlags(newFlags("mail retry", "id"), args)
+	if err != nil {
+		return err
+	}
+	if len(c.Args) != 1 {
+		return errors.New("mail id is required")
+	}
+	id, err := strconv.ParseInt(c.Args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("mail id %q is not a number", c.Args[0])
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	_, err = Mail{ID: id}.Retry()
+	if err != nil {
+		switch err.Error() {
+		case "not found":
+			return fmt.Errorf("mail %d not found", id)
+		case "mail not failed":
+			return fmt.Errorf("mail %d has not failed", id)
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "queued mail %d for delivery\n", id)
+	return nil
+}
+
+// mailDeliver delivers due email without running the server, for example from cron.
+func mailDeliver(args []string) error {
+	c, err := config.LoadFlags(newFlags("mail deliver", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	setupMailer(c.Mailer)
+	sent, err := ProcessOutbox()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "delivered %d messages\n", sent)
+	return nil
+}
+
+func invitationCommand(args []string) error {
+	return subcommand("invitation", args, map[string]func([]string) error{
+		"create": invitationCreate,
+		"list":   invitationList,
+		"delete": invitationDelete,
+	})
+}
+
+func invitationCreate(args []string) error {
+	var invitation Invitation
+	flags := newFlags("invitation create", "")
+	flags.StringVar(&invitation.Email, "email", "", "email address which may register, anyone with the link if empty")
+	flags.StringVar(&invitation.Role, "role", RoleAuthor, "role of users who register, admin or author")
+	flags.Int64Var(&invitation.MaxUses, "uses", 1, "number of times the invitation can be used, 0 for unlimited")
+	expires := flags.Duration("expires", 7*24*time.Hour, "time until the invitation expires, 0 for never")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if !ValidRole(invitation.Role) {
+		return errors.New("-role should be admin or author")
+	}
+	if invitation.MaxUses < 0 || *expires < 0 {
+		return errors.New("-uses and -expires must not be negative")
+	}
+	if *expires > 0 {
+		invitation.Expires = time.Now().Add(*expires).UTC().Unix()
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	invitation, err = invitation.Insert()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, invitation.Link)
+	return nil
+}
+
+func invitationList(args []string) error {
+	c, err := config.LoadFlags(newFlags("invitation list", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	invitations, err := Invitations()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tROLE\tUSES\tEXPIRES\tLINK")
+	for _, invitation := range invitations {
+		uses := fmt.Sprintf("%d/%d", invitation.Uses, invitation.MaxUses)
+		if invitation.MaxUses == 0 {
+			uses = fmt.Sprintf("%d", invitation.Uses)
+		}
+		expires := "never"
+		if invitation.Expires != 0 {
+			expires = time.Unix(invitation.Expires, 0).UTC().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", invitation.ID, invitation.Email, invitation.Role, uses, expires, invitation.Link)
+	}
+	return w.Flush()
+}
+
+func invitationDelete(args []string) error {
+	c, err := config.LoadFlags(newFlags("invitation delete", "id"), args)
+	if err != nil {
+		return err
+	}
+	if len(c.Args) != 1 {
+		return errors.New("invitation id is required")
+	}
+	id, err := strconv.ParseInt(c.Args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invitation id %q is not a number", c.Args[0])
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	err = Invitation{ID: id}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			return fmt.Errorf("invitation %d not found", id)
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "revoked invitation %d\n", id)
+	return nil
+}
+
+func newsletterCommand(args []string) error {
+	return subcommand("newsletter", args, map[string]func([]string) error{
+		"list":        newsletterList,
+		"subscribers": newsletterSubscribers,
+		"digest":      newsletterDigest,
+	})
+}
+
+func newsletterList(args []string) error {
+	c, err := config.LoadFlags(newFlags("newsletter list", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	newsletters, err := Newsletters()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tSUBJECT\tRECIPIENTS\tSENT\tPENDING\tFAILED\tCREATED")
+	for _, newsletter := range newsletters {
+		status, err := newsletter.Status()
+		if err != nil {
+			return err
+		}
+		created := time.Unix(newsletter.Created, 0).UTC().Format("2006-01-02 15:04")
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n", newsletter.ID, newsletter.Kind, newsletter.Subject,
+			newsletter.Recipients, status[MailSent], status[MailPending], status[MailFailed], created)
+	}
+	return w.Flush()
+}
+
+func newsletterSubscribers(args []string) error {
+	flags := newFlags("newsletter subscribers", "")
+	status := flags.String("status", "", "list only subscribers with status pending, confirmed or unsubscribed")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	subscribers, err := Subscribers(*status)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tEMAIL\tSTATUS\tDIGEST\tCREATED")
+	for _, subscriber := range subscribers {
+		created := time.Unix(subscriber.Created, 0).UTC().Format("2006-01-02 15:04")
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\n", subscriber.ID, subscriber.Email, subscriber.Status, subscriber.Digest, created)
+	}
+	return w.Flush()
+}
+
+// newsletterDigest queues the weekly digest without running the server, for example from cron.
+func newsletterDigest(args []string) error {
+	c, err := config.LoadFlags(newFlags("newsletter digest", ""), args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	newsletter, err := SendDigest()
+	if err != nil {
+		switch err.Error() {
+		case "digest not due":
+			fmt.Fprintln(stdout, "digest is not due yet")
+			return nil
+		case "digest empty":
+			fmt.Fprintln(stdout, "no posts have been published since the previous digest")
+			return nil
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "queued digest to %d subscribers\n", newsletter.Recipients)
+	return nil
+}
+
+func buildCommand(args []string) error {
+	flags := newFlags("build", "[directory]")
+	force := flags.Bool("force", false, "render all posts, also those unchanged since the previous build")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	dir := "public"
+	if len(c.Args) > 0 {
+		dir = c.Args[0]
+	}
+	err = quiet(c)
+	if err != nil {
+		return err
+	}
+	err = setup(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	result, err := staticsite.Build(dir, *force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "rendered %d pages, %d posts unchanged, %d files written, %d removed\n", result.Rendered, result.Unchanged, result.Written, result.Removed)
+	return nil
+}
+
+func exportCommand(args []string) error {
+	var options backup.Options
+	flags := newFlags("export", "[file]")
+	noDigests := flags.Bool("no-digests", false, "leave out password digests, users have to recover their passwords after import")
+	flags.BoolVar(&options.CookieHash, "cookiehash", false, "include the secret which signs session cookies")
+	flags.BoolVar(&options.Secrets, "secrets", false, "include the SMTP password, ActivityPub keys, webhook secrets and the outbox")
+	flags.BoolVar(&options.Themes, "themes", true, "include installed themes")
+	flags.BoolVar(&options.Media, "media", true, "include files uploaded through Micropub")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	options.Digests = !*noDigests
+	backup.MediaDirectory = c.Micropub.Media
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	w := stdout
+	if len(c.Args) > 0 && c.Args[0] != "-" {
+		f, err := os.OpenFile(c.Args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = backup.Export(w, options)
+	return err
+}
+
+func importCommand(args []string) error {
+	flags := newFlags("import", "[file]")
+	replace := flags.Bool("replace", false, "delete existing settings, users and posts before importing")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	backup.MediaDirectory = c.Micropub.Media
+	var r io.Reader = os.Stdin
+	if len(c.Args) > 0 && c.Args[0] != "-" {
+		f, err := os.Open(c.Args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	manifest, err := backup.Import(r, *replace)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "imported %d users and %d posts\n", manifest.Users, manifest.Posts)
+	for _, theme := range manifest.Themes {
+		fmt.Fprintf(stdout, "installed theme %s\n", theme)
+	}
+	if manifest.Media > 0 {
+		fmt.Fprintf(stdout, "copied %d uploaded files\n", manifest.Media)
+	}
+	return nil
+}
+
+func tokenCommand(args []string) error {
+	return subcommand("token", args, map[string]func([]string) error{
+		"create": tokenCreate,
+		"list":   tokenList,
+		"delete": tokenDelete,
+	})
+}
+
+func tokenCreate(args []string) error {
+	var token Token
+	flags := newFlags("token create", "")
+	email := flags.String("email", "", "email address of the user the token acts on behalf of")
+	flags.StringVar(&token.Name, "name", "", "name of the token, such as the client it is used in")
+	flags.StringVar(&token.Scope, "scope", strings.Join(Scopes, " "), "space separated scopes of the token")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if token.Name == "" {
+		return errors.New("-name is required")
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	user, err := findUser(*email)
+	if err != nil {
+		return err
+	}
+	token.Owner = user.ID
+	token, err = token.Insert()
+	if err != nil {
+		if err.Error() == "token invalid" {
+			return fmt.Errorf("-scope should be some of %s", strings.Join(Scopes, ", "))
+		}
+		return err
+	}
+	fmt.Fprintln(stdout, token.Secret)
+	return nil
+}
+
+func tokenList(args []string) error {
+	flags := newFlags("token list", "")
+	email := flags.String("email", "", "email address of the user")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	user, err := findUser(*email)
+	if err != nil {
+		return err
+	}
+	tokens, err := Tokens(user.ID)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSCOPE\tCREATED\tLAST USED")
+	for _, token := range tokens {
+		used := "never"
+		if token.LastUsed != 0 {
+			used = time.Unix(token.LastUsed, 0).UTC().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Scope, time.Unix(token.Created, 0).UTC().Format("2006-01-02 15:04"), used)
+	}
+	return w.Flush()
+}
+
+func tokenDelete(args []string) error {
+	flags := newFlags("token delete", "id")
+	email := flags.String("email", "", "email address of the user")
+	c, err := config.LoadFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(c.Args) != 1 {
+		return errors.New("token id is required")
+	}
+	id, err := strconv.ParseInt(c.Args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("token id %q is not a number", c.Args[0])
+	}
+	err = connect(c)
+	if err != nil {
+		return err
+	}
+	defer Close()
+	user, err := findUser(*email)
+	if err != nil {
+		return err
+	}
+	err = Token{ID: id, Owner: user.ID}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			return fmt.Errorf("token %d of %s not found", id, user.Email)
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "revoked token %d\n", id)
+	return nil
+}
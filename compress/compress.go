@@ -0,0 +1,201 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MinSize is the size in bytes below which responses are not compressed,
+// as the gzip header and lost padding would outweigh the gain.
+const MinSize = 1024
+
+// compressible lists media types which are compressed.
+var compressible = map[string]bool{
+	"text/html":              true,
+	"text/plain":             true,
+	"text/css":               true,
+	"text/xml":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/rss+xml":    true,
+	"application/atom+xml":   true,
+	"image/svg+xml":          true,
+}
+
+var writers = sync.Pool{New: func() interface{} {
+	w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+	return w
+}}
+
+// Handler compresses responses of next with gzip if the client accepts it. Strong ETags of compressed
+// responses get a "-gzip" suffix, since they differ from the uncompressed ones byte by byte,
+// and the suffix is removed from If-None-Match before the request is passed to next.
+func Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !Accepts(r.Header.Get("Accept-Encoding"), "gzip") || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(match, `-gzip"`, `"`))
+		}
+		cw := &writer{ResponseWriter: w}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Accepts reports whether Accept-Encoding header value accepts coding, taking quality values into account.
+func Accepts(header, coding string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		if name == coding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// writer buffers the beginning of a response until it knows whether to compress it.
+type writer struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < MinSize {
+			return len(b), nil
+		}
+		err := w.decide()
+		return len(b), err
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide starts the response, compressed if it is compressible and large enough.
+func (w *writer) decide() error {
+	w.decided = true
+	header := w.Header()
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if len(w.buf) >= MinSize && w.compressible() {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+		}
+		w.gz = writers.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *writer) compressible() bool {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || w.status < 200 || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		return false
+	}
+	media, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		media = http.DetectContentType(w.buf)
+		media, _, _ = mime.ParseMediaType(media)
+	}
+	return compressible[media]
+}
+
+// Close writes out buffered data and finishes the gzip stream.
+func (w *writer) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// nothing was written, net/http writes the default response
+			return nil
+		}
+		err := w.decide()
+		if err != nil {
+			return err
+		}
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz.Reset(io.Discard)
+	writers.Put(w.gz)
+	w.gz = nil
+	return err
+}
+
+// Flush sends buffered data to the client, so streamed responses are not held back.
+func (w *writer) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket and similar handlers take over the connection.
+func (w *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
@@ -0,0 +1,6 @@
+// Package compress compresses HTTP responses with gzip when the client accepts it.
+//
+// Only text formats such as HTML, JSON, XML, CSS and JavaScript are compressed, since images
+// and archives are compressed already. Brotli is not offered, as there is no Brotli encoder
+// among the dependencies; negotiation picks gzip or identity.
+package compress
@@ -0,0 +1,635 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/sanitize"
+)
+
+// Config holds all settings needed before the server can start. Site settings edited through
+// the web interface, such as blog name, are stored in the database instead; see sqlx.Vertigo.
+//
+// Values are read in order of precedence, later overriding earlier:
+// defaults, configuration file, environment variables and command line flags.
+// Every field is documented with its TOML key, environment variable and flag, where available.
+type Config struct {
+	// Listen is the address the HTTP server listens on.
+	Listen string `toml:"listen" env:"VERTIGO_LISTEN" flag:"listen" usage:"HTTP listen address"`
+	// Development recompiles templates on every request.
+	Development bool `toml:"development" env:"DEVELOPMENT" flag:"development" usage:"recompile templates on every request"`
+	// Theme overrides the theme selected in site settings.
+	Theme string `toml:"theme" env:"VERTIGO_THEME" flag:"theme" usage:"theme to use instead of the one in site settings"`
+
+	Server   Server   `toml:"server"`
+	TLS      TLS      `toml:"tls"`
+	Database Database `toml:"database"`
+	Cookie   Cookie   `toml:"cookie"`
+	Mailer   Mailer   `toml:"mailer"`
+	Features Features `toml:"features"`
+	Micropub Micropub `toml:"micropub"`
+	Sanitize Sanitize `toml:"sanitize"`
+	Cache    Cache    `toml:"cache"`
+	Metrics  Metrics  `toml:"metrics"`
+	Log      Log      `toml:"log"`
+
+	// File is the path of the configuration file which was read, if any.
+	File string `toml:"-"`
+	// Args holds command line arguments left over after flags.
+	Args []string `toml:"-"`
+}
+
+// Server holds limits of the HTTP server. Durations are given as strings such as "30s" or "2m".
+type Server struct {
+	// ReadHeaderTimeout is the time allowed for reading request headers.
+	ReadHeaderTimeout time.Duration `toml:"read_header_timeout" env:"VERTIGO_READ_HEADER_TIMEOUT" flag:"read-header-timeout" usage:"time allowed to read request headers"`
+	// ReadTimeout is the time allowed for reading the whole request, including the body.
+	ReadTimeout time.Duration `toml:"read_timeout" env:"VERTIGO_READ_TIMEOUT" flag:"read-timeout" usage:"time allowed to read a request"`
+	// WriteTimeout is the time allowed for writing the response.
+	WriteTimeout time.Duration `toml:"write_timeout" env:"VERTIGO_WRITE_TIMEOUT" flag:"write-timeout" usage:"time allowed to write a response"`
+	// IdleTimeout is how long keep-alive connections are kept open between requests.
+	IdleTimeout time.Duration `toml:"idle_timeout" env:"VERTIGO_IDLE_TIMEOUT" flag:"idle-timeout" usage:"time to keep idle connections open"`
+	// MaxHeaderBytes limits the size of request headers.
+	MaxHeaderBytes int `toml:"max_header_bytes" env:"VERTIGO_MAX_HEADER_BYTES" flag:"max-header-bytes" usage:"maximum size of request headers in bytes"`
+	// ShutdownTimeout is how long in-flight requests and background work are waited for on shutdown.
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" env:"VERTIGO_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"time to wait for requests to finish on shutdown"`
+	// Compress enables gzip compression of text responses for clients which accept it.
+	Compress bool `toml:"compress" env:"VERTIGO_COMPRESS" flag:"compress" usage:"compress text responses with gzip"`
+}
+
+// TLS holds HTTPS settings. HTTPS is served on the listen address when both certificate and key are set.
+type TLS struct {
+	// Cert and Key are paths of PEM encoded certificate and private key files.
+	// They are reloaded on SIGHUP and when the files change.
+	Cert string `toml:"cert" env:"VERTIGO_TLS_CERT" flag:"tls-cert" usage:"TLS certificate file, enables HTTPS"`
+	Key  string `toml:"key" env:"VERTIGO_TLS_KEY" flag:"tls-key" usage:"TLS private key file"`
+	// ReloadInterval is how often certificate files are checked for changes. Zero disables the check.
+	ReloadInterval time.Duration `toml:"reload_interval" env:"VERTIGO_TLS_RELOAD_INTERVAL" flag:"tls-reload-interval" usage:"how often to check certificate files for changes"`
+	// Redirect is the address of a plain HTTP listener which redirects all requests to HTTPS.
+	Redirect string `toml:"redirect" env:"VERTIGO_TLS_REDIRECT" flag:"tls-redirect" usage:"HTTP listen address redirecting to HTTPS, for example :80"`
+	// HSTSMaxAge sets Strict-Transport-Security header lifetime in seconds. Zero disables the header.
+	HSTSMaxAge            int  `toml:"hsts_max_age" env:"VERTIGO_HSTS_MAX_AGE" flag:"hsts-max-age" usage:"Strict-Transport-Security max-age in seconds"`
+	HSTSIncludeSubdomains bool `toml:"hsts_include_subdomains" env:"VERTIGO_HSTS_INCLUDE_SUBDOMAINS"`
+	HSTSPreload           bool `toml:"hsts_preload" env:"VERTIGO_HSTS_PRELOAD"`
+}
+
+// Enabled returns whether HTTPS should be served.
+func (tls TLS) Enabled() bool {
+	return tls.Cert != "" && tls.Key != ""
+}
+
+// Database holds database connection settings.
+// DATABASE_URL environment variable sets both driver and source from a PostgreSQL URL.
+type Database struct {
+	Driver string `toml:"driver" env:"VERTIGO_DATABASE_DRIVER" flag:"driver" usage:"database driver to use (sqlite3, postgres)"`
+	Source string `toml:"source" env:"VERTIGO_DATABASE_SOURCE" flag:"source" usage:"database data source"`
+}
+
+// Cookie holds session cookie settings.
+type Cookie struct {
+	// Secret signs session cookies. Defaults to the secret generated on installation.
+	Secret string `toml:"secret" env:"VERTIGO_COOKIE_SECRET"`
+	Domain string `toml:"domain" env:"VERTIGO_COOKIE_DOMAIN" flag:"cookie-domain" usage:"session cookie domain"`
+	MaxAge int    `toml:"max_age" env:"VERTIGO_COOKIE_MAX_AGE" flag:"cookie-max-age" usage:"session cookie lifetime in seconds"`
+	Secure bool   `toml:"secure" env:"VERTIGO_COOKIE_SECURE" flag:"cookie-secure" usage:"send session cookies only over HTTPS"`
+}
+
+// Mailer holds settings of email delivery. SMTP settings take precedence over the ones saved in site settings when set.
+type Mailer struct {
+	// Transport is how email is delivered: "smtp", "sendmail", "file" or "log".
+	// File and log keep messages instead of sending them, for development.
+	Transport string `toml:"transport" env:"VERTIGO_MAILER" flag:"mailer" usage:"email transport: smtp, sendmail, file or log"`
+	Hostname  string `toml:"hostname" env:"SMTP_SERVER"`
+	Port      int    `toml:"port" env:"SMTP_PORT"`
+	Login     string `toml:"login" env:"SMTP_LOGIN"`
+	Password  string `toml:"password" env:"SMTP_PASSWORD"`
+	// From is the address email is sent from. The SMTP login is used when empty.
+	From string `toml:"from" env:"VERTIGO_MAIL_FROM"`
+	// Sendmail is the path of the sendmail program used by sendmail transport.
+	Sendmail string `toml:"sendmail" env:"VERTIGO_SENDMAIL"`
+	// Directory is where file transport writes messages.
+	Directory string `toml:"directory" env:"VERTIGO_MAIL_DIRECTORY"`
+	// Interval is how often the outbox is checked for messages due for another delivery attempt.
+	Interval time.Duration `toml:"interval" env:"VERTIGO_MAIL_INTERVAL"`
+	// Retention is how long sent messages are kept in the outbox. Zero removes them once sent.
+	Retention time.Duration `toml:"retention" env:"VERTIGO_MAIL_RETENTION"`
+}
+
+// Features toggles optional parts of the site.
+type Features struct {
+	Search      bool `toml:"search" env:"VERTIGO_SEARCH" flag:"search" usage:"enable post search"`
+	Feeds       bool `toml:"feeds" env:"VERTIGO_FEEDS" flag:"feeds" usage:"enable RSS feed"`
+	Newsletter  bool `toml:"newsletter" env:"VERTIGO_NEWSLETTER" flag:"newsletter" usage:"let readers subscribe to new posts by email"`
+	Micropub    bool `toml:"micropub" env:"VERTIGO_MICROPUB" flag:"micropub" usage:"accept posts from Micropub clients"`
+	Webmention  bool `toml:"webmention" env:"VERTIGO_WEBMENTION" flag:"webmention" usage:"send and receive Webmentions"`
+	ActivityPub bool `toml:"activitypub" env:"VERTIGO_ACTIVITYPUB" flag:"activitypub" usage:"federate posts with ActivityPub servers"`
+}
+
+// Micropub holds settings of the Micropub endpoint and its media endpoint.
+type Micropub struct {
+	// TokenEndpoint verifies IndieAuth access tokens, for example https://tokens.indieauth.com/token.
+	// Only API tokens are accepted when it is empty.
+	TokenEndpoint string `toml:"token_endpoint" env:"VERTIGO_TOKEN_ENDPOINT"`
+	// AuthorizationEndpoint is advertised to IndieAuth clients along with TokenEndpoint.
+	AuthorizationEndpoint string `toml:"authorization_endpoint" env:"VERTIGO_AUTHORIZATION_ENDPOINT"`
+	// Media is the directory uploaded files are stored in. They are served at /media/.
+	Media string `toml:"media" env:"VERTIGO_MEDIA" flag:"media" usage:"directory of files uploaded through Micropub"`
+	// MaxMediaSize limits the size of uploaded files in bytes.
+	MaxMediaSize int64 `toml:"max_media_size" env:"VERTIGO_MAX_MEDIA_SIZE"`
+}
+
+// Sanitize holds the HTML sanitization policy of each user role: "strict" allows the markup
+// produced by Markdown and "trusted" also embedded media and layout elements.
+// Run "vertigo post resanitize" after changing them to clean existing posts again.
+type Sanitize struct {
+	Admin  string `toml:"admin" env:"VERTIGO_SANITIZE_ADMIN"`
+	Author string `toml:"author" env:"VERTIGO_SANITIZE_AUTHOR"`
+}
+
+// Cache holds settings of the cache of pages rendered for visitors who are not logged in.
+type Cache struct {
+	Enabled bool `toml:"enabled" env:"VERTIGO_CACHE" flag:"cache" usage:"cache pages rendered for visitors who are not logged in"`
+	// Size is the maximum total size of cached pages in bytes.
+	Size int `toml:"size" env:"VERTIGO_CACHE_SIZE" flag:"cache-size" usage:"maximum total size of cached pages in bytes"`
+	// MaxAge is how long browsers and proxies may show a cached page without revalidating it.
+	MaxAge time.Duration `toml:"max_age" env:"VERTIGO_CACHE_MAX_AGE" flag:"cache-max-age" usage:"how long clients may reuse cached pages without revalidating"`
+}
+
+// Metrics holds settings of the /metrics endpoint, which is disabled by default.
+type Metrics struct {
+	Enabled bool `toml:"enabled" env:"VERTIGO_METRICS" flag:"metrics" usage:"serve Prometheus metrics at /metrics"`
+	// Token is required as "Authorization: Bearer <token>" header to read metrics, if set.
+	Token string `toml:"token" env:"VERTIGO_METRICS_TOKEN"`
+}
+
+// Log holds logging settings.
+type Log struct {
+	// Format is "text" for logfmt style key=value lines or "json".
+	Format string `toml:"format" env:"VERTIGO_LOG_FORMAT" flag:"log-format" usage:"log format, text or json"`
+	Level  string `toml:"level" env:"VERTIGO_LOG_LEVEL" flag:"log-level" usage:"minimum log level: debug, info, warn or error"`
+	// Access logs every request after it has been served.
+	Access bool `toml:"access" env:"VERTIGO_ACCESS_LOG" flag:"access-log" usage:"log every request"`
+	// RedactKeys is a comma separated list of log attributes whose values are never written.
+	RedactKeys string `toml:"redact_keys" env:"VERTIGO_LOG_REDACT_KEYS"`
+	// RedactEmails masks email addresses in log lines.
+	RedactEmails bool `toml:"redact_emails" env:"VERTIGO_LOG_REDACT_EMAILS"`
+}
+
+// Default returns configuration with default values.
+func Default() *Config {
+	return &Config{
+		Listen: ":3000",
+		Server: Server{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    1 << 20,
+			ShutdownTimeout:   30 * time.Second,
+			Compress:          true,
+		},
+		TLS: TLS{
+			ReloadInterval: time.Minute,
+		},
+		Database: Database{
+			Driver: "sqlite3",
+			Source: "vertigo.db",
+		},
+		Cookie: Cookie{
+			MaxAge: 86400 * 30,
+		},
+		Mailer: Mailer{
+			Transport: "smtp",
+			Sendmail:  "/usr/sbin/sendmail",
+			Directory: "mail",
+			Interval:  time.Minute,
+			Retention: 24 * time.Hour,
+		},
+		// features which add public endpoints or contact other servers are opt-in,
+		// so that upgrading does not enable them
+		Features: Features{
+			Search: true,
+			Feeds:  true,
+		},
+		Micropub: Micropub{
+			Media:        "media",
+			MaxMediaSize: 10 << 20,
+		},
+		Sanitize: Sanitize{
+			Admin:  "trusted",
+			Author: "strict",
+		},
+		Cache: Cache{
+			Enabled: true,
+			Size:    32 << 20,
+		},
+		Log: Log{
+			Format:       "text",
+			Level:        "info",
+			Access:       true,
+			RedactKeys:   "password,digest,recovery,cookiehash,mailerpassword,secret,token",
+			RedactEmails: true,
+		},
+	}
+}
+
+// DefaultFile is the configuration file read when none is given with -config flag or VERTIGO_CONFIG.
+const DefaultFile = "vertigo.toml"
+
+// field is a single configurable value of Config.
+type field struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	value reflect.Value
+}
+
+func fields(v reflect.Value, prefix string) []field {
+	var list []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("toml")
+		if key == "" || key == "-" {
+			continue
+		}
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if f.Type.Kind() == reflect.Struct {
+			list = append(list, fields(v.Field(i), key)...)
+			continue
+		}
+		list = append(list, field{
+			key:   key,
+			env:   f.Tag.Get("env"),
+			flag:  f.Tag.Get("flag"),
+			usage: f.Tag.Get("usage"),
+			value: v.Field(i),
+		})
+	}
+	return list
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the field according to its type.
+func (f field) set(s string) error {
+	switch {
+	case f.value.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		f.value.SetInt(int64(d))
+	case f.value.Kind() == reflect.String:
+		f.value.SetString(s)
+	case f.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		f.value.SetBool(b)
+	case f.value.Kind() == reflect.Int || f.value.Kind() == reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		f.value.SetInt(i)
+	case f.value.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.value.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
+
+// setTOML assigns a value parsed from a TOML file to the field.
+func (f field) setTOML(raw interface{}) error {
+	switch v := raw.(type) {
+	case string:
+		if f.value.Kind() != reflect.String && f.value.Type() != durationType {
+			return fmt.Errorf("expected %s, got string", f.value.Type())
+		}
+		return f.set(v)
+	case bool:
+		if f.value.Kind() != reflect.Bool {
+			return fmt.Errorf("expected %s, got boolean", f.value.Type())
+		}
+		f.value.SetBool(v)
+	case int64:
+		switch {
+		case f.value.Type() == durationType:
+			return fmt.Errorf("expected duration string such as \"5s\", got integer")
+		case f.value.Kind() == reflect.Int || f.value.Kind() == reflect.Int64:
+			f.value.SetInt(v)
+		case f.value.Kind() == reflect.Float64:
+			f.value.SetFloat(float64(v))
+		default:
+			return fmt.Errorf("expected %s, got integer", f.value.Type())
+		}
+	case float64:
+		if f.value.Kind() != reflect.Float64 {
+			return fmt.Errorf("expected %s, got number", f.value.Type())
+		}
+		f.value.SetFloat(v)
+	}
+	return nil
+}
+
+// flagValue records values given on the command line, so they can be applied after
+// the configuration file and environment variables.
+type flagValue struct {
+	field field
+	def   string
+	value *string
+}
+
+func (v flagValue) String() string {
+	return v.def
+}
+
+func (v flagValue) Set(s string) error {
+	*v.value = s
+	// parse into a throwaway copy to report malformed values early
+	scratch := reflect.New(v.field.value.Type()).Elem()
+	return field{value: scratch}.set(s)
+}
+
+func (v flagValue) IsBoolFlag() bool {
+	return v.field.value.Kind() == reflect.Bool
+}
+
+// Load reads configuration from the file given with -config flag or VERTIGO_CONFIG environment variable,
+// or DefaultFile if it exists, then from environment variables and finally from flags in args.
+// The resulting configuration is validated.
+func Load(args []string) (*Config, error) {
+	return LoadFlags(flag.NewFlagSet("vertigo", flag.ContinueOnError), args)
+}
+
+// LoadFlags is like Load, but registers configuration flags in flags, so they can be parsed
+// together with flags of a subcommand which have been registered in it beforehand.
+func LoadFlags(flags *flag.FlagSet, args []string) (*Config, error) {
+	config := Default()
+	list := fields(reflect.ValueOf(config).Elem(), "")
+
+	file := flags.String("config", "", "configuration file (default "+DefaultFile+" if it exists)")
+	for _, f := range list {
+		if f.flag == "" {
+			continue
+		}
+		var def string
+		if !f.value.IsZero() {
+			def = fmt.Sprint(f.value.Interface())
+		}
+		flags.Var(flagValue{field: f, def: def, value: new(string)}, f.flag, f.usage)
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	config.Args = flags.Args()
+
+	config.File = *file
+	if config.File == "" {
+		config.File = os.Getenv("VERTIGO_CONFIG")
+	}
+	if config.File == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			config.File = DefaultFile
+		}
+	}
+	if config.File != "" {
+		data, err := ioutil.ReadFile(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+		values, err := parseTOML(data)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %v", config.File, err)
+		}
+		for _, f := range list {
+			v, ok := values[f.key]
+			if !ok {
+				continue
+			}
+			delete(values, f.key)
+			err := f.setTOML(v.raw)
+			if err != nil {
+				return nil, fmt.Errorf("config %s: line %d: %s: %v", config.File, v.line, f.key, err)
+			}
+		}
+		for key, v := range values {
+			return nil, fmt.Errorf("config %s: line %d: unknown key %q", config.File, v.line, key)
+		}
+	}
+
+	// environment variables which predate the configuration file
+	if port := os.Getenv("PORT"); port != "" {
+		config.Listen = ":" + port
+	}
+	if source := os.Getenv("DATABASE_URL"); source != "" {
+		u, err := url.Parse(source)
+		if err != nil {
+			return nil, errors.New("config: DATABASE_URL could not be parsed")
+		}
+		config.Database.Driver = u.Scheme
+		config.Database.Source = source
+	}
+	for _, f := range list {
+		if f.env == "" {
+			continue
+		}
+		if s := os.Getenv(f.env); s != "" {
+			err := f.set(s)
+			if err != nil {
+				return nil, fmt.Errorf("config: environment variable %s: %v", f.env, err)
+			}
+		}
+	}
+
+	var visitErr error
+	flags.Visit(func(fl *flag.Flag) {
+		v, ok := fl.Value.(flagValue)
+		if !ok || visitErr != nil {
+			return
+		}
+		err := v.field.set(*v.value)
+		if err != nil {
+			visitErr = fmt.Errorf("config: flag -%s: %v", fl.Name, err)
+		}
+	})
+	if visitErr != nil {
+		return nil, visitErr
+	}
+
+	return config, config.Validate()
+}
+
+var themeName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Validate checks that the configuration can be used to start the server.
+// All problems found are reported in the returned error.
+func (config *Config) Validate() error {
+	var problems []string
+
+	_, port, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("listen address %q should be host:port, for example :3000", config.Listen))
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil && port != "" {
+		problems = append(problems, fmt.Sprintf("listen port %q is not a valid port number", port))
+	}
+
+	for _, timeout := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"read_header_timeout", config.Server.ReadHeaderTimeout},
+		{"read_timeout", config.Server.ReadTimeout},
+		{"write_timeout", config.Server.WriteTimeout},
+		{"idle_timeout", config.Server.IdleTimeout},
+		{"shutdown_timeout", config.Server.ShutdownTimeout},
+	} {
+		if timeout.value < 0 {
+			problems = append(problems, fmt.Sprintf("server %s can not be negative", timeout.key))
+		}
+	}
+	if config.Server.MaxHeaderBytes <= 0 {
+		problems = append(problems, "server max_header_bytes should be positive")
+	}
+
+	if (config.TLS.Cert == "") != (config.TLS.Key == "") {
+		problems = append(problems, "tls cert and key should be given together")
+	}
+	if config.TLS.ReloadInterval < 0 {
+		problems = append(problems, "tls reload_interval can not be negative")
+	}
+	if config.TLS.Redirect != "" {
+		if !config.TLS.Enabled() {
+			problems = append(problems, "tls redirect requires tls cert and key")
+		}
+		if _, _, err := net.SplitHostPort(config.TLS.Redirect); err != nil {
+			problems = append(problems, fmt.Sprintf("tls redirect address %q should be host:port, for example :80", config.TLS.Redirect))
+		}
+	}
+	if config.TLS.HSTSMaxAge < 0 {
+		problems = append(problems, "tls hsts_max_age can not be negative")
+	}
+	// see https://hstspreload.org for preload list requirements
+	if config.TLS.HSTSPreload && (config.TLS.HSTSMaxAge < 31536000 || !config.TLS.HSTSIncludeSubdomains) {
+		problems = append(problems, "tls hsts_preload requires hsts_max_age of at least 31536000 and hsts_include_subdomains")
+	}
+
+	if config.Cache.Enabled && config.Cache.Size <= 0 {
+		problems = append(problems, "cache size should be positive")
+	}
+	if config.Cache.MaxAge < 0 {
+		problems = append(problems, "cache max_age can not be negative")
+	}
+
+	switch config.Database.Driver {
+	case "sqlite3", "postgres":
+	default:
+		problems = append(problems, fmt.Sprintf("database driver %q is not supported, use sqlite3 or postgres", config.Database.Driver))
+	}
+	if config.Database.Source == "" {
+		problems = append(problems, "database source is empty")
+	}
+
+	for _, role := range []struct {
+		key    string
+		policy string
+	}{
+		{"admin", config.Sanitize.Admin},
+		{"author", config.Sanitize.Author},
+	} {
+		if _, ok := sanitize.Policies[role.policy]; !ok {
+			problems = append(problems, fmt.Sprintf("sanitize %s policy %q is not supported, use strict or trusted", role.key, role.policy))
+		}
+	}
+
+	if config.Cookie.MaxAge < 0 {
+		problems = append(problems, "cookie max_age can not be negative")
+	}
+
+	if config.Mailer.Port < 0 || config.Mailer.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("mailer port %d is not a valid port number", config.Mailer.Port))
+	}
+	switch config.Mailer.Transport {
+	case "smtp", "log":
+	case "sendmail":
+		if config.Mailer.Sendmail == "" {
+			problems = append(problems, "mailer sendmail path is empty")
+		}
+	case "file":
+		if config.Mailer.Directory == "" {
+			problems = append(problems, "mailer directory is empty")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("mailer transport %q is not supported, use smtp, sendmail, file or log", config.Mailer.Transport))
+	}
+	if config.Mailer.Interval <= 0 {
+		problems = append(problems, "mailer interval should be positive")
+	}
+	if config.Mailer.Retention < 0 {
+		problems = append(problems, "mailer retention can not be negative")
+	}
+
+	if config.Features.Micropub {
+		if config.Micropub.Media == "" {
+			problems = append(problems, "micropub media directory is empty")
+		}
+		if config.Micropub.MaxMediaSize <= 0 {
+			problems = append(problems, "micropub max_media_size should be positive")
+		}
+		for _, endpoint := range []struct {
+			key   string
+			value string
+		}{
+			{"token_endpoint", config.Micropub.TokenEndpoint},
+			{"authorization_endpoint", config.Micropub.AuthorizationEndpoint},
+		} {
+			if u, err := url.Parse(endpoint.value); endpoint.value != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+				problems = append(problems, fmt.Sprintf("micropub %s %q should be an absolute http or https URL", endpoint.key, endpoint.value))
+			}
+		}
+		if (config.Micropub.TokenEndpoint == "") != (config.Micropub.AuthorizationEndpoint == "") {
+			problems = append(problems, "micropub token_endpoint and authorization_endpoint should be given together")
+		}
+	}
+
+	switch config.Log.Format {
+	case "text", "json":
+	default:
+		problems = append(problems, fmt.Sprintf("log format %q is not supported, use text or json", config.Log.Format))
+	}
+	switch strings.ToLower(config.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("log level %q is not supported, use debug, info, warn or error", config.Log.Level))
+	}
+
+	if config.Theme != "" && !themeName.MatchString(config.Theme) {
+		problems = append(problems, fmt.Sprintf("theme name %q may only contain lowercase letters, numbers, - and _", config.Theme))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
@@ -0,0 +1,2 @@
+// Package config loads server configuration from a TOML file, environment variables and command line flags.
+package config
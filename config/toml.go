@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// value is a single key/value pair read from a TOML file.
+type value struct {
+	line int
+	raw  interface{}
+}
+
+// parseTOML parses the subset of TOML used by configuration files: comments, [tables],
+// and keys with string, integer, float and boolean values.
+// Keys are returned flattened with their table names, for example "database.driver".
+func parseTOML(data []byte) (map[string]value, error) {
+	values := make(map[string]value)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var table string
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			end := strings.Index(text, "]")
+			if end == -1 || strings.TrimSpace(stripComment(text[end+1:])) != "" {
+				return nil, fmt.Errorf("line %d: malformed table header", line)
+			}
+			table = strings.TrimSpace(text[1:end])
+			if table == "" {
+				return nil, fmt.Errorf("line %d: empty table name", line)
+			}
+			continue
+		}
+
+		eq := strings.Index(text, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key := strings.TrimSpace(text[:eq])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", line)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line, key)
+		}
+		raw, err := parseValue(strings.TrimSpace(text[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		values[key] = value{line: line, raw: raw}
+	}
+	return values, scanner.Err()
+}
+
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return parseBasicString(s)
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		if strings.TrimSpace(stripComment(s[end+2:])) != "" {
+			return nil, fmt.Errorf("unexpected text after string")
+		}
+		return s[1 : end+1], nil
+	}
+	s = strings.TrimSpace(stripComment(s))
+	switch s {
+	case "":
+		return nil, fmt.Errorf("missing value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %q, strings must be quoted", s)
+}
+
+func parseBasicString(s string) (string, error) {
+	var buf bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			if strings.TrimSpace(stripComment(s[i+1:])) != "" {
+				return "", fmt.Errorf("unexpected text after string")
+			}
+			return buf.String(), nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", fmt.Errorf("unterminated string")
+			}
+			switch s[i] {
+			case '"', '\\':
+				buf.WriteByte(s[i])
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'r':
+				buf.WriteByte('\r')
+			case 'u':
+				if i+4 >= len(s) {
+					return "", fmt.Errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", fmt.Errorf("invalid unicode escape")
+				}
+				var b [utf8.UTFMax]byte
+				buf.Write(b[:utf8.EncodeRune(b[:], rune(r))])
+				i += 4
+			default:
+				return "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func stripComment(s string) string {
+	if i := strings.Index(s, "#"); i != -1 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,662 @@
+package sqlx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	slug "github.com/shurcooL/sanitized_anchor_name"
+	"github.com/toldjuuso/vertigo/activitypub"
+	"github.com/toldjuuso/vertigo/metrics"
+	"github.com/toldjuuso/vertigo/sanitize"
+)
+
+// Every author of the site is an ActivityPub actor, which people on Mastodon-style servers can
+// follow. Posts are sent to followers as Article objects when they are published, updated and
+// deleted, see Federate, and replies to posts are stored as comments, see ReceiveActivity.
+
+// ActorKey is the key pair with which requests of the actor of user Owner are signed.
+type ActorKey struct {
+	Owner      int64  `json:"owner"`
+	PrivateKey string `json:"-"`
+	PublicKey  string `json:"publickey"`
+	Created    int64  `json:"created"`
+}
+
+// Follower is an actor on another server following the actor of user Owner.
+// Follow is the ID of the Follow activity, which an Undo refers to.
+type Follower struct {
+	ID          int64  `json:"id"`
+	Owner       int64  `json:"owner"`
+	Actor       string `json:"actor"`
+	Follow      string `json:"follow"`
+	Inbox       string `json:"inbox"`
+	SharedInbox string `json:"sharedinbox"`
+	Created     int64  `json:"created"`
+}
+
+// Comment is a reply to a post from another server. Content is sanitized with the strict policy.
+type Comment struct {
+	ID         int64  `json:"id"`
+	Post       int64  `json:"post"`
+	ObjectID   string `json:"objectid"`
+	Actor      string `json:"actor"`
+	AuthorName string `json:"authorname"`
+	AuthorURL  string `json:"authorurl"`
+	URL        string `json:"url"`
+	Content    string `json:"content"`
+	Published  int64  `json:"published"`
+	Created    int64  `json:"created"`
+}
+
+// ActivityDelivery is an activity queued for delivery to the inbox of a follower. Deliveries
+// use the statuses of webhook deliveries and are retried like them, see Delivery.
+type ActivityDelivery struct {
+	ID          int64  `json:"id"`
+	Owner       int64  `json:"owner"`
+	Inbox       string `json:"inbox"`
+	Activity    string `json:"activity"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"lasterror"`
+	NextAttempt int64  `json:"nextattempt"`
+	Created     int64  `json:"created"`
+	Delivered   int64  `json:"delivered"`
+}
+
+// activityQueued wakes up DeliverActivities when an activity is queued.
+var activityQueued = make(chan struct{}, 1)
+
+// siteURL returns the address of the site without a trailing slash.
+func siteURL() string {
+	return strings.TrimRight(Settings.Hostname, "/")
+}
+
+// ActorURL returns the ID of the actor of user with given ID.
+func ActorURL(owner int64) string {
+	return siteURL() + "/ap/user/" + strconv.FormatInt(owner, 10)
+}
+
+// ObjectURL returns the ID of the Article object of post.
+func ObjectURL(post Post) string {
+	return siteURL() + "/ap/post/" + strconv.FormatInt(post.ID, 10)
+}
+
+// ActorID returns the ID of the user whose actor ID is id.
+// Returns "not found" error if id is not an actor of the site.
+func ActorID(id string) (int64, error) {
+	prefix := siteURL() + "/ap/user/"
+	if !strings.HasPrefix(id, prefix) {
+		return 0, errors.New("not found")
+	}
+	owner, err := strconv.ParseInt(strings.TrimPrefix(id, prefix), 10, 64)
+	if err != nil {
+		return 0, errors.New("not found")
+	}
+	return owner, nil
+}
+
+// iso returns unix time t in the format of ActivityPub documents.
+func iso(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+// usernames returns the usernames of all users by ID: the name of the user as in post slugs,
+// followed by the ID of the user if an older user already has the name.
+func usernames() (map[int64]string, error) {
+	var users []struct {
+		ID   int64
+		Name string
+	}
+	err := db.Select(&users, "SELECT id, name FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string)
+	taken := make(map[string]bool)
+	for _, user := range users {
+		name := slug.Create(user.Name)
+		if name == "" || taken[name] {
+			name = strings.TrimLeft(name+"-"+strconv.FormatInt(user.ID, 10), "-")
+		}
+		taken[name] = true
+		names[user.ID] = name
+	}
+	return names, nil
+}
+
+// Username or user.Username returns the name of user in addresses such as foo@example.com.
+func (user User) Username() (string, error) {
+	names, err := usernames()
+	if err != nil {
+		return "", err
+	}
+	name, ok := names[user.ID]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return name, nil
+}
+
+// UserByUsername returns the user with given username, see User.Username.
+func UserByUsername(username string) (User, error) {
+	var user User
+	names, err := usernames()
+	if err != nil {
+		return user, err
+	}
+	for id, name := range names {
+		if strings.EqualFold(name, username) {
+			user.ID = id
+			return user.Get()
+		}
+	}
+	return user, errors.New("not found")
+}
+
+// actorKey returns the key pair of the actor of user with given ID, generating it on first use.
+func actorKey(owner int64) (ActorKey, error) {
+	defer metrics.Query("actorKey", time.Now())
+	var key ActorKey
+	err := db.Get(&key, db.Rebind("SELECT * FROM actorkeys WHERE owner = ?"), owner)
+	if err == nil || err.Error() != "sql: no rows in result set" {
+		return key, err
+	}
+	key.Owner = owner
+	key.PrivateKey, key.PublicKey, err = activitypub.NewKey()
+	if err != nil {
+		return key, err
+	}
+	key.Created = time.Now().UTC().Unix()
+	_, err = db.NamedExec("INSERT INTO actorkeys (owner, privatekey, publickey, created) VALUES (:owner, :privatekey, :publickey, :created)", key)
+	if err != nil {
+		// another request generated the key first
+		err = db.Get(&key, db.Rebind("SELECT * FROM actorkeys WHERE owner = ?"), owner)
+	}
+	return key, err
+}
+
+// SigningKey returns the key with which requests of the actor of user with given ID are signed.
+func SigningKey(owner int64) (activitypub.Key, error) {
+	key, err := actorKey(owner)
+	if err != nil {
+		return activitypub.Key{}, err
+	}
+	return activitypub.Key{ID: ActorURL(owner) + "#main-key", PrivateKeyPem: key.PrivateKey}, nil
+}
+
+// Actor or user.Actor returns the actor document of user.
+func (user User) Actor() (activitypub.Actor, error) {
+	id := ActorURL(user.ID)
+	username, err := user.Username()
+	if err != nil {
+		return activitypub.Actor{}, err
+	}
+	key, err := actorKey(user.ID)
+	if err != nil {
+		return activitypub.Actor{}, err
+	}
+	return activitypub.Actor{
+		Context:           activitypub.Context,
+		ID:                id,
+		Type:              "Person",
+		PreferredUsername: username,
+		Name:              user.Name,
+		Summary:           Settings.Description,
+		URL:               siteURL() + "/",
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		Endpoints:         &activitypub.Endpoints{SharedInbox: siteURL() + "/ap/inbox"},
+		PublicKey:         activitypub.PublicKey{ID: id + "#main-key", Owner: id, PublicKeyPem: key.PublicKey},
+	}, nil
+}
+
+// Object or post.Object returns the Article object of post, addressed to everyone and the
+// followers of its author.
+func (post Post) Object() map[string]interface{} {
+	object := map[string]interface{}{
+		"id":           ObjectURL(post),
+		"type":         "Article",
+		"attributedTo": ActorURL(post.Author),
+		"name":         post.Title,
+		"content":      post.Content,
+		"url":          postURL(post),
+		"published":    iso(post.Created),
+		"to":           []string{activitypub.Public},
+		"cc":           []string{ActorURL(post.Author) + "/followers"},
+	}
+	if post.Updated > post.Created {
+		object["updated"] = iso(post.Updated)
+	}
+	return object
+}
+
+// activity returns an activity of given type of the actor of owner with object.
+func activity(owner int64, id string, kind string, object interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"@context": activitypub.Context,
+		"id":       id,
+		"type":     kind,
+		"actor":    ActorURL(owner),
+		"to":       []string{activitypub.Public},
+		"cc":       []string{ActorURL(owner) + "/followers"},
+		"object":   object,
+	}
+}
+
+// Outbox or user.Outbox returns Create activities of the published posts of user, newest first.
+func (user User) Outbox() ([]map[string]interface{}, error) {
+	user, err := user.Get()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]map[string]interface{}, 0)
+	for _, post := range user.Posts {
+		if post.Published {
+			create := activity(user.ID, ObjectURL(post)+"#create", "Create", post.Object())
+			delete(create, "@context")
+			create["published"] = iso(post.Created)
+			items = append(items, create)
+		}
+	}
+	return items, nil
+}
+
+// Followers returns followers of the actor of user with given ID in order of following.
+func Followers(owner int64) ([]Follower, error) {
+	defer metrics.Query("Followers", time.Now())
+	followers := make([]Follower, 0)
+	err := db.Select(&followers, db.Rebind("SELECT * FROM followers WHERE owner = ? ORDER BY id"), owner)
+	return followers, err
+}
+
+// Delete or follower.Delete removes follower with given follower.ID of follower.Owner.
+// The follower is not told, so it may keep showing posts it has received.
+func (follower Follower) Delete() error {
+	defer metrics.Query("Follower.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM followers WHERE id = ? AND owner = ?"), follower.ID, follower.Owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// Comments returns all comments, newest first.
+func Comments() ([]Comment, error) {
+	defer metrics.Query("Comments", time.Now())
+	comments := make([]Comment, 0)
+	err := db.Select(&comments, "SELECT * FROM comments ORDER BY id DESC")
+	return comments, err
+}
+
+// Comments or post.Comments returns comments of post, oldest first.
+func (post Post) Comments() ([]Comment, error) {
+	defer metrics.Query("Post.Comments", time.Now())
+	comments := make([]Comment, 0)
+	err := db.Select(&comments, db.Rebind("SELECT * FROM comments WHERE post = ? ORDER BY published, id"), post.ID)
+	return comments, err
+}
+
+// Delete or comment.Delete removes comment with given comment.ID.
+func (comment Comment) Delete() error {
+	defer metrics.Query("Comment.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM comments WHERE id = ?"), comment.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	changed()
+	return nil
+}
+
+// queueActivity queues delivery of activity of the actor of owner to inboxes.
+func queueActivity(owner int64, inboxes []string, activity map[string]interface{}) error {
+	defer metrics.Query("queueActivity", time.Now())
+	payload, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Unix()
+	for _, inbox := range inboxes {
+		_, err = db.NamedExec(`INSERT INTO activitydeliveries (owner, inbox, activity, status, attempts, lasterror, nextattempt, created, delivered)
+			VALUES (:owner, :inbox, :activity, :status, :attempts, :lasterror, :nextattempt, :created, :delivered)`,
+			ActivityDelivery{Owner: owner, Inbox: inbox, Activity: string(payload), Status: DeliveryPending, NextAttempt: now, Created: now})
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case activityQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Federate queues the activity of a content event of post to the followers of its author:
+// Create when the post is published, Update when a published post is updated and Delete when
+// a published post is unpublished or deleted. Other events are not federated.
+func Federate(event string, post Post) error {
+	var kind string
+	var object interface{} = post.Object()
+	id := ObjectURL(post)
+	switch {
+	case event == EventPostPublished:
+		kind, id = "Create", id+"#create-"+strconv.FormatInt(time.Now().Unix(), 10)
+	case event == EventPostUpdated && post.Published:
+		kind, id = "Update", id+"#update-"+strconv.FormatInt(post.Updated, 10)
+	case event == EventPostUnpublished, event == EventPostDeleted && post.Published:
+		kind, id = "Delete", id+"#delete-"+strconv.FormatInt(time.Now().Unix(), 10)
+		object = map[string]interface{}{"id": ObjectURL(post), "type": "Tombstone"}
+	default:
+		return nil
+	}
+	followers, err := Followers(post.Author)
+	if err != nil || len(followers) == 0 {
+		return err
+	}
+	// servers with many followers get the activity once, in their shared inbox
+	var inboxes []string
+	seen := make(map[string]bool)
+	for _, follower := range followers {
+		inbox := follower.SharedInbox
+		if inbox == "" {
+			inbox = follower.Inbox
+		}
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	return queueActivity(post.Author, inboxes, activity(post.Author, id, kind, object))
+}
+
+// ReceiveActivity handles activity sent by actor, whose signature has been verified, to an inbox.
+// Follow and Undo of a Follow add and remove followers, and followers are sent an Accept.
+// Create, Update and Delete of a Note which replies to a published post add, change and remove a comment.
+// Other activities are ignored. Returns "activity invalid" error if the activity is not
+// made by actor or lacks its object.
+func ReceiveActivity(actor activitypub.Actor, received activitypub.Activity) error {
+	if received.Actor != actor.ID || received.ObjectID() == "" {
+		return errors.New("activity invalid")
+	}
+	switch received.Type {
+	case "Follow":
+		followed, err := ActorID(received.ObjectID())
+		if err != nil {
+			return nil
+		}
+		return follow(followed, actor, received)
+	case "Undo":
+		undone, err := received.Embedded()
+		if err != nil {
+			// the Follow is only referred to by its ID
+			_, err = db.Exec(db.Rebind("DELETE FROM followers WHERE actor = ? AND follow = ?"), actor.ID, received.ObjectID())
+			return err
+		}
+		if undone.Type != "Follow" || undone.Actor != actor.ID {
+			return nil
+		}
+		followed, err := ActorID(undone.ObjectID())
+		if err != nil {
+			return nil
+		}
+		_, err = db.Exec(db.Rebind("DELETE FROM followers WHERE owner = ? AND actor = ?"), followed, actor.ID)
+		return err
+	case "Create", "Update":
+		note, err := received.Note()
+		if err != nil {
+			return errors.New("activity invalid")
+		}
+		if note.AttributedTo != actor.ID {
+			return errors.New("activity invalid")
+		}
+		return comment(actor, note, received.Type == "Update")
+	case "Delete":
+		id := received.ObjectID()
+		var err error
+		if id == actor.ID {
+			// the account has been deleted
+			_, err = db.Exec(db.Rebind("DELETE FROM followers WHERE actor = ?"), actor.ID)
+			if err == nil {
+				_, err = db.Exec(db.Rebind("DELETE FROM comments WHERE actor = ?"), actor.ID)
+			}
+		} else {
+			_, err = db.Exec(db.Rebind("DELETE FROM comments WHERE objectid = ? AND actor = ?"), id, actor.ID)
+		}
+		changed()
+		return err
+	}
+	return nil
+}
+
+// follow adds actor as a follower of user with given ID and queues an Accept of the Follow.
+func follow(owner int64, actor activitypub.Actor, received activitypub.Activity) error {
+	defer metrics.Query("follow", time.Now())
+	_, err := User{ID: owner}.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil
+		}
+		return err
+	}
+	follower := Follower{
+		Owner:   owner,
+		Actor:   actor.ID,
+		Follow:  received.ID,
+		Inbox:   actor.Inbox,
+		Created: time.Now().UTC().Unix(),
+	}
+	if actor.SharedInbox() != actor.Inbox {
+		follower.SharedInbox = actor.SharedInbox()
+	}
+	_, err = db.Exec(db.Rebind("DELETE FROM followers WHERE owner = ? AND actor = ?"), owner, actor.ID)
+	if err != nil {
+		return err
+	}
+	_, err = db.NamedExec("INSERT INTO followers (owner, actor, follow, inbox, sharedinbox, created) VALUES (:owner, :actor, :follow, :inbox, :sharedinbox, :created)", follower)
+	if err != nil {
+		return err
+	}
+	accept := map[string]interface{}{
+		"@context": activitypub.Context,
+		"id":       fmt.Sprintf("%s#accept-%d", ActorURL(owner), time.Now().UnixNano()),
+		"type":     "Accept",
+		"actor":    ActorURL(owner),
+		"object":   map[string]interface{}{"id": received.ID, "type": "Follow", "actor": actor.ID, "object": ActorURL(owner)},
+	}
+	return queueActivity(owner, []string{actor.Inbox}, accept)
+}
+
+// ObjectPost returns the published post whose Article has given ID, see ObjectURL.
+// Returns "not found" error if there is no such published post.
+func ObjectPost(id string) (Post, error) {
+	defer metrics.Query("ObjectPost", time.Now())
+	var post Post
+	prefix := siteURL() + "/ap/post/"
+	if !strings.HasPrefix(id, prefix) {
+		return post, errors.New("not found")
+	}
+	n, err := strconv.ParseInt(strings.TrimPrefix(id, prefix), 10, 64)
+	if err != nil {
+		return post, errors.New("not found")
+	}
+	err = db.Get(&post, db.Rebind("SELECT * FROM posts WHERE id = ?"), n)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return post, errors.New("not found")
+		}
+		return post, err
+	}
+	if !post.Published {
+		return post, errors.New("not found")
+	}
+	return post, nil
+}
+
+// replyTarget returns the published post which inReplyTo, the ID of an Article or the address of
+// a post, points to. Returns "not found" error if it is not a published post of the site.
+func replyTarget(inReplyTo string) (Post, error) {
+	if !strings.HasPrefix(inReplyTo, siteURL()+"/post/") {
+		return ObjectPost(inReplyTo)
+	}
+	post := Post{Slug: strings.TrimRight(strings.TrimPrefix(inReplyTo, siteURL()+"/post/"), "/")}
+	post, err := post.Get()
+	if err == nil && !post.Published {
+		err = errors.New("not found")
+	}
+	return post, err
+}
+
+// comment stores note of actor as a comment if it replies to a published post, or with update
+// changes the content of a stored comment.
+func comment(actor activitypub.Actor, note activitypub.Note, update bool) error {
+	defer metrics.Query("comment", time.Now())
+	if note.ID == "" {
+		return errors.New("activity invalid")
+	}
+	content := sanitize.Strict.Sanitize(note.Content)
+	if update {
+		_, err := db.Exec(db.Rebind("UPDATE comments SET content = ? WHERE objectid = ? AND actor = ?"), content, note.ID, actor.ID)
+		changed()
+		return err
+	}
+	post, err := replyTarget(note.InReplyTo)
+	if err != nil {
+		if err.Error() == "not found" {
+			return nil
+		}
+		return err
+	}
+	var count int
+	err = db.Get(&count, db.Rebind("SELECT COUNT(*) FROM comments WHERE objectid = ?"), note.ID)
+	if err != nil || count > 0 {
+		return err
+	}
+	c := Comment{
+		Post:       post.ID,
+		ObjectID:   note.ID,
+		Actor:      actor.ID,
+		AuthorName: actor.Name,
+		AuthorURL:  actor.URL,
+		URL:        note.URL,
+		Content:    content,
+		Created:    time.Now().UTC().Unix(),
+	}
+	if c.AuthorName == "" {
+		c.AuthorName = actor.PreferredUsername
+	}
+	if u, err := url.Parse(c.AuthorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		c.AuthorURL = actor.ID
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		c.URL = note.ID
+	}
+	c.Published = c.Created
+	if published, err := time.Parse(time.RFC3339, note.Published); err == nil {
+		c.Published = published.Unix()
+	}
+	_, err = db.NamedExec(`INSERT INTO comments (post, objectid, actor, authorname, authorurl, url, content, published, created)
+		VALUES (:post, :objectid, :actor, :authorname, :authorurl, :url, :content, :published, :created)`, c)
+	if err != nil {
+		return err
+	}
+	changed()
+	commentCreated(c, post)
+	return nil
+}
+
+// claim reserves delivery for this process for a while, see Mail.claim.
+func (delivery ActivityDelivery) claim(now time.Time) (bool, error) {
+	result, err := db.Exec(db.Rebind("UPDATE activitydeliveries SET nextattempt = ? WHERE id = ? AND status = ? AND nextattempt = ?"),
+		now.Add(10*time.Minute).Unix(), delivery.ID, DeliveryPending, delivery.NextAttempt)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// deliver posts the activity to the inbox and records the outcome.
+func (delivery ActivityDelivery) deliver(now time.Time) error {
+	delivery.Attempts++
+	key, err := SigningKey(delivery.Owner)
+	if err == nil {
+		err = activitypub.Post(delivery.Inbox, key, []byte(delivery.Activity))
+	}
+	if err == nil {
+		metrics.Activities.Inc("delivered")
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+		delivery.Delivered = now.Unix()
+	} else {
+		metrics.Activities.Inc("failed")
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(retryDelay(delivery.Attempts)).Unix()
+		if delivery.Attempts >= MaxDeliveryAttempts {
+			delivery.Status = DeliveryFailed
+			log.Printf("activitypub: giving up on delivery %d to %s after %d attempts: %v", delivery.ID, delivery.Inbox, delivery.Attempts, err)
+		}
+	}
+	_, dberr := db.NamedExec("UPDATE activitydeliveries SET status = :status, attempts = :attempts, lasterror = :lasterror, nextattempt = :nextattempt, delivered = :delivered WHERE id = :id", delivery)
+	if dberr != nil {
+		return dberr
+	}
+	return err
+}
+
+// ProcessActivities attempts all pending activity deliveries which are due and returns the number
+// of deliveries which succeeded.
+func ProcessActivities() (int, error) {
+	now := time.Now().UTC()
+	var due []ActivityDelivery
+	err := db.Select(&due, db.Rebind("SELECT * FROM activitydeliveries WHERE status = ? AND nextattempt <= ? ORDER BY id"), DeliveryPending, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, delivery := range due {
+		ok, err := delivery.claim(now)
+		if err != nil {
+			return delivered, err
+		}
+		if !ok {
+			continue
+		}
+		err = delivery.deliver(now)
+		if err == nil {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// DeliverActivities processes pending activity deliveries every interval and whenever an activity
+// is queued, until ctx is done.
+func DeliverActivities(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := ProcessActivities()
+		if err != nil {
+			log.Println("activitypub: processing deliveries:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-activityQueued:
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package sqlx
+
+import (
+	"context"
+	"sync"
+)
+
+var pending sync.WaitGroup
+
+// Background runs f in a new goroutine. Work started with Background is waited for
+// by Wait, so it is not lost when the server shuts down.
+func Background(f func()) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		f()
+	}()
+}
+
+// Wait blocks until all work started with Background has finished or ctx is done.
+func Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,404 @@
+package sqlx
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pborman/uuid"
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// BackupVersion is the version of the Backup format written by Dump.
+const BackupVersion = 5
+
+// Backup holds all rows of the database. Unlike User and Post, its records include
+// fields which are never rendered, such as password digests and publication state.
+// Rows of Webmentions, followers, comments, activity deliveries, newsletters, webhooks,
+// webhook deliveries, invitations and email templates are kept as they are, since their types
+// render every field.
+type Backup struct {
+	Version  int          `json:"version"`
+	Created  int64        `json:"created"`
+	Settings *Vertigo     `json:"settings,omitempty"`
+	Users    []UserRecord `json:"users"`
+	Posts    []PostRecord `json:"posts"`
+	// Tokens, DeletedPosts, Webmentions, ActorKeys, Followers, Comments and ActivityDeliveries were added in version 4.
+	Tokens             []TokenRecord       `json:"tokens"`
+	DeletedPosts       []DeletedPostRecord `json:"deletedposts"`
+	Webmentions        []Webmention        `json:"webmentions"`
+	ActorKeys          []ActorKeyRecord    `json:"actorkeys"`
+	Followers          []Follower          `json:"followers"`
+	Comments           []Comment           `json:"comments"`
+	ActivityDeliveries []ActivityDelivery  `json:"activitydeliveries"`
+	// Subscribers, Newsletters, Webhooks, Deliveries, Invitations, EmailTemplates and Outbox were added in version 5.
+	Subscribers    []SubscriberRecord `json:"subscribers"`
+	Newsletters    []Newsletter       `json:"newsletters"`
+	Webhooks       []Webhook          `json:"webhooks"`
+	Deliveries     []Delivery         `json:"deliveries"`
+	Invitations    []Invitation       `json:"invitations"`
+	EmailTemplates []EmailTemplate    `json:"emailtemplates"`
+	Outbox         []MailRecord       `json:"outbox"`
+}
+
+// UserRecord is a row of users table.
+type UserRecord struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Location string `json:"location"`
+	Role     string `json:"role"`
+	Digest   []byte `json:"digest,omitempty"`
+	Recovery string `json:"-"`
+	// Verified was added in version 2. Users of older backups are verified on restore.
+	Verified bool `json:"verified"`
+}
+
+// PostRecord is a row of posts table.
+type PostRecord struct {
+	ID         int64  `json:"id"`
+	Title      string `json:"title"`
+	Content    string `json:"content"`
+	Markdown   string `json:"markdown"`
+	Slug       string `json:"slug"`
+	Author     int64  `json:"author"`
+	Excerpt    string `json:"excerpt"`
+	Viewcount  uint   `json:"viewcount"`
+	Published  bool   `json:"published"`
+	Created    int64  `json:"created"`
+	Updated    int64  `json:"updated"`
+	TimeOffset int    `json:"timeoffset"`
+	// Description and Image were added in version 3.
+	Description string `json:"description"`
+	Image       string `json:"image"`
+}
+
+// DeletedPostRecord is a row of deletedposts table.
+type DeletedPostRecord struct {
+	PostRecord
+	Deleted int64 `json:"deleted"`
+}
+
+// TokenRecord is a row of tokens table.
+type TokenRecord struct {
+	ID       int64  `json:"id"`
+	Owner    int64  `json:"owner"`
+	Name     string `json:"name"`
+	Digest   string `json:"digest"`
+	Scope    string `json:"scope"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastused"`
+}
+
+// ActorKeyRecord is a row of actorkeys table. Restoring the private key keeps the ActivityPub
+// identity of the actor, so followers on other servers can still verify its requests.
+type ActorKeyRecord struct {
+	Owner      int64  `json:"owner"`
+	PrivateKey string `json:"privatekey"`
+	PublicKey  string `json:"publickey"`
+	Created    int64  `json:"created"`
+}
+
+// SubscriberRecord is a row of subscribers table.
+type SubscriberRecord struct {
+	ID               int64  `json:"id"`
+	Email            string `json:"email"`
+	Token            string `json:"token"`
+	Status           string `json:"status"`
+	Digest           bool   `json:"digest"`
+	Created          int64  `json:"created"`
+	Confirmed        int64  `json:"confirmed"`
+	ConfirmationSent int64  `json:"confirmationsent"`
+}
+
+// MailRecord is a row of outbox table.
+type MailRecord struct {
+	ID          int64  `json:"id"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Subject     string `json:"subject"`
+	Body        string `json:"body"`
+	HTML        string `json:"html"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"lasterror"`
+	NextAttempt int64  `json:"nextattempt"`
+	Created     int64  `json:"created"`
+	Sent        int64  `json:"sent"`
+	Newsletter  int64  `json:"newsletter"`
+	Unsubscribe string `json:"unsubscribe"`
+}
+
+// Columns of the tables in Backup, in the order they are selected and inserted.
+const (
+	userColumns             = "id, name, email, location, role, digest, recovery, verified"
+	postRecordColumns       = "id, " + postColumns
+	tokenColumns            = "id, owner, name, digest, scope, created, lastused"
+	deletedPostColumns      = postRecordColumns + ", deleted"
+	webmentionColumns       = "id, source, target, post, status, kind, authorname, authorurl, authorphoto, content, published, created, verified, attempts, lasterror, nextattempt"
+	actorKeyColumns         = "owner, privatekey, publickey, created"
+	followerColumns         = "id, owner, actor, follow, inbox, sharedinbox, created"
+	commentColumns          = "id, post, objectid, actor, authorname, authorurl, url, content, published, created"
+	activityDeliveryColumns = "id, owner, inbox, activity, status, attempts, lasterror, nextattempt, created, delivered"
+	subscriberColumns       = "id, email, token, status, digest, created, confirmed, confirmationsent"
+	newsletterColumns       = "id, kind, post, subject, recipients, created"
+	webhookColumns          = "id, url, events, secret, active, created"
+	deliveryColumns         = "id, webhook, event, payload, status, attempts, response, lasterror, nextattempt, created, delivered"
+	invitationColumns       = "id, code, email, role, maxuses, uses, expires, creator, created"
+	emailTemplateColumns    = "name, subject, text, html, updated"
+	mailColumns             = "id, kind, name, address, subject, body, html, status, attempts, lasterror, nextattempt, created, sent, newsletter, unsubscribe"
+)
+
+// backupTables lists tables which are restored from Backup, besides settings. Their rows are
+// deleted when a backup replaces the data of the site, since they refer to users and posts by ID.
+var backupTables = []string{"users", "posts", "tokens", "deletedposts", "webmentions", "actorkeys", "followers", "comments", "activitydeliveries",
+	"subscribers", "newsletters", "webhooks", "deliveries", "invitations", "emailtemplates", "outbox"}
+
+// Dump reads all settings, users, posts and the rows which belong to them from the database.
+func Dump() (*Backup, error) {
+	defer metrics.Query("Dump", time.Now())
+	backup := &Backup{
+		Version:            BackupVersion,
+		Created:            time.Now().UTC().Unix(),
+		Users:              []UserRecord{},
+		Posts:              []PostRecord{},
+		Tokens:             []TokenRecord{},
+		DeletedPosts:       []DeletedPostRecord{},
+		Webmentions:        []Webmention{},
+		ActorKeys:          []ActorKeyRecord{},
+		Followers:          []Follower{},
+		Comments:           []Comment{},
+		ActivityDeliveries: []ActivityDelivery{},
+		Subscribers:        []SubscriberRecord{},
+		Newsletters:        []Newsletter{},
+		Webhooks:           []Webhook{},
+		Deliveries:         []Delivery{},
+		Invitations:        []Invitation{},
+		EmailTemplates:     []EmailTemplate{},
+		Outbox:             []MailRecord{},
+	}
+	if !Settings.Firstrun {
+		settings, err := Settings.Get()
+		if err != nil {
+			return nil, err
+		}
+		settings.ID = 0
+		backup.Settings = &settings
+	}
+	selects := []struct {
+		rows    interface{}
+		table   string
+		columns string
+		order   string
+	}{
+		{&backup.Users, "users", userColumns, "id"},
+		{&backup.Posts, "posts", postRecordColumns, "id"},
+		{&backup.Tokens, "tokens", tokenColumns, "id"},
+		{&backup.DeletedPosts, "deletedposts", deletedPostColumns, "id"},
+		{&backup.Webmentions, "webmentions", webmentionColumns, "id"},
+		{&backup.ActorKeys, "actorkeys", actorKeyColumns, "owner"},
+		{&backup.Followers, "followers", followerColumns, "id"},
+		{&backup.Comments, "comments", commentColumns, "id"},
+		{&backup.ActivityDeliveries, "activitydeliveries", activityDeliveryColumns, "id"},
+		{&backup.Subscribers, "subscribers", subscriberColumns, "id"},
+		{&backup.Newsletters, "newsletters", newsletterColumns, "id"},
+		{&backup.Webhooks, "webhooks", webhookColumns, "id"},
+		{&backup.Deliveries, "deliveries", deliveryColumns, "id"},
+		{&backup.Invitations, "invitations", invitationColumns, "id"},
+		{&backup.EmailTemplates, "emailtemplates", emailTemplateColumns, "name"},
+		{&backup.Outbox, "outbox", mailColumns, "id"},
+	}
+	for _, s := range selects {
+		err := db.Select(s.rows, "SELECT "+s.columns+" FROM "+s.table+" ORDER BY "+s.order)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return backup, nil
+}
+
+// insertRow inserts row into table. Values are read from the fields of row named after columns.
+func insertRow(tx *sqlx.Tx, table string, columns string, row interface{}) error {
+	_, err := tx.NamedExec("INSERT INTO "+table+" ("+columns+") VALUES (:"+strings.Join(strings.Split(columns, ", "), ", :")+")", row)
+	return err
+}
+
+// Restore writes backup into the database, keeping IDs of all rows, and reloads Settings.
+// Unless replace is set, returns "database not empty" error if the database already has users,
+// posts or settings. With replace, existing rows are deleted in the same transaction.
+// Users without password digests are given an empty digest, so they have to recover their password,
+// settings without CookieHash are given a new one, and so are webhooks without Secret.
+func Restore(backup *Backup, replace bool) error {
+	defer metrics.Query("Restore", time.Now())
+	if backup.Version < 1 || backup.Version > BackupVersion {
+		return errors.New("backup version unsupported")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replace {
+		// rows missing from older backups would belong to other users and posts with the same IDs
+		for _, table := range append([]string{"settings"}, backupTables...) {
+			_, err = tx.Exec("DELETE FROM " + table)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		var count int
+		err = tx.Get(&count, "SELECT (SELECT COUNT(*) FROM users) + (SELECT COUNT(*) FROM posts) + (SELECT COUNT(*) FROM settings)")
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("database not empty")
+		}
+	}
+
+	if backup.Settings != nil {
+		settings := *backup.Settings
+		settings.ID = 1
+		settings.Firstrun = false
+		if settings.CookieHash == "" {
+			settings.CookieHash = uuid.New()
+		}
+		_, err = tx.NamedExec(`INSERT INTO settings (id, name, hostname, firstrun, cookiehash, allowregistrations, description, mailerlogin, mailerport, mailerpassword, mailerhostname, theme)
+			VALUES (:id, :name, :hostname, :firstrun, :cookiehash, :allowregistrations, :description, :mailerlogin, :mailerport, :mailerpassword, :mailerhostname, :theme)`, settings)
+		if err != nil {
+			return err
+		}
+	}
+	for _, user := range backup.Users {
+		if user.Digest == nil {
+			user.Digest = []byte{}
+		}
+		if backup.Version < 2 {
+			user.Verified = true
+		}
+		err = insertRow(tx, "users", userColumns, user)
+		if err != nil {
+			return err
+		}
+	}
+	for _, post := range backup.Posts {
+		err = insertRow(tx, "posts", postRecordColumns, post)
+		if err != nil {
+			return err
+		}
+	}
+	for _, token := range backup.Tokens {
+		err = insertRow(tx, "tokens", tokenColumns, token)
+		if err != nil {
+			return err
+		}
+	}
+	for _, post := range backup.DeletedPosts {
+		err = insertRow(tx, "deletedposts", deletedPostColumns, post)
+		if err != nil {
+			return err
+		}
+	}
+	for _, mention := range backup.Webmentions {
+		err = insertRow(tx, "webmentions", webmentionColumns, mention)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range backup.ActorKeys {
+		err = insertRow(tx, "actorkeys", actorKeyColumns, key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, follower := range backup.Followers {
+		err = insertRow(tx, "followers", followerColumns, follower)
+		if err != nil {
+			return err
+		}
+	}
+	for _, comment := range backup.Comments {
+		err = insertRow(tx, "comments", commentColumns, comment)
+		if err != nil {
+			return err
+		}
+	}
+	for _, delivery := range backup.ActivityDeliveries {
+		err = insertRow(tx, "activitydeliveries", activityDeliveryColumns, delivery)
+		if err != nil {
+			return err
+		}
+	}
+	for _, subscriber := range backup.Subscribers {
+		err = insertRow(tx, "subscribers", subscriberColumns, subscriber)
+		if err != nil {
+			return err
+		}
+	}
+	for _, newsletter := range backup.Newsletters {
+		err = insertRow(tx, "newsletters", newsletterColumns, newsletter)
+		if err != nil {
+			return err
+		}
+	}
+	for _, webhook := range backup.Webhooks {
+		if webhook.Secret == "" {
+			webhook.Secret, err = webhookSecret()
+			if err != nil {
+				return err
+			}
+		}
+		err = insertRow(tx, "webhooks", webhookColumns, webhook)
+		if err != nil {
+			return err
+		}
+	}
+	for _, delivery := range backup.Deliveries {
+		err = insertRow(tx, "deliveries", deliveryColumns, delivery)
+		if err != nil {
+			return err
+		}
+	}
+	for _, invitation := range backup.Invitations {
+		err = insertRow(tx, "invitations", invitationColumns, invitation)
+		if err != nil {
+			return err
+		}
+	}
+	for _, template := range backup.EmailTemplates {
+		err = insertRow(tx, "emailtemplates", emailTemplateColumns, template)
+		if err != nil {
+			return err
+		}
+	}
+	for _, mail := range backup.Outbox {
+		err = insertRow(tx, "outbox", mailColumns, mail)
+		if err != nil {
+			return err
+		}
+	}
+	if driver == "postgres" {
+		// rows were inserted with explicit IDs, so sequences have to catch up
+		for _, table := range backupTables {
+			if table == "actorkeys" || table == "emailtemplates" {
+				continue
+			}
+			_, err = tx.Exec("SELECT setval(pg_get_serial_sequence('" + table + "', 'id'), COALESCE((SELECT MAX(id) FROM " + table + "), 0) + 1, false)")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	changed()
+	Settings = VertigoSettings()
+	return nil
+}
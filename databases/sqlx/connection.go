@@ -1,9 +1,9 @@
 package sqlx
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"log"
-	"net/url"
 	"os"
 
 	//_ "github.com/go-sql-driver/mysql"
@@ -13,6 +13,9 @@ import (
 )
 
 var db *sqlx.DB
+
+// driver is the name of the database driver in use.
+var driver string
 var Settings *Vertigo
 
 var sqlite3 = `
@@ -125,20 +128,36 @@ func Drop() {
 	db.MustExec("DROP TABLE users")
 	db.MustExec("DROP TABLE posts")
 	db.MustExec("DROP TABLE settings")
+	db.MustExec("DROP TABLE outbox")
+	db.MustExec("DROP TABLE emailtemplates")
+	db.MustExec("DROP TABLE invitations")
+	db.MustExec("DROP TABLE subscribers")
+	db.MustExec("DROP TABLE newsletters")
+	db.MustExec("DROP TABLE webhooks")
+	db.MustExec("DROP TABLE deliveries")
+	db.MustExec("DROP TABLE tokens")
+	db.MustExec("DROP TABLE deletedposts")
+	db.MustExec("DROP TABLE webmentions")
+	db.MustExec("DROP TABLE actorkeys")
+	db.MustExec("DROP TABLE followers")
+	db.MustExec("DROP TABLE comments")
+	db.MustExec("DROP TABLE activitydeliveries")
+	db.MustExec("DROP TABLE migrations")
 	os.Remove("vertigo.db")
+	changed()
 }
 
-var Driver = flag.String("driver", "sqlite3", "Database driver to use (sqlite3, mysql, postgres)")
-var Source = flag.String("source", "vertigo.db", "Database data source")
-
-func connect(driver, source string) {
-	conn, err := sqlx.Connect(driver, source)
+// Connect opens a database connection with driver of given name and source, creates the schema
+// and runs migrations if needed and populates the global Settings variable.
+// Supported drivers are "sqlite3" and "postgres".
+func Connect(name, source string) error {
+	conn, err := sqlx.Connect(name, source)
 	if err != nil {
-		log.Fatal("sqlx connect:", err)
+		return err
 	}
 
 	var schema string
-	switch driver {
+	switch name {
 	case "sqlite3":
 		schema = sqlite3
 	/*case "mysql":
@@ -149,28 +168,30 @@ func connect(driver, source string) {
 
 	conn.Exec(schema)
 
-	log.Println("sqlx: using", driver)
+	log.Println("sqlx: using", name)
 
 	db = conn
+	driver = name
+
+	err = Migrate()
+	if err != nil {
+		return err
+	}
 
 	Settings = VertigoSettings()
+	changed()
+	return nil
 }
 
-func init() {
-
-	flag.Parse()
-
-	if os.Getenv("DATABASE_URL") != "" {
-		u, err := url.Parse(os.Getenv("DATABASE_URL"))
-		if err != nil {
-			log.Fatal("database url parameter could not be parsed")
-		}
-		if u.Scheme != "postgres" /* && u.Scheme != "mysql" */ {
-			log.Fatal("unsupported database type")
-		}
-		connect(u.Scheme, os.Getenv("DATABASE_URL"))
-		return
+// Ping checks that the database connection is alive.
+func Ping(ctx context.Context) error {
+	if db == nil {
+		return errors.New("not connected")
 	}
+	return db.PingContext(ctx)
+}
 
-	connect(*Driver, *Source)
+// Close closes the database connection.
+func Close() error {
+	return db.Close()
 }
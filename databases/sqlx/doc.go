@@ -6,6 +6,10 @@
 // * users.go, which handles CRUD methods for users
 // * email.go, which handles method for sending email to users
 // * settings.go, which handles CU methods for settings
+// * migrations.go, which handles versioned changes to existing databases
+// * background.go, which tracks background work so it can be finished on shutdown
+// * backup.go, which reads and restores all rows for exports
+// * version.go, which tracks changes to content for caches of rendered pages
 //
 // All methods defined this package should be implemented in other drivers as well,
 // unless specifically said otherwise.
@@ -1,20 +1,74 @@
 package sqlx
 
 import (
-	"bytes"
-	"encoding/base64"
-	"fmt"
-	"net/mail"
-	"net/smtp"
+	"errors"
+	htmltemplate "html/template"
+	"log"
 	"strconv"
-	"text/template"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/excerpt"
+	"github.com/toldjuuso/vertigo/mailer"
+	"github.com/toldjuuso/vertigo/metrics"
 )
 
 // Email holds data of email sender and recipient for easier handling in templates.
+// Newsletters also have the published post as Article, or the posts of a digest as Articles,
+// and a link which unsubscribes the recipient. Comment notifications have the commented post
+// as Article and the comment as Comment.
 type Email struct {
-	Sender    string
-	Host      string
-	Recipient RecipientStruct
+	Sender      string
+	Site        string
+	Host        string
+	Link        string
+	Recipient   RecipientStruct
+	Article     Article
+	Articles    []Article
+	Comment     Reply
+	Unsubscribe string
+}
+
+// Article holds data of a post for newsletter templates.
+type Article struct {
+	Title    string
+	Link     string
+	Excerpt  string
+	Markdown string
+	// Content is the sanitized HTML of the post, which is not escaped in HTML templates.
+	Content htmltemplate.HTML
+}
+
+// newArticle returns template data of post.
+func newArticle(post Post) Article {
+	return Article{
+		Title:    post.Title,
+		Link:     strings.TrimRight(Settings.Hostname, "/") + "/post/" + post.Slug,
+		Excerpt:  post.Excerpt,
+		Markdown: post.Markdown,
+		Content:  htmltemplate.HTML(post.Content),
+	}
+}
+
+// Reply holds data of a comment for comment notification templates.
+type Reply struct {
+	Author    string
+	AuthorURL string
+	Link      string
+	Excerpt   string
+	// Content is the sanitized HTML of the comment, which is not escaped in HTML templates.
+	Content htmltemplate.HTML
+}
+
+// newReply returns template data of comment.
+func newReply(comment Comment) Reply {
+	return Reply{
+		Author:    comment.AuthorName,
+		AuthorURL: comment.AuthorURL,
+		Link:      comment.URL,
+		Excerpt:   excerpt.Make(comment.Content, 50),
+		Content:   htmltemplate.HTML(comment.Content),
+	}
 }
 
 // RecipientStruct holds data of email recipient for easier handling in templates.
@@ -25,75 +79,200 @@ type RecipientStruct struct {
 	RecoveryKey string
 }
 
-var RecoveryTemplate = `Hello {{ .Recipient.Name }}
+// EmailTemplate is an email template edited by admins. It takes precedence over the template
+// of the same name in the theme, see package mailer.
+type EmailTemplate struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+	Updated int64  `json:"updated"`
+}
+
+// newEmail returns template data for email from the site to user, linking to path of the site.
+func newEmail(user User, path string) Email {
+	host := strings.TrimRight(Settings.Hostname, "/")
+	return Email{
+		Sender: sender(),
+		Site:   Settings.Name,
+		Host:   host,
+		Link:   host + path,
+		Recipient: RecipientStruct{
+			ID:          strconv.Itoa(int(user.ID)),
+			Name:        user.Name,
+			Address:     user.Email,
+			RecoveryKey: user.Recovery,
+		},
+	}
+}
 
-Somebody requested password recovery on this email.
+// Queue renders email template with given name and queues the result in the outbox.
+func (email Email) Queue(name string) error {
+	template, _, err := GetEmailTemplate(name)
+	if err != nil {
+		return err
+	}
+	mail, err := email.mail(template)
+	if err != nil {
+		return err
+	}
+	_, err = mail.Queue()
+	return err
+}
 
-You may reset your password through this link: {{ .Host }}/user/reset/{{ .Recipient.ID }}/{{ .Recipient.RecoveryKey }}`
+// mail renders template with email and returns the result as mail to the recipient.
+func (email Email) mail(template mailer.Template) (Mail, error) {
+	message, err := template.Render(email)
+	if err != nil {
+		return Mail{}, err
+	}
+	return Mail{
+		Kind:        template.Name,
+		Name:        email.Recipient.Name,
+		Address:     email.Recipient.Address,
+		Subject:     message.Subject,
+		Body:        message.Body,
+		HTML:        message.HTML,
+		Unsubscribe: email.Unsubscribe,
+	}, nil
+}
 
-// SendRecoveryEmail dispatches predefined recovery email to recipient defined in parameters.
-// Makes use of https://gist.github.com/andelf/5004821
+// SendRecoveryEmail queues recovery email to user in the outbox, see Mail.
 func (user User) SendRecoveryEmail() error {
+	return newEmail(user, "/user/reset/"+strconv.Itoa(int(user.ID))+"/"+user.Recovery).Queue("recovery")
+}
 
-	var email Email
-	email.Sender = Settings.MailerLogin
-	email.Host = Settings.Hostname
-	email.Recipient.ID = strconv.Itoa(int(user.ID))
-	email.Recipient.Name = user.Name
-	email.Recipient.Address = user.Email
-	email.Recipient.RecoveryKey = user.Recovery
+// SendWelcomeEmail queues welcome email to a newly registered or verified user in the outbox.
+func (user User) SendWelcomeEmail() error {
+	return newEmail(user, "/user/login").Queue("welcome")
+}
 
-	from := mail.Address{
-		Name:    Settings.Name,
-		Address: email.Sender,
+// SendNotification queues an email telling the author of post about comment in the outbox.
+// Nothing is sent if the author has no email address.
+func (comment Comment) SendNotification(post Post) error {
+	author, err := User{ID: post.Author}.Get()
+	if err != nil || author.Email == "" {
+		return err
 	}
-	to := mail.Address{
-		Name:    email.Recipient.Name,
-		Address: email.Recipient.Address,
+	email := newEmail(author, "/post/"+post.Slug)
+	email.Article = newArticle(post)
+	email.Comment = newReply(comment)
+	return email.Queue("comment")
+}
+
+// commentCreated is called whenever a comment of post has been stored, whichever way it
+// was received, and notifies the author of post about it.
+func commentCreated(comment Comment, post Post) {
+	err := comment.SendNotification(post)
+	if err != nil {
+		log.Println("mailer: queueing comment notification:", err)
 	}
-	title := "Password reset"
+}
 
-	t, err := template.New("mail").Parse(RecoveryTemplate)
+// PreviewEmail renders email template with given name with sample data.
+func PreviewEmail(template mailer.Template) (mailer.Message, error) {
+	user := User{ID: 1, Name: "Jane Doe", Email: "jane@example.com", Recovery: "00000000-0000-0000-0000-000000000000"}
+	email := newEmail(user, "/")
+	switch template.Name {
+	case "recovery":
+		email.Link = email.Host + "/user/reset/1/" + user.Recovery
+	case "welcome":
+		email.Link = email.Host + "/user/login"
+	case "verification":
+		email.Link = email.Host + "/user/verify/" + user.VerificationToken(time.Now().Add(VerificationLifetime))
+	case "subscription", "newsletter", "digest":
+		subscriber := Subscriber{Email: user.Email, Token: "0000000000000000"}
+		email = subscriber.email(email.Host + "/newsletter/confirm/" + subscriber.Token)
+		sample := Post{
+			Title:    "Hello world",
+			Slug:     "hello-world",
+			Markdown: "This is a **sample** post.",
+			Content:  "<p>This is a <strong>sample</strong> post.</p>",
+			Excerpt:  "This is a sample post.",
+		}
+		email.Article = newArticle(sample)
+		email.Articles = []Article{email.Article, email.Article}
+	case "comment":
+		email.Link = email.Host + "/post/hello-world"
+		email.Article = newArticle(Post{Title: "Hello world", Slug: "hello-world"})
+		email.Comment = newReply(Comment{
+			AuthorName: "John Doe",
+			AuthorURL:  "https://example.com/@john",
+			URL:        "https://example.com/@john/1",
+			Content:    "<p>Nice <strong>post</strong>!</p>",
+		})
+	}
+	message, err := template.Render(email)
 	if err != nil {
-		return err
+		return message, err
+	}
+	message.To.Name = user.Name
+	message.To.Address = user.Email
+	message.From.Name = Settings.Name
+	message.From.Address = sender()
+	message.Unsubscribe = email.Unsubscribe
+	return message, nil
+}
+
+// GetEmailTemplate returns email template with given name and where it comes from: "database"
+// if admins have edited it and "theme" otherwise. Returns "not found" error for unknown names.
+func GetEmailTemplate(name string) (mailer.Template, string, error) {
+	t, err := EmailTemplate{Name: name}.Get()
+	if err == nil {
+		return mailer.Template{Name: t.Name, Subject: t.Subject, Text: t.Text, HTML: t.HTML}, "database", nil
+	}
+	if err.Error() != "not found" {
+		return mailer.Template{Name: name}, "", err
 	}
+	template, err := mailer.Load(name)
+	return template, "theme", err
+}
 
-	var buf bytes.Buffer
-	err = t.Execute(&buf, email)
+// Get returns edited email template with given t.Name.
+func (t EmailTemplate) Get() (EmailTemplate, error) {
+	defer metrics.Query("EmailTemplate.Get", time.Now())
+	err := db.Get(&t, db.Rebind("SELECT * FROM emailtemplates WHERE name = ?"), t.Name)
 	if err != nil {
-		return err
+		if err.Error() == "sql: no rows in result set" {
+			return t, errors.New("not found")
+		}
+		return t, err
 	}
+	return t, nil
+}
 
-	header := make(map[string]string)
-	header["From"] = from.String()
-	header["To"] = to.String()
-	header["Subject"] = title
-	header["MIME-Version"] = "1.0"
-	header["Content-Type"] = "text/plain; charset=\"utf-8\""
-	header["Content-Transfer-Encoding"] = "base64"
-
-	var message string
-	for k, v := range header {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
-	}
-	message += "\r\n" + base64.StdEncoding.EncodeToString(buf.Bytes())
-
-	auth := smtp.PlainAuth(
-		"",
-		Settings.MailerLogin,
-		Settings.MailerPassword,
-		Settings.MailerHostname,
-	)
-
-	err = smtp.SendMail(
-		fmt.Sprintf("%s:%d", Settings.MailerHostname, Settings.MailerPort),
-		auth,
-		from.Address,
-		[]string{to.Address},
-		[]byte(message),
-	)
+// Save stores t, replacing the previous version. Returns "email template invalid" error
+// if any part of it fails to parse and "not found" error for unknown names.
+func (t EmailTemplate) Save() (EmailTemplate, error) {
+	defer metrics.Query("EmailTemplate.Save", time.Now())
+	if !mailer.Known(t.Name) {
+		return t, errors.New("not found")
+	}
+	err := mailer.Template{Name: t.Name, Subject: t.Subject, Text: t.Text, HTML: t.HTML}.Parse()
 	if err != nil {
-		return err
+		return t, errors.New("email template invalid")
+	}
+	t.Updated = time.Now().UTC().Unix()
+	tx, err := db.Beginx()
+	if err != nil {
+		return t, err
 	}
-	return nil
+	_, err = tx.Exec(tx.Rebind("DELETE FROM emailtemplates WHERE name = ?"), t.Name)
+	if err != nil {
+		tx.Rollback()
+		return t, err
+	}
+	_, err = tx.NamedExec("INSERT INTO emailtemplates (name, subject, text, html, updated) VALUES (:name, :subject, :text, :html, :updated)", t)
+	if err != nil {
+		tx.Rollback()
+		return t, err
+	}
+	return t, tx.Commit()
+}
+
+// Delete removes edits of t, so the template of the theme is used again.
+func (t EmailTemplate) Delete() error {
+	defer metrics.Query("EmailTemplate.Delete", time.Now())
+	_, err := db.Exec(db.Rebind("DELETE FROM emailtemplates WHERE name = ?"), t.Name)
+	return err
 }
@@ -0,0 +1,157 @@
+package sqlx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// Invitation lets people register while registrations are closed, see Settings.AllowRegistrations.
+// Invitations are redeemed with their Code, which admins hand out as registration links.
+// Users who register with an invitation get its Role. If Email is set, only that address may
+// register with it. MaxUses of 0 and Expires of 0 mean that the invitation can be used any number
+// of times and that it does not expire.
+type Invitation struct {
+	ID      int64  `json:"id"`
+	Code    string `json:"code"`
+	Email   string `json:"email" form:"email"`
+	Role    string `json:"role" form:"role"`
+	MaxUses int64  `json:"maxuses" form:"maxuses"`
+	Uses    int64  `json:"uses"`
+	Expires int64  `json:"expires" form:"expires"`
+	Creator int64  `json:"creator"`
+	Created int64  `json:"created"`
+	// Link is the address of the registration page of the invitation.
+	Link string `json:"link" db:"-"`
+}
+
+// withLink returns invitation with Link set according to site hostname.
+func (invitation Invitation) withLink() Invitation {
+	invitation.Link = strings.TrimRight(Settings.Hostname, "/") + "/user/register?invitation=" + invitation.Code
+	return invitation
+}
+
+// Insert or invitation.Insert creates a new invitation with a random code.
+// Role defaults to author. Returns "invitation invalid" error for unknown roles or negative
+// MaxUses, and "invitation expired" for expiration times in the past.
+func (invitation Invitation) Insert() (Invitation, error) {
+	defer metrics.Query("Invitation.Insert", time.Now())
+	if invitation.Role == "" {
+		invitation.Role = RoleAuthor
+	}
+	if !ValidRole(invitation.Role) || invitation.MaxUses < 0 {
+		return invitation, errors.New("invitation invalid")
+	}
+	invitation.Created = time.Now().UTC().Unix()
+	if invitation.Expires != 0 && invitation.Expires <= invitation.Created {
+		return invitation, errors.New("invitation expired")
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return invitation, err
+	}
+	invitation.Code = hex.EncodeToString(b)
+	invitation.Email = strings.TrimSpace(invitation.Email)
+	invitation.Uses = 0
+	_, err = db.NamedExec(`INSERT INTO invitations (code, email, role, maxuses, uses, expires, creator, created)
+		VALUES (:code, :email, :role, :maxuses, :uses, :expires, :creator, :created)`, invitation)
+	if err != nil {
+		return invitation, err
+	}
+	return invitation.GetByCode()
+}
+
+// Get or invitation.Get returns invitation with given invitation.ID.
+func (invitation Invitation) Get() (Invitation, error) {
+	defer metrics.Query("Invitation.Get", time.Now())
+	err := db.Get(&invitation, db.Rebind("SELECT * FROM invitations WHERE id = ?"), invitation.ID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return invitation, errors.New("not found")
+		}
+		return invitation, err
+	}
+	return invitation.withLink(), nil
+}
+
+// GetByCode or invitation.GetByCode returns invitation with given invitation.Code.
+func (invitation Invitation) GetByCode() (Invitation, error) {
+	defer metrics.Query("Invitation.GetByCode", time.Now())
+	err := db.Get(&invitation, db.Rebind("SELECT * FROM invitations WHERE code = ?"), invitation.Code)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return invitation, errors.New("not found")
+		}
+		return invitation, err
+	}
+	return invitation.withLink(), nil
+}
+
+// Invitations returns all invitations, newest first.
+func Invitations() ([]Invitation, error) {
+	defer metrics.Query("Invitations", time.Now())
+	invitations := make([]Invitation, 0)
+	err := db.Select(&invitations, "SELECT * FROM invitations ORDER BY id DESC")
+	for i := range invitations {
+		invitations[i] = invitations[i].withLink()
+	}
+	return invitations, err
+}
+
+// Delete or invitation.Delete revokes invitation with given invitation.ID.
+// Users who have registered with it are not affected.
+func (invitation Invitation) Delete() error {
+	defer metrics.Query("Invitation.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM invitations WHERE id = ?"), invitation.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// Redeem or invitation.Redeem uses invitation with given invitation.Code once for registering
+// given email address. Returns "invitation invalid" error for unknown codes and codes of other
+// addresses, "invitation expired" for expired invitations and "invitation used" for invitations
+// which have been used MaxUses times already.
+func (invitation Invitation) Redeem(email string) (Invitation, error) {
+	defer metrics.Query("Invitation.Redeem", time.Now())
+	invitation, err := invitation.GetByCode()
+	if err != nil {
+		if err.Error() == "not found" {
+			return invitation, errors.New("invitation invalid")
+		}
+		return invitation, err
+	}
+	if invitation.Email != "" && !strings.EqualFold(invitation.Email, strings.TrimSpace(email)) {
+		return invitation, errors.New("invitation invalid")
+	}
+	if invitation.Expires != 0 && invitation.Expires <= time.Now().UTC().Unix() {
+		return invitation, errors.New("invitation expired")
+	}
+	// the use is claimed in one statement, so concurrent registrations can not exceed MaxUses
+	result, err := db.Exec(db.Rebind("UPDATE invitations SET uses = uses + 1 WHERE id = ? AND (maxuses = 0 OR uses < maxuses)"), invitation.ID)
+	if err != nil {
+		return invitation, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return invitation, errors.New("invitation used")
+	}
+	invitation.Uses++
+	return invitation, nil
+}
+
+// Release or invitation.Release gives back a use claimed with Redeem, for example when
+// the registration fails afterwards.
+func (invitation Invitation) Release() error {
+	defer metrics.Query("Invitation.Release", time.Now())
+	_, err := db.Exec(db.Rebind("UPDATE invitations SET uses = uses - 1 WHERE id = ? AND uses > 0"), invitation.ID)
+	return err
+}
@@ -0,0 +1,443 @@
+package sqlx
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/toldjuuso/excerpt"
+	"github.com/toldjuuso/vertigo/sanitize"
+)
+
+// Migration is a versioned change to an existing database. Migrations are run in order of
+// Version on startup and each of them is run only once, inside a transaction.
+// New columns should be added here instead of the CREATE TABLE schemas, so that
+// both new and existing databases end up with the same structure.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sqlx.Tx) error
+}
+
+// Migrations lists all migrations known to the application.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "add user roles",
+		Up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("ALTER TABLE users ADD COLUMN role varchar(255) NOT NULL DEFAULT 'author'")
+			if err != nil {
+				return err
+			}
+			// the oldest account is the one created right after the installation wizard
+			_, err = tx.Exec("UPDATE users SET role = 'admin' WHERE id = (SELECT MIN(id) FROM users)")
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "sanitize existing post content",
+		Up:          sanitizePosts,
+	},
+	{
+		Version:     3,
+		Description: "add site theme",
+		Up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("ALTER TABLE settings ADD COLUMN theme varchar(255) NOT NULL DEFAULT 'default'")
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "add outbox",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE outbox (
+				` + id + `,
+				kind varchar(255) NOT NULL,
+				name varchar(255) NOT NULL,
+				address varchar(255) NOT NULL,
+				subject varchar(255) NOT NULL,
+				body text NOT NULL,
+				status varchar(255) NOT NULL,
+				attempts integer NOT NULL DEFAULT 0,
+				lasterror text NOT NULL DEFAULT '',
+				nextattempt bigint NOT NULL,
+				created bigint NOT NULL,
+				sent bigint NOT NULL DEFAULT 0
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("CREATE INDEX outbox_status ON outbox (status, nextattempt)")
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "add email templates",
+		Up: func(tx *sqlx.Tx) error {
+			_, err := tx.Exec("ALTER TABLE outbox ADD COLUMN html text NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE emailtemplates (
+				name varchar(255) NOT NULL PRIMARY KEY,
+				subject varchar(255) NOT NULL,
+				text text NOT NULL,
+				html text NOT NULL,
+				updated bigint NOT NULL
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "add email verification",
+		Up: func(tx *sqlx.Tx) error {
+			// existing accounts were created before verification and are trusted as they are
+			_, err := tx.Exec("ALTER TABLE users ADD COLUMN verified bool NOT NULL DEFAULT true")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE users ADD COLUMN verificationsent bigint NOT NULL DEFAULT 0")
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "add invitations",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE invitations (
+				` + id + `,
+				code varchar(255) NOT NULL UNIQUE,
+				email varchar(255) NOT NULL DEFAULT '',
+				role varchar(255) NOT NULL,
+				maxuses bigint NOT NULL DEFAULT 0,
+				uses bigint NOT NULL DEFAULT 0,
+				expires bigint NOT NULL DEFAULT 0,
+				creator bigint NOT NULL,
+				created bigint NOT NULL
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "add newsletter",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE subscribers (
+				` + id + `,
+				email varchar(255) NOT NULL UNIQUE,
+				token varchar(255) NOT NULL UNIQUE,
+				status varchar(255) NOT NULL,
+				digest bool NOT NULL DEFAULT false,
+				created bigint NOT NULL,
+				confirmed bigint NOT NULL DEFAULT 0,
+				confirmationsent bigint NOT NULL DEFAULT 0
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE newsletters (
+				` + id + `,
+				kind varchar(255) NOT NULL,
+				post bigint NOT NULL DEFAULT 0,
+				subject varchar(255) NOT NULL DEFAULT '',
+				recipients integer NOT NULL DEFAULT 0,
+				created bigint NOT NULL
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE outbox ADD COLUMN newsletter bigint NOT NULL DEFAULT 0")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE outbox ADD COLUMN unsubscribe varchar(255) NOT NULL DEFAULT ''")
+			return err
+		},
+	},
+	{
+		Version:     9,
+		Description: "add webhooks",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE webhooks (
+				` + id + `,
+				url text NOT NULL,
+				events text NOT NULL,
+				secret varchar(255) NOT NULL UNIQUE,
+				active bool NOT NULL DEFAULT true,
+				created bigint NOT NULL
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE deliveries (
+				` + id + `,
+				webhook bigint NOT NULL,
+				event varchar(255) NOT NULL,
+				payload text NOT NULL,
+				status varchar(255) NOT NULL,
+				attempts integer NOT NULL DEFAULT 0,
+				response integer NOT NULL DEFAULT 0,
+				lasterror text NOT NULL DEFAULT '',
+				nextattempt bigint NOT NULL,
+				created bigint NOT NULL,
+				delivered bigint NOT NULL DEFAULT 0
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     10,
+		Description: "add API tokens and deleted posts",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE tokens (
+				` + id + `,
+				owner bigint NOT NULL,
+				name varchar(255) NOT NULL,
+				digest varchar(255) NOT NULL UNIQUE,
+				scope varchar(255) NOT NULL,
+				created bigint NOT NULL,
+				lastused bigint NOT NULL DEFAULT 0
+			)`)
+			if err != nil {
+				return err
+			}
+			// deleted posts keep the columns of posts, see Post.Undelete
+			_, err = tx.Exec(`CREATE TABLE deletedposts (
+				` + id + `,
+				title varchar(255) NOT NULL,
+				content text NOT NULL,
+				markdown text NOT NULL,
+				slug varchar(255) NOT NULL,
+				author bigint NOT NULL,
+				excerpt varchar(255) NOT NULL,
+				viewcount bigint NOT NULL DEFAULT 0,
+				published bool NOT NULL DEFAULT false,
+				created bigint NOT NULL,
+				updated bigint NOT NULL,
+				timeoffset integer NOT NULL DEFAULT 0,
+				deleted bigint NOT NULL
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     11,
+		Description: "add webmentions",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE webmentions (
+				` + id + `,
+				source text NOT NULL,
+				target text NOT NULL,
+				post bigint NOT NULL,
+				status varchar(255) NOT NULL,
+				kind varchar(255) NOT NULL,
+				authorname text NOT NULL DEFAULT '',
+				authorurl text NOT NULL DEFAULT '',
+				authorphoto text NOT NULL DEFAULT '',
+				content text NOT NULL DEFAULT '',
+				published bigint NOT NULL DEFAULT 0,
+				created bigint NOT NULL,
+				verified bigint NOT NULL DEFAULT 0,
+				attempts integer NOT NULL DEFAULT 0,
+				lasterror text NOT NULL DEFAULT '',
+				nextattempt bigint NOT NULL
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     12,
+		Description: "add ActivityPub actors, followers and comments",
+		Up: func(tx *sqlx.Tx) error {
+			id := "id integer NOT NULL PRIMARY KEY"
+			if driver == "postgres" {
+				id = "id serial NOT NULL PRIMARY KEY"
+			}
+			_, err := tx.Exec(`CREATE TABLE actorkeys (
+				owner bigint NOT NULL PRIMARY KEY,
+				privatekey text NOT NULL,
+				publickey text NOT NULL,
+				created bigint NOT NULL
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE followers (
+				` + id + `,
+				owner bigint NOT NULL,
+				actor text NOT NULL,
+				follow text NOT NULL,
+				inbox text NOT NULL,
+				sharedinbox text NOT NULL DEFAULT '',
+				created bigint NOT NULL
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE comments (
+				` + id + `,
+				post bigint NOT NULL,
+				objectid text NOT NULL,
+				actor text NOT NULL,
+				authorname text NOT NULL DEFAULT '',
+				authorurl text NOT NULL DEFAULT '',
+				url text NOT NULL DEFAULT '',
+				content text NOT NULL,
+				published bigint NOT NULL,
+				created bigint NOT NULL
+			)`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE activitydeliveries (
+				` + id + `,
+				owner bigint NOT NULL,
+				inbox text NOT NULL,
+				activity text NOT NULL,
+				status varchar(255) NOT NULL,
+				attempts integer NOT NULL DEFAULT 0,
+				lasterror text NOT NULL DEFAULT '',
+				nextattempt bigint NOT NULL,
+				created bigint NOT NULL,
+				delivered bigint NOT NULL DEFAULT 0
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     13,
+		Description: "add post description and social image",
+		Up: func(tx *sqlx.Tx) error {
+			// deleted posts keep the columns of posts, see Post.Undelete
+			for _, table := range []string{"posts", "deletedposts"} {
+				_, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN description text NOT NULL DEFAULT ''")
+				if err != nil {
+					return err
+				}
+				_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN image text NOT NULL DEFAULT ''")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// Pending returns migrations which have not been applied to the database yet.
+func Pending() ([]Migration, error) {
+	var versions []int
+	err := db.Select(&versions, "SELECT version FROM migrations")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, version := range versions {
+		applied[version] = true
+	}
+	var pending []Migration
+	for _, migration := range Migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate runs all migrations which have not been applied to the database yet.
+func Migrate() error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS migrations (version integer NOT NULL PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	pending, err := Pending()
+	if err != nil {
+		return err
+	}
+	for _, migration := range pending {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		err = migration.Up(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.NamedExec("INSERT INTO migrations (version) VALUES (:version)", migration)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		log.Println("sqlx: applied migration", migration.Version, migration.Description)
+	}
+	return nil
+}
+
+// ResanitizePosts sanitizes the content of all posts again with the current policies.
+// Should be called after changing the policies of roles, see sanitize.Roles.
+func ResanitizePosts() error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	err = sanitizePosts(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer changed()
+	return tx.Commit()
+}
+
+func sanitizePosts(tx *sqlx.Tx) error {
+	var posts []struct {
+		ID      int64  `db:"id"`
+		Content string `db:"content"`
+		Excerpt string `db:"excerpt"`
+		Role    string `db:"role"`
+	}
+	err := tx.Select(&posts, "SELECT posts.id, posts.content, posts.excerpt, COALESCE(users.role, '') AS role FROM posts LEFT JOIN users ON users.id = posts.author")
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		post.Content = sanitize.ForRole(post.Role).Sanitize(post.Content)
+		post.Excerpt = excerpt.Make(post.Content, 15)
+		_, err := tx.NamedExec("UPDATE posts SET content = :content, excerpt = :excerpt WHERE id = :id", post)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package sqlx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/mailer"
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// Subscriber is a reader who gets new posts by email. Subscriptions are confirmed by following
+// the link of a confirmation email, so nobody gets newsletters they have not asked for. Token
+// identifies the subscriber in confirmation and unsubscription links. Subscribers with Digest
+// get a weekly digest instead of an email for every post.
+type Subscriber struct {
+	ID               int64  `json:"id"`
+	Email            string `json:"email" form:"email"`
+	Token            string `json:"-"`
+	Status           string `json:"status"`
+	Digest           bool   `json:"digest" form:"digest"`
+	Created          int64  `json:"created"`
+	Confirmed        int64  `json:"confirmed"`
+	ConfirmationSent int64  `json:"-"`
+}
+
+// Statuses of subscribers.
+const (
+	SubscriberPending      = "pending"
+	SubscriberConfirmed    = "confirmed"
+	SubscriberUnsubscribed = "unsubscribed"
+)
+
+// Newsletter is a mailing of a published post, or of the posts published during a week as a digest.
+// Messages of the newsletter are queued in the outbox, see Mail.Newsletter.
+type Newsletter struct {
+	ID         int64  `json:"id"`
+	Kind       string `json:"kind"`
+	Post       int64  `json:"post"`
+	Subject    string `json:"subject"`
+	Recipients int    `json:"recipients"`
+	Created    int64  `json:"created"`
+}
+
+// Kinds of newsletters.
+const (
+	NewsletterPost   = "post"
+	NewsletterDigest = "digest"
+)
+
+// DigestInterval is the time between digests.
+const DigestInterval = 7 * 24 * time.Hour
+
+// email returns template data for email to subscriber, with given link.
+func (subscriber Subscriber) email(link string) Email {
+	host := strings.TrimRight(Settings.Hostname, "/")
+	email := newEmail(User{Email: subscriber.Email}, "/")
+	email.Link = link
+	email.Unsubscribe = host + "/newsletter/unsubscribe/" + subscriber.Token
+	return email
+}
+
+// Subscribe adds email address to subscribers and queues a confirmation email to it. Subscribers
+// who have unsubscribed or not confirmed yet get a new confirmation email, at most once in
+// VerificationInterval. Confirmed subscribers are left as they are, so the result does not tell
+// whether the address has subscribed before. Returns "subscriber email invalid" error for
+// malformed addresses.
+func Subscribe(address string, digest bool) error {
+	defer metrics.Query("Subscribe", time.Now())
+	parsed, err := netmail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return errors.New("subscriber email invalid")
+	}
+	subscriber := Subscriber{Email: strings.ToLower(parsed.Address)}
+	now := time.Now().UTC()
+	err = db.Get(&subscriber, db.Rebind("SELECT * FROM subscribers WHERE email = ?"), subscriber.Email)
+	switch {
+	case err != nil && err.Error() == "sql: no rows in result set":
+		b := make([]byte, 16)
+		_, err = rand.Read(b)
+		if err != nil {
+			return err
+		}
+		subscriber.Token = hex.EncodeToString(b)
+		subscriber.Status = SubscriberPending
+		subscriber.Digest = digest
+		subscriber.Created = now.Unix()
+		subscriber.ConfirmationSent = now.Unix()
+		_, err = db.NamedExec(`INSERT INTO subscribers (email, token, status, digest, created, confirmed, confirmationsent)
+			VALUES (:email, :token, :status, :digest, :created, :confirmed, :confirmationsent)`, subscriber)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case subscriber.Status == SubscriberConfirmed:
+		return nil
+	case time.Unix(subscriber.ConfirmationSent, 0).Add(VerificationInterval).After(now):
+		return nil
+	default:
+		// claimed before queueing, so concurrent requests do not send twice
+		result, err := db.Exec(db.Rebind("UPDATE subscribers SET status = ?, digest = ?, confirmationsent = ? WHERE id = ? AND confirmationsent = ?"),
+			SubscriberPending, digest, now.Unix(), subscriber.ID, subscriber.ConfirmationSent)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return nil
+		}
+	}
+	host := strings.TrimRight(Settings.Hostname, "/")
+	return subscriber.email(host + "/newsletter/confirm/" + subscriber.Token).Queue("subscription")
+}
+
+// GetByToken returns subscriber with given subscriber.Token.
+func (subscriber Subscriber) GetByToken() (Subscriber, error) {
+	defer metrics.Query("Subscriber.GetByToken", time.Now())
+	err := db.Get(&subscriber, db.Rebind("SELECT * FROM subscribers WHERE token = ?"), subscriber.Token)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return subscriber, errors.New("not found")
+		}
+		return subscriber, err
+	}
+	return subscriber, nil
+}
+
+// Confirm confirms subscription with given subscriber.Token. Returns "not found" error for unknown
+// tokens and for subscribers who have unsubscribed since.
+func (subscriber Subscriber) Confirm() (Subscriber, error) {
+	subscriber, err := subscriber.GetByToken()
+	if err != nil {
+		return subscriber, err
+	}
+	switch subscriber.Status {
+	case SubscriberConfirmed:
+		return subscriber, nil
+	case SubscriberUnsubscribed:
+		return subscriber, errors.New("not found")
+	}
+	defer metrics.Query("Subscriber.Confirm", time.Now())
+	subscriber.Status = SubscriberConfirmed
+	subscriber.Confirmed = time.Now().UTC().Unix()
+	_, err = db.NamedExec("UPDATE subscribers SET status = :status, confirmed = :confirmed WHERE id = :id", subscriber)
+	return subscriber, err
+}
+
+// Unsubscribe stops newsletters to subscriber with given subscriber.Token. The address is kept,
+// so it can not be subscribed again without confirmation. Returns "not found" error for unknown tokens.
+func (subscriber Subscriber) Unsubscribe() (Subscriber, error) {
+	subscriber, err := subscriber.GetByToken()
+	if err != nil {
+		return subscriber, err
+	}
+	defer metrics.Query("Subscriber.Unsubscribe", time.Now())
+	subscriber.Status = SubscriberUnsubscribed
+	_, err = db.NamedExec("UPDATE subscribers SET status = :status WHERE id = :id", subscriber)
+	return subscriber, err
+}
+
+// Delete removes subscriber with given subscriber.ID.
+func (subscriber Subscriber) Delete() error {
+	defer metrics.Query("Subscriber.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM subscribers WHERE id = ?"), subscriber.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// Subscribers returns subscribers with given status, or all of them if status is empty, newest first.
+func Subscribers(status string) ([]Subscriber, error) {
+	defer metrics.Query("Subscribers", time.Now())
+	subscribers := make([]Subscriber, 0)
+	var err error
+	if status == "" {
+		err = db.Select(&subscribers, "SELECT * FROM subscribers ORDER BY id DESC")
+	} else {
+		err = db.Select(&subscribers, db.Rebind("SELECT * FROM subscribers WHERE status = ? ORDER BY id DESC"), status)
+	}
+	return subscribers, err
+}
+
+// Newsletters returns all newsletters, newest first.
+func Newsletters() ([]Newsletter, error) {
+	defer metrics.Query("Newsletters", time.Now())
+	newsletters := make([]Newsletter, 0)
+	err := db.Select(&newsletters, "SELECT * FROM newsletters ORDER BY id DESC")
+	return newsletters, err
+}
+
+// Status returns the number of messages of newsletter in the outbox by status. Messages sent
+// before the outbox was purged are not counted.
+func (newsletter Newsletter) Status() (map[string]int, error) {
+	defer metrics.Query("Newsletter.Status", time.Now())
+	var rows []struct {
+		Status string
+		Count  int
+	}
+	err := db.Select(&rows, db.Rebind("SELECT status, COUNT(*) AS count FROM outbox WHERE newsletter = ? GROUP BY status"), newsletter.ID)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{MailPending: 0, MailSent: 0, MailFailed: 0}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// insert records newsletter and returns it with its ID.
+func (newsletter Newsletter) insert() (Newsletter, error) {
+	newsletter.Created = time.Now().UTC().Unix()
+	_, err := db.NamedExec(`INSERT INTO newsletters (kind, post, subject, recipients, created)
+		VALUES (:kind, :post, :subject, :recipients, :created)`, newsletter)
+	if err != nil {
+		return newsletter, err
+	}
+	err = db.Get(&newsletter, db.Rebind("SELECT * FROM newsletters WHERE kind = ? AND post = ? ORDER BY id DESC LIMIT 1"), newsletter.Kind, newsletter.Post)
+	return newsletter, err
+}
+
+// send queues newsletter rendered from template to subscribers who have confirmed their
+// subscription and chosen digests or not, and records the number of recipients.
+func (newsletter Newsletter) send(template mailer.Template, email Email, digest bool) (Newsletter, error) {
+	var subscribers []Subscriber
+	err := db.Select(&subscribers, db.Rebind("SELECT * FROM subscribers WHERE status = ? AND digest = ? ORDER BY id"), SubscriberConfirmed, digest)
+	if err != nil {
+		return newsletter, err
+	}
+	for _, subscriber := range subscribers {
+		data := subscriber.email(email.Link)
+		data.Article = email.Article
+		data.Articles = email.Articles
+		mail, err := data.mail(template)
+		if err != nil {
+			return newsletter, err
+		}
+		mail.Newsletter = newsletter.ID
+		_, err = mail.Queue()
+		if err != nil {
+			return newsletter, err
+		}
+		newsletter.Subject = mail.Subject
+		newsletter.Recipients++
+	}
+	_, err = db.NamedExec("UPDATE newsletters SET subject = :subject, recipients = :recipients WHERE id = :id", newsletter)
+	return newsletter, err
+}
+
+// SendNewsletter queues an email of published post to subscribers who have not chosen digests.
+// Each post is sent only once, so publishing it again after unpublishing does not send it again.
+// Returns "newsletter sent" error if the post has been sent already and "post not published" error
+// if it is not published.
+func (post Post) SendNewsletter() (Newsletter, error) {
+	defer metrics.Query("Post.SendNewsletter", time.Now())
+	newsletter := Newsletter{Kind: NewsletterPost, Post: post.ID, Subject: post.Title}
+	if !post.Published {
+		return newsletter, errors.New("post not published")
+	}
+	var count int
+	err := db.Get(&count, db.Rebind("SELECT COUNT(*) FROM newsletters WHERE kind = ? AND post = ?"), NewsletterPost, post.ID)
+	if err != nil {
+		return newsletter, err
+	}
+	if count > 0 {
+		return newsletter, errors.New("newsletter sent")
+	}
+	template, _, err := GetEmailTemplate("newsletter")
+	if err != nil {
+		return newsletter, err
+	}
+	newsletter, err = newsletter.insert()
+	if err != nil {
+		return newsletter, err
+	}
+	article := newArticle(post)
+	return newsletter.send(template, Email{Link: article.Link, Article: article, Articles: []Article{article}}, false)
+}
+
+// SendDigest queues a digest of posts published since the previous digest to subscribers who have
+// chosen digests. Returns "digest not due" error if the previous digest was sent less than
+// DigestInterval ago and "digest empty" error if no posts have been published since.
+func SendDigest() (Newsletter, error) {
+	defer metrics.Query("SendDigest", time.Now())
+	newsletter := Newsletter{Kind: NewsletterDigest}
+	now := time.Now().UTC()
+	since := now.Add(-DigestInterval).Unix()
+	var previous []int64
+	err := db.Select(&previous, db.Rebind("SELECT created FROM newsletters WHERE kind = ? ORDER BY id DESC LIMIT 1"), NewsletterDigest)
+	if err != nil {
+		return newsletter, err
+	}
+	if len(previous) > 0 {
+		if previous[0] > since {
+			return newsletter, errors.New("digest not due")
+		}
+		since = previous[0]
+	}
+	// posts are recorded as newsletters when they are published, also when nobody gets them right away
+	var posts []Post
+	err = db.Select(&posts, db.Rebind(`SELECT posts.* FROM posts JOIN newsletters ON newsletters.post = posts.id
+		WHERE newsletters.kind = ? AND newsletters.created > ? AND posts.published = ? ORDER BY newsletters.created`), NewsletterPost, since, true)
+	if err != nil {
+		return newsletter, err
+	}
+	if len(posts) == 0 {
+		return newsletter, errors.New("digest empty")
+	}
+	template, _, err := GetEmailTemplate("digest")
+	if err != nil {
+		return newsletter, err
+	}
+	newsletter, err = newsletter.insert()
+	if err != nil {
+		return newsletter, err
+	}
+	var articles []Article
+	for _, post := range posts {
+		articles = append(articles, newArticle(post))
+	}
+	return newsletter.send(template, Email{Link: strings.TrimRight(Settings.Hostname, "/") + "/", Article: articles[0], Articles: articles}, true)
+}
+
+// SendDigests sends a digest whenever one is due, checking every interval until ctx is done.
+func SendDigests(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		newsletter, err := SendDigest()
+		switch {
+		case err == nil:
+			log.Printf("newsletter: queued digest %d to %d subscribers", newsletter.ID, newsletter.Recipients)
+		case err.Error() != "digest not due" && err.Error() != "digest empty":
+			log.Println("newsletter: sending digest:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package sqlx
+
+import (
+	"context"
+	"errors"
+	"log"
+	netmail "net/mail"
+	"time"
+
+	"github.com/toldjuuso/vertigo/mailer"
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// Mail is an email message in the outbox. Messages are queued with Queue and delivered
+// in the background by DeliverMail, so failures of the mail server do not fail requests.
+// Failed deliveries are retried with exponential backoff, and messages which still fail after
+// MaxMailAttempts are marked as failed and left in the outbox for admins to inspect and retry.
+type Mail struct {
+	ID          int64  `json:"id"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Subject     string `json:"subject"`
+	Body        string `json:"-"`
+	HTML        string `json:"-"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"lasterror"`
+	NextAttempt int64  `json:"nextattempt"`
+	Created     int64  `json:"created"`
+	Sent        int64  `json:"sent"`
+	// Newsletter is the ID of the newsletter the message belongs to, if any, see Newsletter.
+	Newsletter  int64  `json:"newsletter"`
+	Unsubscribe string `json:"-"`
+}
+
+// Statuses of outbox messages.
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailFailed  = "failed"
+)
+
+// MaxMailAttempts is the number of delivery attempts after which a message is marked as failed.
+const MaxMailAttempts = 8
+
+// Mailer delivers messages from the outbox. When nil, messages are sent over SMTP
+// with the mailer settings of the site.
+var Mailer mailer.Mailer
+
+// MailFrom is the address email is sent from. When empty, the mailer login of the site is used.
+var MailFrom string
+
+// sender returns the address email is sent from.
+func sender() string {
+	if MailFrom != "" {
+		return MailFrom
+	}
+	return Settings.MailerLogin
+}
+
+// mailQueued wakes up DeliverMail when a message is queued.
+var mailQueued = make(chan struct{}, 1)
+
+// transport returns the Mailer in use.
+func transport() mailer.Mailer {
+	if Mailer != nil {
+		return Mailer
+	}
+	return mailer.SMTP{
+		Hostname: Settings.MailerHostname,
+		Port:     Settings.MailerPort,
+		Login:    Settings.MailerLogin,
+		Password: Settings.MailerPassword,
+	}
+}
+
+// retryDelay returns how long to wait before attempting delivery again after given number of attempts:
+// a minute after the first, doubling up to six hours.
+func retryDelay(attempts int) time.Duration {
+	delay := time.Minute << uint(attempts-1)
+	if attempts > 10 || delay > 6*time.Hour {
+		return 6 * time.Hour
+	}
+	return delay
+}
+
+// Queue adds mail to the outbox for delivery as soon as possible. Kind names the purpose
+// of the message, such as "recovery", and is used in metrics.
+func (mail Mail) Queue() (Mail, error) {
+	defer metrics.Query("Mail.Queue", time.Now())
+	mail.Status = MailPending
+	mail.Attempts = 0
+	mail.LastError = ""
+	mail.Created = time.Now().UTC().Unix()
+	mail.NextAttempt = mail.Created
+	mail.Sent = 0
+	_, err := db.NamedExec(`INSERT INTO outbox (kind, name, address, subject, body, html, status, attempts, lasterror, nextattempt, created, sent, newsletter, unsubscribe)
+		VALUES (:kind, :name, :address, :subject, :body, :html, :status, :attempts, :lasterror, :nextattempt, :created, :sent, :newsletter, :unsubscribe)`, mail)
+	if err != nil {
+		return mail, err
+	}
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+	return mail, nil
+}
+
+// Get returns mail with given mail.ID.
+func (mail Mail) Get() (Mail, error) {
+	defer metrics.Query("Mail.Get", time.Now())
+	err := db.Get(&mail, db.Rebind("SELECT * FROM outbox WHERE id = ?"), mail.ID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return mail, errors.New("not found")
+		}
+		return mail, err
+	}
+	return mail, nil
+}
+
+// Outbox returns messages in the outbox with given status, or all of them if status is empty,
+// newest first.
+func Outbox(status string) ([]Mail, error) {
+	defer metrics.Query("Outbox", time.Now())
+	outbox := make([]Mail, 0)
+	var err error
+	if status == "" {
+		err = db.Select(&outbox, "SELECT * FROM outbox ORDER BY id DESC")
+	} else {
+		err = db.Select(&outbox, db.Rebind("SELECT * FROM outbox WHERE status = ? ORDER BY id DESC"), status)
+	}
+	return outbox, err
+}
+
+// OutboxCounts returns the number of messages in the outbox by status.
+func OutboxCounts() (map[string]int, error) {
+	defer metrics.Query("OutboxCounts", time.Now())
+	var rows []struct {
+		Status string
+		Count  int
+	}
+	err := db.Select(&rows, "SELECT status, COUNT(*) AS count FROM outbox GROUP BY status")
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{MailPending: 0, MailSent: 0, MailFailed: 0}
+	for _, row := range rows {
+		counts[row.Status] = row.Count
+	}
+	return counts, nil
+}
+
+// Retry queues a failed message for delivery again, with a fresh number of attempts.
+// Returns "mail not failed" error if the message has not failed.
+func (mail Mail) Retry() (Mail, error) {
+	mail, err := mail.Get()
+	if err != nil {
+		return mail, err
+	}
+	if mail.Status != MailFailed {
+		return mail, errors.New("mail not failed")
+	}
+	defer metrics.Query("Mail.Retry", time.Now())
+	mail.Status = MailPending
+	mail.Attempts = 0
+	mail.NextAttempt = time.Now().UTC().Unix()
+	_, err = db.NamedExec("UPDATE outbox SET status = :status, attempts = :attempts, nextattempt = :nextattempt WHERE id = :id", mail)
+	if err != nil {
+		return mail, err
+	}
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+	return mail, nil
+}
+
+// PurgeOutbox removes messages which were sent before given time.
+func PurgeOutbox(before time.Time) error {
+	defer metrics.Query("PurgeOutbox", time.Now())
+	_, err := db.Exec(db.Rebind("DELETE FROM outbox WHERE status = ? AND sent < ?"), MailSent, before.UTC().Unix())
+	return err
+}
+
+// message returns mail as a message from the site.
+func (mail Mail) message() mailer.Message {
+	return mailer.Message{
+		From:        netmail.Address{Name: Settings.Name, Address: sender()},
+		To:          netmail.Address{Name: mail.Name, Address: mail.Address},
+		Subject:     mail.Subject,
+		Body:        mail.Body,
+		HTML:        mail.HTML,
+		Unsubscribe: mail.Unsubscribe,
+	}
+}
+
+// claim reserves mail for delivery by this process for a while, so that other processes
+// sharing the database do not send it at the same time. Reports whether mail was claimed.
+func (mail Mail) claim(now time.Time) (bool, error) {
+	result, err := db.Exec(db.Rebind("UPDATE outbox SET nextattempt = ? WHERE id = ? AND status = ? AND nextattempt = ?"),
+		now.Add(10*time.Minute).Unix(), mail.ID, MailPending, mail.NextAttempt)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// deliver attempts to send mail and records the outcome.
+func (mail Mail) deliver(m mailer.Mailer, now time.Time) error {
+	mail.Attempts++
+	err := m.Send(mail.message())
+	if err == nil {
+		metrics.Emails.Inc(mail.Kind, "sent")
+		mail.Status = MailSent
+		mail.LastError = ""
+		mail.Sent = now.Unix()
+	} else {
+		metrics.Emails.Inc(mail.Kind, "failed")
+		mail.LastError = err.Error()
+		mail.NextAttempt = now.Add(retryDelay(mail.Attempts)).Unix()
+		if mail.Attempts >= MaxMailAttempts {
+			mail.Status = MailFailed
+			log.Printf("mailer: giving up on mail %d to %s after %d attempts: %v", mail.ID, mail.Address, mail.Attempts, err)
+		} else {
+			log.Printf("mailer: delivery of mail %d failed, attempt %d: %v", mail.ID, mail.Attempts, err)
+		}
+	}
+	_, dberr := db.NamedExec("UPDATE outbox SET status = :status, attempts = :attempts, lasterror = :lasterror, nextattempt = :nextattempt, sent = :sent WHERE id = :id", mail)
+	if dberr != nil {
+		return dberr
+	}
+	return err
+}
+
+// ProcessOutbox attempts delivery of all pending messages which are due and returns
+// the number of messages sent.
+func ProcessOutbox() (int, error) {
+	now := time.Now().UTC()
+	var due []Mail
+	err := db.Select(&due, db.Rebind("SELECT * FROM outbox WHERE status = ? AND nextattempt <= ? ORDER BY id"), MailPending, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	m := transport()
+	sent := 0
+	for _, mail := range due {
+		ok, err := mail.claim(now)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			continue
+		}
+		err = mail.deliver(m, now)
+		if err == nil {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// DeliverMail processes the outbox every interval and whenever a message is queued,
+// until ctx is done. The outbox is processed once more when ctx is done, so that mail
+// queued by the last requests is not left waiting for the next start.
+// Sent messages are removed once they are older than retention.
+func DeliverMail(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := ProcessOutbox()
+		if err != nil {
+			log.Println("mailer: processing outbox:", err)
+		}
+		err = PurgeOutbox(time.Now().Add(-retention))
+		if err != nil {
+			log.Println("mailer: purging outbox:", err)
+		}
+		select {
+		case <-ctx.Done():
+			_, err := ProcessOutbox()
+			if err != nil {
+				log.Println("mailer: processing outbox:", err)
+			}
+			return
+		case <-ticker.C:
+		case <-mailQueued:
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 	slug "github.com/shurcooL/sanitized_anchor_name"
 	"github.com/toldjuuso/excerpt"
 	"github.com/toldjuuso/timezone"
+	"github.com/toldjuuso/vertigo/metrics"
+	"github.com/toldjuuso/vertigo/sanitize"
 )
 
 // Post struct contains all relevant data when it comes to posts. Most fields
@@ -29,6 +31,22 @@ type Post struct {
 	Created    int64  `json:"created"`
 	Updated    int64  `json:"updated"`
 	TimeOffset int    `json:"timeoffset"`
+	// Description and Image override the excerpt and the first image of the post
+	// in search results and links shared on social media.
+	Description string `json:"description" form:"description"`
+	Image       string `json:"image" form:"image"`
+	// AuthorName and AuthorRole are the current name and role of the author, filled by Get and GetAll
+	// so that pages can show the author and sanitize the content without looking up the author.
+	AuthorName string `json:"-"`
+	AuthorRole string `json:"-"`
+}
+
+// selectPosts selects posts together with the name and role of their author.
+const selectPosts = "SELECT posts.*, COALESCE(users.name, '') AS authorname, COALESCE(users.role, '') AS authorrole FROM posts LEFT JOIN users ON users.id = posts.author"
+
+// markdown renders Markdown to HTML and sanitizes the result with the policy of given role.
+func markdown(text string, role string) string {
+	return sanitize.ForRole(role).Sanitize(string(blackfriday.MarkdownCommon([]byte(text))))
 }
 
 // Insert or post.Insert inserts Post object into database.
@@ -36,12 +54,13 @@ type Post struct {
 // Fills post.Author, post.Created, post.Edited, post.Excerpt, post.Slug and post.Published automatically.
 // Returns Post and error object.
 func (post Post) Insert(user User) (Post, error) {
+	defer metrics.Query("Post.Insert", time.Now())
 	_, offset, err := timezone.Offset(user.Location)
 	if err != nil {
 		return post, err
 	}
 	post.TimeOffset = offset
-	post.Content = string(blackfriday.MarkdownCommon([]byte(post.Markdown)))
+	post.Content = markdown(post.Markdown, user.Role)
 	post.Author = user.ID
 	post.Created = time.Now().UTC().Round(time.Second).Unix()
 	post.Updated = post.Created
@@ -49,11 +68,52 @@ func (post Post) Insert(user User) (Post, error) {
 	post.Slug = slug.Create(post.Title)
 	post.Published = false
 	post.Viewcount = 0
-	_, err = db.NamedExec(`INSERT INTO posts (title, content, markdown, slug, author, excerpt, viewcount, published, created, updated, timeoffset)
-		VALUES (:title, :content, :markdown, :slug, :author, :excerpt, :viewcount, :published, :created, :updated, :timeoffset)`, post)
+	_, err = db.NamedExec(`INSERT INTO posts (title, content, markdown, slug, author, excerpt, viewcount, published, created, updated, timeoffset, description, image)
+		VALUES (:title, :content, :markdown, :slug, :author, :excerpt, :viewcount, :published, :created, :updated, :timeoffset, :description, :image)`, post)
 	if err != nil {
 		return post, err
 	}
+	changed()
+	return post, nil
+}
+
+// Import inserts a post migrated from another blog into database with user as its author.
+// Unlike Insert, post.Slug, post.Created, post.Updated and post.Published are kept as given,
+// and only filled if empty. Returns "post slug exists" error if the slug is taken.
+func (post Post) Import(user User) (Post, error) {
+	defer metrics.Query("Post.Import", time.Now())
+	_, offset, err := timezone.Offset(user.Location)
+	if err != nil {
+		return post, err
+	}
+	if post.Slug == "" {
+		post.Slug = slug.Create(post.Title)
+	}
+	var count int
+	err = db.Get(&count, db.Rebind("SELECT COUNT(*) FROM posts WHERE slug = ?"), post.Slug)
+	if err != nil {
+		return post, err
+	}
+	if count > 0 {
+		return post, errors.New("post slug exists")
+	}
+	post.TimeOffset = offset
+	post.Content = markdown(post.Markdown, user.Role)
+	post.Author = user.ID
+	if post.Created == 0 {
+		post.Created = time.Now().UTC().Round(time.Second).Unix()
+	}
+	if post.Updated < post.Created {
+		post.Updated = post.Created
+	}
+	post.Excerpt = excerpt.Make(post.Content, 15)
+	post.Viewcount = 0
+	_, err = db.NamedExec(`INSERT INTO posts (title, content, markdown, slug, author, excerpt, viewcount, published, created, updated, timeoffset, description, image)
+		VALUES (:title, :content, :markdown, :slug, :author, :excerpt, :viewcount, :published, :created, :updated, :timeoffset, :description, :image)`, post)
+	if err != nil {
+		return post, err
+	}
+	changed()
 	return post, nil
 }
 
@@ -61,7 +121,8 @@ func (post Post) Insert(user User) (Post, error) {
 // Requires session session as a parameter.
 // Returns Ad and error object.
 func (post Post) Get() (Post, error) {
-	stmt, err := db.PrepareNamed("SELECT * FROM posts WHERE slug = :slug")
+	defer metrics.Query("Post.Get", time.Now())
+	stmt, err := db.PrepareNamed(selectPosts + " WHERE posts.slug = :slug")
 	if err != nil {
 		return post, err
 	}
@@ -79,17 +140,25 @@ func (post Post) Get() (Post, error) {
 // Requires active session cookie.
 // Returns updated Post object and an error object.
 func (post Post) Update(entry Post) (Post, error) {
+	defer metrics.Query("Post.Update", time.Now())
+	var author User
+	author.ID = post.Author
+	role, err := author.GetRole()
+	if err != nil && err.Error() != "not found" {
+		return post, err
+	}
 	entry.ID = post.ID
-	entry.Content = string(blackfriday.MarkdownCommon([]byte(entry.Markdown)))
+	entry.Content = markdown(entry.Markdown, role)
 	entry.Excerpt = excerpt.Make(entry.Content, 15)
 	entry.Slug = slug.Create(entry.Title)
 	entry.Updated = time.Now().UTC().Round(time.Second).Unix()
-	_, err := db.NamedExec(
-		"UPDATE posts SET title = :title, content = :content, markdown = :markdown, slug = :slug, excerpt = :excerpt, published = :published, updated = :updated WHERE id = :id",
+	_, err = db.NamedExec(
+		"UPDATE posts SET title = :title, content = :content, markdown = :markdown, slug = :slug, excerpt = :excerpt, published = :published, updated = :updated, description = :description, image = :image WHERE id = :id",
 		entry)
 	if err != nil {
 		return post, err
 	}
+	changed()
 	entry.Viewcount = post.Viewcount
 	entry.Created = post.Created
 	entry.TimeOffset = post.TimeOffset
@@ -98,30 +167,135 @@ func (post Post) Update(entry Post) (Post, error) {
 }
 
 func (post Post) Unpublish() error {
+	defer metrics.Query("Post.Unpublish", time.Now())
 	post.Published = false
 	_, err := db.NamedExec("UPDATE posts SET published = :published WHERE id = :id", post)
 	if err != nil {
 		return err
 	}
+	changed()
 	return nil
 }
 
+// Announcement tells how many Webmentions Announce sent and how many subscribers the newsletter was queued to.
+type Announcement struct {
+	Webmentions int
+	Recipients  int
+}
+
+// Announce or post.Announce tells about post which has been published. It emits the webhook event,
+// and when enabled in features, federates post with ActivityPub, sends Webmentions to pages it links to
+// and emails it to newsletter subscribers, who get each post only once. Every step is attempted
+// and errors of the failed ones are returned together.
+// Both the publish routes and the CLI announce posts with it, so they do the same steps.
+func (post Post) Announce(features map[string]bool) (Announcement, error) {
+	var announcement Announcement
+	var errs []error
+	err := Emit(EventPostPublished, post)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if features["activitypub"] {
+		err = Federate(EventPostPublished, post)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if features["webmention"] {
+		announcement.Webmentions, err = post.SendWebmentions()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if features["newsletter"] {
+		newsletter, err := post.SendNewsletter()
+		if err != nil && err.Error() != "newsletter sent" {
+			errs = append(errs, err)
+		}
+		announcement.Recipients = newsletter.Recipients
+	}
+	return announcement, errors.Join(errs...)
+}
+
+// postColumns lists the columns of posts which are kept for deleted posts, see Undelete.
+const postColumns = "title, content, markdown, slug, author, excerpt, viewcount, published, created, updated, timeoffset, description, image"
+
 // Delete or post.Delete deletes a post according to post.Slug.
+// A copy of the post is kept, so that it can be restored with Undelete.
 // Requires session cookie.
 // Returns error object.
 func (post Post) Delete() error {
-	_, err := db.NamedExec("DELETE FROM posts WHERE id = :id", post)
+	defer metrics.Query("Post.Delete", time.Now())
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(tx.Rebind("INSERT INTO deletedposts ("+postColumns+", deleted) SELECT "+postColumns+", ? FROM posts WHERE id = ?"),
+		time.Now().UTC().Unix(), post.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(tx.Rebind("DELETE FROM posts WHERE id = ?"), post.ID)
 	if err != nil {
 		return err
 	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	changed()
 	return nil
 }
 
+// Undelete or post.Undelete restores the latest deleted post with given post.Slug written by post.Author.
+// Returns "not found" error if there is no such post and "post slug exists" if another post has
+// taken the slug since.
+func (post Post) Undelete() (Post, error) {
+	defer metrics.Query("Post.Undelete", time.Now())
+	var id int64
+	err := db.Get(&id, db.Rebind("SELECT id FROM deletedposts WHERE slug = ? AND author = ? ORDER BY deleted DESC, id DESC LIMIT 1"), post.Slug, post.Author)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return post, errors.New("not found")
+		}
+		return post, err
+	}
+	var count int
+	err = db.Get(&count, db.Rebind("SELECT COUNT(*) FROM posts WHERE slug = ?"), post.Slug)
+	if err != nil {
+		return post, err
+	}
+	if count > 0 {
+		return post, errors.New("post slug exists")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return post, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(tx.Rebind("INSERT INTO posts ("+postColumns+") SELECT "+postColumns+" FROM deletedposts WHERE id = ?"), id)
+	if err != nil {
+		return post, err
+	}
+	_, err = tx.Exec(tx.Rebind("DELETE FROM deletedposts WHERE id = ?"), id)
+	if err != nil {
+		return post, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return post, err
+	}
+	changed()
+	return post.Get()
+}
+
 // GetAll or user.GetAll returns all user in database.
 // Returns []User and error object.
 func (post Post) GetAll() ([]Post, error) {
+	defer metrics.Query("Post.GetAll", time.Now())
 	var posts []Post
-	rows, err := db.Queryx("SELECT * FROM posts ORDER BY created DESC")
+	rows, err := db.Queryx(selectPosts + " ORDER BY posts.created DESC")
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
 			posts = make([]Post, 0)
@@ -139,11 +313,11 @@ func (post Post) GetAll() ([]Post, error) {
 	return posts, nil
 }
 
-// Update or user.Update updates parameter "entry" with data given in parameter "user".
-// Returns updated Ad object and an error object.
+// Increment or post.Increment adds one to view count of the post with given post.Slug.
+// View counts do not change ContentVersion, so cached pages show them as they were when rendered.
 func (post Post) Increment() {
-	post.Viewcount += 1
-	_, err := db.NamedExec("UPDATE posts SET viewcount = :viewcount WHERE id = :id", post)
+	defer metrics.Query("Post.Increment", time.Now())
+	_, err := db.NamedExec("UPDATE posts SET viewcount = viewcount + 1 WHERE slug = :slug", post)
 	if err != nil {
 		log.Println("analytics error:", err)
 	}
@@ -2,8 +2,10 @@ package sqlx
 
 import (
 	"log"
+	"time"
 
 	"github.com/pborman/uuid"
+	"github.com/toldjuuso/vertigo/metrics"
 )
 
 // Vertigo struct is used as a site wide settings structure.
@@ -21,6 +23,7 @@ type Vertigo struct {
 	MailerPort         int    `json:"mailerport" form:"mailerport"`
 	MailerPassword     string `json:"mailerpassword" form:"mailerpassword"`
 	MailerHostname     string `json:"mailerhostname" form:"mailerhostname"`
+	Theme              string `json:"theme" form:"theme"`
 }
 
 /*
@@ -72,20 +75,23 @@ CookieHash on the other hand will return the secret hash used to sign your cooki
 // Fills settings.ID, settings.CookieHash and settings.FirstRun automatically.
 // Returns *Vertigo and error object.
 func (settings Vertigo) Insert() (*Vertigo, error) {
+	defer metrics.Query("Vertigo.Insert", time.Now())
 	settings.ID = 1
 	settings.CookieHash = uuid.New()
 	settings.Firstrun = false
-	_, err := db.NamedExec(`INSERT INTO settings (id, name, hostname, firstrun, cookiehash, allowregistrations, description, mailerlogin, mailerport, mailerpassword, mailerhostname)
-		VALUES (:id, :name, :hostname, :firstrun, :cookiehash, :allowregistrations, :description, :mailerlogin, :mailerport, :mailerpassword, :mailerhostname)`, settings)
+	_, err := db.NamedExec(`INSERT INTO settings (id, name, hostname, firstrun, cookiehash, allowregistrations, description, mailerlogin, mailerport, mailerpassword, mailerhostname, theme)
+		VALUES (:id, :name, :hostname, :firstrun, :cookiehash, :allowregistrations, :description, :mailerlogin, :mailerport, :mailerpassword, :mailerhostname, :theme)`, settings)
 	if err != nil {
 		return &settings, err
 	}
+	changed()
 	return &settings, nil
 }
 
 // Get or settings.Get returns settings saved to database.
 // Returns Vertigo and error object.
 func (settings Vertigo) Get() (Vertigo, error) {
+	defer metrics.Query("Vertigo.Get", time.Now())
 	var v Vertigo
 	v.ID = 1
 	stmt, err := db.PrepareNamed("SELECT * FROM settings WHERE id = :id")
@@ -102,15 +108,17 @@ func (settings Vertigo) Get() (Vertigo, error) {
 // Update or settings.Update writes changes made to global settings variable into database.
 // Returns *Vertigo and an error object.
 func (settings Vertigo) Update() (*Vertigo, error) {
+	defer metrics.Query("Vertigo.Update", time.Now())
 	settings.ID = 1
 	settings.Firstrun = false
 	settings.CookieHash = Settings.CookieHash
 	_, err := db.NamedExec(
-		"UPDATE settings SET name = :name, hostname = :hostname, firstrun = :firstrun, allowregistrations = :allowregistrations, description = :description, mailerlogin = :mailerlogin, mailerport = :mailerport, mailerpassword = :mailerpassword, mailerhostname = :mailerhostname WHERE id = :id",
+		"UPDATE settings SET name = :name, hostname = :hostname, firstrun = :firstrun, allowregistrations = :allowregistrations, description = :description, mailerlogin = :mailerlogin, mailerport = :mailerport, mailerpassword = :mailerpassword, mailerhostname = :mailerhostname, theme = :theme WHERE id = :id",
 		settings)
 	if err != nil {
 		return &settings, err
 	}
+	changed()
 	return &settings, nil
 }
 
@@ -0,0 +1,148 @@
+package sqlx
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// Token is a personal API token with which clients such as Micropub apps act on behalf of
+// the user with ID Owner without a session cookie. Only the digest of the token is stored;
+// Secret is set once by Insert. Scope is a space separated list of scopes, see Scopes.
+type Token struct {
+	ID       int64  `json:"id"`
+	Owner    int64  `json:"owner"`
+	Name     string `json:"name"`
+	Digest   string `json:"-"`
+	Scope    string `json:"scope"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastused"`
+	// Secret is the token itself, only known right after it has been created.
+	Secret string `json:"secret,omitempty" db:"-"`
+}
+
+// Scopes lists scopes which tokens can be given, named after Micropub scopes.
+var Scopes = []string{"create", "update", "delete", "media"}
+
+// tokenDigest returns the digest of secret which is stored instead of the token.
+func tokenDigest(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// validScope returns scope without duplicates and extra spaces. Empty scope means all scopes.
+// Returns "token invalid" error for unknown scopes.
+func validScope(scope string) (string, error) {
+	if strings.TrimSpace(scope) == "" {
+		return strings.Join(Scopes, " "), nil
+	}
+	var valid []string
+	seen := make(map[string]bool)
+	for _, s := range strings.Fields(scope) {
+		known := false
+		for _, k := range Scopes {
+			known = known || k == s
+		}
+		if !known {
+			return "", errors.New("token invalid")
+		}
+		if !seen[s] {
+			seen[s] = true
+			valid = append(valid, s)
+		}
+	}
+	return strings.Join(valid, " "), nil
+}
+
+// HasScope reports whether token has been given scope.
+func (token Token) HasScope(scope string) bool {
+	for _, s := range strings.Fields(token.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert or token.Insert creates a token for token.Owner and returns it with Secret set.
+// Returns "token invalid" error if name is empty or scope unknown.
+func (token Token) Insert() (Token, error) {
+	defer metrics.Query("Token.Insert", time.Now())
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return token, errors.New("token invalid")
+	}
+	scope, err := validScope(token.Scope)
+	if err != nil {
+		return token, err
+	}
+	token.Scope = scope
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return token, err
+	}
+	secret := hex.EncodeToString(b)
+	token.Digest = tokenDigest(secret)
+	token.Created = time.Now().UTC().Unix()
+	token.LastUsed = 0
+	_, err = db.NamedExec("INSERT INTO tokens (owner, name, digest, scope, created, lastused) VALUES (:owner, :name, :digest, :scope, :created, :lastused)", token)
+	if err != nil {
+		return token, err
+	}
+	err = db.Get(&token, db.Rebind("SELECT * FROM tokens WHERE digest = ?"), token.Digest)
+	token.Secret = secret
+	return token, err
+}
+
+// Tokens returns tokens of the user with given ID, newest first.
+func Tokens(owner int64) ([]Token, error) {
+	defer metrics.Query("Tokens", time.Now())
+	tokens := make([]Token, 0)
+	err := db.Select(&tokens, db.Rebind("SELECT * FROM tokens WHERE owner = ? ORDER BY id DESC"), owner)
+	return tokens, err
+}
+
+// Delete or token.Delete revokes token with given token.ID of token.Owner.
+func (token Token) Delete() error {
+	defer metrics.Query("Token.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM tokens WHERE id = ? AND owner = ?"), token.ID, token.Owner)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// Authenticate returns the token with given secret and its user, and records when it was used.
+// Returns "not found" error for unknown tokens and tokens of deleted users.
+func Authenticate(secret string) (Token, User, error) {
+	defer metrics.Query("Authenticate", time.Now())
+	var token Token
+	var user User
+	if secret == "" {
+		return token, user, errors.New("not found")
+	}
+	err := db.Get(&token, db.Rebind("SELECT * FROM tokens WHERE digest = ?"), tokenDigest(secret))
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return token, user, errors.New("not found")
+		}
+		return token, user, err
+	}
+	user.ID = token.Owner
+	user, err = user.Get()
+	if err != nil {
+		return token, user, err
+	}
+	token.LastUsed = time.Now().UTC().Unix()
+	_, err = db.Exec(db.Rebind("UPDATE tokens SET lastused = ? WHERE id = ?"), token.LastUsed, token.ID)
+	return token, user, err
+}
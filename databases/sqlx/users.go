@@ -6,9 +6,17 @@ import (
 	"time"
 
 	"github.com/pborman/uuid"
+	"github.com/toldjuuso/vertigo/metrics"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Roles a user can have. The first registered user becomes an admin and everyone else an author.
+// The role decides, among other things, which HTML sanitization policy is applied to the user's posts.
+const (
+	RoleAdmin  = "admin"
+	RoleAuthor = "author"
+)
+
 // User struct holds all relevant data for representing user accounts on Vertigo.
 // A complete User struct also includes Posts field (type []Post) which includes
 // all posts made by the user.
@@ -16,11 +24,17 @@ type User struct {
 	ID       int64  `json:"id"`
 	Name     string `json:"name" form:"name"`
 	Password string `json:"password,omitempty" form:"password" sql:"-"`
-	Recovery string `json:"-"`
-	Digest   []byte `json:"-"`
-	Email    string `json:"email" form:"email" binding:"required"`
-	Posts    []Post `json:"posts"`
-	Location string `json:"location" form:"location"`
+	// Invitation is the code of an invitation used for registering, see Invitation.
+	Invitation string `json:"invitation,omitempty" form:"invitation" db:"-"`
+	Recovery   string `json:"-"`
+	Digest     []byte `json:"-"`
+	Email      string `json:"email" form:"email" binding:"required"`
+	Posts      []Post `json:"posts"`
+	Location   string `json:"location" form:"location"`
+	Role       string `json:"role"`
+	// Verified tells whether the user has proven to control Email, see SendVerificationEmail.
+	Verified         bool  `json:"verified"`
+	VerificationSent int64 `json:"-"`
 }
 
 // GenerateHash generates bcrypt hash from plaintext password
@@ -51,11 +65,18 @@ func (user User) Login() (User, error) {
 	password := user.Password
 	user, err := user.GetByEmail()
 	if err != nil {
+		if err.Error() == "not found" {
+			metrics.Logins.Inc("not_found")
+		} else {
+			metrics.Logins.Inc("error")
+		}
 		return user, err
 	}
 	if !CompareHash(user.Digest, password) {
+		metrics.Logins.Inc("wrong_password")
 		return user, errors.New("wrong username or password")
 	}
+	metrics.Logins.Inc("success")
 	return user, nil
 }
 
@@ -63,24 +84,30 @@ func (user User) Login() (User, error) {
 // Can only used to update Name and Digest fields because of how user.Get works.
 // Currently not used elsewhere than in password Recovery, that's why the Digest generation.
 func (user User) Update(entry User) (User, error) {
+	defer metrics.Query("User.Update", time.Now())
 	_, err := db.NamedExec(
 		"UPDATE users SET name = :name, digest = :digest, location = :location, recovery = :recovery WHERE id = :id",
 		entry)
 	if err != nil {
 		return entry, err
 	}
+	changed()
 	return entry, nil
 }
 
 // Recover or user.Recover is used to recover User's password according to user.Email
 // The function will insert user.Recovery field with generated UUID string and dispatch an email
 // to the corresponding user.Email address. It will also add TTL to Recovery field.
+// Returns "user not verified" error for users whose address has not been verified.
 func (user User) Recover() error {
 
 	user, err := user.GetByEmail()
 	if err != nil {
 		return err
 	}
+	if !user.Verified {
+		return errors.New("user not verified")
+	}
 
 	entry := user
 	entry.Recovery = uuid.New()
@@ -99,6 +126,7 @@ func (user User) Recover() error {
 }
 
 func (user User) PasswordReset(entry User) (User, error) {
+	defer metrics.Query("User.PasswordReset", time.Now())
 	digest, err := GenerateHash(entry.Password)
 	if err != nil {
 		return entry, err
@@ -128,6 +156,7 @@ func (user User) ExpireRecovery(t time.Duration) {
 // Requires session session as a parameter.
 // Returns Ad and error object.
 func (user User) Get() (User, error) {
+	defer metrics.Query("User.Get", time.Now())
 	stmt, err := db.PrepareNamed("SELECT * FROM users WHERE id = :id")
 	if err != nil {
 		return user, err
@@ -159,6 +188,7 @@ func (user User) Get() (User, error) {
 // GetByEmail or user.GetByEmail returns User object according to given .Email
 // with post information merged.
 func (user User) GetByEmail() (User, error) {
+	defer metrics.Query("User.GetByEmail", time.Now())
 	stmt, err := db.PrepareNamed("SELECT * FROM users WHERE email = :email")
 	if err != nil {
 		return user, err
@@ -187,9 +217,46 @@ func (user User) GetByEmail() (User, error) {
 	return user, nil
 }
 
+// GetRole or user.GetRole returns the role of user according to given .ID
+// without merging post information.
+func (user User) GetRole() (string, error) {
+	defer metrics.Query("User.GetRole", time.Now())
+	stmt, err := db.PrepareNamed("SELECT role FROM users WHERE id = :id")
+	if err != nil {
+		return "", err
+	}
+	var role string
+	err = stmt.Get(&role, user)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return "", errors.New("not found")
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+// SiteOwner returns the oldest admin, who is taken to be the owner of the site, for example when
+// someone signs in with the address of the site through IndieAuth.
+func SiteOwner() (User, error) {
+	defer metrics.Query("SiteOwner", time.Now())
+	var user User
+	err := db.Get(&user, db.Rebind("SELECT id FROM users WHERE role = ? ORDER BY id LIMIT 1"), RoleAdmin)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return user, errors.New("not found")
+		}
+		return user, err
+	}
+	return user.Get()
+}
+
 // Insert or user.Insert inserts a new User struct into the database.
 // The function creates .Digest hash from .Password.
+// If .Role is empty, the first user in the database is made an admin and the rest authors.
+// The first user is always verified, since there is nobody else to vouch for them.
 func (user User) Insert() (User, error) {
+	defer metrics.Query("User.Insert", time.Now())
 	digest, err := GenerateHash(user.Password)
 	if err != nil {
 		return user, err
@@ -198,8 +265,20 @@ func (user User) Insert() (User, error) {
 	if err != nil {
 		return user, errors.New("user location invalid")
 	}
+	if user.Role == "" {
+		var count int
+		err = db.Get(&count, "SELECT COUNT(*) FROM users")
+		if err != nil {
+			return user, err
+		}
+		user.Role = RoleAuthor
+		if count == 0 {
+			user.Role = RoleAdmin
+			user.Verified = true
+		}
+	}
 	user.Digest = digest
-	_, err = db.NamedExec("INSERT INTO users (name, digest, email, location) VALUES (:name, :digest, :email, :location)", user)
+	_, err = db.NamedExec("INSERT INTO users (name, digest, email, location, role, verified) VALUES (:name, :digest, :email, :location, :role, :verified)", user)
 	if err != nil {
 		if err.Error() == "UNIQUE constraint failed: users.email" || err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"` {
 			return user, errors.New("user email exists")
@@ -211,6 +290,7 @@ func (user User) Insert() (User, error) {
 
 // GetAll or user.GetAll fetches all users with post data merged from the database.
 func (user User) GetAll() ([]User, error) {
+	defer metrics.Query("User.GetAll", time.Now())
 	var users []User
 	rows, err := db.Queryx("SELECT * FROM users")
 	if err != nil {
@@ -239,3 +319,27 @@ func (user User) GetAll() ([]User, error) {
 	}
 	return users, nil
 }
+
+// ValidRole returns whether role is one of the known user roles.
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleAuthor
+}
+
+// SetRole or user.SetRole changes the role of user with given user.ID.
+// Returns "user role invalid" error if role is not known.
+func (user User) SetRole(role string) (User, error) {
+	defer metrics.Query("User.SetRole", time.Now())
+	if !ValidRole(role) {
+		return user, errors.New("user role invalid")
+	}
+	user.Role = role
+	result, err := db.NamedExec("UPDATE users SET role = :role WHERE id = :id", user)
+	if err != nil {
+		return user, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return user, errors.New("not found")
+	}
+	changed()
+	return user, nil
+}
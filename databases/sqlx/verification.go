@@ -0,0 +1,127 @@
+package sqlx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// VerificationLifetime is how long verification links are valid.
+const VerificationLifetime = 7 * 24 * time.Hour
+
+// VerificationInterval is the minimum time between verification emails to the same user.
+const VerificationInterval = 5 * time.Minute
+
+// verificationSignature signs user ID, email address and expiry time with the cookie secret
+// of the site, so the link stops working if the address changes.
+func verificationSignature(id int64, email string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(Settings.CookieHash))
+	fmt.Fprintf(mac, "verify\x00%d\x00%s\x00%d", id, strings.ToLower(email), expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerificationToken returns a signed token which verifies the email address of user until expires.
+func (user User) VerificationToken(expires time.Time) string {
+	unix := expires.UTC().Unix()
+	return fmt.Sprintf("%d.%d.%s", user.ID, unix, verificationSignature(user.ID, user.Email, unix))
+}
+
+// SendVerificationEmail queues an email with a verification link to user in the outbox. Returns
+// "user verified" error if the user is verified already, and "verification throttled" error if
+// the previous email was sent less than VerificationInterval ago.
+func (user User) SendVerificationEmail() error {
+	user, err := user.Get()
+	if err != nil {
+		return err
+	}
+	if user.Verified {
+		return errors.New("user verified")
+	}
+	now := time.Now().UTC()
+	if time.Unix(user.VerificationSent, 0).Add(VerificationInterval).After(now) {
+		return errors.New("verification throttled")
+	}
+	defer metrics.Query("User.SendVerificationEmail", time.Now())
+	// claimed before queueing, so concurrent requests do not send twice
+	result, err := db.Exec(db.Rebind("UPDATE users SET verificationsent = ? WHERE id = ? AND verificationsent = ?"), now.Unix(), user.ID, user.VerificationSent)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("verification throttled")
+	}
+	token := user.VerificationToken(now.Add(VerificationLifetime))
+	return newEmail(user, "/user/verify/"+token).Queue("verification")
+}
+
+// VerifyEmail verifies the email address of the user a token from VerificationToken was made for.
+// Returns "verification token invalid" error if the token is malformed, forged or made for another
+// address, and "verification token expired" error if it has expired.
+func VerifyEmail(token string) (User, error) {
+	var user User
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return user, errors.New("verification token invalid")
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return user, errors.New("verification token invalid")
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return user, errors.New("verification token invalid")
+	}
+	user.ID = id
+	user, err = user.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			return user, errors.New("verification token invalid")
+		}
+		return user, err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(verificationSignature(user.ID, user.Email, expires))) {
+		return user, errors.New("verification token invalid")
+	}
+	if time.Now().Unix() > expires {
+		return user, errors.New("verification token expired")
+	}
+	return user.Verify()
+}
+
+// Verify marks user with given user.ID as verified. Admins use it to vouch for users
+// whose email cannot be delivered.
+func (user User) Verify() (User, error) {
+	defer metrics.Query("User.Verify", time.Now())
+	user.Verified = true
+	result, err := db.NamedExec("UPDATE users SET verified = :verified WHERE id = :id", user)
+	if err != nil {
+		return user, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return user, errors.New("not found")
+	}
+	changed()
+	return user, nil
+}
+
+// GetVerified or user.GetVerified returns whether user with given .ID is verified
+// without merging post information.
+func (user User) GetVerified() (bool, error) {
+	defer metrics.Query("User.GetVerified", time.Now())
+	var verified bool
+	err := db.Get(&verified, db.Rebind("SELECT verified FROM users WHERE id = ?"), user.ID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return false, errors.New("not found")
+		}
+		return false, err
+	}
+	return verified, nil
+}
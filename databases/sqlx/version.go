@@ -0,0 +1,17 @@
+package sqlx
+
+import "sync/atomic"
+
+// version counts changes to content shown on public pages.
+var version atomic.Uint64
+
+// ContentVersion returns a number which changes whenever posts, users or settings change,
+// so caches of rendered pages know when they are stale. View counts are not tracked.
+func ContentVersion() uint64 {
+	return version.Load()
+}
+
+// changed marks content as changed, see ContentVersion.
+func changed() {
+	version.Add(1)
+}
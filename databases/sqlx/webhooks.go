@@ -0,0 +1,410 @@
+package sqlx
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/metrics"
+)
+
+// Webhook is an endpoint which is sent content events as JSON with an HTTP POST request.
+// Events is a comma separated list of the events the endpoint receives, see Events.
+// Requests are signed with Secret, see Signature, and deliveries which fail are retried like email,
+// see Delivery.
+type Webhook struct {
+	ID      int64  `json:"id"`
+	URL     string `json:"url"`
+	Events  string `json:"events"`
+	Secret  string `json:"secret"`
+	Active  bool   `json:"active"`
+	Created int64  `json:"created"`
+}
+
+// Content events sent to webhooks. EventPing is only sent by Webhook.Test.
+const (
+	EventPostCreated     = "post.created"
+	EventPostUpdated     = "post.updated"
+	EventPostPublished   = "post.published"
+	EventPostUnpublished = "post.unpublished"
+	EventPostDeleted     = "post.deleted"
+	EventUserCreated     = "user.created"
+	EventPing            = "ping"
+)
+
+// Events lists the events webhooks can receive.
+var Events = []string{EventPostCreated, EventPostUpdated, EventPostPublished, EventPostUnpublished, EventPostDeleted, EventUserCreated}
+
+// Delivery is a request to a webhook. Deliveries are kept as a log of what was sent to which
+// webhook and how the endpoint responded.
+type Delivery struct {
+	ID          int64  `json:"id"`
+	Webhook     int64  `json:"webhook"`
+	Event       string `json:"event"`
+	Payload     string `json:"payload"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	Response    int    `json:"response"`
+	LastError   string `json:"lasterror"`
+	NextAttempt int64  `json:"nextattempt"`
+	Created     int64  `json:"created"`
+	Delivered   int64  `json:"delivered"`
+}
+
+// Statuses of deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// MaxDeliveryAttempts is the number of attempts after which a delivery is marked as failed.
+const MaxDeliveryAttempts = 8
+
+// WebhookClient sends webhook requests.
+var WebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// deliveryQueued wakes up DeliverWebhooks when a delivery is queued.
+var deliveryQueued = make(chan struct{}, 1)
+
+// validEvents returns events, a comma separated list, without spaces and duplicates.
+// Returns "webhook invalid" error for unknown events.
+func validEvents(events string) (string, error) {
+	var valid []string
+	seen := make(map[string]bool)
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		if event == "" || seen[event] {
+			continue
+		}
+		known := false
+		for _, e := range Events {
+			known = known || e == event
+		}
+		if !known {
+			return "", errors.New("webhook invalid")
+		}
+		seen[event] = true
+		valid = append(valid, event)
+	}
+	if len(valid) == 0 {
+		return "", errors.New("webhook invalid")
+	}
+	return strings.Join(valid, ","), nil
+}
+
+// validate checks URL and Events of webhook. Returns "webhook invalid" error if the URL is not
+// an absolute http or https URL or an event is unknown.
+func (webhook Webhook) validate() (Webhook, error) {
+	u, err := url.Parse(strings.TrimSpace(webhook.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook, errors.New("webhook invalid")
+	}
+	webhook.URL = u.String()
+	webhook.Events, err = validEvents(webhook.Events)
+	return webhook, err
+}
+
+// Receives reports whether webhook receives event.
+func (webhook Webhook) Receives(event string) bool {
+	for _, e := range strings.Split(webhook.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookSecret returns a new random secret for signing requests of a webhook.
+func webhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Insert creates webhook with a random secret. The webhook is active.
+func (webhook Webhook) Insert() (Webhook, error) {
+	defer metrics.Query("Webhook.Insert", time.Now())
+	webhook, err := webhook.validate()
+	if err != nil {
+		return webhook, err
+	}
+	webhook.Secret, err = webhookSecret()
+	if err != nil {
+		return webhook, err
+	}
+	webhook.Active = true
+	webhook.Created = time.Now().UTC().Unix()
+	_, err = db.NamedExec("INSERT INTO webhooks (url, events, secret, active, created) VALUES (:url, :events, :secret, :active, :created)", webhook)
+	if err != nil {
+		return webhook, err
+	}
+	err = db.Get(&webhook, db.Rebind("SELECT * FROM webhooks WHERE secret = ?"), webhook.Secret)
+	return webhook, err
+}
+
+// Get returns webhook with given webhook.ID.
+func (webhook Webhook) Get() (Webhook, error) {
+	defer metrics.Query("Webhook.Get", time.Now())
+	err := db.Get(&webhook, db.Rebind("SELECT * FROM webhooks WHERE id = ?"), webhook.ID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return webhook, errors.New("not found")
+		}
+		return webhook, err
+	}
+	return webhook, nil
+}
+
+// Update changes URL, Events and Active of webhook with given webhook.ID. The secret is kept.
+func (webhook Webhook) Update() (Webhook, error) {
+	defer metrics.Query("Webhook.Update", time.Now())
+	webhook, err := webhook.validate()
+	if err != nil {
+		return webhook, err
+	}
+	result, err := db.NamedExec("UPDATE webhooks SET url = :url, events = :events, active = :active WHERE id = :id", webhook)
+	if err != nil {
+		return webhook, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return webhook, errors.New("not found")
+	}
+	return webhook.Get()
+}
+
+// Delete removes webhook with given webhook.ID and its deliveries.
+func (webhook Webhook) Delete() error {
+	defer metrics.Query("Webhook.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM webhooks WHERE id = ?"), webhook.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	_, err = db.Exec(db.Rebind("DELETE FROM deliveries WHERE webhook = ?"), webhook.ID)
+	return err
+}
+
+// Webhooks returns all webhooks in order of creation.
+func Webhooks() ([]Webhook, error) {
+	defer metrics.Query("Webhooks", time.Now())
+	webhooks := make([]Webhook, 0)
+	err := db.Select(&webhooks, "SELECT * FROM webhooks ORDER BY id")
+	return webhooks, err
+}
+
+// Deliveries returns at most limit latest deliveries to webhook, newest first.
+func (webhook Webhook) Deliveries(limit int) ([]Delivery, error) {
+	defer metrics.Query("Webhook.Deliveries", time.Now())
+	deliveries := make([]Delivery, 0)
+	err := db.Select(&deliveries, db.Rebind("SELECT * FROM deliveries WHERE webhook = ? ORDER BY id DESC LIMIT ?"), webhook.ID, limit)
+	return deliveries, err
+}
+
+// Emit queues event with data for delivery to active webhooks which receive it.
+// Data is sent as the "data" field of the payload.
+func Emit(event string, data interface{}) error {
+	var webhooks []Webhook
+	err := db.Select(&webhooks, db.Rebind("SELECT * FROM webhooks WHERE active = ?"), true)
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Receives(event) {
+			continue
+		}
+		_, err = webhook.queue(event, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Test queues a ping event to webhook, also if it is inactive, and returns the delivery.
+func (webhook Webhook) Test() (Delivery, error) {
+	webhook, err := webhook.Get()
+	if err != nil {
+		return Delivery{}, err
+	}
+	return webhook.queue(EventPing, map[string]interface{}{"webhook": webhook.ID, "site": Settings.Hostname})
+}
+
+// queue adds a delivery of event with data to webhook.
+func (webhook Webhook) queue(event string, data interface{}) (Delivery, error) {
+	defer metrics.Query("Webhook.queue", time.Now())
+	now := time.Now().UTC()
+	payload, err := json.Marshal(map[string]interface{}{"event": event, "created": now.Unix(), "data": data})
+	if err != nil {
+		return Delivery{}, err
+	}
+	delivery := Delivery{
+		Webhook:     webhook.ID,
+		Event:       event,
+		Payload:     string(payload),
+		Status:      DeliveryPending,
+		NextAttempt: now.Unix(),
+		Created:     now.Unix(),
+	}
+	_, err = db.NamedExec(`INSERT INTO deliveries (webhook, event, payload, status, attempts, response, lasterror, nextattempt, created, delivered)
+		VALUES (:webhook, :event, :payload, :status, :attempts, :response, :lasterror, :nextattempt, :created, :delivered)`, delivery)
+	if err != nil {
+		return delivery, err
+	}
+	err = db.Get(&delivery, db.Rebind("SELECT * FROM deliveries WHERE webhook = ? ORDER BY id DESC LIMIT 1"), webhook.ID)
+	if err != nil {
+		return delivery, err
+	}
+	select {
+	case deliveryQueued <- struct{}{}:
+	default:
+	}
+	return delivery, nil
+}
+
+// Signature returns the signature of payload with secret, which is sent in the X-Vertigo-Signature
+// header: "sha256=" followed by the hex encoded HMAC-SHA256 of the request body.
+func Signature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// claim reserves delivery for this process for a while, see Mail.claim.
+func (delivery Delivery) claim(now time.Time) (bool, error) {
+	result, err := db.Exec(db.Rebind("UPDATE deliveries SET nextattempt = ? WHERE id = ? AND status = ? AND nextattempt = ?"),
+		now.Add(10*time.Minute).Unix(), delivery.ID, DeliveryPending, delivery.NextAttempt)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// post sends delivery to webhook and returns the status code of the response.
+// Responses other than 2xx are errors.
+func (delivery Delivery) post(webhook Webhook) (int, error) {
+	request, err := http.NewRequest("POST", webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Vertigo-Webhook")
+	request.Header.Set("X-Vertigo-Event", delivery.Event)
+	request.Header.Set("X-Vertigo-Delivery", strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set("X-Vertigo-Signature", Signature(webhook.Secret, []byte(delivery.Payload)))
+	response, err := WebhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("webhook responded %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// deliver attempts delivery and records the outcome.
+func (delivery Delivery) deliver(webhook Webhook, now time.Time) error {
+	delivery.Attempts++
+	var err error
+	delivery.Response, err = delivery.post(webhook)
+	if err == nil {
+		metrics.Webhooks.Inc(delivery.Event, "delivered")
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+		delivery.Delivered = now.Unix()
+	} else {
+		metrics.Webhooks.Inc(delivery.Event, "failed")
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = now.Add(retryDelay(delivery.Attempts)).Unix()
+		if delivery.Attempts >= MaxDeliveryAttempts {
+			delivery.Status = DeliveryFailed
+			log.Printf("webhooks: giving up on delivery %d to %s after %d attempts: %v", delivery.ID, webhook.URL, delivery.Attempts, err)
+		}
+	}
+	_, dberr := db.NamedExec("UPDATE deliveries SET status = :status, attempts = :attempts, response = :response, lasterror = :lasterror, nextattempt = :nextattempt, delivered = :delivered WHERE id = :id", delivery)
+	if dberr != nil {
+		return dberr
+	}
+	return err
+}
+
+// ProcessDeliveries attempts all pending deliveries which are due and returns the number of
+// deliveries which succeeded. Deliveries to deleted webhooks are marked as failed.
+func ProcessDeliveries() (int, error) {
+	now := time.Now().UTC()
+	var due []Delivery
+	err := db.Select(&due, db.Rebind("SELECT * FROM deliveries WHERE status = ? AND nextattempt <= ? ORDER BY id"), DeliveryPending, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, delivery := range due {
+		ok, err := delivery.claim(now)
+		if err != nil {
+			return delivered, err
+		}
+		if !ok {
+			continue
+		}
+		webhook, err := Webhook{ID: delivery.Webhook}.Get()
+		if err != nil {
+			if err.Error() != "not found" {
+				return delivered, err
+			}
+			_, err = db.Exec(db.Rebind("UPDATE deliveries SET status = ?, lasterror = ? WHERE id = ?"), DeliveryFailed, "webhook deleted", delivery.ID)
+			if err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		err = delivery.deliver(webhook, now)
+		if err == nil {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// DeliverWebhooks processes pending deliveries every interval and whenever an event is emitted,
+// until ctx is done.
+func DeliverWebhooks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := ProcessDeliveries()
+		if err != nil {
+			log.Println("webhooks: processing deliveries:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-deliveryQueued:
+		}
+	}
+}
+
+// WebhookUser returns data of user sent to webhooks, without password digest and tokens.
+func WebhookUser(user User) map[string]interface{} {
+	return map[string]interface{}{"id": user.ID, "name": user.Name, "email": user.Email, "role": user.Role}
+}
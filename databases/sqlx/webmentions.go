@@ -0,0 +1,328 @@
+package sqlx
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/vertigo/metrics"
+	"github.com/toldjuuso/vertigo/webmention"
+)
+
+// Webmention is a notification that Source, a page elsewhere on the web, links to Target,
+// a published post of the site. Received Webmentions are verified in the background by
+// VerifyWebmentions, after which the likes, reposts and replies among them are shown under the post.
+// Sources which can not be fetched are retried like email, see Mail.
+type Webmention struct {
+	ID     int64  `json:"id"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Post is the ID of the post Target points to.
+	Post        int64  `json:"post"`
+	Status      string `json:"status"`
+	Kind        string `json:"kind"`
+	AuthorName  string `json:"authorname"`
+	AuthorURL   string `json:"authorurl"`
+	AuthorPhoto string `json:"authorphoto"`
+	Content     string `json:"content"`
+	Published   int64  `json:"published"`
+	Created     int64  `json:"created"`
+	Verified    int64  `json:"verified"`
+	Attempts    int    `json:"attempts"`
+	LastError   string `json:"lasterror"`
+	NextAttempt int64  `json:"nextattempt"`
+}
+
+// Statuses of received Webmentions. Rejected Webmentions are kept so that a source
+// which is updated to link to the post again can be verified anew.
+const (
+	WebmentionPending  = "pending"
+	WebmentionVerified = "verified"
+	WebmentionRejected = "rejected"
+)
+
+// MaxWebmentionAttempts is the number of attempts to fetch the source after which a Webmention is rejected.
+const MaxWebmentionAttempts = 5
+
+// webmentionReceived wakes up VerifyWebmentions when a Webmention is received.
+var webmentionReceived = make(chan struct{}, 1)
+
+// postURL returns the address of post on the site.
+func postURL(post Post) string {
+	return strings.TrimRight(Settings.Hostname, "/") + "/post/" + post.Slug
+}
+
+// targetPost returns the published post target points to.
+// Returns "target not found" error if target is not a published post of the site.
+func targetPost(target *url.URL) (Post, error) {
+	var post Post
+	site, err := url.Parse(Settings.Hostname)
+	if err != nil || !strings.EqualFold(site.Host, target.Host) {
+		return post, errors.New("target not found")
+	}
+	prefix := strings.TrimRight(site.Path, "/") + "/post/"
+	if !strings.HasPrefix(target.Path, prefix) {
+		return post, errors.New("target not found")
+	}
+	post.Slug = strings.TrimRight(strings.TrimPrefix(target.Path, prefix), "/")
+	if post.Slug == "" || strings.Contains(post.Slug, "/") {
+		return post, errors.New("target not found")
+	}
+	post, err = post.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			return post, errors.New("target not found")
+		}
+		return post, err
+	}
+	if !post.Published {
+		return post, errors.New("target not found")
+	}
+	return post, nil
+}
+
+// Receive queues verification of a Webmention from source to target. A Webmention which has been
+// received before is verified again, since the source may have been updated or deleted.
+// Returns "webmention invalid" error if source or target is not an absolute http or https URL or
+// they are the same, and "target not found" error if target is not a published post of the site.
+func Receive(source string, target string) (Webmention, error) {
+	defer metrics.Query("Receive", time.Now())
+	var mention Webmention
+	s, err := url.Parse(strings.TrimSpace(source))
+	if err != nil || (s.Scheme != "http" && s.Scheme != "https") || s.Host == "" {
+		return mention, errors.New("webmention invalid")
+	}
+	t, err := url.Parse(strings.TrimSpace(target))
+	if err != nil || (t.Scheme != "http" && t.Scheme != "https") || t.Host == "" {
+		return mention, errors.New("webmention invalid")
+	}
+	if s.String() == t.String() {
+		return mention, errors.New("webmention invalid")
+	}
+	post, err := targetPost(t)
+	if err != nil {
+		return mention, err
+	}
+	now := time.Now().UTC().Unix()
+	err = db.Get(&mention, db.Rebind("SELECT * FROM webmentions WHERE source = ? AND target = ?"), s.String(), t.String())
+	switch {
+	case err == nil:
+		if mention.Status == WebmentionVerified {
+			changed()
+		}
+		mention.Post = post.ID
+		mention.Status = WebmentionPending
+		mention.Attempts = 0
+		mention.LastError = ""
+		mention.NextAttempt = now
+		_, err = db.NamedExec("UPDATE webmentions SET post = :post, status = :status, attempts = :attempts, lasterror = :lasterror, nextattempt = :nextattempt WHERE id = :id", mention)
+	case err.Error() == "sql: no rows in result set":
+		mention = Webmention{
+			Source:      s.String(),
+			Target:      t.String(),
+			Post:        post.ID,
+			Status:      WebmentionPending,
+			Kind:        webmention.KindMention,
+			Created:     now,
+			NextAttempt: now,
+		}
+		_, err = db.NamedExec(`INSERT INTO webmentions (source, target, post, status, kind, authorname, authorurl, authorphoto, content, published, created, verified, attempts, lasterror, nextattempt)
+			VALUES (:source, :target, :post, :status, :kind, :authorname, :authorurl, :authorphoto, :content, :published, :created, :verified, :attempts, :lasterror, :nextattempt)`, mention)
+		if err == nil {
+			err = db.Get(&mention, db.Rebind("SELECT * FROM webmentions WHERE source = ? AND target = ?"), mention.Source, mention.Target)
+		}
+	}
+	if err != nil {
+		return mention, err
+	}
+	metrics.Webmentions.Inc("received", "queued")
+	select {
+	case webmentionReceived <- struct{}{}:
+	default:
+	}
+	return mention, nil
+}
+
+// Get returns Webmention with given mention.ID.
+func (mention Webmention) Get() (Webmention, error) {
+	defer metrics.Query("Webmention.Get", time.Now())
+	err := db.Get(&mention, db.Rebind("SELECT * FROM webmentions WHERE id = ?"), mention.ID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return mention, errors.New("not found")
+		}
+		return mention, err
+	}
+	return mention, nil
+}
+
+// Delete removes Webmention with given mention.ID, for example spam which links to a post.
+func (mention Webmention) Delete() error {
+	defer metrics.Query("Webmention.Delete", time.Now())
+	result, err := db.Exec(db.Rebind("DELETE FROM webmentions WHERE id = ?"), mention.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.New("not found")
+	}
+	changed()
+	return nil
+}
+
+// Webmentions returns received Webmentions with given status, or all of them if status is empty,
+// newest first.
+func Webmentions(status string) ([]Webmention, error) {
+	defer metrics.Query("Webmentions", time.Now())
+	mentions := make([]Webmention, 0)
+	var err error
+	if status == "" {
+		err = db.Select(&mentions, "SELECT * FROM webmentions ORDER BY id DESC")
+	} else {
+		err = db.Select(&mentions, db.Rebind("SELECT * FROM webmentions WHERE status = ? ORDER BY id DESC"), status)
+	}
+	return mentions, err
+}
+
+// Webmentions or post.Webmentions returns verified Webmentions of post in order of verification.
+func (post Post) Webmentions() ([]Webmention, error) {
+	defer metrics.Query("Post.Webmentions", time.Now())
+	mentions := make([]Webmention, 0)
+	err := db.Select(&mentions, db.Rebind("SELECT * FROM webmentions WHERE post = ? AND status = ? ORDER BY verified, id"), post.ID, WebmentionVerified)
+	return mentions, err
+}
+
+// claim reserves mention for this process for a while, see Mail.claim.
+func (mention Webmention) claim(now time.Time) (bool, error) {
+	result, err := db.Exec(db.Rebind("UPDATE webmentions SET nextattempt = ? WHERE id = ? AND status = ? AND nextattempt = ?"),
+		now.Add(10*time.Minute).Unix(), mention.ID, WebmentionPending, mention.NextAttempt)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// verify fetches the source of mention and records the outcome.
+func (mention Webmention) verify(now time.Time) error {
+	mention.Attempts++
+	found, err := webmention.Verify(mention.Source, mention.Target)
+	switch {
+	case err == nil:
+		metrics.Webmentions.Inc("received", "verified")
+		mention.Status = WebmentionVerified
+		mention.Kind = found.Kind
+		mention.AuthorName = found.AuthorName
+		mention.AuthorURL = found.AuthorURL
+		mention.AuthorPhoto = found.AuthorPhoto
+		mention.Content = found.Content
+		mention.Published = found.Published
+		mention.Verified = now.Unix()
+		mention.LastError = ""
+	case err.Error() == "source gone" || err.Error() == "target not linked":
+		metrics.Webmentions.Inc("received", "rejected")
+		mention.Status = WebmentionRejected
+		mention.LastError = err.Error()
+	default:
+		metrics.Webmentions.Inc("received", "failed")
+		mention.LastError = err.Error()
+		mention.NextAttempt = now.Add(retryDelay(mention.Attempts)).Unix()
+		if mention.Attempts >= MaxWebmentionAttempts {
+			mention.Status = WebmentionRejected
+			log.Printf("webmentions: giving up on %s after %d attempts: %v", mention.Source, mention.Attempts, err)
+		}
+	}
+	_, dberr := db.NamedExec(`UPDATE webmentions SET status = :status, kind = :kind, authorname = :authorname, authorurl = :authorurl, authorphoto = :authorphoto,
+		content = :content, published = :published, verified = :verified, attempts = :attempts, lasterror = :lasterror, nextattempt = :nextattempt WHERE id = :id`, mention)
+	if dberr != nil {
+		return dberr
+	}
+	if mention.Status == WebmentionVerified {
+		changed()
+	}
+	return err
+}
+
+// ProcessWebmentions verifies all pending Webmentions which are due and returns the number
+// of Webmentions which were verified.
+func ProcessWebmentions() (int, error) {
+	now := time.Now().UTC()
+	var due []Webmention
+	err := db.Select(&due, db.Rebind("SELECT * FROM webmentions WHERE status = ? AND nextattempt <= ? ORDER BY id"), WebmentionPending, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	verified := 0
+	for _, mention := range due {
+		ok, err := mention.claim(now)
+		if err != nil {
+			return verified, err
+		}
+		if !ok {
+			continue
+		}
+		err = mention.verify(now)
+		if err == nil {
+			verified++
+		}
+	}
+	return verified, nil
+}
+
+// VerifyWebmentions processes pending Webmentions every interval and whenever one is received,
+// until ctx is done.
+func VerifyWebmentions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := ProcessWebmentions()
+		if err != nil {
+			log.Println("webmentions: processing received Webmentions:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webmentionReceived:
+		}
+	}
+}
+
+// SendWebmentions or post.SendWebmentions notifies the pages linked from the content of post
+// which accept Webmentions that the post links to them, and returns the number of Webmentions sent.
+// Links to the site itself and pages without an endpoint are skipped. Every link is tried,
+// and the first failure is returned.
+func (post Post) SendWebmentions() (int, error) {
+	source := postURL(post)
+	site, err := url.Parse(Settings.Hostname)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	var failure error
+	for _, target := range webmention.Links(post.Content, source) {
+		if u, err := url.Parse(target); err != nil || strings.EqualFold(u.Host, site.Host) {
+			continue
+		}
+		endpoint, err := webmention.Discover(target)
+		if err == nil {
+			err = webmention.Send(endpoint, source, target)
+		}
+		if err != nil {
+			if err.Error() == "endpoint not found" {
+				continue
+			}
+			metrics.Webmentions.Inc("sent", "failed")
+			if failure == nil {
+				failure = err
+			}
+			continue
+		}
+		metrics.Webmentions.Inc("sent", "sent")
+		sent++
+	}
+	return sent, failure
+}
@@ -0,0 +1,4 @@
+// Package importer migrates posts from other blogging platforms. Exports are first read into a Site by
+// ReadWordPress, ReadGhost or ReadMarkdown, which Import then writes into the database, or only plans
+// in dry-run mode. HTML bodies are converted to Markdown with Markdown.
+package importer
@@ -0,0 +1,177 @@
+package importer
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	slug "github.com/shurcooL/sanitized_anchor_name"
+)
+
+// ReadMarkdown reads posts from Markdown files with front matter under dir, as used by Jekyll and Hugo.
+// Front matter may be YAML between "---" lines or TOML between "+++" lines. Of it, title, slug, date,
+// lastmod (or updated or last_modified_at), draft, published and author are read; nested values are not supported.
+// Jekyll file names of form YYYY-MM-DD-slug.md give the date and slug, files in _drafts directories are drafts,
+// and Hugo page bundles (slug/index.md) are named after their directory. Hugo list pages (_index.md) are left out.
+// Authors are identified by their names.
+func ReadMarkdown(dir string) (*Site, error) {
+	site := &Site{}
+	authors := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if ext != ".md" && ext != ".markdown" || strings.HasPrefix(name, "_index.") {
+			return nil
+		}
+		post, err := readMarkdownFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		post.Source = filepath.ToSlash(rel)
+		if post.Author != "" && !authors[post.Author] {
+			authors[post.Author] = true
+			site.Authors = append(site.Authors, Author{Login: post.Author, Name: post.Author})
+		}
+		site.Posts = append(site.Posts, *post)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return site, nil
+}
+
+// jekyllName matches Jekyll post file names, which start with the date of the post.
+var jekyllName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
+
+func readMarkdownFile(path string) (*Post, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	matter, body, err := frontMatter(string(data))
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+
+	post := &Post{
+		Title:     matter["title"],
+		Slug:      matter["slug"],
+		Markdown:  strings.TrimSpace(body),
+		Author:    matter["author"],
+		Published: matter["draft"] != "true" && matter["published"] != "false",
+	}
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if stem == "index" {
+		stem = filepath.Base(filepath.Dir(path))
+	}
+	if m := jekyllName.FindStringSubmatch(stem); m != nil {
+		stem = m[2]
+		post.Created = parseTime("2006-01-02", m[1])
+	}
+	for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(path)), "/") {
+		if dir == "_drafts" {
+			post.Published = false
+		}
+	}
+	if date := parseDate(matter["date"]); !date.IsZero() {
+		post.Created = date
+	}
+	for _, key := range []string{"lastmod", "updated", "last_modified_at"} {
+		if date := parseDate(matter[key]); !date.IsZero() {
+			post.Updated = date
+		}
+	}
+	if post.Slug == "" {
+		post.Slug = slug.Create(stem)
+	}
+	if post.Title == "" {
+		post.Title = stem
+	}
+	return post, nil
+}
+
+// frontMatter splits a Markdown file into its front matter and body. Files without front matter
+// have an empty front matter.
+func frontMatter(s string) (map[string]string, string, error) {
+	matter := make(map[string]string)
+	s = strings.TrimPrefix(strings.ReplaceAll(s, "\r\n", "\n"), "\ufeff")
+	delimiter, separator := "---", ":"
+	if strings.HasPrefix(s, "+++\n") {
+		delimiter, separator = "+++", "="
+	} else if !strings.HasPrefix(s, "---\n") {
+		return matter, s, nil
+	}
+	end := strings.Index(s[4:], "\n"+delimiter)
+	if end < 0 {
+		return nil, "", errors.New("front matter not closed")
+	}
+	header, body := s[4:4+end], s[4+end+1+len(delimiter):]
+	scanner := bufio.NewScanner(strings.NewReader(header))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// nested values and list items are indented or start with a dash
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '-' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+		i := strings.Index(line, separator)
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		matter[key] = unquote(strings.TrimSpace(line[i+1:]))
+	}
+	return matter, body, nil
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			if s, err := strconv.Unquote(value); err == nil {
+				return s
+			}
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// dateLayouts lists layouts of dates in front matter, as written by Jekyll and Hugo.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseDate(value string) time.Time {
+	for _, layout := range dateLayouts {
+		if t := parseTime(layout, value); !t.IsZero() {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
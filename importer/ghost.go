@@ -0,0 +1,127 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	slug "github.com/shurcooL/sanitized_anchor_name"
+)
+
+// ghostData is the subset of a Ghost export used by ReadGhost.
+type ghostData struct {
+	Posts []struct {
+		ID          json.RawMessage `json:"id"`
+		Title       string          `json:"title"`
+		Slug        string          `json:"slug"`
+		HTML        string          `json:"html"`
+		Markdown    string          `json:"markdown"`
+		Type        string          `json:"type"`
+		Page        bool            `json:"page"`
+		Status      string          `json:"status"`
+		Author      json.RawMessage `json:"author_id"`
+		CreatedAt   json.RawMessage `json:"created_at"`
+		UpdatedAt   json.RawMessage `json:"updated_at"`
+		PublishedAt json.RawMessage `json:"published_at"`
+	} `json:"posts"`
+	Users []struct {
+		ID    json.RawMessage `json:"id"`
+		Name  string          `json:"name"`
+		Slug  string          `json:"slug"`
+		Email string          `json:"email"`
+	} `json:"users"`
+	PostsAuthors []struct {
+		Post   json.RawMessage `json:"post_id"`
+		Author json.RawMessage `json:"author_id"`
+		Order  int             `json:"sort_order"`
+	} `json:"posts_authors"`
+}
+
+// ReadGhost reads posts and authors from a Ghost JSON export, which Ghost writes from Settings → Labs → Export.
+// Both current exports, which have HTML bodies, and old ones, which have Markdown bodies, are supported.
+// Pages are left out. Published posts stay published and other posts become unpublished posts.
+func ReadGhost(r io.Reader) (*Site, error) {
+	var export struct {
+		DB   []struct{ Data ghostData } `json:"db"`
+		Data *ghostData                 `json:"data"`
+	}
+	err := json.NewDecoder(r).Decode(&export)
+	if err != nil {
+		return nil, errors.New("Ghost export invalid")
+	}
+	data := export.Data
+	if len(export.DB) > 0 {
+		data = &export.DB[0].Data
+	}
+	if data == nil {
+		return nil, errors.New("Ghost export invalid")
+	}
+
+	site := &Site{}
+	for _, user := range data.Users {
+		site.Authors = append(site.Authors, Author{Login: ghostID(user.ID), Name: user.Name, Email: user.Email})
+	}
+	// posts may have many authors, the primary one has the lowest sort order
+	primary := make(map[string]string)
+	order := make(map[string]int)
+	for _, pa := range data.PostsAuthors {
+		post := ghostID(pa.Post)
+		if current, ok := order[post]; !ok || pa.Order < current {
+			primary[post] = ghostID(pa.Author)
+			order[post] = pa.Order
+		}
+	}
+	for _, p := range data.Posts {
+		if p.Page || (p.Type != "" && p.Type != "post") {
+			continue
+		}
+		id := ghostID(p.ID)
+		post := Post{
+			Title:     p.Title,
+			Slug:      p.Slug,
+			Markdown:  p.Markdown,
+			Author:    ghostID(p.Author),
+			Published: p.Status == "published",
+			Source:    "post " + id,
+		}
+		if author, ok := primary[id]; ok {
+			post.Author = author
+		}
+		if post.Markdown == "" {
+			post.Markdown, post.Kept = Markdown(p.HTML)
+		}
+		post.Created = ghostTime(p.PublishedAt, p.CreatedAt)
+		post.Updated = ghostTime(p.UpdatedAt)
+		if post.Slug == "" {
+			post.Slug = slug.Create(post.Title)
+		}
+		site.Posts = append(site.Posts, post)
+	}
+	return site, nil
+}
+
+// ghostID returns an ID of a Ghost export as a string. Old exports have numeric IDs and new ones strings.
+func ghostID(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
+
+// ghostTime parses the first of values which is a valid time. Old exports have
+// times as milliseconds since epoch and new ones as RFC 3339 strings.
+func ghostTime(values ...json.RawMessage) time.Time {
+	for _, raw := range values {
+		if ms, err := strconv.ParseInt(string(raw), 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+		}
+		value := ghostID(raw)
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t.UTC()
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,211 @@
+package importer
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/toldjuuso/vertigo/databases/sqlx"
+)
+
+// Site holds posts and their authors read from an export of another platform.
+type Site struct {
+	Authors []Author
+	Posts   []Post
+}
+
+// Author is an author of posts on another platform. Login identifies the author within the export.
+type Author struct {
+	Login string
+	Name  string
+	Email string
+}
+
+// Post is a post on another platform. Author refers to Author.Login.
+type Post struct {
+	Title     string
+	Slug      string
+	Markdown  string
+	Author    string
+	Created   time.Time
+	Updated   time.Time
+	Published bool
+	// Source identifies the post in the export for reporting, such as a file name or an ID.
+	Source string
+	// Kept lists HTML elements which could not be converted to Markdown.
+	Kept []string
+}
+
+// Options controls how Import maps authors to users. Authors are matched to existing users by
+// email address, or by name if the export has no email addresses.
+type Options struct {
+	// DryRun reports what would be imported without writing anything.
+	DryRun bool
+	// Author is email address of the user who is given posts of unknown authors.
+	Author string
+	// CreateAuthors creates users for authors which do not match existing users by email address.
+	// The users are given random passwords, so they have to recover their passwords to log in.
+	CreateAuthors bool
+}
+
+// Report lists what Import did, or would do in dry-run mode.
+type Report struct {
+	DryRun  bool
+	Authors []AuthorResult
+	Posts   []PostResult
+}
+
+// AuthorResult tells which user an author of the export is mapped to.
+type AuthorResult struct {
+	Author Author
+	User   string
+	// Action is "match" for existing users, "create" for new users and "default" for Options.Author.
+	Action string
+}
+
+// PostResult tells what happened to a post of the export.
+type PostResult struct {
+	Post Post
+	User string
+	// Action is "create" or "skip". Reason explains skipped posts.
+	Action string
+	Reason string
+}
+
+// Counts returns the number of created and skipped posts in the report.
+func (report *Report) Counts() (created, skipped int) {
+	for _, result := range report.Posts {
+		if result.Action == "create" {
+			created++
+		} else {
+			skipped++
+		}
+	}
+	return created, skipped
+}
+
+// Import writes posts of site into the database according to options.
+// Posts keep their slugs and dates. Posts whose slugs are already taken are skipped.
+func Import(site *Site, options Options) (*Report, error) {
+	report := &Report{DryRun: options.DryRun}
+
+	var user sqlx.User
+	users, err := user.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	byEmail := make(map[string]sqlx.User)
+	byName := make(map[string]sqlx.User)
+	for _, user := range users {
+		byEmail[strings.ToLower(user.Email)] = user
+		byName[strings.ToLower(user.Name)] = user
+	}
+	var fallback *sqlx.User
+	if options.Author != "" {
+		user, ok := byEmail[strings.ToLower(options.Author)]
+		if !ok {
+			return nil, errors.New("author not found")
+		}
+		fallback = &user
+	}
+
+	authors := make(map[string]sqlx.User)
+	for _, author := range site.Authors {
+		result := AuthorResult{Author: author}
+		user, ok := byEmail[strings.ToLower(author.Email)]
+		if author.Email == "" {
+			user, ok = byName[strings.ToLower(author.Name)]
+		}
+		switch {
+		case ok && author.Name+author.Email != "":
+			result.Action = "match"
+		case options.CreateAuthors && author.Email != "":
+			result.Action = "create"
+			user = sqlx.User{Name: author.Name, Email: author.Email, Password: uuid.New(), Location: "UTC", Role: sqlx.RoleAuthor, Verified: true}
+			if user.Name == "" {
+				user.Name = author.Login
+			}
+			if !options.DryRun {
+				_, err = user.Insert()
+				if err != nil {
+					return report, err
+				}
+				user, err = user.GetByEmail()
+				if err != nil {
+					return report, err
+				}
+			}
+			byEmail[strings.ToLower(author.Email)] = user
+		case fallback != nil:
+			result.Action = "default"
+			user = *fallback
+		default:
+			report.Authors = append(report.Authors, result)
+			continue
+		}
+		result.User = user.Email
+		authors[author.Login] = user
+		report.Authors = append(report.Authors, result)
+	}
+
+	slugs := make(map[string]bool)
+	for _, post := range site.Posts {
+		result := PostResult{Post: post, Action: "skip"}
+		user, ok := authors[post.Author]
+		if !ok && fallback != nil {
+			user, ok = *fallback, true
+		}
+		switch {
+		case !ok:
+			result.Reason = "author has no user, see -author"
+		case strings.TrimSpace(post.Title) == "":
+			result.Reason = "title missing"
+		case slugs[post.Slug]:
+			result.Reason = "slug repeated in export"
+		}
+		if result.Reason != "" {
+			report.Posts = append(report.Posts, result)
+			continue
+		}
+		result.User = user.Email
+		slugs[post.Slug] = true
+
+		entry := sqlx.Post{
+			Title:     post.Title,
+			Slug:      post.Slug,
+			Markdown:  post.Markdown,
+			Created:   unix(post.Created),
+			Updated:   unix(post.Updated),
+			Published: post.Published,
+		}
+		if options.DryRun {
+			existing, err := sqlx.Post{Slug: post.Slug}.Get()
+			if err == nil && existing.ID != 0 {
+				result.Reason = "slug exists"
+			} else if err != nil && err.Error() != "not found" {
+				return report, err
+			}
+		} else {
+			_, err = entry.Import(user)
+			if err != nil {
+				if err.Error() != "post slug exists" {
+					return report, err
+				}
+				result.Reason = "slug exists"
+			}
+		}
+		if result.Reason == "" {
+			result.Action = "create"
+		}
+		report.Posts = append(report.Posts, result)
+	}
+	return report, nil
+}
+
+func unix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UTC().Unix()
+}
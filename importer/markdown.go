@@ -0,0 +1,302 @@
+package importer
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Markdown converts HTML to Markdown. Elements which have no Markdown equivalent, such as tables
+// and embedded media, are kept as HTML, which Markdown allows. Their names are returned, so they
+// can be reported for review.
+func Markdown(s string) (string, []string) {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(s), context)
+	if err != nil {
+		return s, []string{"document"}
+	}
+	for _, n := range nodes {
+		context.AppendChild(n)
+	}
+	c := converter{kept: make(map[string]bool)}
+	text := strings.TrimSpace(c.blocks(context))
+	var kept []string
+	for name := range c.kept {
+		kept = append(kept, name)
+	}
+	sort.Strings(kept)
+	return text, kept
+}
+
+type converter struct {
+	kept map[string]bool
+}
+
+// raw lists elements which are kept as HTML.
+var raw = map[atom.Atom]bool{
+	atom.Table: true, atom.Iframe: true, atom.Video: true, atom.Audio: true, atom.Object: true,
+	atom.Embed: true, atom.Form: true, atom.Details: true, atom.Dl: true, atom.Sup: true, atom.Sub: true,
+}
+
+// dropped lists elements which are left out with their contents.
+var dropped = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Head: true, atom.Title: true,
+}
+
+// block lists elements which start a new block.
+var block = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true,
+	atom.Aside: true, atom.Nav: true, atom.Figure: true, atom.Figcaption: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Blockquote: true, atom.Ul: true, atom.Ol: true, atom.Li: true, atom.Pre: true, atom.Hr: true,
+	atom.Table: true, atom.Iframe: true, atom.Video: true, atom.Audio: true, atom.Object: true,
+	atom.Embed: true, atom.Form: true, atom.Details: true, atom.Dl: true, atom.Body: true, atom.Html: true,
+}
+
+// blocks converts children of n to Markdown blocks separated by blank lines.
+// Consecutive inline children are joined into a paragraph.
+func (c converter) blocks(n *html.Node) string {
+	var out []string
+	var paragraph strings.Builder
+	flush := func() {
+		if text := tidy(paragraph.String()); text != "" {
+			out = append(out, text)
+		}
+		paragraph.Reset()
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && block[child.DataAtom] {
+			flush()
+			if text := c.block(child); strings.TrimSpace(text) != "" {
+				out = append(out, text)
+			}
+			continue
+		}
+		paragraph.WriteString(c.inline(child))
+	}
+	flush()
+	return strings.Join(out, "\n\n")
+}
+
+func (c converter) block(n *html.Node) string {
+	if raw[n.DataAtom] {
+		return c.keep(n)
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Figcaption:
+		return c.blocks(n)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		return strings.Repeat("#", level) + " " + strings.ReplaceAll(tidy(c.children(n)), "\\\n", " ")
+	case atom.Blockquote:
+		return prefix(c.blocks(n), "> ", "> ")
+	case atom.Ul, atom.Ol:
+		return c.list(n)
+	case atom.Li:
+		return prefix(c.blocks(n), "- ", "  ")
+	case atom.Pre:
+		return c.pre(n)
+	case atom.Hr:
+		return "* * *"
+	}
+	return c.blocks(n)
+}
+
+func (c converter) list(n *html.Node) string {
+	var items []string
+	number := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		number = start
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode {
+			continue
+		}
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		items = append(items, prefix(c.blocks(child), marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+func (c converter) pre(n *html.Node) string {
+	language := ""
+	code := n
+	if n.FirstChild != nil && n.FirstChild == n.LastChild && n.FirstChild.DataAtom == atom.Code {
+		code = n.FirstChild
+		for _, class := range strings.Fields(attr(code, "class")) {
+			if strings.HasPrefix(class, "language-") {
+				language = strings.TrimPrefix(class, "language-")
+			}
+		}
+	}
+	text := strings.TrimRight(textContent(code), "\n")
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + text + "\n" + fence
+}
+
+// inline converts n to Markdown inline content.
+func (c converter) inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return escape(whitespace.ReplaceAllString(n.Data, " "))
+	case html.ElementNode:
+	default:
+		return ""
+	}
+	if dropped[n.DataAtom] {
+		return ""
+	}
+	if raw[n.DataAtom] {
+		return c.keep(n)
+	}
+	switch n.DataAtom {
+	case atom.Strong, atom.B:
+		return wrap(c.children(n), "**")
+	case atom.Em, atom.I, atom.Cite:
+		return wrap(c.children(n), "*")
+	case atom.Del, atom.S, atom.Strike:
+		return wrap(c.children(n), "~~")
+	case atom.Code, atom.Kbd, atom.Samp:
+		text := textContent(n)
+		fence := "`"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+			text = " " + text + " "
+		}
+		return fence + text + fence
+	case atom.A:
+		text := strings.TrimSpace(c.children(n))
+		href := attr(n, "href")
+		if href == "" {
+			return text
+		}
+		if title := attr(n, "title"); title != "" {
+			return "[" + text + "](" + destination(href) + " \"" + strings.ReplaceAll(title, `"`, `\"`) + "\")"
+		}
+		return "[" + text + "](" + destination(href) + ")"
+	case atom.Img:
+		return "![" + escape(attr(n, "alt")) + "](" + destination(attr(n, "src")) + ")"
+	case atom.Br:
+		return "\\\n"
+	}
+	return c.children(n)
+}
+
+func (c converter) children(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.ElementNode && block[child.DataAtom] {
+			// block inside inline content, such as a div in a link, is flattened
+			b.WriteString(" " + c.blocks(child) + " ")
+			continue
+		}
+		b.WriteString(c.inline(child))
+	}
+	return b.String()
+}
+
+// keep renders n as HTML and records its name.
+func (c converter) keep(n *html.Node) string {
+	c.kept[n.Data] = true
+	var buf bytes.Buffer
+	html.Render(&buf, n)
+	return buf.String()
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+var escaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", "&lt;")
+
+// escape escapes characters which Markdown would interpret in text.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// tidy trims spaces around line breaks and at both ends of inline content, and escapes
+// characters which would start a block at the beginning of a line.
+func tidy(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(whitespace.ReplaceAllString(line, " "))
+		if blockStart.MatchString(line) {
+			line = `\` + line
+		}
+		lines[i] = line
+	}
+	return strings.TrimSuffix(strings.TrimSpace(strings.Join(lines, "\n")), "\\")
+}
+
+var blockStart = regexp.MustCompile(`^(#|>|[-+] |\d+[.)] )`)
+
+// wrap surrounds s with emphasis marker, keeping surrounding whitespace outside of it.
+func wrap(s, marker string) string {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return s
+	}
+	start := s[:strings.Index(s, trimmed)]
+	end := s[len(start)+len(trimmed):]
+	return start + marker + trimmed + marker + end
+}
+
+// prefix prefixes the first line of s with first and the rest of non-empty lines with rest.
+func prefix(s, first, rest string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			lines[i] = first + line
+		case line != "":
+			lines[i] = rest + line
+		case strings.TrimSpace(rest) != "":
+			lines[i] = strings.TrimSpace(rest)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// destination returns URL suitable for a Markdown link.
+func destination(url string) string {
+	if strings.ContainsAny(url, " ()") {
+		return "<" + url + ">"
+	}
+	return url
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.DataAtom == atom.Br {
+			b.WriteString("\n")
+			continue
+		}
+		b.WriteString(textContent(child))
+	}
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package importer
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	slug "github.com/shurcooL/sanitized_anchor_name"
+)
+
+// wxr is the subset of WordPress eXtended RSS used by ReadWordPress.
+type wxr struct {
+	Authors []struct {
+		Login       string `xml:"author_login"`
+		Email       string `xml:"author_email"`
+		DisplayName string `xml:"author_display_name"`
+	} `xml:"channel>author"`
+	Items []struct {
+		Title       string `xml:"title"`
+		Creator     string `xml:"creator"`
+		Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+		ID          string `xml:"post_id"`
+		Name        string `xml:"post_name"`
+		Type        string `xml:"post_type"`
+		Status      string `xml:"status"`
+		DateGMT     string `xml:"post_date_gmt"`
+		Date        string `xml:"post_date"`
+		ModifiedGMT string `xml:"post_modified_gmt"`
+	} `xml:"channel>item"`
+}
+
+// wordpressTime is the layout of dates in WXR files.
+const wordpressTime = "2006-01-02 15:04:05"
+
+// ReadWordPress reads posts and authors from a WordPress eXtended RSS (WXR) export, which WordPress
+// writes from Tools → Export. Pages, attachments and trashed posts are left out. Published posts
+// stay published and drafts become unpublished posts.
+func ReadWordPress(r io.Reader) (*Site, error) {
+	var export wxr
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	err := decoder.Decode(&export)
+	if err != nil {
+		return nil, errors.New("WordPress export invalid")
+	}
+	site := &Site{}
+	for _, author := range export.Authors {
+		site.Authors = append(site.Authors, Author{Login: author.Login, Name: author.DisplayName, Email: author.Email})
+	}
+	for _, item := range export.Items {
+		if item.Type != "post" || item.Status == "trash" || item.Status == "auto-draft" {
+			continue
+		}
+		markdown, kept := Markdown(autop(item.Content))
+		post := Post{
+			Title:     item.Title,
+			Slug:      item.Name,
+			Markdown:  markdown,
+			Author:    item.Creator,
+			Published: item.Status == "publish",
+			Source:    "post " + item.ID,
+			Kept:      kept,
+		}
+		// drafts have zero GMT dates, their local dates are used instead
+		post.Created = parseTime(wordpressTime, item.DateGMT, item.Date)
+		post.Updated = parseTime(wordpressTime, item.ModifiedGMT)
+		if post.Slug == "" {
+			post.Slug = slug.Create(post.Title)
+		}
+		site.Posts = append(site.Posts, post)
+	}
+	return site, nil
+}
+
+var (
+	paragraphs = regexp.MustCompile(`\n\s*\n`)
+	blockTag   = regexp.MustCompile(`(?i)<(p|div|h[1-6]|ul|ol|li|blockquote|pre|table|figure|hr)[\s>/]`)
+	blockEdge  = regexp.MustCompile(`(?i)^</?(p|div|h[1-6]|ul|ol|li|blockquote|pre|table|figure|hr|!--)`)
+)
+
+// autop adds paragraphs to content written in the classic WordPress editor, which stores
+// paragraphs as blank lines and line breaks as newlines, like WordPress does when displaying it.
+// Content of the block editor has paragraph tags already and is returned as is.
+func autop(content string) string {
+	if strings.Contains(content, "<p>") || strings.Contains(content, "<p ") {
+		return content
+	}
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	var out []string
+	for _, chunk := range paragraphs.Split(strings.TrimSpace(content), -1) {
+		if blockEdge.MatchString(chunk) || blockTag.MatchString(chunk) && strings.HasPrefix(chunk, "<") {
+			out = append(out, chunk)
+			continue
+		}
+		out = append(out, "<p>"+strings.ReplaceAll(chunk, "\n", "<br>\n")+"</p>")
+	}
+	return strings.Join(out, "\n")
+}
+
+// parseTime parses the first of values which is a valid time in layout, as UTC.
+// Returns zero time if none are.
+func parseTime(layout string, values ...string) time.Time {
+	for _, value := range values {
+		t, err := time.Parse(layout, strings.TrimSpace(value))
+		if err == nil && t.Year() > 1 {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,3 @@
+// Package indieauth verifies access tokens issued by an IndieAuth token endpoint, so that
+// people can sign in to Micropub clients with the address of their site.
+package indieauth
@@ -0,0 +1,93 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Token is the verified information of an access token.
+type Token struct {
+	// Me is the URL of the person the token was issued to.
+	Me       string `json:"me"`
+	ClientID string `json:"client_id"`
+	// Scope is a space separated list of scopes granted to the client.
+	Scope string `json:"scope"`
+}
+
+// HasScope reports whether the token has been given scope.
+func (token Token) HasScope(scope string) bool {
+	for _, s := range strings.Fields(token.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Client sends verification requests to token endpoints.
+var Client = &http.Client{Timeout: 10 * time.Second}
+
+// Verify asks token endpoint about token, as described in the IndieAuth specification.
+// Returns "token invalid" error if the endpoint rejects the token or does not tell whom it belongs to.
+func Verify(endpoint string, token string) (Token, error) {
+	var result Token
+	request, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return result, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Accept", "application/json")
+	response, err := Client.Do(request)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	body := io.LimitReader(response.Body, 1<<16)
+	switch {
+	case response.StatusCode == 400 || response.StatusCode == 401 || response.StatusCode == 403:
+		return result, errors.New("token invalid")
+	case response.StatusCode != 200:
+		return result, fmt.Errorf("token endpoint responded %s", response.Status)
+	}
+	// some endpoints answer with a form encoded body despite the Accept header
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return result, err
+		}
+		values, err := url.ParseQuery(string(b))
+		if err != nil {
+			return result, err
+		}
+		result = Token{Me: values.Get("me"), ClientID: values.Get("client_id"), Scope: values.Get("scope")}
+	} else {
+		err = json.NewDecoder(body).Decode(&result)
+		if err != nil {
+			return result, err
+		}
+	}
+	if result.Me == "" {
+		return result, errors.New("token invalid")
+	}
+	return result, nil
+}
+
+// SameSite reports whether profile URL me is the site at hostname, ignoring the scheme,
+// trailing slashes and letter case of the host.
+func SameSite(me string, hostname string) bool {
+	a, err := url.Parse(strings.TrimSpace(me))
+	if err != nil || a.Host == "" {
+		return false
+	}
+	b, err := url.Parse(strings.TrimSpace(hostname))
+	if err != nil || b.Host == "" {
+		return false
+	}
+	return strings.EqualFold(a.Host, b.Host) && strings.TrimRight(a.Path, "/") == strings.TrimRight(b.Path, "/")
+}
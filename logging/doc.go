@@ -0,0 +1,3 @@
+// Package logging sets up structured, leveled logging and tags requests with IDs,
+// so all log lines written while serving a request can be found together.
+package logging
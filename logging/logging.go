@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/toldjuuso/vertigo/config"
+)
+
+// Redacted replaces values of redacted attributes.
+const Redacted = "[REDACTED]"
+
+var email = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// New returns a logger writing to w in the format and level given in c.
+// Attributes named in c.RedactKeys are replaced with Redacted and, if c.RedactEmails is set,
+// email addresses in messages and attribute values are masked.
+func New(w io.Writer, c config.Log) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Level))
+	if err != nil {
+		return nil, errors.New("log level invalid")
+	}
+
+	keys := make(map[string]bool)
+	for _, key := range strings.Split(c.RedactKeys, ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			keys[key] = true
+		}
+	}
+
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if keys[strings.ToLower(a.Key)] {
+				return slog.String(a.Key, Redacted)
+			}
+			if !c.RedactEmails {
+				return a
+			}
+			switch v := a.Value.Resolve(); {
+			case v.Kind() == slog.KindString:
+				return slog.String(a.Key, MaskEmails(v.String()))
+			case v.Kind() == slog.KindAny:
+				if err, ok := v.Any().(error); ok {
+					return slog.String(a.Key, MaskEmails(err.Error()))
+				}
+			}
+			return a
+		},
+	}
+
+	switch c.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	case "text", "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	}
+	return nil, errors.New("log format invalid")
+}
+
+// Setup makes a logger configured according to c the default logger. Output of the standard
+// log package is written through it as well, at info level.
+func Setup(w io.Writer, c config.Log) error {
+	logger, err := New(w, c)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// MaskEmails replaces the local part of email addresses in s, keeping the domain for debugging.
+func MaskEmails(s string) string {
+	return email.ReplaceAllStringFunc(s, func(address string) string {
+		return "***" + address[strings.LastIndex(address, "@"):]
+	})
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Header is the HTTP header which carries request IDs.
+const Header = "X-Request-ID"
+
+type contextKey struct{}
+
+// valid matches request IDs accepted from clients and proxies.
+var valid = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ID returns the request ID stored in ctx, or an empty string.
+func ID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Request returns the default logger with the ID of r attached.
+func Request(r *http.Request) *slog.Logger {
+	if id := ID(r.Context()); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// responseRecorder remembers status code and size of the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Middleware tags every request with an ID, which is taken from X-Request-ID request header
+// if it is present and well-formed, or generated otherwise. The ID is returned in X-Request-ID
+// response header and attached to loggers returned by Request.
+// If access is set, every request is logged after it has been served. Query strings are left out,
+// since they may contain secrets.
+func Middleware(access bool, next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid.MatchString(id) {
+			id = newID()
+		}
+		w.Header().Set(Header, id)
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, id))
+
+		if !access {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		Request(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"size", recorder.size,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	}
+	return http.HandlerFunc(fn)
+}
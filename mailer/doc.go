@@ -0,0 +1,10 @@
+// Package mailer delivers email messages.
+//
+// Mailer is implemented by SMTP, which sends messages to an SMTP server, Sendmail, which pipes
+// them to a sendmail compatible program, and File and Log, which keep messages on disk or in the
+// log instead of sending them, for development. Messages are queued in the outbox of package
+// sqlx and delivered in the background, so a slow or failing mail server does not fail requests.
+//
+// Messages are rendered from templates of the theme, see Template, and have an HTML body
+// in addition to the plain text one when the template has one.
+package mailer
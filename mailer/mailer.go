@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is an email message with a plain text body and an optional HTML body.
+// Unsubscribe is the address of a one-click unsubscription link for mailing lists, see RFC 8058.
+type Message struct {
+	From        mail.Address
+	To          mail.Address
+	Subject     string
+	Body        string
+	HTML        string
+	Unsubscribe string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(message Message) error
+}
+
+// Bytes returns message in MIME format. Bodies are encoded as quoted-printable, and a message
+// with an HTML body is sent as multipart/alternative with the plain text body first.
+func (message Message) Bytes() []byte {
+	var buf bytes.Buffer
+	header := [][2]string{
+		{"From", message.From.String()},
+		{"To", message.To.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", message.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID(message.From.Address)},
+		{"MIME-Version", "1.0"},
+	}
+	if message.Unsubscribe != "" {
+		header = append(header,
+			[2]string{"List-Unsubscribe", "<" + message.Unsubscribe + ">"},
+			[2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	for _, field := range header {
+		fmt.Fprintf(&buf, "%s: %s\r\n", field[0], field[1])
+	}
+	if message.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&buf, message.Body)
+		return buf.Bytes()
+	}
+	parts := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+	for _, part := range [][2]string{{"text/plain", message.Body}, {"text/html", message.HTML}} {
+		w, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + `; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		writeQuotedPrintable(w, part[1])
+	}
+	parts.Close()
+	return buf.Bytes()
+}
+
+// writeQuotedPrintable writes s into w in quoted-printable encoding with CRLF line endings.
+func writeQuotedPrintable(w io.Writer, s string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")))
+	qp.Close()
+}
+
+// messageID returns a unique Message-ID in the domain of sender address.
+func messageID(sender string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(sender, "@"); i >= 0 {
+		domain = sender[i+1:]
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// SMTP sends messages to an SMTP server, authenticating with Login and Password if Login is set.
+type SMTP struct {
+	Hostname string
+	Port     int
+	Login    string
+	Password string
+}
+
+// Send sends message.
+func (s SMTP) Send(message Message) error {
+	if s.Hostname == "" {
+		return errors.New("smtp hostname not set")
+	}
+	var auth smtp.Auth
+	if s.Login != "" {
+		auth = smtp.PlainAuth("", s.Login, s.Password, s.Hostname)
+	}
+	return smtp.SendMail(fmt.Sprintf("%s:%d", s.Hostname, s.Port), auth, message.From.Address, []string{message.To.Address}, message.Bytes())
+}
+
+// Sendmail pipes messages to a sendmail compatible program at Path, such as /usr/sbin/sendmail.
+type Sendmail struct {
+	Path string
+}
+
+// Send sends message.
+func (s Sendmail) Send(message Message) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(s.Path, "-i", "-f", message.From.Address, "--", message.To.Address)
+	cmd.Stdin = bytes.NewReader(message.Bytes())
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", s.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// File writes messages into Directory as .eml files instead of sending them.
+type File struct {
+	Directory string
+}
+
+// Send writes message into a new file.
+func (f File) Send(message Message) error {
+	err := os.MkdirAll(f.Directory, 0755)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(b))
+	return os.WriteFile(filepath.Join(f.Directory, name), message.Bytes(), 0644)
+}
+
+// Log logs messages instead of sending them.
+type Log struct{}
+
+// Send logs message.
+func (Log) Send(message Message) error {
+	log.Printf("mailer: to %s, subject %q:\n%s", message.To.String(), message.Subject, message.Body)
+	return nil
+}
@@ -0,0 +1,141 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Names lists the email templates the application sends.
+var Names = []string{"recovery", "verification", "welcome", "subscription", "newsletter", "digest", "comment"}
+
+// Templates returns the file system email templates are read from: "email/<name>.txt" holds
+// the subject and plain text body of an email, "email/<name>.html" its optional HTML body,
+// and "email/layout.html" the document around HTML bodies.
+var Templates = func() fs.FS {
+	return os.DirFS("templates")
+}
+
+// Template holds sources of an email template. Subject and Text are text/template templates
+// and HTML is an html/template template rendered inside the layout.
+type Template struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// Load reads template with given name from Templates. The text file starts with a "Subject:" line,
+// followed by an empty line and the body, like an email. Returns "not found" error if there is no
+// text file for name.
+func Load(name string) (Template, error) {
+	t := Template{Name: name}
+	if !Known(name) {
+		return t, errors.New("not found")
+	}
+	data, err := fs.ReadFile(Templates(), path.Join("email", name+".txt"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return t, errors.New("not found")
+		}
+		return t, err
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if strings.HasPrefix(text, "Subject:") {
+		header, body, _ := strings.Cut(text, "\n")
+		t.Subject = strings.TrimSpace(strings.TrimPrefix(header, "Subject:"))
+		text = strings.TrimPrefix(body, "\n")
+	}
+	t.Text = text
+	data, err = fs.ReadFile(Templates(), path.Join("email", name+".html"))
+	if err == nil {
+		t.HTML = string(data)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return t, err
+	}
+	return t, nil
+}
+
+// Known reports whether name is listed in Names.
+func Known(name string) bool {
+	for _, n := range Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse checks that all parts of t are valid templates.
+func (t Template) Parse() error {
+	_, err := template.New("subject").Parse(t.Subject)
+	if err != nil {
+		return err
+	}
+	_, err = template.New("text").Parse(t.Text)
+	if err != nil {
+		return err
+	}
+	_, err = t.html()
+	return err
+}
+
+func (t Template) html() (*htmltemplate.Template, error) {
+	layout := `{{template "content" .}}`
+	data, err := fs.ReadFile(Templates(), "email/layout.html")
+	if err == nil {
+		layout = string(data)
+	}
+	tmpl, err := htmltemplate.New("layout").Parse(layout)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.New("content").Parse(t.HTML)
+}
+
+// Render executes t with data and returns a message with its subject and bodies.
+// The message is left without an HTML body if t has none.
+func (t Template) Render(data interface{}) (Message, error) {
+	var message Message
+	var buf bytes.Buffer
+	subject, err := template.New("subject").Parse(t.Subject)
+	if err != nil {
+		return message, err
+	}
+	err = subject.Execute(&buf, data)
+	if err != nil {
+		return message, err
+	}
+	message.Subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	text, err := template.New("text").Parse(t.Text)
+	if err != nil {
+		return message, err
+	}
+	err = text.Execute(&buf, data)
+	if err != nil {
+		return message, err
+	}
+	message.Body = buf.String()
+
+	if strings.TrimSpace(t.HTML) == "" {
+		return message, nil
+	}
+	buf.Reset()
+	html, err := t.html()
+	if err != nil {
+		return message, err
+	}
+	err = html.ExecuteTemplate(&buf, "layout", data)
+	if err != nil {
+		return message, err
+	}
+	message.HTML = buf.String()
+	return message, nil
+}
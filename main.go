@@ -1,18 +1,29 @@
 package main
 
 import (
+	"embed"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
+	"github.com/toldjuuso/vertigo/activitypub"
+	"github.com/toldjuuso/vertigo/backup"
+	"github.com/toldjuuso/vertigo/cache"
+	"github.com/toldjuuso/vertigo/config"
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/mailer"
+	"github.com/toldjuuso/vertigo/metrics"
 	"github.com/toldjuuso/vertigo/render"
 	. "github.com/toldjuuso/vertigo/routes"
+	"github.com/toldjuuso/vertigo/sanitize"
 	. "github.com/toldjuuso/vertigo/session"
+	"github.com/toldjuuso/vertigo/webmention"
 
 	"github.com/gorilla/context"
 	"github.com/gorilla/sessions"
@@ -20,7 +31,134 @@ import (
 	"github.com/justinas/alice"
 )
 
-var Store = sessions.NewCookieStore([]byte(Settings.CookieHash))
+var Store *sessions.CookieStore
+
+// conf is the configuration the server was set up with.
+var conf = config.Default()
+
+// Default templates and static files are compiled into the binary, so it can be run from any directory.
+// Files in "templates" and "static" directories of the working directory take precedence over them.
+//
+//go:embed templates
+var templates embed.FS
+
+//go:embed static
+var static embed.FS
+
+func init() {
+	t, err := fs.Sub(templates, "templates")
+	if err != nil {
+		log.Fatal("embedded templates:", err)
+	}
+	s, err := fs.Sub(static, "static")
+	if err != nil {
+		log.Fatal("embedded static files:", err)
+	}
+	render.DefaultTemplates = render.Overlay(os.DirFS("templates"), t)
+	render.DefaultStatic = render.Overlay(os.DirFS("static"), s)
+}
+
+// setup connects to the database and prepares templates and session store according to c.
+func setup(c *config.Config) error {
+	conf = c
+
+	setupSanitize(c.Sanitize)
+	err := Connect(c.Database.Driver, c.Database.Source)
+	if err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+
+	setupMailer(c.Mailer)
+	mailer.Templates = func() fs.FS {
+		return render.Current().Templates()
+	}
+	if c.Theme != "" {
+		Settings.Theme = c.Theme
+	}
+
+	render.Development = c.Development
+	// sites under development link to each other on the local network
+	webmention.AllowPrivate = c.Development
+	activitypub.AllowPrivate = c.Development
+	setupFeatures(c.Features)
+	MicropubConfig = c.Micropub
+	backup.MediaDirectory = c.Micropub.Media
+	render.Endpoints["token_endpoint"] = c.Micropub.TokenEndpoint
+	render.Endpoints["authorization_endpoint"] = c.Micropub.AuthorizationEndpoint
+	err = render.Load(Settings.Theme)
+	if err != nil {
+		if c.Theme != "" {
+			return fmt.Errorf("theme %s: %v", c.Theme, err)
+		}
+		log.Println("could not load theme", Settings.Theme+":", err)
+		err = render.Load(render.DefaultTheme)
+		if err != nil {
+			return fmt.Errorf("default theme: %v", err)
+		}
+	}
+
+	secret := Settings.CookieHash
+	if c.Cookie.Secret != "" {
+		secret = c.Cookie.Secret
+	}
+	Store = sessions.NewCookieStore([]byte(secret))
+	Store.Options = &sessions.Options{
+		Path:     "/",
+		Domain:   c.Cookie.Domain,
+		MaxAge:   c.Cookie.MaxAge,
+		Secure:   c.Cookie.Secure || c.TLS.Enabled(),
+		HttpOnly: true,
+	}
+	return nil
+}
+
+// setupFeatures tells templates and routes which optional features are enabled.
+func setupFeatures(c config.Features) {
+	render.Features["search"] = c.Search
+	render.Features["feeds"] = c.Feeds
+	render.Features["newsletter"] = c.Newsletter
+	render.Features["micropub"] = c.Micropub
+	render.Features["webmention"] = c.Webmention
+	render.Features["activitypub"] = c.ActivityPub
+	render.Features["accounts"] = true
+}
+
+// setupMailer overrides mailer settings of the site with configured ones and selects the transport
+// of the outbox. SMTP uses the mailer settings of the site.
+func setupMailer(c config.Mailer) {
+	if c.Hostname != "" {
+		Settings.MailerHostname = c.Hostname
+	}
+	if c.Port != 0 {
+		Settings.MailerPort = c.Port
+	}
+	if c.Login != "" {
+		Settings.MailerLogin = c.Login
+	}
+	if c.Password != "" {
+		Settings.MailerPassword = c.Password
+	}
+	MailFrom = c.From
+	switch c.Transport {
+	case "sendmail":
+		Mailer = mailer.Sendmail{Path: c.Sendmail}
+	case "file":
+		Mailer = mailer.File{Directory: c.Directory}
+	case "log":
+		Mailer = mailer.Log{}
+	default:
+		Mailer = nil
+	}
+}
+
+// setupSanitize sets the sanitization policies of user roles. Migrations sanitize posts,
+// so it has to be called before connecting to the database.
+func setupSanitize(c config.Sanitize) {
+	sanitize.Roles = map[string]*sanitize.Policy{
+		RoleAdmin:  sanitize.Policies[c.Admin],
+		RoleAuthor: sanitize.Policies[c.Author],
+	}
+}
 
 func session(next http.Handler) http.Handler {
 
@@ -58,6 +196,8 @@ func bindPost(next http.Handler) http.Handler {
 		var post Post
 		post.Title = title
 		post.Markdown = r.PostFormValue("markdown")
+		post.Description = strings.TrimSpace(r.PostFormValue("description"))
+		post.Image = strings.TrimSpace(r.PostFormValue("image"))
 		context.Set(r, "post", post)
 		next.ServeHTTP(w, r)
 	}
@@ -159,6 +299,7 @@ func bindSettings(next http.Handler) http.Handler {
 		settings.MailerLogin = r.PostFormValue("mailerlogin")
 		settings.MailerPassword = r.PostFormValue("mailerpassword")
 		settings.MailerHostname = r.PostFormValue("mailerhostname")
+		settings.Theme = r.PostFormValue("theme")
 		context.Set(r, "settings", settings)
 		next.ServeHTTP(w, r)
 	}
@@ -202,6 +343,7 @@ func bindUser(next http.Handler) http.Handler {
 		user.Location = r.PostFormValue("location")
 		user.Name = r.PostFormValue("name")
 		user.Recovery = r.PostFormValue("recovery")
+		user.Invitation = r.PostFormValue("invitation")
 		context.Set(r, "user", user)
 		next.ServeHTTP(w, r)
 	}
@@ -246,14 +388,18 @@ func bindReset(next http.Handler) http.Handler {
 }
 
 func staticFile(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, "static/"+r.URL.Path[1:])
+	serveStatic(w, r, r.URL.Path)
 }
 
 func staticResource(w http.ResponseWriter, r *http.Request) {
-	file := r.URL.Path
-	s := http.Dir("static")
+	serveStatic(w, r, strings.TrimPrefix(r.URL.Path, "/static"))
+}
 
-	f, err := s.Open(strings.TrimPrefix(file, "/static"))
+// serveStatic serves file from the static directory of the current theme.
+// Files requested by their fingerprinted name, see render.Fingerprint, may be cached for a year.
+func serveStatic(w http.ResponseWriter, r *http.Request, file string) {
+	file, immutable := render.Unfingerprint(file)
+	f, err := render.Static.Open(file)
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -265,24 +411,54 @@ func staticResource(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
+	if fi.IsDir() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
 	http.ServeContent(w, r, file, fi.ModTime(), f)
 }
 
 func NewServer() *vestigo.Router {
 
 	protectedHandler := alice.New(session, ProtectedPage)
-	postForm := alice.New(session, ProtectedPage, bindPost)
+	adminHandler := alice.New(session, AdminPage)
+	// users who have not verified their email address may not publish anything
+	verifiedHandler := alice.New(session, ProtectedPage, VerifiedPage)
+	postForm := alice.New(session, ProtectedPage, VerifiedPage, bindPost)
 	postUser := alice.New(session, bindUser)
 	recoverUser := alice.New(session, bindUser)
 	postSearch := alice.New(bindSearch)
 	postReset := alice.New(bindReset)
 	postSettings := alice.New(session, bindSettings)
+	// settings apply to the whole site, for example its theme, so only admins may change them
+	adminSettings := alice.New(session, AdminPage, bindSettings)
 	sessionRedirect := alice.New(session, SessionRedirect)
 
-	r := vestigo.NewRouter()
+	r := router{vestigo.NewRouter()}
 
-	r.Get("/", Homepage)
-	r.Get("/rss", ReadFeed)
+	// pages which are the same for all visitors who are not logged in are cached
+	cached := func(handler http.HandlerFunc, hit func(r *http.Request)) http.HandlerFunc {
+		return handler
+	}
+	if conf.Cache.Enabled && !conf.Development {
+		pages := cache.New(conf.Cache.Size, ContentVersion)
+		pages.Session = "id"
+		pages.MaxAge = conf.Cache.MaxAge
+		cached = func(handler http.HandlerFunc, hit func(r *http.Request)) http.HandlerFunc {
+			return pages.Handler(handler, hit).ServeHTTP
+		}
+	}
+	countView := func(r *http.Request) {
+		Background(Post{Slug: vestigo.Param(r, "slug")}.Increment)
+	}
+
+	r.Get("/", cached(Homepage, nil))
+	if conf.Features.Feeds {
+		r.Get("/rss", cached(ReadFeed, nil))
+	}
 	r.Get("/apple-touch-icon.png", staticFile)
 	r.Get("/favicon.ico", staticFile)
 	r.Get("/browserconfig.xml", staticFile)
@@ -294,28 +470,68 @@ func NewServer() *vestigo.Router {
 	// Please note that `/new` route has to be before the `/:slug` route. Otherwise the program will try
 	// to fetch for Post named "new".
 	// For now I'll keep it this way to streamline route naming.
-	r.Get("/posts/new", protectedHandler.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+	r.Get("/posts/new", verifiedHandler.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
 		render.R.HTML(w, 200, "post/new", nil)
 	}).(http.HandlerFunc))
 	r.Post("/posts/new", postForm.ThenFunc(CreatePost).(http.HandlerFunc))
 
-	r.Post("/posts/search", postSearch.ThenFunc(SearchPost).(http.HandlerFunc))
+	if conf.Features.Search {
+		r.Post("/posts/search", postSearch.ThenFunc(SearchPost).(http.HandlerFunc))
+	}
 	r.Get("/post/:slug/edit", protectedHandler.ThenFunc(EditPost).(http.HandlerFunc))
 	r.Post("/post/:slug/edit", postForm.ThenFunc(UpdatePost).(http.HandlerFunc))
 	r.Get("/post/:slug/delete", protectedHandler.ThenFunc(DeletePost).(http.HandlerFunc))
-	r.Get("/post/:slug/publish", protectedHandler.ThenFunc(PublishPost).(http.HandlerFunc))
+	r.Get("/post/:slug/publish", verifiedHandler.ThenFunc(PublishPost).(http.HandlerFunc))
 	r.Get("/post/:slug/unpublish", protectedHandler.ThenFunc(UnpublishPost).(http.HandlerFunc))
-	r.Get("/post/:slug", ReadPost)
+	r.Get("/post/:slug", cached(ReadPost, countView))
+
+	if conf.Features.Newsletter {
+		r.Post("/newsletter/subscribe", SubscribeNewsletter)
+		r.Get("/newsletter/confirm/:token", ConfirmSubscription)
+		r.Get("/newsletter/unsubscribe/:token", UnsubscribePage)
+		r.Post("/newsletter/unsubscribe/:token", UnsubscribeNewsletter)
+		r.Post("/api/newsletter/subscribe", SubscribeNewsletter)
+		r.Get("/api/newsletter/confirm/:token", ConfirmSubscription)
+		r.Post("/api/newsletter/unsubscribe/:token", UnsubscribeNewsletter)
+	}
+
+	if conf.Features.Micropub {
+		r.Get("/micropub", Micropub)
+		r.Post("/micropub", Micropub)
+		r.Post("/micropub/media", MicropubMedia)
+		r.Get("/media/:name", ReadMedia)
+	}
+
+	if conf.Features.Webmention {
+		r.Post("/webmention", ReceiveWebmention)
+	}
+
+	if conf.Features.ActivityPub {
+		r.Get("/.well-known/webfinger", WebFinger)
+		r.Get("/ap/user/:id", ReadActor)
+		r.Get("/ap/user/:id/outbox", ReadActorOutbox)
+		r.Get("/ap/user/:id/followers", ReadActorFollowers)
+		r.Post("/ap/user/:id/inbox", Inbox)
+		r.Post("/ap/inbox", Inbox)
+		r.Get("/ap/post/:id", ReadObject)
+	}
 
 	r.Get("/user", protectedHandler.Then(http.HandlerFunc(ReadUser)).(http.HandlerFunc))
 	//r.HandleFunc("/delete", ProtectedPage, binding.Form(User{}), DeleteUser)
 	r.Get("/user/settings", protectedHandler.ThenFunc(ReadSettings).(http.HandlerFunc))
-	r.Post("/user/settings", postSettings.ThenFunc(UpdateSettings).(http.HandlerFunc))
+	r.Post("/user/settings", adminSettings.ThenFunc(UpdateSettings).(http.HandlerFunc))
 
 	r.Post("/user/installation", postSettings.ThenFunc(UpdateSettings).(http.HandlerFunc))
 
 	r.Get("/user/register", sessionRedirect.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
-		render.R.HTML(w, 200, "user/register", nil)
+		// invitation links fill in the code and the address the invitation was made for
+		invitation := Invitation{Code: r.URL.Query().Get("invitation")}
+		if invitation.Code != "" {
+			if found, err := invitation.GetByCode(); err == nil {
+				invitation = found
+			}
+		}
+		render.R.HTML(w, 200, "user/register", invitation)
 	}).(http.HandlerFunc))
 
 	r.Post("/user/register", postUser.ThenFunc(CreateUser).(http.HandlerFunc))
@@ -337,14 +553,53 @@ func NewServer() *vestigo.Router {
 
 	r.Post("/user/login", recoverUser.ThenFunc(LoginUser).(http.HandlerFunc))
 	r.Get("/user/logout", LogoutUser)
+	r.Get("/user/verify/:token", VerifyUser)
+	r.Post("/user/verify", protectedHandler.ThenFunc(ResendVerification).(http.HandlerFunc))
+	r.Get("/user/webhooks", adminHandler.ThenFunc(ReadWebhooks).(http.HandlerFunc))
+	r.Post("/user/webhooks", adminHandler.ThenFunc(CreateWebhook).(http.HandlerFunc))
+	r.Get("/user/webhook/:id/delete", adminHandler.ThenFunc(DeleteWebhook).(http.HandlerFunc))
+	r.Post("/user/webhook/:id/test", adminHandler.ThenFunc(TestWebhook).(http.HandlerFunc))
 
 	r.Get("/api", func(w http.ResponseWriter, r *http.Request) {
 		render.R.HTML(w, 200, "api/index", nil)
 	})
 
 	r.Get("/api/settings", protectedHandler.ThenFunc(ReadSettings).(http.HandlerFunc))
-	r.Post("/api/settings", postSettings.ThenFunc(UpdateSettings).(http.HandlerFunc))
+	r.Post("/api/settings", adminSettings.ThenFunc(UpdateSettings).(http.HandlerFunc))
 	r.Post("/api/installation", postSettings.ThenFunc(UpdateSettings).(http.HandlerFunc))
+	r.Get("/api/themes", adminHandler.ThenFunc(ReadThemes).(http.HandlerFunc))
+	r.Post("/api/themes", adminHandler.ThenFunc(InstallTheme).(http.HandlerFunc))
+	r.Get("/api/export", adminHandler.ThenFunc(ExportSite).(http.HandlerFunc))
+	r.Post("/api/import", adminHandler.ThenFunc(ImportSite).(http.HandlerFunc))
+	r.Get("/api/emails", adminHandler.ThenFunc(ReadEmailTemplates).(http.HandlerFunc))
+	r.Get("/api/email/:name", adminHandler.ThenFunc(ReadEmailTemplate).(http.HandlerFunc))
+	r.Post("/api/email/:name", adminHandler.ThenFunc(UpdateEmailTemplate).(http.HandlerFunc))
+	r.Get("/api/email/:name/delete", adminHandler.ThenFunc(DeleteEmailTemplate).(http.HandlerFunc))
+	r.Get("/api/email/:name/preview", adminHandler.ThenFunc(PreviewEmailTemplate).(http.HandlerFunc))
+	r.Post("/api/email/:name/preview", adminHandler.ThenFunc(PreviewEmailTemplate).(http.HandlerFunc))
+	r.Get("/api/invitations", adminHandler.ThenFunc(ReadInvitations).(http.HandlerFunc))
+	r.Post("/api/invitations", adminHandler.ThenFunc(CreateInvitation).(http.HandlerFunc))
+	r.Get("/api/invitation/:id/delete", adminHandler.ThenFunc(DeleteInvitation).(http.HandlerFunc))
+	r.Get("/api/subscribers", adminHandler.ThenFunc(ReadSubscribers).(http.HandlerFunc))
+	r.Get("/api/subscriber/:id/delete", adminHandler.ThenFunc(DeleteSubscriber).(http.HandlerFunc))
+	r.Get("/api/newsletters", adminHandler.ThenFunc(ReadNewsletters).(http.HandlerFunc))
+	r.Get("/api/tokens", protectedHandler.ThenFunc(ReadTokens).(http.HandlerFunc))
+	r.Post("/api/tokens", protectedHandler.ThenFunc(CreateToken).(http.HandlerFunc))
+	r.Get("/api/token/:id/delete", protectedHandler.ThenFunc(DeleteToken).(http.HandlerFunc))
+	r.Get("/api/webhooks", adminHandler.ThenFunc(ReadWebhooks).(http.HandlerFunc))
+	r.Post("/api/webhooks", adminHandler.ThenFunc(CreateWebhook).(http.HandlerFunc))
+	r.Post("/api/webhook/:id", adminHandler.ThenFunc(UpdateWebhook).(http.HandlerFunc))
+	r.Get("/api/webhook/:id/delete", adminHandler.ThenFunc(DeleteWebhook).(http.HandlerFunc))
+	r.Get("/api/webhook/:id/deliveries", adminHandler.ThenFunc(ReadDeliveries).(http.HandlerFunc))
+	r.Post("/api/webhook/:id/test", adminHandler.ThenFunc(TestWebhook).(http.HandlerFunc))
+	r.Get("/api/webmentions", adminHandler.ThenFunc(ReadWebmentions).(http.HandlerFunc))
+	r.Get("/api/webmention/:id/delete", adminHandler.ThenFunc(DeleteWebmention).(http.HandlerFunc))
+	r.Get("/api/followers", protectedHandler.ThenFunc(ReadFollowers).(http.HandlerFunc))
+	r.Get("/api/follower/:id/delete", protectedHandler.ThenFunc(DeleteFollower).(http.HandlerFunc))
+	r.Get("/api/comments", adminHandler.ThenFunc(ReadComments).(http.HandlerFunc))
+	r.Get("/api/comment/:id/delete", adminHandler.ThenFunc(DeleteComment).(http.HandlerFunc))
+	r.Get("/api/outbox", adminHandler.ThenFunc(ReadOutbox).(http.HandlerFunc))
+	r.Post("/api/outbox/:id/retry", adminHandler.ThenFunc(RetryMail).(http.HandlerFunc))
 	r.Get("/api/users", ReadUsers)
 	r.Get("/api/users/", ReadUsers)
 	r.Get("/api/user/logout", LogoutUser)
@@ -354,29 +609,51 @@ func NewServer() *vestigo.Router {
 	r.Post("/api/user/login", recoverUser.ThenFunc(LoginUser).(http.HandlerFunc))
 	r.Post("/api/user/recover", recoverUser.ThenFunc(RecoverUser).(http.HandlerFunc))
 	r.Post("/api/user/reset/:id/:recovery", postReset.ThenFunc(ResetUserPassword).(http.HandlerFunc))
+	r.Get("/api/user/verify/:token", VerifyUser)
+	r.Post("/api/user/verify", protectedHandler.ThenFunc(ResendVerification).(http.HandlerFunc))
+	r.Post("/api/user/:id/verify", adminHandler.ThenFunc(VerifyUserByAdmin).(http.HandlerFunc))
 
-	r.Post("/api/posts/search", postSearch.ThenFunc(SearchPost).(http.HandlerFunc))
+	if conf.Features.Search {
+		r.Post("/api/posts/search", postSearch.ThenFunc(SearchPost).(http.HandlerFunc))
+	}
 	r.Get("/api/posts", ReadPosts)
 	r.Post("/api/post", postForm.ThenFunc(CreatePost).(http.HandlerFunc))
 	r.Post("/api/post/:slug/edit", postForm.ThenFunc(UpdatePost).(http.HandlerFunc))
 	r.Get("/api/post/:slug/delete", protectedHandler.ThenFunc(DeletePost).(http.HandlerFunc))
-	r.Get("/api/post/:slug/publish", protectedHandler.ThenFunc(PublishPost).(http.HandlerFunc))
+	r.Get("/api/post/:slug/publish", verifiedHandler.ThenFunc(PublishPost).(http.HandlerFunc))
 	r.Get("/api/post/:slug/unpublish", protectedHandler.ThenFunc(UnpublishPost).(http.HandlerFunc))
 	r.Get("/api/post/:slug", ReadPost)
 
-	return r
+	r.Get("/healthz", HealthCheck)
+	r.Get("/readyz", ReadinessCheck)
+
+	if conf.Metrics.Enabled {
+		r.Get("/metrics", metrics.Handler(conf.Metrics.Token).ServeHTTP)
+	}
+
+	return r.Router
+}
+
+// router records metrics of every registered route, labeled with the route pattern.
+type router struct {
+	*vestigo.Router
+}
+
+func (r router) Get(path string, handler http.HandlerFunc) {
+	r.Router.Get(path, metrics.Instrument("GET", path, handler))
+}
+
+func (r router) Post(path string, handler http.HandlerFunc) {
+	r.Router.Post(path, metrics.Instrument("POST", path, handler))
 }
 
 func main() {
-	server := NewServer()
-	if os.Getenv("PORT") == "" {
-		log.Fatal(http.ListenAndServe(":3000", server))
-	} else {
-		port, err := strconv.Atoi(os.Getenv("PORT"))
-		if err != nil {
-			log.Println("Port was defined but could not be parsed.")
-			os.Exit(1)
-		}
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), server))
+	err := run(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "vertigo:", err)
+		os.Exit(1)
 	}
 }
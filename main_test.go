@@ -1,28 +1,65 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/toldjuuso/vertigo/activitypub"
+	"github.com/toldjuuso/vertigo/backup"
+	"github.com/toldjuuso/vertigo/cache"
+	"github.com/toldjuuso/vertigo/certificate"
+	"github.com/toldjuuso/vertigo/compress"
+	"github.com/toldjuuso/vertigo/config"
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/importer"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/mailer"
+	"github.com/toldjuuso/vertigo/metrics"
+	"github.com/toldjuuso/vertigo/netguard"
+	"github.com/toldjuuso/vertigo/render"
+	"github.com/toldjuuso/vertigo/routes"
+	"github.com/toldjuuso/vertigo/sanitize"
+	"github.com/toldjuuso/vertigo/staticsite"
+	"github.com/toldjuuso/vertigo/webmention"
 
 	"github.com/PuerkitoBio/goquery"
+	"github.com/husobee/vestigo"
 	"github.com/russross/blackfriday"
 	slug "github.com/shurcooL/sanitized_anchor_name"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/toldjuuso/excerpt"
 )
 
-var server = NewServer()
+var server *vestigo.Router
 var settings Vertigo
 var user User
 var post Post
@@ -33,6 +70,26 @@ var sessioncookie string
 var secondusersessioncookie string
 var malformedsessioncookie = "MTQxNDc2NzAyOXxEdi1CQkFFQ180SUFBUkFCRUFBQUhmLUNBQUVHYzNSeWFXNW5EQVlBQkhWelpYSUZhVzUwTmpRRUFnQUN8Y2PFc-lZ8aEMWypbKXTD-LWg6o9DtJaMzd8NMc8m87A="
 
+func TestMain(m *testing.M) {
+	c, err := config.Load(nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	c.Features.Newsletter = true
+	c.Features.Micropub = true
+	c.Features.Webmention = true
+	c.Features.ActivityPub = true
+	c.Metrics.Enabled = true
+	err = setup(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server = NewServer()
+	os.Exit(m.Run())
+}
+
 func TestInstallationWizard(t *testing.T) {
 
 	Convey("Opening homepage", t, func() {
@@ -49,6 +106,25 @@ func TestInstallationWizard(t *testing.T) {
 	})
 }
 
+func TestHealthChecksBeforeInstallation(t *testing.T) {
+
+	Convey("Process should be alive", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/healthz", nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		So(recorder.Body.String(), ShouldEqual, `{"status":"ok"}`)
+	})
+
+	Convey("Site should not be ready before installation wizard is completed", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/readyz", nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 503)
+		So(recorder.Body.String(), ShouldContainSubstring, `"installation":"not completed"`)
+	})
+}
+
 func TestStaticPages(t *testing.T) {
 
 	Convey("All static pages should return 200 OK", t, func() {
@@ -175,6 +251,17 @@ func TestSettingValues(t *testing.T) {
 	})
 }
 
+func TestHealthChecksAfterInstallation(t *testing.T) {
+
+	Convey("Site should be ready after installation wizard is completed", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/readyz", nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		So(recorder.Body.String(), ShouldEqual, `{"checks":{"database":"ok","installation":"ok","migrations":"ok","settings":"ok"},"status":"ready"}`)
+	})
+}
+
 func TestManipulatingSettings(t *testing.T) {
 
 	Convey("when manipulating the global Settings variable", t, func() {
@@ -270,7 +357,7 @@ func TestReadUser(t *testing.T) {
 		request, _ := http.NewRequest("GET", fmt.Sprintf("/api/user/%d", user.ID), nil)
 		server.ServeHTTP(recorder, request)
 		So(recorder.Code, ShouldEqual, 200)
-		So(recorder.Body.String(), ShouldEqual, `{"id":1,"name":"Juuso","email":"vertigo-test@mailinator.com","posts":[],"location":"Europe/Helsinki"}`)
+		So(recorder.Body.String(), ShouldEqual, `{"id":1,"name":"Juuso","email":"vertigo-test@mailinator.com","posts":[],"location":"Europe/Helsinki","role":"admin","verified":true}`)
 	})
 }
 
@@ -281,7 +368,7 @@ func TestReadUsers(t *testing.T) {
 		request, _ := http.NewRequest("GET", "/api/users/", nil)
 		server.ServeHTTP(recorder, request)
 		So(recorder.Code, ShouldEqual, 200)
-		So(recorder.Body.String(), ShouldEqual, `[{"id":1,"name":"Juuso","email":"vertigo-test@mailinator.com","posts":[],"location":"Europe/Helsinki"}]`)
+		So(recorder.Body.String(), ShouldEqual, `[{"id":1,"name":"Juuso","email":"vertigo-test@mailinator.com","posts":[],"location":"Europe/Helsinki","role":"admin","verified":true}]`)
 	})
 }
 
@@ -920,7 +1007,7 @@ func TestDeletePost(t *testing.T) {
 			server.ServeHTTP(recorder, request)
 			So(recorder.Code, ShouldEqual, 200)
 			So(recorder.Body.String(), ShouldEqual, `{"success":"Post deleted"}`)
-			if *Driver == "sqlite3" {
+			if conf.Database.Driver == "sqlite3" {
 				// SQLite's re-assigns ID if one is removed
 				post.ID--
 			}
@@ -1044,6 +1131,94 @@ func testUpdateSettings(t *testing.T, payload []byte, s Vertigo) {
 	})
 }
 
+func TestThemes(t *testing.T) {
+
+	Convey("using API", t, func() {
+
+		Convey("listing themes without sessioncookies should return 401", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/api/themes", nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 401)
+		})
+
+		Convey("listing themes should return the default theme", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/api/themes", nil)
+			cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldStartWith, `[{"name":"default"`)
+		})
+
+		Convey("installing a theme which is not a zip archive should return 400", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/themes", strings.NewReader("foobar"))
+			cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 400)
+		})
+
+		Convey("installing a valid theme should return 200", func() {
+			var archive bytes.Buffer
+			z := zip.NewWriter(&archive)
+			f, _ := z.Create("theme.json")
+			f.Write([]byte(`{"name": "vertigo-test", "description": "Test theme"}`))
+			f, _ = z.Create("templates/404.tmpl")
+			f.Write([]byte(`<h2>Test theme</h2>`))
+			z.Close()
+			defer os.RemoveAll("themes")
+
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/themes", &archive)
+			cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldEqual, `{"name":"vertigo-test","description":"Test theme","author":"","version":""}`)
+		})
+
+		Convey("installing a theme which extracts to more than the limit should return 413", func() {
+			var archive bytes.Buffer
+			z := zip.NewWriter(&archive)
+			f, _ := z.Create("theme.json")
+			f.Write([]byte(`{"name": "vertigo-bomb"}`))
+			f, _ = z.Create("static/zeros")
+			f.Write(make([]byte, 1<<20))
+			z.Close()
+			defer func(size int64) { render.MaxThemeSize = size }(render.MaxThemeSize)
+			render.MaxThemeSize = 1 << 10
+			defer os.RemoveAll("themes")
+
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/themes", &archive)
+			cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 413)
+			_, err := os.Stat(filepath.Join("themes", "vertigo-bomb"))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("updating settings with a theme which does not exist should return 422", func() {
+			var s Vertigo
+			s = settings
+			s.Theme = "foobar"
+			payload, _ := json.Marshal(s)
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/settings", bytes.NewReader(payload))
+			cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+			request.AddCookie(cookie)
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 422)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"Theme does not exist."}`)
+		})
+	})
+}
+
 func TestAllowRegistration(t *testing.T) {
 
 	Convey("creation after allowregistrations is false", t, func() {
@@ -1087,6 +1262,82 @@ func TestMarkdown(t *testing.T) {
 	TestPublishPost(t)
 }
 
+func TestSanitization(t *testing.T) {
+
+	Convey("sanitizing post content", t, func() {
+
+		Convey("Markdown output should pass unchanged", func() {
+			html := string(blackfriday.MarkdownCommon([]byte("### foo\n*foo* \"foo\" **foo** [bar](http://example.com)")))
+			So(sanitize.Strict.Sanitize(html), ShouldEqual, html)
+		})
+
+		Convey("scripts and event handlers should be removed", func() {
+			So(sanitize.Strict.Sanitize(`<p onclick="alert(1)">foo<script>alert(1)</script></p>`), ShouldEqual, "<p>foo</p>")
+		})
+
+		Convey("unsafe URL schemes should be removed", func() {
+			So(sanitize.Strict.Sanitize(`<a href="java&#x09;script:alert(1)">foo</a>`), ShouldEqual, "<a>foo</a>")
+			So(sanitize.Strict.Sanitize(`<img src="data:image/svg+xml;base64,PHN2Zz4=">`), ShouldEqual, "<img>")
+		})
+
+		Convey("embeds should only be allowed for admins", func() {
+			embed := `<iframe src="https://example.com/embed"></iframe>`
+			So(sanitize.ForRole(RoleAuthor).Sanitize(embed), ShouldEqual, "")
+			So(sanitize.ForRole(RoleAdmin).Sanitize(embed), ShouldEqual, embed)
+		})
+
+		Convey("policies of roles should follow configuration", func() {
+			embed := `<iframe src="https://example.com/embed"></iframe>`
+			setupSanitize(config.Sanitize{Admin: "strict", Author: "strict"})
+			defer setupSanitize(config.Default().Sanitize)
+			So(sanitize.ForRole(RoleAdmin).Sanitize(embed), ShouldEqual, "")
+		})
+
+		Convey("existing posts should be sanitized again on request", func() {
+			So(ResanitizePosts(), ShouldBeNil)
+		})
+	})
+
+	Convey("rendering a post with raw HTML", t, func() {
+
+		Convey("should not output the script", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/post", strings.NewReader(`{"title": "Sanitized post", "markdown": "foo <script>alert(1)</script>"}`))
+			cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+			request.AddCookie(cookie)
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			var p Post
+			json.Unmarshal(recorder.Body.Bytes(), &p)
+			So(p.Content, ShouldNotContainSubstring, "<script>")
+
+			recorder = httptest.NewRecorder()
+			request, _ = http.NewRequest("GET", "/post/"+p.Slug, nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldNotContainSubstring, "alert(1)")
+		})
+
+		Convey("should keep embeds of admins", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/post", strings.NewReader(`{"title": "Embedded post", "markdown": "<iframe src=\"https://example.com/embed\"></iframe>"}`))
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			var p Post
+			json.Unmarshal(recorder.Body.Bytes(), &p)
+
+			recorder = httptest.NewRecorder()
+			request, _ = http.NewRequest("GET", "/post/"+p.Slug, nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, `<iframe src="https://example.com/embed"></iframe>`)
+		})
+	})
+}
+
 func TestFeeds(t *testing.T) {
 
 	Convey("reading feeds", t, func() {
@@ -1174,157 +1425,1935 @@ func TestSearch(t *testing.T) {
 	})
 }
 
-func TestUserLogout(t *testing.T) {
+func TestConfiguration(t *testing.T) {
 
-	Convey("using API", t, func() {
-		var recorder = httptest.NewRecorder()
-		request, _ := http.NewRequest("GET", "/api/user/logout", nil)
-		server.ServeHTTP(recorder, request)
-		So(recorder.Code, ShouldEqual, 200)
-		So(recorder.Body.String(), ShouldEqual, `{"success":"You've been logged out."}`)
-	})
+	Convey("Loading configuration", t, func() {
+		file, _ := ioutil.TempFile("", "vertigo-*.toml")
+		defer os.Remove(file.Name())
 
-	Convey("using frontend", t, func() {
-		var recorder = httptest.NewRecorder()
-		request, _ := http.NewRequest("GET", "/user/logout", nil)
-		server.ServeHTTP(recorder, request)
-		So(recorder.Code, ShouldEqual, 302)
+		Convey("without any sources it should use defaults", func() {
+			c, err := config.Load([]string{"-config", os.DevNull})
+			So(err, ShouldBeNil)
+			So(c.Listen, ShouldEqual, ":3000")
+			So(c.Database.Driver, ShouldEqual, "sqlite3")
+			So(c.Features.Search, ShouldBeTrue)
+			So(c.Features.ActivityPub, ShouldBeFalse)
+			So(c.Metrics.Enabled, ShouldBeFalse)
+		})
+
+		Convey("file should override defaults, environment the file and flags the environment", func() {
+			file.WriteString("listen = \":4000\"\n[database]\nsource = \"file.db\"\n[features]\nfeeds = false # no RSS\n")
+			file.Close()
+			os.Setenv("VERTIGO_DATABASE_SOURCE", "env.db")
+			os.Setenv("VERTIGO_LISTEN", ":5000")
+			defer os.Unsetenv("VERTIGO_DATABASE_SOURCE")
+			defer os.Unsetenv("VERTIGO_LISTEN")
+			c, err := config.Load([]string{"-config", file.Name(), "-listen", ":6000"})
+			So(err, ShouldBeNil)
+			So(c.Features.Feeds, ShouldBeFalse)
+			So(c.Database.Source, ShouldEqual, "env.db")
+			So(c.Listen, ShouldEqual, ":6000")
+		})
+
+		Convey("unknown keys should be reported with line number", func() {
+			file.WriteString("listen = \":4000\"\nlisten_port = 4000\n")
+			file.Close()
+			_, err := config.Load([]string{"-config", file.Name()})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `line 2: unknown key "listen_port"`)
+		})
+
+		Convey("invalid values should be reported together", func() {
+			os.Setenv("VERTIGO_SANITIZE_AUTHOR", "none")
+			defer os.Unsetenv("VERTIGO_SANITIZE_AUTHOR")
+			_, err := config.Load([]string{"-config", os.DevNull, "-listen", "3000", "-driver", "mysql"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "listen address")
+			So(err.Error(), ShouldContainSubstring, "database driver")
+			So(err.Error(), ShouldContainSubstring, `sanitize author policy "none"`)
+		})
 	})
 }
 
-func TestPasswordRecovery(t *testing.T) {
+func TestGracefulShutdown(t *testing.T) {
 
-	Convey("using frontend", t, func() {
+	Convey("HTTP server should use configured limits", t, func() {
+		c := config.Default()
+		c.Server.ReadTimeout = time.Second
+		srv := newHTTPServer(c, server)
+		So(srv.ReadTimeout, ShouldEqual, time.Second)
+		So(srv.MaxHeaderBytes, ShouldEqual, c.Server.MaxHeaderBytes)
+	})
 
-		Convey("should return 401 with email which does not exist", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", "/user/recover", strings.NewReader(`email=foobar@example.com`))
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 401)
-			So(recorder.Body.String(), ShouldEqual, `{"error":"User with that email does not exist."}`)
+	Convey("Waiting for background work", t, func() {
+
+		Convey("it should return once the work has finished", func() {
+			done := false
+			Background(func() {
+				time.Sleep(10 * time.Millisecond)
+				done = true
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			So(Wait(ctx), ShouldBeNil)
+			So(done, ShouldBeTrue)
 		})
 
-		Convey("should return 302 with latest user email", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", "/user/recover", strings.NewReader(fmt.Sprintf(`email=%s`, user.Email)))
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 302)
+		Convey("it should give up after the deadline", func() {
+			release := make(chan bool)
+			Background(func() { <-release })
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			So(errors.Is(Wait(ctx), context.DeadlineExceeded), ShouldBeTrue)
+			close(release)
 		})
 	})
+}
 
-	Convey("using API", t, func() {
+// writeCertificate writes a self-signed certificate for localhost with given serial number
+// and its key to dir and returns the certificate.
+func writeCertificate(dir string, serial int64) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
 
-		Convey("should return 200 with latest user email", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", "/api/user/recover", strings.NewReader(fmt.Sprintf(`{"email": "%s"}`, user.Email)))
-			request.Header.Set("Content-Type", "application/json")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 200)
-			So(recorder.Body.String(), ShouldEqual, `{"success":"We've sent you a link to your email which you may use you reset your password."}`)
+func TestTLS(t *testing.T) {
+
+	Convey("Serving HTTPS", t, func() {
+		dir, _ := ioutil.TempDir("", "vertigo-tls")
+		defer os.RemoveAll(dir)
+		first := writeCertificate(dir, 1)
+		reloader, err := certificate.New(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+		So(err, ShouldBeNil)
+
+		c := config.Default()
+		c.TLS.HSTSMaxAge = 31536000
+		c.TLS.HSTSIncludeSubdomains = true
+		srv := newHTTPServer(c, hsts(c.TLS, server))
+		srv.TLSConfig = newTLSConfig(reloader)
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		go srv.ServeTLS(listener, "", "")
+		defer srv.Close()
+
+		// serial returns serial number of the certificate presented by the server
+		serial := func() int64 {
+			conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				return 0
+			}
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		}
+
+		Convey("it should serve pages with HSTS header", func() {
+			pool := x509.NewCertPool()
+			pool.AddCert(first)
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+			response, err := client.Get("https://" + listener.Addr().String() + "/api")
+			So(err, ShouldBeNil)
+			response.Body.Close()
+			So(response.StatusCode, ShouldEqual, 200)
+			So(response.Header.Get("Strict-Transport-Security"), ShouldEqual, "max-age=31536000; includeSubDomains")
 		})
-	})
 
-	testShouldRecoveryFieldBeBlank(t, false)
-}
+		Convey("it should use a new certificate after reloading", func() {
+			So(serial(), ShouldEqual, 1)
+			writeCertificate(dir, 2)
+			So(reloader.Reload(), ShouldBeNil)
+			So(serial(), ShouldEqual, 2)
+		})
 
-func testShouldRecoveryFieldBeBlank(t *testing.T, value bool) {
+		Convey("it should keep the old certificate if new one is broken", func() {
+			ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte("broken"), 0600)
+			So(reloader.Reload(), ShouldNotBeNil)
+			So(serial(), ShouldEqual, 1)
+		})
 
-	Convey("the latest user should have recovery key defined", t, func() {
-		user, _ = user.GetByEmail()
-		if value == false {
-			So(strings.TrimSpace(user.Recovery), ShouldNotBeBlank)
-		} else {
-			So(strings.TrimSpace(user.Recovery), ShouldEqual, "")
-		}
-		recovery = user.Recovery
+		Convey("it should notice changed files when watching", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go reloader.Watch(ctx, 10*time.Millisecond)
+			// make sure modification time differs on file systems with coarse timestamps
+			time.Sleep(10 * time.Millisecond)
+			writeCertificate(dir, 3)
+			later := time.Now().Add(time.Second)
+			os.Chtimes(filepath.Join(dir, "cert.pem"), later, later)
+			os.Chtimes(filepath.Join(dir, "key.pem"), later, later)
+			time.Sleep(100 * time.Millisecond)
+			So(serial(), ShouldEqual, 3)
+		})
 	})
-}
 
-func TestPasswordReset(t *testing.T) {
+	Convey("Redirecting plain HTTP", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "http://example.com:8080/post/hello?page=2", nil)
 
-	Convey("using frontend", t, func() {
+		Convey("it should redirect to the same URL on HTTPS", func() {
+			redirectHTTPS(":443").ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 301)
+			So(recorder.Header().Get("Location"), ShouldEqual, "https://example.com/post/hello?page=2")
+		})
 
-		Convey("should return 400 when ID is malformed", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", "/user/reset/foobar/"+recovery, strings.NewReader(`password=newpassword`))
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 400)
-			So(recorder.Body.String(), ShouldEqual, `{"error":"User ID could not be parsed from request URL."}`)
+		Convey("it should keep non-standard HTTPS port", func() {
+			redirectHTTPS(":8443").ServeHTTP(recorder, request)
+			So(recorder.Header().Get("Location"), ShouldEqual, "https://example.com:8443/post/hello?page=2")
 		})
+	})
 
-		Convey("should return 400 when recovery UUID does not pass UUID checks", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", "/user/reset/1/foobar", strings.NewReader(`password=newpassword`))
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 400)
-			So(recorder.Body.String(), ShouldEqual, `{"error":"Could not parse UUID from the request."}`)
+	Convey("TLS configuration", t, func() {
+
+		Convey("it should require both certificate and key", func() {
+			_, err := config.Load([]string{"-config", os.DevNull, "-tls-cert", "cert.pem"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "tls cert and key should be given together")
 		})
 
-		Convey("should return 400 when user with given ID does not exist", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", fmt.Sprintf(`/user/reset/%d/%s`, 7, recovery), strings.NewReader(`password=newpassword`))
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 400)
-			So(recorder.Body.String(), ShouldEqual, `{"error":"User with that ID does not exist."}`)
+		Convey("it should require TLS for redirect listener", func() {
+			_, err := config.Load([]string{"-config", os.DevNull, "-tls-redirect", ":80"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "tls redirect requires tls cert and key")
 		})
 	})
+}
 
-	Convey("using API", t, func() {
+func TestMetrics(t *testing.T) {
 
-		Convey("should return 200 with valid information", func() {
+	Convey("Reading metrics", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api", nil)
+		server.ServeHTTP(recorder, request)
+
+		Convey("it should count requests by route pattern", func() {
 			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", fmt.Sprintf(`/api/user/reset/%d/%s`, user.ID, recovery), strings.NewReader(`{"password":"newpassword"}`))
-			request.Header.Set("Content-Type", "application/json")
+			request, _ := http.NewRequest("GET", "/metrics", nil)
 			server.ServeHTTP(recorder, request)
 			So(recorder.Code, ShouldEqual, 200)
-			user.Password = "newpassword"
+			So(recorder.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+			So(recorder.Body.String(), ShouldContainSubstring, `vertigo_http_requests_total{method="GET",route="/api",code="200"}`)
+			So(recorder.Body.String(), ShouldContainSubstring, `vertigo_http_request_duration_seconds_bucket{method="GET",route="/api",le="+Inf"}`)
+			So(recorder.Body.String(), ShouldContainSubstring, `vertigo_db_query_duration_seconds_count{method="User.GetByEmail"}`)
+			So(recorder.Body.String(), ShouldContainSubstring, `vertigo_logins_total{outcome="success"}`)
+			So(recorder.Body.String(), ShouldContainSubstring, "go_goroutines ")
+		})
+
+		Convey("it should require token if one is configured", func() {
+			handler := metrics.Handler("secret")
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/metrics", nil)
+			handler.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 401)
+
+			recorder = httptest.NewRecorder()
+			request.Header.Set("Authorization", "Bearer secret")
+			handler.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
 		})
 	})
 
-	testShouldRecoveryFieldBeBlank(t, true)
-	TestUserSignin(t)
+	Convey("Histograms should be cumulative", t, func() {
+		histogram := metrics.NewHistogram("test_duration_seconds", "Test histogram.", []float64{1, 2}, "kind")
+		histogram.Observe(0.5, `quote"d`)
+		histogram.Observe(1.5, `quote"d`)
+		var buf bytes.Buffer
+		metrics.WriteTo(&buf)
+		So(buf.String(), ShouldContainSubstring, `test_duration_seconds_bucket{kind="quote\"d",le="1"} 1`)
+		So(buf.String(), ShouldContainSubstring, `test_duration_seconds_bucket{kind="quote\"d",le="2"} 2`)
+		So(buf.String(), ShouldContainSubstring, `test_duration_seconds_sum{kind="quote\"d"} 2`)
+		So(buf.String(), ShouldContainSubstring, `test_duration_seconds_count{kind="quote\"d"} 2`)
+	})
 }
 
-func TestRecoveryKeyExpiration(t *testing.T) {
-
-	Convey("using frontend", t, func() {
+func TestLogging(t *testing.T) {
 
-		Convey("should redirect to login page with notification", func() {
-			var recorder = httptest.NewRecorder()
-			request, _ := http.NewRequest("POST", "/user/recover", strings.NewReader(fmt.Sprintf(`email=%s`, user.Email)))
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			server.ServeHTTP(recorder, request)
-			So(recorder.Code, ShouldEqual, 302)
+	Convey("Tagging requests with IDs", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api", nil)
+		var id string
+		handler := logging.Middleware(false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id = logging.ID(r.Context())
+		}))
+
+		Convey("it should generate an ID and return it in a header", func() {
+			handler.ServeHTTP(recorder, request)
+			So(id, ShouldNotBeEmpty)
+			So(recorder.Header().Get("X-Request-ID"), ShouldEqual, id)
 		})
-	})
 
-	testShouldRecoveryFieldBeBlank(t, false)
+		Convey("it should keep a well-formed ID given by the client", func() {
+			request.Header.Set("X-Request-ID", "abc-123")
+			handler.ServeHTTP(recorder, request)
+			So(id, ShouldEqual, "abc-123")
+		})
 
-	Convey("recovery key should be blank after expiring", t, func() {
+		Convey("it should replace a malformed ID", func() {
+			request.Header.Set("X-Request-ID", "abc\n123")
+			handler.ServeHTTP(recorder, request)
+			So(id, ShouldNotEqual, "abc\n123")
+		})
+	})
 
-		var u User
-		u.ID = int64(1)
-		go u.ExpireRecovery(1 * time.Second)
-		time.Sleep(2 * time.Second)
+	Convey("Writing logs", t, func() {
+		var buf bytes.Buffer
+		c := config.Default().Log
+		c.Format = "json"
+		logger, err := logging.New(&buf, c)
+		So(err, ShouldBeNil)
+
+		Convey("it should redact configured keys and email addresses", func() {
+			logger.Info("login of user@example.com", "password", "hunter2", "error", errors.New("no user john@example.com"))
+			var line map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["msg"], ShouldEqual, "login of ***@example.com")
+			So(line["password"], ShouldEqual, logging.Redacted)
+			So(line["error"], ShouldEqual, "no user ***@example.com")
+		})
 
-		u, _ = user.Get()
-		So(strings.TrimSpace(u.Recovery), ShouldEqual, "")
+		Convey("it should skip messages below configured level", func() {
+			c.Level = "warn"
+			logger, _ := logging.New(&buf, c)
+			logger.Info("hidden")
+			So(buf.Len(), ShouldEqual, 0)
+		})
 	})
 }
 
-func TestPostSecurity(t *testing.T) {
+func TestCommands(t *testing.T) {
 
-	var s Vertigo
-	s = settings
-	s.AllowRegistrations = true
-	payload, _ := json.Marshal(s)
+	Convey("Running commands", t, func() {
+		var buf bytes.Buffer
+		stdout = &buf
+		defer func() { stdout = os.Stdout }()
 
-	testUpdateSettings(t, payload, s)
+		Convey("help should list all commands", func() {
+			So(run([]string{"help"}), ShouldBeNil)
+			for name := range commands {
+				So(buf.String(), ShouldContainSubstring, "  "+name)
+			}
+		})
+
+		Convey("unknown commands should be reported", func() {
+			err := run([]string{"frobnicate"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, `unknown command "frobnicate"`)
+		})
+
+		Convey("command groups should list their subcommands", func() {
+			err := run([]string{"user", "delete"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "usage: vertigo user <create|list|reset-password|set-role|verify>")
+		})
+
+		Convey("user create should require email and password", func() {
+			err := run([]string{"user", "create", "-config", os.DevNull, "-name", "Nobody"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "-email and -password are required")
+		})
+
+		Convey("settings set should require key value pairs", func() {
+			err := run([]string{"settings", "set", "-config", os.DevNull, "name"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "settings should be given as key value pairs")
+		})
+	})
+
+	Convey("Settings fields should be accessible by their JSON keys", t, func() {
+		settings := *Settings
+		field, err := settingsField(&settings, "name")
+		So(err, ShouldBeNil)
+		So(field.String(), ShouldEqual, Settings.Name)
+
+		_, err = settingsField(&settings, "cookiehash")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestSiteArchive(t *testing.T) {
+
+	Convey("Exporting the site", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api/export?cookiehash=true&secrets=true", nil)
+		cookie := &http.Cookie{Name: "id", Value: sessioncookie}
+		request.AddCookie(cookie)
+		server.ServeHTTP(recorder, request)
+		archive := recorder.Body.Bytes()
+
+		Convey("it should return a gzip compressed tar archive", func() {
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Content-Disposition"), ShouldStartWith, `attachment; filename="vertigo-`)
+			entries := readArchive(archive)
+			So(entries, ShouldContainKey, "manifest.json")
+			So(entries, ShouldContainKey, "data.json")
+
+			var manifest backup.Manifest
+			So(json.Unmarshal(entries["manifest.json"], &manifest), ShouldBeNil)
+			So(manifest.Format, ShouldEqual, backup.Format)
+			So(manifest.Version, ShouldEqual, backup.Version)
+			So(manifest.Users, ShouldBeGreaterThan, 0)
+
+			var data Backup
+			So(json.Unmarshal(entries["data.json"], &data), ShouldBeNil)
+			So(data.Settings.CookieHash, ShouldEqual, Settings.CookieHash)
+			So(data.Users[0].Digest, ShouldNotBeEmpty)
+		})
+
+		Convey("it should leave out digests and cookie secret unless asked", func() {
+			var buf bytes.Buffer
+			_, err := backup.Export(&buf, backup.Options{})
+			So(err, ShouldBeNil)
+			var data Backup
+			So(json.Unmarshal(readArchive(buf.Bytes())["data.json"], &data), ShouldBeNil)
+			So(data.Settings.CookieHash, ShouldBeEmpty)
+			So(data.Users[0].Digest, ShouldBeEmpty)
+			So(data.Settings.MailerPassword, ShouldBeEmpty)
+			So(data.ActorKeys, ShouldBeEmpty)
+			So(data.Outbox, ShouldBeEmpty)
+		})
+
+		Convey("importing it should require replace on a site with data", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/import", bytes.NewReader(archive))
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 409)
+		})
+
+		Convey("importing it with replace should restore the same data", func() {
+			before, err := Dump()
+			So(err, ShouldBeNil)
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/import?replace=true", bytes.NewReader(archive))
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			after, err := Dump()
+			So(err, ShouldBeNil)
+			So(after.Settings, ShouldResemble, before.Settings)
+			So(len(after.Users), ShouldEqual, len(before.Users))
+			So(after.Posts, ShouldResemble, before.Posts)
+		})
+
+		Convey("importing something else should fail", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/import", strings.NewReader("not an archive"))
+			request.AddCookie(cookie)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 400)
+		})
+	})
+
+	Convey("Exporting and importing rows which belong to users and posts", t, func() {
+		before, err := Dump()
+		So(err, ShouldBeNil)
+		media := backup.MediaDirectory
+		backup.MediaDirectory = t.TempDir()
+		defer func() { backup.MediaDirectory = media }()
+		upload := filepath.Join(backup.MediaDirectory, "0123456789abcdef0123456789abcdef.png")
+		So(ioutil.WriteFile(upload, []byte("image"), 0644), ShouldBeNil)
+
+		data := *before
+		owner := data.Users[0].ID
+		post := data.Posts[0].ID
+		data.Tokens = []TokenRecord{{ID: 1, Owner: owner, Name: "Phone", Digest: "digest", Scope: "create", Created: 1, LastUsed: 2}}
+		data.DeletedPosts = []DeletedPostRecord{{PostRecord: PostRecord{ID: 100, Title: "Gone", Slug: "gone", Author: owner, Created: 1, Updated: 1}, Deleted: 2}}
+		data.Webmentions = []Webmention{{ID: 1, Source: "https://example.org/", Target: "http://example.com/post/first", Post: post, Status: WebmentionVerified, Kind: "like", Created: 1, Verified: 2, NextAttempt: 1}}
+		data.ActorKeys = []ActorKeyRecord{{Owner: owner, PrivateKey: "private", PublicKey: "public", Created: 1}}
+		data.Followers = []Follower{{ID: 1, Owner: owner, Actor: "https://social.example/users/bob", Follow: "https://social.example/follows/1", Inbox: "https://social.example/users/bob/inbox", Created: 1}}
+		data.Comments = []Comment{{ID: 1, Post: post, ObjectID: "https://social.example/notes/1", Actor: "https://social.example/users/bob", Content: "<p>Nice</p>", Published: 1, Created: 1}}
+		data.ActivityDeliveries = []ActivityDelivery{{ID: 1, Owner: owner, Inbox: "https://social.example/users/bob/inbox", Activity: "{}", Status: DeliveryDelivered, Attempts: 1, NextAttempt: 1, Created: 1, Delivered: 2}}
+		data.Subscribers = []SubscriberRecord{{ID: 1, Email: "reader@example.com", Token: "0123456789abcdef", Status: SubscriberConfirmed, Created: 1, Confirmed: 2, ConfirmationSent: 1}}
+		data.Newsletters = []Newsletter{{ID: 1, Kind: NewsletterPost, Post: post, Subject: "First", Recipients: 1, Created: 2}}
+		data.Webhooks = []Webhook{{ID: 1, URL: "https://hooks.example/", Events: "post.published", Secret: "secret", Active: true, Created: 1}}
+		data.Deliveries = []Delivery{{ID: 1, Webhook: 1, Event: "post.published", Payload: "{}", Status: DeliveryDelivered, Attempts: 1, Response: 200, NextAttempt: 1, Created: 1, Delivered: 2}}
+		data.Invitations = []Invitation{{ID: 1, Code: "invitation", Role: RoleAuthor, MaxUses: 1, Creator: owner, Created: 1}}
+		data.EmailTemplates = []EmailTemplate{{Name: "welcome", Subject: "Hi", Text: "Welcome", Updated: 1}}
+		data.Outbox = []MailRecord{{ID: 1, Kind: "newsletter", Address: "reader@example.com", Subject: "First", Body: "Hello", Status: MailSent, Attempts: 1, NextAttempt: 1, Created: 1, Sent: 2, Newsletter: 1, Unsubscribe: "http://example.com/newsletter/unsubscribe/0123456789abcdef"}}
+		So(Restore(&data, true), ShouldBeNil)
+		defer Restore(before, true)
+
+		var withoutSecrets bytes.Buffer
+		_, err = backup.Export(&withoutSecrets, backup.Options{Digests: true})
+		So(err, ShouldBeNil)
+
+		var buf bytes.Buffer
+		manifest, err := backup.Export(&buf, backup.Options{Digests: true, CookieHash: true, Secrets: true, Media: true})
+		So(err, ShouldBeNil)
+		So(manifest.Media, ShouldEqual, 1)
+		So(Restore(before, true), ShouldBeNil)
+		So(os.Remove(upload), ShouldBeNil)
+
+		manifest, err = backup.Import(&buf, true)
+		So(err, ShouldBeNil)
+		So(manifest.Media, ShouldEqual, 1)
+		after, err := Dump()
+		So(err, ShouldBeNil)
+		So(after.Tokens, ShouldResemble, data.Tokens)
+		So(after.DeletedPosts, ShouldResemble, data.DeletedPosts)
+		So(after.Webmentions, ShouldResemble, data.Webmentions)
+		So(after.ActorKeys, ShouldResemble, data.ActorKeys)
+		So(after.Followers, ShouldResemble, data.Followers)
+		So(after.Comments, ShouldResemble, data.Comments)
+		So(after.ActivityDeliveries, ShouldResemble, data.ActivityDeliveries)
+		So(after.Subscribers, ShouldResemble, data.Subscribers)
+		So(after.Newsletters, ShouldResemble, data.Newsletters)
+		So(after.Webhooks, ShouldResemble, data.Webhooks)
+		So(after.Deliveries, ShouldResemble, data.Deliveries)
+		So(after.Invitations, ShouldResemble, data.Invitations)
+		So(after.EmailTemplates, ShouldResemble, data.EmailTemplates)
+		So(after.Outbox, ShouldResemble, data.Outbox)
+		content, err := ioutil.ReadFile(upload)
+		So(err, ShouldBeNil)
+		So(string(content), ShouldEqual, "image")
+
+		_, err = backup.Import(&withoutSecrets, true)
+		So(err, ShouldBeNil)
+		after, err = Dump()
+		So(err, ShouldBeNil)
+		So(after.ActorKeys, ShouldBeEmpty)
+		So(after.Outbox, ShouldBeEmpty)
+		So(after.Subscribers, ShouldResemble, data.Subscribers)
+		So(len(after.Webhooks), ShouldEqual, 1)
+		So(after.Webhooks[0].Secret, ShouldNotBeEmpty)
+		So(after.Webhooks[0].Secret, ShouldNotEqual, "secret")
+	})
+}
+
+// readArchive returns contents of regular files in a gzip compressed tar archive by name.
+func readArchive(data []byte) map[string][]byte {
+	entries := make(map[string][]byte)
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return entries
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			return entries
+		}
+		entries[header.Name], _ = ioutil.ReadAll(archive)
+	}
+}
+
+func TestImporters(t *testing.T) {
+
+	Convey("Converting HTML to Markdown", t, func() {
+
+		Convey("it should convert paragraphs, emphasis, links and lists", func() {
+			text, kept := importer.Markdown(`<p>Some <strong>bold </strong>and <a href="https://example.com">a link</a>.</p><ul><li>one</li><li><em>two</em></li></ul>`)
+			So(text, ShouldEqual, "Some **bold** and [a link](https://example.com).\n\n- one\n- *two*")
+			So(kept, ShouldBeEmpty)
+		})
+
+		Convey("it should escape Markdown in text and keep code as is", func() {
+			text, _ := importer.Markdown(`<p># 2*3</p><pre><code class="language-go">a := b * c</code></pre>`)
+			So(text, ShouldEqual, "\\# 2\\*3\n\n```go\na := b * c\n```")
+		})
+
+		Convey("it should keep tables as HTML and report them", func() {
+			text, kept := importer.Markdown(`<table><tr><td>cell</td></tr></table>`)
+			So(text, ShouldContainSubstring, "<td>cell</td>")
+			So(kept, ShouldResemble, []string{"table"})
+		})
+	})
+
+	Convey("Reading a WordPress export", t, func() {
+		site, err := importer.ReadWordPress(strings.NewReader(`<?xml version="1.0"?>
+<rss xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+<wp:author><wp:author_login>juuso</wp:author_login><wp:author_email>vertigo-test@mailinator.com</wp:author_email></wp:author>
+<item><title>Imported post</title><dc:creator>juuso</dc:creator><content:encoded><![CDATA[First
+
+Second]]></content:encoded><wp:post_date_gmt>2015-03-04 08:00:00</wp:post_date_gmt><wp:post_name>imported-post</wp:post_name><wp:status>publish</wp:status><wp:post_type>post</wp:post_type></item>
+<item><title>About</title><wp:post_type>page</wp:post_type></item>
+</channel>
+</rss>`))
+		So(err, ShouldBeNil)
+		So(len(site.Posts), ShouldEqual, 1)
+		So(site.Posts[0].Markdown, ShouldEqual, "First\n\nSecond")
+		So(site.Posts[0].Created.Unix(), ShouldEqual, 1425456000)
+
+		Convey("a dry run should map authors by email without creating posts", func() {
+			report, err := importer.Import(site, importer.Options{DryRun: true})
+			So(err, ShouldBeNil)
+			So(report.Authors[0].Action, ShouldEqual, "match")
+			So(report.Posts[0].Action, ShouldEqual, "create")
+			_, err = Post{Slug: "imported-post"}.Get()
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Reading a Ghost export", t, func() {
+		site, err := importer.ReadGhost(strings.NewReader(`{"db":[{"data":{"posts":[{"id":"1","title":"Ghost","slug":"ghost","html":"<p>Hi</p>","status":"draft","type":"post","created_at":"2019-05-01T10:00:00.000Z"}],"users":[{"id":"9","name":"Juuso","email":"vertigo-test@mailinator.com"}],"posts_authors":[{"post_id":"1","author_id":"9"}]}}]}`))
+		So(err, ShouldBeNil)
+		So(len(site.Posts), ShouldEqual, 1)
+		So(site.Posts[0].Author, ShouldEqual, "9")
+		So(site.Posts[0].Markdown, ShouldEqual, "Hi")
+		So(site.Posts[0].Published, ShouldBeFalse)
+	})
+}
+
+func TestStaticSite(t *testing.T) {
+
+	Convey("Building a static site", t, func() {
+		dir, err := ioutil.TempDir("", "vertigo-build")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		result, err := staticsite.Build(dir, false)
+		So(err, ShouldBeNil)
+		So(result.Unchanged, ShouldEqual, 0)
+
+		Convey("it should write pages, feed, sitemap and static files", func() {
+			for _, name := range []string{"index.html", "sitemap.xml", "rss.xml", "favicon.ico", "static/css/style.css"} {
+				_, err := os.Stat(filepath.Join(dir, name))
+				So(err, ShouldBeNil)
+			}
+			home, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+			So(err, ShouldBeNil)
+			So(string(home), ShouldNotContainSubstring, `action="/posts/search"`)
+			So(string(home), ShouldNotContainSubstring, `href="/user/login"`)
+		})
+
+		Convey("rebuilding it should skip unchanged posts and files", func() {
+			again, err := staticsite.Build(dir, false)
+			So(err, ShouldBeNil)
+			So(again.Written, ShouldEqual, 0)
+			So(again.Unchanged, ShouldEqual, result.Rendered-again.Rendered)
+		})
+	})
+}
+
+func TestPageCache(t *testing.T) {
+
+	Convey("Caching responses", t, func() {
+		var version uint64
+		pages := cache.New(10, func() uint64 { return version })
+
+		Convey("it should evict least recently used responses when full", func() {
+			pages.Add("/a", 0, &cache.Response{Body: []byte("aaaa")})
+			pages.Add("/b", 0, &cache.Response{Body: []byte("bbbb")})
+			pages.Get("/a")
+			pages.Add("/c", 0, &cache.Response{Body: []byte("cccc")})
+			_, ok := pages.Get("/b")
+			So(ok, ShouldBeFalse)
+			_, ok = pages.Get("/a")
+			So(ok, ShouldBeTrue)
+			entries, size := pages.Len()
+			So(entries, ShouldEqual, 2)
+			So(size, ShouldEqual, 8)
+		})
+
+		Convey("it should drop all responses when content changes", func() {
+			pages.Add("/a", 0, &cache.Response{Body: []byte("aaaa")})
+			version++
+			_, ok := pages.Get("/a")
+			So(ok, ShouldBeFalse)
+			pages.Add("/a", 0, &cache.Response{Body: []byte("aaaa")})
+			_, ok = pages.Get("/a")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("Serving the homepage", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/", nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		etag := recorder.Header().Get("ETag")
+		So(etag, ShouldNotBeEmpty)
+
+		Convey("it should serve it from the cache the second time", func() {
+			var recorder = httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, "HIT")
+			So(recorder.Header().Get("ETag"), ShouldEqual, etag)
+		})
+
+		Convey("it should answer 304 if the client has the same version", func() {
+			var recorder = httptest.NewRecorder()
+			request.Header.Set("If-None-Match", etag)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 304)
+			So(recorder.Body.Len(), ShouldEqual, 0)
+		})
+
+		Convey("it should render it again after settings change", func() {
+			_, err := Settings.Update()
+			So(err, ShouldBeNil)
+			var recorder = httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			So(recorder.Header().Get("X-Cache"), ShouldEqual, "MISS")
+		})
+
+		Convey("it should not be cached for logged in users", func() {
+			var recorder = httptest.NewRecorder()
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Header().Get("X-Cache"), ShouldBeEmpty)
+			So(recorder.Header().Get("Cache-Control"), ShouldEqual, "private, no-cache")
+		})
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+
+	Convey("Serving JSON through the conditional middleware", t, func() {
+		handler := cache.Conditional(server)
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api/posts", nil)
+		handler.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		etag := recorder.Header().Get("ETag")
+		So(etag, ShouldStartWith, `"`)
+
+		Convey("it should answer 304 if the client has the same version", func() {
+			var recorder = httptest.NewRecorder()
+			request.Header.Set("If-None-Match", etag)
+			handler.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 304)
+			So(recorder.Body.Len(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Reading a post", t, func() {
+		handler := cache.Conditional(server)
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api/post/"+post.Slug, nil)
+		handler.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		modified := recorder.Header().Get("Last-Modified")
+		So(modified, ShouldNotBeEmpty)
+
+		Convey("it should answer 304 if it has not been modified since", func() {
+			var recorder = httptest.NewRecorder()
+			request.Header.Set("If-Modified-Since", modified)
+			handler.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 304)
+		})
+	})
+
+	Convey("Compressing responses", t, func() {
+		body := strings.Repeat("<p>Hello world!</p>", 100)
+		handler := compress.Handler(cache.Conditional(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			fmt.Fprint(w, body)
+		})))
+
+		Convey("it should use gzip when the client accepts it", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/", nil)
+			request.Header.Set("Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+			handler.ServeHTTP(recorder, request)
+			So(recorder.Header().Get("Content-Encoding"), ShouldEqual, "gzip")
+			So(recorder.Header().Get("ETag"), ShouldEndWith, `-gzip"`)
+			reader, err := gzip.NewReader(recorder.Body)
+			So(err, ShouldBeNil)
+			data, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, body)
+
+			Convey("and answer 304 to the ETag of the compressed response", func() {
+				var second = httptest.NewRecorder()
+				request.Header.Set("If-None-Match", recorder.Header().Get("ETag"))
+				handler.ServeHTTP(second, request)
+				So(second.Code, ShouldEqual, 304)
+			})
+		})
+
+		Convey("it should not compress when the client refuses gzip", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/", nil)
+			request.Header.Set("Accept-Encoding", "gzip;q=0, identity")
+			handler.ServeHTTP(recorder, request)
+			So(recorder.Header().Get("Content-Encoding"), ShouldBeEmpty)
+			So(recorder.Body.String(), ShouldEqual, body)
+		})
+	})
+
+	Convey("Fingerprinting static files", t, func() {
+		url := render.Fingerprint("css/style.css")
+		So(url, ShouldNotEqual, "/static/css/style.css")
+		So(url, ShouldStartWith, "/static/css/style.")
+
+		Convey("it should serve them with a long-lived Cache-Control", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", url, nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Cache-Control"), ShouldContainSubstring, "immutable")
+		})
+
+		Convey("it should serve outdated fingerprints without it", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/static/css/style.0000000000.css", nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Cache-Control"), ShouldBeEmpty)
+		})
+	})
+}
+
+func TestUserLogout(t *testing.T) {
+
+	Convey("using API", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api/user/logout", nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		So(recorder.Body.String(), ShouldEqual, `{"success":"You've been logged out."}`)
+	})
+
+	Convey("using frontend", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/user/logout", nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 302)
+	})
+}
+
+func TestPasswordRecovery(t *testing.T) {
+
+	Convey("using frontend", t, func() {
+
+		Convey("should return 401 with email which does not exist", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/user/recover", strings.NewReader(`email=foobar@example.com`))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 401)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"User with that email does not exist."}`)
+		})
+
+		Convey("should return 302 with latest user email", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/user/recover", strings.NewReader(fmt.Sprintf(`email=%s`, user.Email)))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 302)
+		})
+	})
+
+	Convey("using API", t, func() {
+
+		Convey("should return 200 with latest user email", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/user/recover", strings.NewReader(fmt.Sprintf(`{"email": "%s"}`, user.Email)))
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldEqual, `{"success":"We've sent you a link to your email which you may use you reset your password."}`)
+		})
+	})
+
+	testShouldRecoveryFieldBeBlank(t, false)
+}
+
+// testMailer records sent messages, failing with err if set.
+type testMailer struct {
+	sent []mailer.Message
+	err  error
+}
+
+func (m *testMailer) Send(message mailer.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, message)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+
+	Convey("Delivering recovery email from the outbox", t, func() {
+		transport := &testMailer{}
+		Mailer = transport
+		defer func() { Mailer = nil }()
+		_, err := ProcessOutbox()
+		So(err, ShouldBeNil)
+		So(len(transport.sent), ShouldBeGreaterThan, 0)
+		// email to users registered earlier in the suite was queued before the recovery email
+		recovery := transport.sent[len(transport.sent)-1]
+		So(recovery.Subject, ShouldEqual, "Password reset")
+		So(recovery.To.Address, ShouldEqual, user.Email)
+		So(recovery.From.Address, ShouldEqual, Settings.MailerLogin)
+		counts, err := OutboxCounts()
+		So(err, ShouldBeNil)
+		So(counts[MailPending], ShouldEqual, 0)
+		So(counts[MailSent], ShouldEqual, len(transport.sent))
+	})
+
+	// Convey runs the block once per leaf, so the mail is queued and attempted only once
+	// here to leave exactly one pending message in the outbox.
+	transport := &testMailer{err: errors.New("connection refused")}
+	Mailer = transport
+	defer func() { Mailer = nil }()
+	_, queueErr := Mail{Kind: "test", Name: "Foo", Address: "foo@example.com", Subject: "Hello", Body: "Hello"}.Queue()
+	sent, processErr := ProcessOutbox()
+
+	Convey("Failing to deliver email", t, func() {
+		So(queueErr, ShouldBeNil)
+		So(processErr, ShouldBeNil)
+		So(sent, ShouldEqual, 0)
+		outbox, err := Outbox(MailPending)
+		So(err, ShouldBeNil)
+		So(len(outbox), ShouldEqual, 1)
+		mail := outbox[0]
+		So(mail.Attempts, ShouldEqual, 1)
+		So(mail.LastError, ShouldEqual, "connection refused")
+		So(mail.NextAttempt, ShouldBeGreaterThan, time.Now().Unix())
+
+		Convey("it should not be attempted again before the retry delay", func() {
+			transport.err = nil
+			sent, err := ProcessOutbox()
+			So(err, ShouldBeNil)
+			So(sent, ShouldEqual, 0)
+		})
+
+		Convey("it should not be retried by admins while pending", func() {
+			_, err := mail.Retry()
+			So(err.Error(), ShouldEqual, "mail not failed")
+		})
+
+		Convey("admins should see it in the outbox", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/api/outbox?status=pending", nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, `"lasterror":"connection refused"`)
+			So(recorder.Body.String(), ShouldNotContainSubstring, `"body"`)
+		})
+	})
+
+	Convey("Purging the outbox", t, func() {
+		So(PurgeOutbox(time.Now().Add(-time.Hour)), ShouldBeNil)
+		counts, err := OutboxCounts()
+		So(err, ShouldBeNil)
+		So(counts[MailSent], ShouldBeGreaterThan, 0)
+
+		Convey("it should remove sent email older than retention and keep pending email", func() {
+			So(PurgeOutbox(time.Now().Add(time.Second)), ShouldBeNil)
+			counts, err := OutboxCounts()
+			So(err, ShouldBeNil)
+			So(counts[MailSent], ShouldEqual, 0)
+			So(counts[MailPending], ShouldEqual, 1)
+		})
+	})
+}
+
+func TestEmailTemplates(t *testing.T) {
+
+	Convey("Rendering email templates of the theme", t, func() {
+		template, source, err := GetEmailTemplate("recovery")
+		So(err, ShouldBeNil)
+		So(source, ShouldEqual, "theme")
+		message, err := PreviewEmail(template)
+		So(err, ShouldBeNil)
+		So(message.Subject, ShouldEqual, "Password reset")
+		So(message.Body, ShouldContainSubstring, "/user/reset/1/")
+		So(message.HTML, ShouldContainSubstring, "<p>Hello Jane Doe</p>")
+
+		Convey("it should encode both bodies as multipart/alternative", func() {
+			data := string(message.Bytes())
+			So(data, ShouldContainSubstring, "Content-Type: multipart/alternative; boundary=")
+			So(data, ShouldContainSubstring, `Content-Type: text/plain; charset="utf-8"`)
+			So(data, ShouldContainSubstring, `Content-Type: text/html; charset="utf-8"`)
+		})
+
+		Convey("it should be sent from the configured address", func() {
+			setupMailer(config.Mailer{From: "blog@example.com"})
+			defer func() { MailFrom = "" }()
+			message, err := PreviewEmail(template)
+			So(err, ShouldBeNil)
+			So(message.From.Address, ShouldEqual, "blog@example.com")
+		})
+	})
+
+	Convey("Editing an email template", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/email/welcome", strings.NewReader(`{"subject":"Hi {{.Recipient.Name}}","text":"Welcome to {{.Site}}","html":""}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		_, source, err := GetEmailTemplate("welcome")
+		So(err, ShouldBeNil)
+		So(source, ShouldEqual, "database")
+
+		Convey("it should be used in previews", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/api/email/welcome/preview", nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, `"subject":"Hi Jane Doe"`)
+		})
+
+		Convey("it should reject templates which do not parse", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/email/welcome", strings.NewReader(`{"subject":"Hi","text":"{{.Site","html":""}`))
+			request.Header.Set("Content-Type", "application/json")
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 400)
+		})
+
+		Convey("it should use the template of the theme again after deleting it", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/api/email/welcome/delete", nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			_, source, err := GetEmailTemplate("welcome")
+			So(err, ShouldBeNil)
+			So(source, ShouldEqual, "theme")
+		})
+	})
+}
+
+func TestInvitations(t *testing.T) {
+
+	Convey("Creating an invitation", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/invitations", strings.NewReader(`{"email":"invited@example.com","role":"admin","maxuses":1}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		var invitation Invitation
+		json.Unmarshal(recorder.Body.Bytes(), &invitation)
+		So(invitation.Code, ShouldNotBeBlank)
+		So(invitation.Role, ShouldEqual, RoleAdmin)
+		So(invitation.Link, ShouldEndWith, "/user/register?invitation="+invitation.Code)
+
+		Convey("it should not be redeemed for other addresses", func() {
+			_, err := invitation.Redeem("someone@example.com")
+			So(err.Error(), ShouldEqual, "invitation invalid")
+		})
+
+		Convey("registering with it should assign its role", func() {
+			var recorder = httptest.NewRecorder()
+			payload := fmt.Sprintf(`{"name":"Invited", "password":"foo", "email":"invited@example.com", "location":"UTC", "invitation":"%s"}`, invitation.Code)
+			request, _ := http.NewRequest("POST", "/api/user", strings.NewReader(payload))
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			var invited User
+			json.Unmarshal(recorder.Body.Bytes(), &invited)
+			So(invited.Role, ShouldEqual, RoleAdmin)
+			So(invited.Verified, ShouldBeFalse)
+
+			Convey("it should not be used more than allowed", func() {
+				_, err := invitation.Redeem("invited@example.com")
+				So(err.Error(), ShouldEqual, "invitation used")
+			})
+		})
+	})
+
+	Convey("Expired and revoked invitations should be refused", t, func() {
+		_, err := Invitation{Expires: time.Now().Add(-time.Hour).Unix()}.Insert()
+		So(err.Error(), ShouldEqual, "invitation expired")
+		invitation, err := Invitation{Expires: time.Now().Add(time.Hour).Unix()}.Insert()
+		So(err, ShouldBeNil)
+		So(invitation.Role, ShouldEqual, RoleAuthor)
+		So(invitation.Delete(), ShouldBeNil)
+		_, err = invitation.Redeem("someone@example.com")
+		So(err.Error(), ShouldEqual, "invitation invalid")
+	})
+}
+
+func TestNewsletter(t *testing.T) {
+
+	var passes int
+	Convey("Subscribing to the newsletter", t, func() {
+		// Convey re-runs this block for every leaf, so start each pass
+		// without the subscriber the previous one created.
+		passes++
+		existing, err := Subscribers("")
+		So(err, ShouldBeNil)
+		for _, subscriber := range existing {
+			So(subscriber.Delete(), ShouldBeNil)
+		}
+		So(Subscribe("not an address", false).Error(), ShouldEqual, "subscriber email invalid")
+		So(Subscribe("Reader@Example.com", false), ShouldBeNil)
+		pending, err := Subscribers(SubscriberPending)
+		So(err, ShouldBeNil)
+		So(len(pending), ShouldEqual, 1)
+		subscriber := pending[0]
+		So(subscriber.Email, ShouldEqual, "reader@example.com")
+
+		Convey("subscribing again should not send another confirmation", func() {
+			counts, _ := OutboxCounts()
+			So(Subscribe("reader@example.com", false), ShouldBeNil)
+			again, _ := OutboxCounts()
+			So(again[MailPending], ShouldEqual, counts[MailPending])
+		})
+
+		Convey("confirming it should send published posts to the subscriber", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/api/newsletter/confirm/"+subscriber.Token, nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+
+			author := User{ID: 1, Location: "UTC", Role: RoleAdmin}
+			title := fmt.Sprintf("Newsletter post %d", passes)
+			draft, err := Post{Title: title, Markdown: "Sent by **email**."}.Insert(author)
+			So(err, ShouldBeNil)
+			draft, err = draft.Get()
+			So(err, ShouldBeNil)
+			_, err = draft.SendNewsletter()
+			So(err.Error(), ShouldEqual, "post not published")
+			entry := draft
+			entry.Published = true
+			published, err := draft.Update(entry)
+			So(err, ShouldBeNil)
+			newsletter, err := published.SendNewsletter()
+			So(err, ShouldBeNil)
+			So(newsletter.Recipients, ShouldEqual, 1)
+			So(newsletter.Subject, ShouldEqual, title)
+
+			outbox, err := Outbox(MailPending)
+			So(err, ShouldBeNil)
+			So(outbox[0].Newsletter, ShouldEqual, newsletter.ID)
+			So(outbox[0].Address, ShouldEqual, "reader@example.com")
+			So(outbox[0].Unsubscribe, ShouldEndWith, "/newsletter/unsubscribe/"+subscriber.Token)
+
+			Convey("publishing it again should not send it again", func() {
+				_, err := published.SendNewsletter()
+				So(err.Error(), ShouldEqual, "newsletter sent")
+			})
+
+			Convey("posts published while the newsletter is turned off should not be sent", func() {
+				render.Features["newsletter"] = false
+				defer func() { render.Features["newsletter"] = true }()
+				quiet, err := Post{Title: title + " quietly", Markdown: "Not sent."}.Insert(author)
+				So(err, ShouldBeNil)
+				var recorder = httptest.NewRecorder()
+				request, _ := http.NewRequest("GET", "/api/post/"+quiet.Slug+"/publish", nil)
+				request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+				server.ServeHTTP(recorder, request)
+				So(recorder.Code, ShouldEqual, 200)
+				So(Wait(context.Background()), ShouldBeNil)
+				quiet, err = quiet.Get()
+				So(err, ShouldBeNil)
+				newsletter, err := quiet.SendNewsletter()
+				So(err, ShouldBeNil)
+				So(newsletter.Recipients, ShouldEqual, 1)
+			})
+
+			Convey("announcing a post should email it to subscribers only once", func() {
+				draft, err := Post{Title: title + " announced", Markdown: "Announced."}.Insert(author)
+				So(err, ShouldBeNil)
+				draft, err = draft.Get()
+				So(err, ShouldBeNil)
+				entry := draft
+				entry.Published = true
+				announced, err := draft.Update(entry)
+				So(err, ShouldBeNil)
+				announcement, err := announced.Announce(map[string]bool{"newsletter": true})
+				So(err, ShouldBeNil)
+				So(announcement.Recipients, ShouldEqual, 1)
+				announcement, err = announced.Announce(map[string]bool{"newsletter": true})
+				So(err, ShouldBeNil)
+				So(announcement.Recipients, ShouldEqual, 0)
+			})
+
+			Convey("one-click unsubscription should stop newsletters", func() {
+				var recorder = httptest.NewRecorder()
+				request, _ := http.NewRequest("POST", "/newsletter/unsubscribe/"+subscriber.Token, strings.NewReader("List-Unsubscribe=One-Click"))
+				request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				server.ServeHTTP(recorder, request)
+				So(recorder.Code, ShouldEqual, 200)
+				unsubscribed, err := Subscribers(SubscriberUnsubscribed)
+				So(err, ShouldBeNil)
+				So(len(unsubscribed), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Digests should not be sent more than once a week", t, func() {
+		_, err := SendDigest()
+		if err == nil {
+			_, err = SendDigest()
+		}
+		So(err.Error(), ShouldBeIn, []string{"digest not due", "digest empty"})
+	})
+}
+
+func testShouldRecoveryFieldBeBlank(t *testing.T, value bool) {
+
+	Convey("the latest user should have recovery key defined", t, func() {
+		user, _ = user.GetByEmail()
+		if value == false {
+			So(strings.TrimSpace(user.Recovery), ShouldNotBeBlank)
+		} else {
+			So(strings.TrimSpace(user.Recovery), ShouldEqual, "")
+		}
+		recovery = user.Recovery
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+
+	Convey("Webhooks should be sent signed content events", t, func() {
+		type received struct {
+			event     string
+			signature string
+			body      []byte
+		}
+		requests := make(chan received, 10)
+		status := 200
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests <- received{r.Header.Get("X-Vertigo-Event"), r.Header.Get("X-Vertigo-Signature"), body}
+			w.WriteHeader(status)
+		}))
+		defer receiver.Close()
+
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/webhooks", strings.NewReader(`{"url":"`+receiver.URL+`","events":"post.created, ping"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 422)
+
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("POST", "/api/webhooks", strings.NewReader(`{"url":"`+receiver.URL+`","events":"post.created, post.deleted"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		var webhook Webhook
+		json.Unmarshal(recorder.Body.Bytes(), &webhook)
+		So(webhook.Events, ShouldEqual, "post.created,post.deleted")
+		So(webhook.Secret, ShouldNotBeBlank)
+		defer webhook.Delete()
+
+		verify := func(r received) bool {
+			mac := hmac.New(sha256.New, []byte(webhook.Secret))
+			mac.Write(r.body)
+			return r.signature == "sha256="+hex.EncodeToString(mac.Sum(nil))
+		}
+
+		Convey("test events should be delivered with a valid signature", func() {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", fmt.Sprintf("/api/webhook/%d/test", webhook.ID), nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			_, err := ProcessDeliveries()
+			So(err, ShouldBeNil)
+			r := <-requests
+			So(r.event, ShouldEqual, EventPing)
+			So(verify(r), ShouldBeTrue)
+		})
+
+		Convey("creating a post should emit post.created", func() {
+			So(Emit(EventPostUpdated, Post{Slug: "ignored"}), ShouldBeNil)
+			So(Emit(EventPostCreated, Post{Title: "Hooked", Slug: "hooked"}), ShouldBeNil)
+			_, err := ProcessDeliveries()
+			So(err, ShouldBeNil)
+			r := <-requests
+			So(r.event, ShouldEqual, EventPostCreated)
+			So(verify(r), ShouldBeTrue)
+			var payload struct {
+				Event string `json:"event"`
+				Data  Post   `json:"data"`
+			}
+			So(json.Unmarshal(r.body, &payload), ShouldBeNil)
+			So(payload.Event, ShouldEqual, EventPostCreated)
+			So(payload.Data.Slug, ShouldEqual, "hooked")
+			So(len(requests), ShouldEqual, 0)
+		})
+
+		Convey("failed deliveries should be logged and retried later", func() {
+			status = 503
+			delivery, err := webhook.Test()
+			So(err, ShouldBeNil)
+			delivered, err := ProcessDeliveries()
+			So(err, ShouldBeNil)
+			So(delivered, ShouldEqual, 0)
+			<-requests
+
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", fmt.Sprintf("/api/webhook/%d/deliveries?limit=1", webhook.ID), nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			var deliveries []Delivery
+			json.Unmarshal(recorder.Body.Bytes(), &deliveries)
+			So(len(deliveries), ShouldEqual, 1)
+			So(deliveries[0].ID, ShouldEqual, delivery.ID)
+			So(deliveries[0].Status, ShouldEqual, DeliveryPending)
+			So(deliveries[0].Attempts, ShouldEqual, 1)
+			So(deliveries[0].Response, ShouldEqual, 503)
+			So(deliveries[0].NextAttempt, ShouldBeGreaterThan, time.Now().Unix())
+		})
+	})
+}
+
+func TestMicropub(t *testing.T) {
+
+	micropub := func(method, target, token, contentType, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Convey("Creating an API token", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/api/tokens", strings.NewReader(`{"name":"phone"}`))
+		request.Header.Set("Content-Type", "application/json")
+		request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		var token Token
+		json.Unmarshal(recorder.Body.Bytes(), &token)
+		So(token.Secret, ShouldNotBeBlank)
+		So(token.Scope, ShouldEqual, "create update delete media")
+
+		Convey("requests without a valid token should be refused", func() {
+			So(micropub("GET", "/micropub?q=config", "", "", "").Code, ShouldEqual, 401)
+			So(micropub("GET", "/micropub?q=config", "invalid", "", "").Code, ShouldEqual, 401)
+			recorder := micropub("GET", "/micropub?q=config", token.Secret, "", "")
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, "/micropub/media")
+		})
+
+		Convey("entries should be created, updated, deleted and undeleted", func() {
+			recorder := micropub("POST", "/micropub", token.Secret, "application/x-www-form-urlencoded", "h=entry&name=Micropub+entry&content=Written+elsewhere")
+			So(recorder.Code, ShouldEqual, 201)
+			So(recorder.Header().Get("Location"), ShouldEndWith, "/post/micropub-entry")
+			post, err := Post{Slug: "micropub-entry"}.Get()
+			So(err, ShouldBeNil)
+			So(post.Published, ShouldBeTrue)
+			So(post.Markdown, ShouldEqual, "Written elsewhere")
+
+			recorder = micropub("POST", "/micropub", token.Secret, "application/json",
+				`{"action":"update","url":"`+recorder.Header().Get("Location")+`","replace":{"content":["Rewritten"],"post-status":["draft"]}}`)
+			So(recorder.Code, ShouldEqual, 204)
+			post, err = post.Get()
+			So(err, ShouldBeNil)
+			So(post.Markdown, ShouldEqual, "Rewritten")
+			So(post.Published, ShouldBeFalse)
+
+			recorder = micropub("GET", "/micropub?q=source&properties[]=post-status&url=/post/micropub-entry", token.Secret, "", "")
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldEqual, `{"properties":{"post-status":["draft"]}}`)
+
+			recorder = micropub("POST", "/micropub", token.Secret, "application/json", `{"action":"delete","url":"/post/micropub-entry"}`)
+			So(recorder.Code, ShouldEqual, 204)
+			_, err = post.Get()
+			So(err.Error(), ShouldEqual, "not found")
+
+			recorder = micropub("POST", "/micropub", token.Secret, "application/json", `{"action":"undelete","url":"/post/micropub-entry"}`)
+			So(recorder.Code, ShouldEqual, 204)
+			post, err = post.Get()
+			So(err, ShouldBeNil)
+			So(post.Markdown, ShouldEqual, "Rewritten")
+			So(post.Delete(), ShouldBeNil)
+		})
+
+		Convey("tokens should be limited to their scopes", func() {
+			limited, err := Token{Owner: token.Owner, Name: "uploads", Scope: "media"}.Insert()
+			So(err, ShouldBeNil)
+			recorder := micropub("POST", "/micropub", limited.Secret, "application/x-www-form-urlencoded", "h=entry&content=Not+allowed")
+			So(recorder.Code, ShouldEqual, 403)
+			So(recorder.Body.String(), ShouldContainSubstring, "insufficient_scope")
+
+			routes.MicropubConfig.Media, _ = ioutil.TempDir("", "vertigo-media")
+			defer os.RemoveAll(routes.MicropubConfig.Media)
+			body := &bytes.Buffer{}
+			form := multipart.NewWriter(body)
+			part, _ := form.CreateFormFile("file", "pixel.gif")
+			part.Write([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"))
+			form.Close()
+			recorder = micropub("POST", "/micropub/media", limited.Secret, form.FormDataContentType(), body.String())
+			So(recorder.Code, ShouldEqual, 201)
+			So(recorder.Header().Get("Location"), ShouldEndWith, ".gif")
+		})
+
+		Convey("revoked tokens should not be accepted", func() {
+			So(Token{ID: token.ID, Owner: token.Owner}.Delete(), ShouldBeNil)
+			So(micropub("GET", "/micropub?q=config", token.Secret, "", "").Code, ShouldEqual, 401)
+		})
+	})
+}
+
+func TestMetadata(t *testing.T) {
+
+	Convey("Pages should describe themselves with metadata", t, func() {
+		post, err := Post{Title: "Described", Markdown: "Some words about things.\n\n![Cover](/media/cover.png)"}.Insert(user)
+		So(err, ShouldBeNil)
+		post, err = post.Get()
+		So(err, ShouldBeNil)
+		entry := post
+		entry.Published = true
+		post, err = post.Update(entry)
+		So(err, ShouldBeNil)
+		defer post.Delete()
+
+		page := func(path string) *goquery.Document {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", path, nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			doc, _ := goquery.NewDocumentFromReader(recorder.Body)
+			return doc
+		}
+		attr := func(doc *goquery.Document, selector string, name string) string {
+			value, _ := doc.Find(selector).Attr(name)
+			return value
+		}
+
+		Convey("posts should default to their excerpt and first image", func() {
+			doc := page("/post/described")
+			So(attr(doc, "link[rel=canonical]", "href"), ShouldEqual, "http://example.com/post/described")
+			So(attr(doc, `meta[property="og:type"]`, "content"), ShouldEqual, "article")
+			So(attr(doc, `meta[property="og:description"]`, "content"), ShouldEqual, "Some words about things.")
+			So(attr(doc, `meta[property="og:image"]`, "content"), ShouldEqual, "http://example.com/media/cover.png")
+			So(attr(doc, `meta[name="twitter:card"]`, "content"), ShouldEqual, "summary_large_image")
+
+			var data map[string]interface{}
+			So(json.Unmarshal([]byte(doc.Find(`script[type="application/ld+json"]`).Text()), &data), ShouldBeNil)
+			So(data["@type"], ShouldEqual, "BlogPosting")
+			So(data["headline"], ShouldEqual, "Described")
+			So(data["datePublished"], ShouldEqual, time.Unix(post.Created, 0).UTC().Format(time.RFC3339))
+			So(data["author"].(map[string]interface{})["name"], ShouldEqual, user.Name)
+
+			So(doc.Find(".h-entry .p-name").Text(), ShouldEqual, "Described")
+			So(doc.Find(".h-entry .p-author.h-card").Text(), ShouldEqual, user.Name)
+			So(attr(doc, ".h-entry .dt-published", "datetime"), ShouldEqual, time.Unix(post.Created, 0).In(time.FixedZone("", post.TimeOffset)).Format(time.RFC3339))
+		})
+
+		Convey("description and image of posts should be overridable", func() {
+			entry := post
+			entry.Description = `A "short" summary`
+			entry.Image = "https://cdn.example.com/social.jpg"
+			_, err := post.Update(entry)
+			So(err, ShouldBeNil)
+			doc := page("/post/described")
+			So(attr(doc, `meta[name="description"]`, "content"), ShouldEqual, `A "short" summary`)
+			So(attr(doc, `meta[property="og:image"]`, "content"), ShouldEqual, "https://cdn.example.com/social.jpg")
+			So(attr(doc, ".h-entry .p-summary", "value"), ShouldEqual, `A "short" summary`)
+		})
+
+		Convey("the front page should be an h-feed with a canonical link", func() {
+			doc := page("/")
+			So(attr(doc, "link[rel=canonical]", "href"), ShouldEqual, "http://example.com/")
+			So(attr(doc, `meta[property="og:type"]`, "content"), ShouldEqual, "website")
+			So(doc.Find(`script[type="application/ld+json"]`).Length(), ShouldEqual, 0)
+			So(attr(doc, ".h-feed .h-entry a.u-url[href='/post/described']", "class"), ShouldContainSubstring, "p-name")
+		})
+	})
+}
+
+func TestPublicAddresses(t *testing.T) {
+
+	Convey("Clients fetching addresses of other servers should only dial public addresses", t, func() {
+		for _, address := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "169.254.169.254", "0.0.0.0", "224.0.0.1", "::1", "fe80::1", "fd00::1"} {
+			So(netguard.Public(net.ParseIP(address)), ShouldBeFalse)
+		}
+		So(netguard.Public(net.ParseIP("93.184.216.34")), ShouldBeTrue)
+		So(netguard.Public(net.ParseIP("2606:2800:220:1::1")), ShouldBeTrue)
+		So(netguard.Control(func() bool { return false })("tcp", "127.0.0.1:80", nil), ShouldNotBeNil)
+		So(netguard.Control(func() bool { return true })("tcp", "127.0.0.1:80", nil), ShouldBeNil)
+	})
+}
+
+func TestWebmention(t *testing.T) {
+
+	Convey("Webmentions should be sent and received", t, func() {
+		webmention.AllowPrivate = true
+		defer func() { webmention.AllowPrivate = false }()
+		var site *httptest.Server
+		reply := `<div class="h-entry"><a class="p-author h-card" href="/">Foo</a> <a class="u-in-reply-to" href="http://example.com/post/mentioned">in reply to</a> <p class="e-content">Nice  post!</p></div>`
+		sent := make(chan url.Values, 10)
+		site = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/reply":
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				fmt.Fprint(w, reply)
+			case "/article":
+				w.Header().Set("Link", `</endpoint>; rel="webmention"`)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				fmt.Fprint(w, "<p>Article</p>")
+			case "/endpoint":
+				r.ParseForm()
+				sent <- r.PostForm
+				w.WriteHeader(202)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer site.Close()
+
+		post, err := Post{Title: "Mentioned", Markdown: "See [the article](" + site.URL + "/article) and [home](/)."}.Insert(user)
+		So(err, ShouldBeNil)
+		post, err = post.Get()
+		So(err, ShouldBeNil)
+		entry := post
+		entry.Published = true
+		post, err = post.Update(entry)
+		So(err, ShouldBeNil)
+		defer post.Delete()
+
+		receive := func(source, target string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			form := url.Values{"source": {source}, "target": {target}}
+			request, _ := http.NewRequest("POST", "/webmention", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		Convey("the endpoint should be advertised on posts", func() {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/post/mentioned", nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Link"), ShouldEqual, `<http://example.com/webmention>; rel="webmention"`)
+			So(recorder.Body.String(), ShouldContainSubstring, `<link rel="webmention" href="/webmention">`)
+		})
+
+		Convey("Webmentions to anything but published posts should be refused", func() {
+			So(receive("not a url", "http://example.com/post/mentioned").Code, ShouldEqual, 400)
+			So(receive(site.URL+"/reply", "http://example.com/post/missing").Code, ShouldEqual, 400)
+			So(receive(site.URL+"/reply", "http://elsewhere.com/post/mentioned").Code, ShouldEqual, 400)
+		})
+
+		Convey("replies should be verified and shown under the post", func() {
+			So(receive(site.URL+"/reply", "http://example.com/post/mentioned").Code, ShouldEqual, 202)
+			verified, err := ProcessWebmentions()
+			So(err, ShouldBeNil)
+			So(verified, ShouldEqual, 1)
+			mentions, err := post.Webmentions()
+			So(err, ShouldBeNil)
+			So(len(mentions), ShouldEqual, 1)
+			So(mentions[0].Kind, ShouldEqual, webmention.KindReply)
+			So(mentions[0].AuthorName, ShouldEqual, "Foo")
+			So(mentions[0].AuthorURL, ShouldEqual, site.URL+"/")
+			So(mentions[0].Content, ShouldEqual, "Nice post!")
+
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/post/mentioned", nil)
+			server.ServeHTTP(recorder, request)
+			doc, _ := goquery.NewDocumentFromReader(recorder.Body)
+			So(doc.Find("section[role=webmentions] blockquote p").Text(), ShouldEqual, "Nice post!")
+
+			Convey("and removed when the source no longer links to the post", func() {
+				reply = "<p>Deleted</p>"
+				So(receive(site.URL+"/reply", "http://example.com/post/mentioned").Code, ShouldEqual, 202)
+				_, err := ProcessWebmentions()
+				So(err, ShouldBeNil)
+				mentions, err := post.Webmentions()
+				So(err, ShouldBeNil)
+				So(len(mentions), ShouldEqual, 0)
+				rejected, err := Webmentions(WebmentionRejected)
+				So(err, ShouldBeNil)
+				So(len(rejected), ShouldEqual, 1)
+				So(rejected[0].LastError, ShouldEqual, "target not linked")
+				So(rejected[0].Delete(), ShouldBeNil)
+			})
+		})
+
+		Convey("publishing should notify linked pages with an endpoint", func() {
+			count, err := post.SendWebmentions()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			form := <-sent
+			So(form.Get("source"), ShouldEqual, "http://example.com/post/mentioned")
+			So(form.Get("target"), ShouldEqual, site.URL+"/article")
+		})
+	})
+}
+
+func TestActivityPub(t *testing.T) {
+
+	activitypub.AllowPrivate = true
+	defer func() { activitypub.AllowPrivate = false }()
+	// Convey runs the block once per leaf, so the instance is started once here and
+	// the follower it adds in one pass is the same actor in the next.
+	private, public, keyErr := activitypub.NewKey()
+	actor, actorErr := user.Actor()
+	var instance *httptest.Server
+	received := make(chan activitypub.Activity, 10)
+	instance = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/bar":
+			w.Header().Set("Content-Type", activitypub.ContentType)
+			json.NewEncoder(w).Encode(activitypub.Actor{
+				ID:                instance.URL + "/users/bar",
+				Type:              "Person",
+				PreferredUsername: "bar",
+				Name:              "Bar",
+				URL:               instance.URL + "/@bar",
+				Inbox:             instance.URL + "/users/bar/inbox",
+				Endpoints:         &activitypub.Endpoints{SharedInbox: instance.URL + "/inbox"},
+				PublicKey:         activitypub.PublicKey{ID: instance.URL + "/users/bar#main-key", Owner: instance.URL + "/users/bar", PublicKeyPem: public},
+			})
+		case "/users/mallory":
+			// claims to be an actor of another server, signing with a key of this one
+			w.Header().Set("Content-Type", activitypub.ContentType)
+			json.NewEncoder(w).Encode(activitypub.Actor{
+				ID:        "https://victim.example/users/alice",
+				Type:      "Person",
+				Inbox:     instance.URL + "/users/bar/inbox",
+				PublicKey: activitypub.PublicKey{ID: instance.URL + "/users/mallory#main-key", Owner: "https://victim.example/users/alice", PublicKeyPem: public},
+			})
+		case "/users/bar/inbox", "/inbox":
+			body, _ := ioutil.ReadAll(r.Body)
+			if activitypub.KeyID(r) != actor.PublicKey.ID || activitypub.Verify(r, body, actor.PublicKey.PublicKeyPem) != nil {
+				w.WriteHeader(401)
+				return
+			}
+			var activity activitypub.Activity
+			json.Unmarshal(body, &activity)
+			received <- activity
+			w.WriteHeader(202)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer instance.Close()
+	bar := instance.URL + "/users/bar"
+	key := activitypub.Key{ID: bar + "#main-key", PrivateKeyPem: private}
+
+	Convey("Posts should be federated with ActivityPub", t, func() {
+		So(keyErr, ShouldBeNil)
+		So(actorErr, ShouldBeNil)
+		// activities left over from the previous pass are not expected by this one
+		for len(received) > 0 {
+			<-received
+		}
+
+		send := func(inbox string, activity map[string]interface{}, key activitypub.Key) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(activity)
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "http://example.com"+inbox, bytes.NewReader(body))
+			request.RequestURI = inbox
+			request.Header.Set("Content-Type", activitypub.ContentType)
+			So(key.Sign(request, body), ShouldBeNil)
+			server.ServeHTTP(recorder, request)
+			return recorder
+		}
+		deliver := func() activitypub.Activity {
+			_, err := ProcessActivities()
+			So(err, ShouldBeNil)
+			select {
+			case activity := <-received:
+				return activity
+			default:
+				return activitypub.Activity{}
+			}
+		}
+
+		Convey("users should be found with WebFinger", func() {
+			username, err := user.Username()
+			So(err, ShouldBeNil)
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("GET", "/.well-known/webfinger?resource=acct:"+username+"@example.com", nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Body.String(), ShouldContainSubstring, `"href":"http://example.com/ap/user/`+strconv.FormatInt(user.ID, 10)+`"`)
+
+			recorder = httptest.NewRecorder()
+			request, _ = http.NewRequest("GET", "/.well-known/webfinger?resource=acct:"+username+"@elsewhere.com", nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 404)
+
+			recorder = httptest.NewRecorder()
+			request, _ = http.NewRequest("GET", "/ap/user/"+strconv.FormatInt(user.ID, 10), nil)
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Content-Type"), ShouldStartWith, activitypub.ContentType)
+			So(recorder.Body.String(), ShouldContainSubstring, "BEGIN PUBLIC KEY")
+		})
+
+		Convey("unsigned and wrongly signed activities should be refused", func() {
+			recorder := httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/ap/inbox", strings.NewReader(`{"type":"Follow","actor":"`+bar+`","object":"`+actor.ID+`"}`))
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 401)
+
+			other, _, err := activitypub.NewKey()
+			So(err, ShouldBeNil)
+			follow := map[string]interface{}{"id": bar + "#follow", "type": "Follow", "actor": bar, "object": actor.ID}
+			So(send("/ap/inbox", follow, activitypub.Key{ID: key.ID, PrivateKeyPem: other}).Code, ShouldEqual, 401)
+			followers, err := Followers(user.ID)
+			So(err, ShouldBeNil)
+			So(len(followers), ShouldEqual, 0)
+		})
+
+		Convey("actors served by another server than their own should be refused", func() {
+			alice := "https://victim.example/users/alice"
+			follow := map[string]interface{}{"id": alice + "#follow", "type": "Follow", "actor": alice, "object": actor.ID}
+			So(send("/ap/inbox", follow, activitypub.Key{ID: instance.URL + "/users/mallory#main-key", PrivateKeyPem: private}).Code, ShouldEqual, 401)
+			followers, err := Followers(user.ID)
+			So(err, ShouldBeNil)
+			So(len(followers), ShouldEqual, 0)
+		})
+
+		Convey("a signed Follow should add a follower and be accepted", func() {
+			follow := map[string]interface{}{"id": bar + "#follow", "type": "Follow", "actor": bar, "object": actor.ID}
+			So(send(actor.Inbox[len("http://example.com"):], follow, key).Code, ShouldEqual, 202)
+			followers, err := Followers(user.ID)
+			So(err, ShouldBeNil)
+			So(len(followers), ShouldEqual, 1)
+			So(followers[0].Actor, ShouldEqual, bar)
+			So(followers[0].SharedInbox, ShouldEqual, instance.URL+"/inbox")
+			accept := deliver()
+			So(accept.Type, ShouldEqual, "Accept")
+			So(accept.ObjectID(), ShouldEqual, bar+"#follow")
+
+			Convey("publishing should deliver the post to the follower", func() {
+				post, err := Post{Title: "Federated", Markdown: "Hello fediverse."}.Insert(user)
+				So(err, ShouldBeNil)
+				post, err = post.Get()
+				So(err, ShouldBeNil)
+				entry := post
+				entry.Published = true
+				post, err = post.Update(entry)
+				So(err, ShouldBeNil)
+				defer post.Delete()
+				So(Federate(EventPostPublished, post), ShouldBeNil)
+				create := deliver()
+				So(create.Type, ShouldEqual, "Create")
+				So(create.ObjectID(), ShouldEqual, ObjectURL(post))
+
+				Convey("and replies should be shown as comments until deleted", func() {
+					build := t.TempDir()
+					_, err := staticsite.Build(build, false)
+					So(err, ShouldBeNil)
+
+					reply := map[string]interface{}{"id": bar + "/statuses/1#create", "type": "Create", "actor": bar, "object": map[string]interface{}{
+						"id": bar + "/statuses/1", "type": "Note", "attributedTo": bar, "inReplyTo": ObjectURL(post),
+						"content": `<p>Nice post!<script>alert(1)</script></p>`, "url": instance.URL + "/@bar/1",
+					}}
+					So(send("/ap/inbox", reply, key).Code, ShouldEqual, 202)
+					comments, err := post.Comments()
+					So(err, ShouldBeNil)
+					So(len(comments), ShouldEqual, 1)
+					So(comments[0].AuthorName, ShouldEqual, "Bar")
+					So(comments[0].Content, ShouldEqual, "<p>Nice post!</p>")
+
+					outbox, err := Outbox(MailPending)
+					So(err, ShouldBeNil)
+					So(len(outbox), ShouldBeGreaterThan, 0)
+					So(outbox[0].Kind, ShouldEqual, "comment")
+					So(outbox[0].Address, ShouldEqual, user.Email)
+					So(outbox[0].Subject, ShouldEqual, "New comment on Federated")
+					So(outbox[0].HTML, ShouldContainSubstring, "<p>Nice post!</p>")
+
+					recorder := httptest.NewRecorder()
+					request, _ := http.NewRequest("GET", "/post/federated", nil)
+					server.ServeHTTP(recorder, request)
+					doc, _ := goquery.NewDocumentFromReader(recorder.Body)
+					So(doc.Find("section[role=comments] blockquote p").Text(), ShouldEqual, "Nice post!")
+
+					_, err = staticsite.Build(build, false)
+					So(err, ShouldBeNil)
+					page, err := ioutil.ReadFile(filepath.Join(build, "post", "federated", "index.html"))
+					So(err, ShouldBeNil)
+					So(string(page), ShouldContainSubstring, "Nice post!")
+
+					remove := map[string]interface{}{"id": bar + "/statuses/1#delete", "type": "Delete", "actor": bar, "object": bar + "/statuses/1"}
+					So(send("/ap/inbox", remove, key).Code, ShouldEqual, 202)
+					comments, err = post.Comments()
+					So(err, ShouldBeNil)
+					So(len(comments), ShouldEqual, 0)
+				})
+
+				Convey("and deleting should deliver a Delete", func() {
+					So(Federate(EventPostDeleted, post), ShouldBeNil)
+					remove := deliver()
+					So(remove.Type, ShouldEqual, "Delete")
+					So(remove.ObjectID(), ShouldEqual, ObjectURL(post))
+				})
+			})
+
+			Convey("an Undo should remove the follower", func() {
+				undo := map[string]interface{}{"id": bar + "#undo", "type": "Undo", "actor": bar, "object": follow}
+				So(send("/ap/inbox", undo, key).Code, ShouldEqual, 202)
+				followers, err := Followers(user.ID)
+				So(err, ShouldBeNil)
+				So(len(followers), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+
+	Convey("using frontend", t, func() {
+
+		Convey("should return 400 when ID is malformed", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/user/reset/foobar/"+recovery, strings.NewReader(`password=newpassword`))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 400)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"User ID could not be parsed from request URL."}`)
+		})
+
+		Convey("should return 400 when recovery UUID does not pass UUID checks", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/user/reset/1/foobar", strings.NewReader(`password=newpassword`))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 400)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"Could not parse UUID from the request."}`)
+		})
+
+		Convey("should return 400 when user with given ID does not exist", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", fmt.Sprintf(`/user/reset/%d/%s`, 7, recovery), strings.NewReader(`password=newpassword`))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 400)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"User with that ID does not exist."}`)
+		})
+	})
+
+	Convey("using API", t, func() {
+
+		Convey("should return 200 with valid information", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", fmt.Sprintf(`/api/user/reset/%d/%s`, user.ID, recovery), strings.NewReader(`{"password":"newpassword"}`))
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 200)
+			user.Password = "newpassword"
+		})
+	})
+
+	testShouldRecoveryFieldBeBlank(t, true)
+	TestUserSignin(t)
+}
+
+func TestRecoveryKeyExpiration(t *testing.T) {
+
+	Convey("using frontend", t, func() {
+
+		Convey("should redirect to login page with notification", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/user/recover", strings.NewReader(fmt.Sprintf(`email=%s`, user.Email)))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 302)
+		})
+	})
+
+	testShouldRecoveryFieldBeBlank(t, false)
+
+	Convey("recovery key should be blank after expiring", t, func() {
+
+		var u User
+		u.ID = int64(1)
+		go u.ExpireRecovery(1 * time.Second)
+		time.Sleep(2 * time.Second)
+
+		u, _ = user.Get()
+		So(strings.TrimSpace(u.Recovery), ShouldEqual, "")
+	})
+}
+
+func testEmailVerification(t *testing.T) {
+
+	Convey("Registered user should not be verified", t, func() {
+		verified, err := user.GetVerified()
+		So(err, ShouldBeNil)
+		So(verified, ShouldBeFalse)
+
+		Convey("creating posts should be forbidden", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/post", strings.NewReader(`{"title": "Unverified", "markdown": "Spam"}`))
+			request.Header.Set("Content-Type", "application/json")
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 403)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"Please verify your email address first."}`)
+		})
+
+		Convey("recovering password should be forbidden", func() {
+			err := user.Recover()
+			So(err.Error(), ShouldEqual, "user not verified")
+		})
+
+		Convey("requesting a new link right after registering should be throttled", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/user/verify", nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 429)
+		})
+
+		Convey("tampered or expired tokens should be rejected", func() {
+			_, err := VerifyEmail(user.VerificationToken(time.Now().Add(time.Hour)) + "0")
+			So(err.Error(), ShouldEqual, "verification token invalid")
+			_, err = VerifyEmail(user.VerificationToken(time.Now().Add(-time.Hour)))
+			So(err.Error(), ShouldEqual, "verification token expired")
+		})
+	})
+
+	Convey("Following the verification link", t, func() {
+		var recorder = httptest.NewRecorder()
+		request, _ := http.NewRequest("GET", "/api/user/verify/"+user.VerificationToken(time.Now().Add(VerificationLifetime)), nil)
+		server.ServeHTTP(recorder, request)
+		So(recorder.Code, ShouldEqual, 200)
+		So(recorder.Body.String(), ShouldEqual, `{"success":"Your email address has been verified."}`)
+		verified, err := user.GetVerified()
+		So(err, ShouldBeNil)
+		So(verified, ShouldBeTrue)
+
+		Convey("requesting a new link should conflict", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", "/api/user/verify", nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 409)
+		})
+
+		Convey("verifying by admins should require admin session", func() {
+			var recorder = httptest.NewRecorder()
+			request, _ := http.NewRequest("POST", fmt.Sprintf("/api/user/%d/verify", user.ID), nil)
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 403)
+		})
+	})
+}
+
+func TestPostSecurity(t *testing.T) {
+
+	var s Vertigo
+	s = settings
+	s.AllowRegistrations = true
+	payload, _ := json.Marshal(s)
+
+	testUpdateSettings(t, payload, s)
 
 	settings.AllowRegistrations = true
 
@@ -1337,6 +3366,7 @@ func TestPostSecurity(t *testing.T) {
 
 	testCreateUser(t, user.Name, user.Password, user.Email, user.Location)
 	TestUserSignin(t)
+	testEmailVerification(t)
 
 	Convey("using API", t, func() {
 
@@ -1371,6 +3401,17 @@ func TestPostSecurity(t *testing.T) {
 			So(recorder.Code, ShouldEqual, 401)
 			So(recorder.Body.String(), ShouldEqual, `{"error":"Unauthorized"}`)
 		})
+
+		Convey("updating settings as an author", func() {
+			var recorder = httptest.NewRecorder()
+			payload, _ := json.Marshal(settings)
+			request, _ := http.NewRequest("POST", "/api/settings", bytes.NewReader(payload))
+			request.AddCookie(&http.Cookie{Name: "id", Value: sessioncookie})
+			request.Header.Set("Content-Type", "application/json")
+			server.ServeHTTP(recorder, request)
+			So(recorder.Code, ShouldEqual, 403)
+			So(recorder.Body.String(), ShouldEqual, `{"error":"Forbidden"}`)
+		})
 	})
 }
 
@@ -0,0 +1,3 @@
+// Package metrics collects counters and histograms about the running server and exposes
+// them in Prometheus text exposition format.
+package metrics
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// Requests counts HTTP requests by method, route pattern and status code.
+	Requests = NewCounter("vertigo_http_requests_total", "Number of HTTP requests by route.", "method", "route", "code")
+	// RequestDuration observes time taken to serve HTTP requests by method and route pattern.
+	RequestDuration = NewHistogram("vertigo_http_request_duration_seconds", "Time taken to serve HTTP requests by route.", DefaultBuckets, "method", "route")
+	// QueryDuration observes time taken by database methods, such as "Post.Get".
+	QueryDuration = NewHistogram("vertigo_db_query_duration_seconds", "Time taken by database methods.", DefaultBuckets, "method")
+	// Logins counts login attempts by outcome: "success", "wrong_password", "not_found" or "error".
+	Logins = NewCounter("vertigo_logins_total", "Number of login attempts by outcome.", "outcome")
+	// Sessions counts session events: "created", "deleted" and "rejected" for requests without a valid session.
+	Sessions = NewCounter("vertigo_sessions_total", "Number of session events.", "event")
+	// Emails counts sent emails by kind and result, which is "sent" or "failed".
+	Emails = NewCounter("vertigo_emails_total", "Number of emails sent by kind and result.", "kind", "result")
+	// Webhooks counts webhook delivery attempts by event and result, which is "delivered" or "failed".
+	Webhooks = NewCounter("vertigo_webhook_deliveries_total", "Number of webhook delivery attempts by event and result.", "event", "result")
+	// Webmentions counts Webmentions by direction, "sent" or "received", and result.
+	Webmentions = NewCounter("vertigo_webmentions_total", "Number of Webmentions sent and received by result.", "direction", "result")
+	// Activities counts deliveries of ActivityPub activities by result, which is "delivered" or "failed".
+	Activities = NewCounter("vertigo_activitypub_deliveries_total", "Number of ActivityPub delivery attempts by result.", "result")
+	// Cache counts requests to cached routes by result: "hit", "miss" or "bypass" for logged in users.
+	Cache = NewCounter("vertigo_cache_requests_total", "Number of requests to cached routes by result.", "result")
+)
+
+// Query records time elapsed since start for database method. Meant to be deferred:
+//
+//	defer metrics.Query("Post.Get", time.Now())
+func Query(method string, start time.Time) {
+	QueryDuration.Observe(time.Since(start).Seconds(), method)
+}
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Instrument records request count and duration of handler under given route pattern.
+// Route patterns are used instead of request paths to keep the number of series bounded.
+func Instrument(method, route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		RequestDuration.Observe(time.Since(start).Seconds(), method, route)
+		Requests.Inc(method, route, strconv.Itoa(recorder.status))
+	}
+}
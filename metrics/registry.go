@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector writes its metrics in text exposition format.
+type collector interface {
+	collect(w io.Writer)
+}
+
+var (
+	mu         sync.Mutex
+	collectors []collector
+)
+
+func register(c collector) {
+	mu.Lock()
+	collectors = append(collectors, c)
+	mu.Unlock()
+}
+
+// WriteTo writes all registered metrics to w in Prometheus text exposition format.
+func WriteTo(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	mu.Lock()
+	list := append([]collector(nil), collectors...)
+	mu.Unlock()
+	for _, c := range list {
+		c.collect(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler serves metrics. If token is not empty, requests have to carry it
+// in "Authorization: Bearer <token>" header.
+func Handler(token string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// series is a single combination of label values of a metric.
+type series struct {
+	values []string
+	// value of a counter, or sum of observations of a histogram
+	value float64
+	// count holds cumulative bucket counts of a histogram, the last one being +Inf
+	count []uint64
+}
+
+// family holds all series of a metric.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// get returns series with given label values, creating it if needed. Must be called with f.mu held.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// find returns series with given label values or nil if nothing has been recorded for them.
+func (f *family) find(values []string) *series {
+	return f.series[strings.Join(values, "\xff")]
+}
+
+// sorted returns copies of all series ordered by their label values.
+func (f *family) sorted() []series {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := make([]series, 0, len(f.series))
+	for _, s := range f.series {
+		c := *s
+		c.count = append([]uint64(nil), s.count...)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		for k := range list[i].values {
+			if list[i].values[k] != list[j].values[k] {
+				return list[i].values[k] < list[j].values[k]
+			}
+		}
+		return false
+	})
+	return list
+}
+
+func (f *family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// labelString formats label names and values as {name="value",...}.
+// Extra name and value pair is appended if given, for histogram buckets.
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+escapeLabel(extra[1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+var startTime = time.Now()
+
+// runtimeCollector reports Go runtime statistics using the metric names of the official Prometheus client.
+type runtimeCollector struct{}
+
+func init() {
+	register(runtimeCollector{})
+}
+
+func (runtimeCollector) collect(w io.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+	}
+	counter := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(v))
+	}
+
+	fmt.Fprintf(w, "# HELP go_info Information about the Go environment.\n# TYPE go_info gauge\ngo_info{version=\"%s\"} 1\n", escapeLabel(runtime.Version()))
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(stats.Alloc))
+	counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(stats.TotalAlloc))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(stats.Sys))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(stats.HeapObjects))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(stats.HeapInuse))
+	counter("go_gc_cycles_total", "Number of completed garbage collection cycles.", float64(stats.NumGC))
+	counter("go_gc_pause_seconds_total", "Total time spent in garbage collection pauses.", float64(stats.PauseTotalNs)/1e9)
+	gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", float64(startTime.Unix()))
+}
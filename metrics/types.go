@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Counter is a metric which only goes up, partitioned by label values.
+type Counter struct {
+	family *family
+}
+
+// NewCounter registers a new counter with given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter of given label values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter of given label values. Negative values are ignored.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	c.family.mu.Lock()
+	c.family.get(values).value += v
+	c.family.mu.Unlock()
+}
+
+// Value returns current value of the counter of given label values.
+func (c *Counter) Value(values ...string) float64 {
+	c.family.mu.Lock()
+	defer c.family.mu.Unlock()
+	if s := c.family.find(values); s != nil {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) collect(w io.Writer) {
+	c.family.header(w)
+	for _, s := range c.family.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.family.name, labelString(c.family.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// DefaultBuckets are histogram bucket upper bounds in seconds suitable for request and query durations.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets, partitioned by label values.
+type Histogram struct {
+	family  *family
+	buckets []float64
+}
+
+// NewHistogram registers a new histogram with given bucket upper bounds and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &Histogram{family: newFamily(name, help, "histogram", labels), buckets: b}
+	register(h)
+	return h
+}
+
+// Observe records v in the histogram of given label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.family.mu.Lock()
+	defer h.family.mu.Unlock()
+	s := h.family.get(values)
+	if s.count == nil {
+		s.count = make([]uint64, len(h.buckets)+1)
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.count[i]++
+		}
+	}
+	s.count[len(h.buckets)]++
+	s.value += v
+}
+
+// Count returns the number of observations in the histogram of given label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	h.family.mu.Lock()
+	defer h.family.mu.Unlock()
+	if s := h.family.find(values); s != nil {
+		return s.count[len(h.buckets)]
+	}
+	return 0
+}
+
+func (h *Histogram) collect(w io.Writer) {
+	f := h.family
+	f.header(w)
+	for _, s := range f.sorted() {
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.values, "le", formatFloat(upper)), s.count[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.values, "le", "+Inf"), s.count[len(h.buckets)])
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labelString(f.labels, s.values), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labelString(f.labels, s.values), s.count[len(h.buckets)])
+	}
+}
+
+// GaugeFunc is a metric whose value is read by calling a function on every scrape.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a new gauge which reports the value returned by fn.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) collect(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, escapeHelp(g.help))
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
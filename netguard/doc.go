@@ -0,0 +1,3 @@
+// Package netguard keeps HTTP clients which fetch addresses chosen by other people, such as
+// Webmention sources and ActivityPub actors, from reaching the local network of the server.
+package netguard
@@ -0,0 +1,32 @@
+package netguard
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Public reports whether ip is an address on the public internet.
+func Public(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Control returns a net.Dialer Control function which refuses connections to addresses
+// which are not public, unless allowPrivate reports true. Checking the address being dialed,
+// rather than the host name of the request, also covers redirects and DNS names which resolve
+// to private addresses.
+func Control(allowPrivate func() bool) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		if allowPrivate() {
+			return nil
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if !Public(net.ParseIP(host)) {
+			return fmt.Errorf("address %s is not public", host)
+		}
+		return nil
+	}
+}
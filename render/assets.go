@@ -0,0 +1,145 @@
+package render
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultTemplates and DefaultStatic hold templates and static files of the default theme.
+	// They read from "templates" and "static" directories in the working directory unless replaced,
+	// for example with files embedded into the binary.
+	DefaultTemplates fs.FS = os.DirFS("templates")
+	DefaultStatic    fs.FS = os.DirFS("static")
+)
+
+// Overlay returns a file system which reads files from the first of layers containing them.
+// Directory listings are merged from all layers.
+func Overlay(layers ...fs.FS) fs.FS {
+	return overlay(layers)
+}
+
+type overlay []fs.FS
+
+func (o overlay) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, layer := range o {
+		f, err := layer.Open(name)
+		if err == nil {
+			return f, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (o overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	seen := make(map[string]bool)
+	found := false
+	for _, layer := range o {
+		list, err := fs.ReadDir(layer, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+		for _, entry := range list {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if !found {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fingerprinted matches names of static files with a fingerprint, such as css/style.0123456789.css.
+var fingerprinted = regexp.MustCompile(`^(.+)\.([0-9a-f]{10})(\.[^./]+)$`)
+
+// fingerprints remembers hashes of static files of the current theme by name.
+var fingerprints = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// Fingerprint returns the URL of static file name of the current theme with a hash of its contents
+// in the file name, such as /static/css/style.0123456789.css for css/style.css. The URL changes
+// whenever the file does, so it can be cached by clients indefinitely. If the file cannot be read,
+// its plain URL is returned. Hashes are remembered until another theme is loaded, except in development.
+func Fingerprint(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	hash, err := fileHash(name)
+	if err != nil {
+		return "/static/" + name
+	}
+	ext := path.Ext(name)
+	return "/static/" + strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// Unfingerprint resolves a static file name which may contain a fingerprint. It returns the name
+// of the file to serve and whether the fingerprint matches the current contents of the file,
+// in which case the response can be cached indefinitely. Names without a valid fingerprint are
+// returned as they are. Hashes are remembered like in Fingerprint, so files are not read on every request.
+func Unfingerprint(name string) (string, bool) {
+	m := fingerprinted.FindStringSubmatch(strings.TrimPrefix(name, "/"))
+	if m == nil {
+		return name, false
+	}
+	file := m[1] + m[3]
+	hash, err := fileHash(file)
+	if err != nil {
+		return name, false
+	}
+	if strings.HasPrefix(name, "/") {
+		file = "/" + file
+	}
+	return file, hash == m[2]
+}
+
+// resetFingerprints forgets remembered hashes when static files change.
+func resetFingerprints() {
+	fingerprints.Lock()
+	fingerprints.m = make(map[string]string)
+	fingerprints.Unlock()
+}
+
+// fileHash returns the beginning of the SHA-256 hash of static file name of the current theme.
+// Hashes are remembered except in development, when files may change. Files which can not be read
+// are not remembered, since names of missing files come from requests.
+func fileHash(name string) (string, error) {
+	fingerprints.Lock()
+	// Load replaces the map after switching themes, so a hash of the previous theme
+	// read meanwhile is stored in the map which is thrown away
+	m := fingerprints.m
+	hash, ok := m[name]
+	fingerprints.Unlock()
+	if ok && !Development {
+		return hash, nil
+	}
+	data, err := fs.ReadFile(Current().Static(), name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])[:10]
+	fingerprints.Lock()
+	m[name] = hash
+	fingerprints.Unlock()
+	return hash, nil
+}
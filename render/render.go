@@ -2,25 +2,177 @@ package render
 
 import (
 	"html/template"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
 
+	"github.com/PuerkitoBio/goquery"
 	"github.com/toldjuuso/timezone"
+	"github.com/toldjuuso/vertigo/sanitize"
 	unrolled "github.com/unrolled/render"
 )
 
-var R = unrolled.New(unrolled.Options{
-	Funcs:  []template.FuncMap{helpers},
-	Layout: "layout",
-})
+// Features holds optional features of the site and whether they are enabled.
+// Templates can check them with the feature helper.
+var Features = map[string]bool{}
+
+// Endpoints holds addresses of external endpoints advertised on pages, such as the IndieAuth
+// token endpoint, by name. Endpoints which are not configured are empty.
+var Endpoints = map[string]string{}
+
+// R renders templates of the current theme. It must not be used before a theme is loaded with Load.
+var R = &Renderer{}
+
+// Renderer renders responses with the templates of the theme which was loaded last.
+// It is safe for concurrent use while another theme is being loaded.
+type Renderer struct {
+	current atomic.Pointer[unrolled.Render]
+}
+
+// HTML renders template name of the current theme with binding as the response.
+func (r *Renderer) HTML(w http.ResponseWriter, status int, name string, binding interface{}, htmlOpt ...unrolled.HTMLOptions) error {
+	return r.current.Load().HTML(w, status, name, binding, htmlOpt...)
+}
+
+// JSON renders v as a JSON response.
+func (r *Renderer) JSON(w http.ResponseWriter, status int, v interface{}) error {
+	return r.current.Load().JSON(w, status, v)
+}
+
+// Text renders v as a plain text response.
+func (r *Renderer) Text(w http.ResponseWriter, status int, v string) error {
+	return r.current.Load().Text(w, status, v)
+}
+
+// metadata describes a page for search engines and social media, see the meta helper.
+type metadata struct {
+	// Type is the Open Graph type of the page: "article" for posts and "website" for others.
+	Type        string
+	Title       string
+	Description string
+	// URL is the canonical address of the page, or empty if it has none.
+	URL   string
+	Image string
+	// Data is the JSON-LD description of the page, or nil if it has none.
+	Data map[string]interface{}
+}
+
+// absolute resolves ref against Settings.Hostname. Returns an empty string unless the result
+// is an HTTP address.
+func absolute(ref string) string {
+	base, err := url.Parse(Settings.Hostname)
+	if err != nil || ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// postMetadata returns metadata of post. Its description and image default to the excerpt
+// and the first image of the post.
+func postMetadata(post Post) metadata {
+	meta := metadata{
+		Type:        "article",
+		Title:       post.Title,
+		Description: post.Description,
+		URL:         absolute("/post/" + post.Slug),
+		Image:       absolute(post.Image),
+	}
+	if meta.Description == "" {
+		meta.Description = strings.Join(strings.Fields(post.Excerpt), " ")
+	}
+	if meta.Image == "" {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(post.Content))
+		if err == nil {
+			src, _ := doc.Find("img[src]").First().Attr("src")
+			meta.Image = absolute(src)
+		}
+	}
+	meta.Data = map[string]interface{}{
+		"@context":      "https://schema.org",
+		"@type":         "BlogPosting",
+		"headline":      post.Title,
+		"description":   meta.Description,
+		"datePublished": time.Unix(post.Created, 0).UTC().Format(time.RFC3339),
+		"dateModified":  time.Unix(post.Updated, 0).UTC().Format(time.RFC3339),
+		"author":        map[string]interface{}{"@type": "Person", "name": post.AuthorName, "url": absolute("/")},
+		"publisher":     map[string]interface{}{"@type": "Organization", "name": blogname()},
+	}
+	if meta.URL != "" {
+		meta.Data["url"] = meta.URL
+		meta.Data["mainEntityOfPage"] = meta.URL
+	}
+	if meta.Image != "" {
+		meta.Data["image"] = meta.Image
+	}
+	return meta
+}
+
+// blogname returns the name of the site, or "Blog in Go" if none is defined.
+func blogname() string {
+	if Settings.Name == "" {
+		return "Blog in Go"
+	}
+	return Settings.Name
+}
+
+// description returns the description of the site, or "Blog in Go" if none is defined.
+func description() string {
+	if Settings.Description == "" {
+		return "Blog in Go"
+	}
+	return Settings.Description
+}
 
 var helpers = template.FuncMap{
-	// unescape unescapes HTML of s.
-	// Used in templates such as "/post/display.tmpl"
+	// unescape unescapes HTML of s after sanitizing it with the strict policy.
 	"unescape": func(s string) template.HTML {
-		return template.HTML(s)
+		return template.HTML(sanitize.Strict.Sanitize(s))
+	},
+	// content unescapes post's Content after sanitizing it with the policy of the author's role.
+	// Used in templates such as "/post/display.tmpl"
+	"content": func(p Post) template.HTML {
+		return template.HTML(sanitize.ForRole(p.AuthorRole).Sanitize(p.Content))
+	},
+	// webmentions returns verified Webmentions of post, grouped by kind: "like", "repost", "reply" and "mention".
+	// Used in "/post/display.tmpl"
+	"webmentions": func(p Post) map[string][]Webmention {
+		mentions, err := p.Webmentions()
+		if err != nil {
+			log.Println("template helper webmentions, post.Webmentions:", err)
+		}
+		kinds := make(map[string][]Webmention)
+		for _, mention := range mentions {
+			kinds[mention.Kind] = append(kinds[mention.Kind], mention)
+		}
+		return kinds
+	},
+	// comments returns replies to post received over ActivityPub, oldest first.
+	// Used in "/post/display.tmpl"
+	"comments": func(p Post) []Comment {
+		comments, err := p.Comments()
+		if err != nil {
+			log.Println("template helper comments, post.Comments:", err)
+		}
+		return comments
+	},
+	// object returns the address of the ActivityPub object of page data t if it is a post
+	// and ActivityPub is enabled, or an empty string otherwise. Used in "/layout.tmpl"
+	"object": func(t interface{}) string {
+		post, exists := t.(Post)
+		if !exists || !post.Published || !Features["activitypub"] {
+			return ""
+		}
+		return ObjectURL(post)
 	},
 	// title renders post's Title as the HTML document's title.
 	"title": func(t interface{}) string {
@@ -30,19 +182,35 @@ var helpers = template.FuncMap{
 		}
 		return Settings.Name
 	},
-	"blogname": func() string {
-		if Settings.Name == "" {
-			return "Blog in Go"
-		}
-		return Settings.Name
-	},
+	"blogname": blogname,
 	// description renders page description.
 	// If none is defined, returns "Blog in Go" instead.
-	"description": func() string {
-		if Settings.Description == "" {
-			return "Blog in Go"
+	"description": description,
+	// meta returns metadata of the page rendered from template name with data t: the post for
+	// "post/display" and the site for others. Only posts and "home" have a canonical address.
+	// Used in "/layout.tmpl"
+	"meta": func(name string, t interface{}) metadata {
+		if post, exists := t.(Post); exists && name == "post/display" {
+			return postMetadata(post)
+		}
+		meta := metadata{Type: "website", Title: blogname(), Description: description()}
+		if name == "home" {
+			meta.URL = absolute("/")
+		}
+		return meta
+	},
+	// author returns the author of post as loaded with the post, without their posts.
+	// Used in "/post/display.tmpl"
+	"author": func(p Post) User {
+		return User{ID: p.Author, Name: p.AuthorName, Role: p.AuthorRole}
+	},
+	// owner returns the owner of the site, see SiteOwner. Used in "/home.tmpl"
+	"owner": func() User {
+		user, err := SiteOwner()
+		if err != nil {
+			log.Println("template helper owner, SiteOwner:", err)
 		}
-		return Settings.Description
+		return user
 	},
 	// updated checks if post has been updated.
 	"updated": func(p Post) bool {
@@ -58,8 +226,9 @@ var helpers = template.FuncMap{
 	"shortdate": func(d int64, offset int) string {
 		return time.Unix(d, 0).UTC().In(time.FixedZone("", offset)).Format("02 Jan 2006")
 	},
+	// iso8601 formats unix date d with offset for datetime attributes, such as 2006-01-02T15:04:05+02:00.
 	"iso8601": func(d int64, offset int) string {
-		return time.Unix(d, 0).UTC().In(time.FixedZone("", offset)).Format("2006-01-02T15:04:05+07:00")
+		return time.Unix(d, 0).UTC().In(time.FixedZone("", offset)).Format(time.RFC3339)
 	},
 	// env returns environment variable of s.
 	"env": func(s string) string {
@@ -69,6 +238,24 @@ var helpers = template.FuncMap{
 	"timezones": func() []timezone.Timezone {
 		return timezone.Locations
 	},
+	// themes returns all installed themes for the theme selector on settings.tmpl.
+	"themes": func() []Theme {
+		themes, err := Themes()
+		if err != nil {
+			log.Println("template helper themes, Themes:", err)
+		}
+		return themes
+	},
+	// asset returns the fingerprinted URL of a static file, see Fingerprint.
+	"asset": Fingerprint,
+	// feature returns whether optional feature with given name is enabled.
+	"feature": func(name string) bool {
+		return Features[name]
+	},
+	// endpoint returns the address of external endpoint with given name, see Endpoints.
+	"endpoint": func(name string) string {
+		return Endpoints[name]
+	},
 	// returns whether registrations are allowed on user/login.tmpl
 	"registerationsallowed": func() bool {
 		return Settings.AllowRegistrations
@@ -0,0 +1,277 @@
+package render
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	unrolled "github.com/unrolled/render"
+)
+
+// Theme is a directory which contains "templates" and "static" directories and a
+// "theme.json" metadata file. Themes are placed in ThemesDirectory, one directory per theme,
+// named after the theme. Templates and static files missing from a theme are read from the default theme,
+// see DefaultTemplates and DefaultStatic.
+type Theme struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Version     string `json:"version"`
+	Path        string `json:"-"`
+}
+
+// DefaultTheme is the name of the theme which ships with Vertigo.
+const DefaultTheme = "default"
+
+var (
+	// ThemesDirectory is the directory in which installed themes are looked for.
+	ThemesDirectory = "themes"
+	// Development recompiles templates on every request, so changes in template files
+	// are visible without restarting the server. Takes effect on next Load.
+	Development = false
+	// MaxThemeSize and MaxThemeFiles limit the total size and number of files extracted
+	// from a theme archive, so that a small archive can not fill the disk.
+	MaxThemeSize  int64 = 50 << 20
+	MaxThemeFiles       = 1000
+)
+
+// current is the theme used to render pages, see Current.
+var current atomic.Pointer[Theme]
+
+func init() {
+	current.Store(&Theme{Name: DefaultTheme, Description: "Default theme of Vertigo"})
+}
+
+// Current returns the theme used to render pages.
+func Current() Theme {
+	return *current.Load()
+}
+
+var themeName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Templates returns templates of the theme, falling back to the default theme.
+func (theme Theme) Templates() fs.FS {
+	if theme.Name == DefaultTheme {
+		return DefaultTemplates
+	}
+	return Overlay(os.DirFS(filepath.Join(theme.Path, "templates")), DefaultTemplates)
+}
+
+// Static returns static files of the theme, falling back to the default theme.
+func (theme Theme) Static() fs.FS {
+	if theme.Name == DefaultTheme {
+		return DefaultStatic
+	}
+	return Overlay(os.DirFS(filepath.Join(theme.Path, "static")), DefaultStatic)
+}
+
+// Themes returns all installed themes, the default theme first.
+func Themes() ([]Theme, error) {
+	themes := []Theme{{Name: DefaultTheme, Description: "Default theme of Vertigo"}}
+	dirs, err := ioutil.ReadDir(ThemesDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return themes, nil
+		}
+		return themes, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == DefaultTheme {
+			continue
+		}
+		theme, err := GetTheme(dir.Name())
+		if err != nil {
+			continue
+		}
+		themes = append(themes, theme)
+	}
+	return themes, nil
+}
+
+// GetTheme reads metadata of the theme with given name from its theme.json file.
+func GetTheme(name string) (Theme, error) {
+	var theme Theme
+	if name == "" || name == DefaultTheme {
+		return Theme{Name: DefaultTheme, Description: "Default theme of Vertigo"}, nil
+	}
+	if !themeName.MatchString(name) {
+		return theme, errors.New("not found")
+	}
+	dir := filepath.Join(ThemesDirectory, name)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "theme.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return theme, errors.New("not found")
+		}
+		return theme, err
+	}
+	err = json.Unmarshal(data, &theme)
+	if err != nil {
+		return theme, err
+	}
+	theme.Name = name
+	theme.Path = dir
+	return theme, nil
+}
+
+// Load compiles templates of the theme with given name and makes it the current theme.
+// Templates which fail to compile are returned as an error and the previous theme is kept.
+func Load(name string) (err error) {
+	theme, err := GetTheme(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// unrolled/render panics on template syntax errors
+		if r := recover(); r != nil {
+			err = fmt.Errorf("theme %s: %v", theme.Name, r)
+		}
+	}()
+	r := unrolled.New(unrolled.Options{
+		Directory:     "templates",
+		Asset:         asset(theme),
+		AssetNames:    assetNames(theme),
+		Funcs:         []template.FuncMap{helpers},
+		Layout:        "layout",
+		IsDevelopment: Development,
+	})
+	R.current.Store(r)
+	current.Store(&theme)
+	resetFingerprints()
+	return nil
+}
+
+// assetNames lists templates of the theme as "templates/<name>".
+func assetNames(theme Theme) func() []string {
+	return func() []string {
+		var names []string
+		fs.WalkDir(theme.Templates(), ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			names = append(names, path.Join("templates", p))
+			return nil
+		})
+		return names
+	}
+}
+
+// asset reads a template of the theme.
+func asset(theme Theme) func(name string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		return fs.ReadFile(theme.Templates(), strings.TrimPrefix(name, "templates/"))
+	}
+}
+
+// Static serves static files of the current theme, falling back to the default theme.
+var Static http.FileSystem = staticFileSystem{}
+
+type staticFileSystem struct{}
+
+func (staticFileSystem) Open(name string) (http.File, error) {
+	return http.FS(Current().Static()).Open(name)
+}
+
+// InstallTheme extracts a theme from a zip archive into ThemesDirectory.
+// The archive must contain theme.json in its root. The theme is named after the "name" field
+// of theme.json and only theme.json and files under "templates" and "static" are extracted.
+// Returns "theme archive too large" error if the extracted files would exceed MaxThemeSize
+// or MaxThemeFiles.
+func InstallTheme(r io.ReaderAt, size int64) (Theme, error) {
+	var theme Theme
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return theme, errors.New("theme archive invalid")
+	}
+
+	var metadata *zip.File
+	for _, f := range archive.File {
+		if f.Name == "theme.json" {
+			metadata = f
+		}
+	}
+	if metadata == nil {
+		return theme, errors.New("theme metadata missing")
+	}
+	rc, err := metadata.Open()
+	if err != nil {
+		return theme, err
+	}
+	err = json.NewDecoder(rc).Decode(&theme)
+	rc.Close()
+	if err != nil {
+		return theme, errors.New("theme metadata invalid")
+	}
+	if !themeName.MatchString(theme.Name) || theme.Name == DefaultTheme {
+		return theme, errors.New("theme name invalid")
+	}
+
+	dir := filepath.Join(ThemesDirectory, theme.Name)
+	if _, err := os.Stat(dir); err == nil {
+		return theme, errors.New("theme exists")
+	}
+
+	remaining := MaxThemeSize
+	files := 0
+	for _, f := range archive.File {
+		name := path.Clean(f.Name)
+		if f.FileInfo().IsDir() || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+			continue
+		}
+		if name != "theme.json" && !strings.HasPrefix(name, "templates/") && !strings.HasPrefix(name, "static/") {
+			continue
+		}
+		files++
+		if files > MaxThemeFiles {
+			os.RemoveAll(dir)
+			return theme, errors.New("theme archive too large")
+		}
+		n, err := extract(f, filepath.Join(dir, filepath.FromSlash(name)), remaining)
+		if err != nil {
+			os.RemoveAll(dir)
+			return theme, err
+		}
+		remaining -= n
+	}
+	theme.Path = dir
+	return theme, nil
+}
+
+// extract writes f to dst and returns its size. Sizes in zip headers can not be trusted,
+// so at most limit bytes are read and "theme archive too large" error is returned if f is larger.
+func extract(f *zip.File, dst string, limit int64) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, io.LimitReader(rc, limit+1))
+	if err != nil {
+		return n, err
+	}
+	if n > limit {
+		return n, errors.New("theme archive too large")
+	}
+	return n, nil
+}
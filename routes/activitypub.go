@@ -0,0 +1,332 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/toldjuuso/vertigo/activitypub"
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+	. "github.com/toldjuuso/vertigo/session"
+
+	"github.com/husobee/vestigo"
+)
+
+// activityJSON writes v as an ActivityPub document, or with given content type.
+func activityJSON(w http.ResponseWriter, code int, v interface{}, contentType string) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// federate queues activities of content event of post to ActivityPub followers of its author.
+func federate(r *http.Request, route string, event string, data interface{}) {
+	post, ok := data.(Post)
+	if !ok || !render.Features["activitypub"] {
+		return
+	}
+	err := Federate(event, post)
+	if err != nil {
+		logging.Request(r).Error("Federate failed", "route", route, "event", event, "error", err)
+	}
+}
+
+// actorUser returns the user whose actor is requested. Responds with HTTP 404 if there is none.
+func actorUser(w http.ResponseWriter, r *http.Request, route string) (User, bool) {
+	var user User
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+		return user, false
+	}
+	user, err = User{ID: id}.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return user, false
+		}
+		logging.Request(r).Error("user.Get failed", "route", route, "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return user, false
+	}
+	return user, true
+}
+
+// WebFinger is a route which tells ActivityPub servers the actor of an address such as
+// acct:foo@example.com given as "resource" query parameter, see https://www.rfc-editor.org/rfc/rfc7033.
+// Actor IDs are also accepted as resource.
+func WebFinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Resource query parameter is required."})
+		return
+	}
+	site, _ := url.Parse(Settings.Hostname)
+	var user User
+	var err error
+	if strings.HasPrefix(resource, "acct:") {
+		name, host, _ := strings.Cut(strings.TrimPrefix(resource, "acct:"), "@")
+		if site == nil || !strings.EqualFold(host, site.Host) {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		user, err = UserByUsername(name)
+	} else {
+		var id int64
+		id, err = ActorID(resource)
+		if err == nil {
+			user, err = User{ID: id}.Get()
+		}
+	}
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("UserByUsername failed", "route", "WebFinger", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	username, err := user.Username()
+	if err != nil {
+		logging.Request(r).Error("user.Username failed", "route", "WebFinger", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	activityJSON(w, 200, map[string]interface{}{
+		"subject": "acct:" + username + "@" + site.Host,
+		"aliases": []string{ActorURL(user.ID)},
+		"links": []map[string]string{
+			{"rel": "self", "type": activitypub.ContentType, "href": ActorURL(user.ID)},
+			{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": strings.TrimRight(Settings.Hostname, "/") + "/"},
+		},
+	}, "application/jrd+json")
+}
+
+// ReadActor is a route which returns the ActivityPub actor of user with given ID.
+func ReadActor(w http.ResponseWriter, r *http.Request) {
+	user, ok := actorUser(w, r, "ReadActor")
+	if !ok {
+		return
+	}
+	actor, err := user.Actor()
+	if err != nil {
+		logging.Request(r).Error("user.Actor failed", "route", "ReadActor", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	activityJSON(w, 200, actor, activitypub.ContentType)
+}
+
+// ReadActorOutbox is a route which returns Create activities of the published posts of user
+// with given ID as an ActivityPub collection, newest first.
+func ReadActorOutbox(w http.ResponseWriter, r *http.Request) {
+	user, ok := actorUser(w, r, "ReadActorOutbox")
+	if !ok {
+		return
+	}
+	items, err := user.Outbox()
+	if err != nil {
+		logging.Request(r).Error("user.Outbox failed", "route", "ReadActorOutbox", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	activityJSON(w, 200, map[string]interface{}{
+		"@context":     activitypub.Context,
+		"id":           ActorURL(user.ID) + "/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	}, activitypub.ContentType)
+}
+
+// ReadActorFollowers is a route which returns the number of followers of user with given ID
+// as an ActivityPub collection. The followers themselves are not listed.
+func ReadActorFollowers(w http.ResponseWriter, r *http.Request) {
+	user, ok := actorUser(w, r, "ReadActorFollowers")
+	if !ok {
+		return
+	}
+	followers, err := Followers(user.ID)
+	if err != nil {
+		logging.Request(r).Error("Followers failed", "route", "ReadActorFollowers", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	activityJSON(w, 200, map[string]interface{}{
+		"@context":   activitypub.Context,
+		"id":         ActorURL(user.ID) + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": len(followers),
+	}, activitypub.ContentType)
+}
+
+// ReadObject is a route which returns published post with given ID as an ActivityPub Article.
+func ReadObject(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+		return
+	}
+	post, err := ObjectPost(ObjectURL(Post{ID: id}))
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("ObjectPost failed", "route", "ReadObject", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	object := post.Object()
+	object["@context"] = activitypub.Context
+	activityJSON(w, 200, object, activitypub.ContentType)
+}
+
+// Inbox is a route which receives activities from other servers, sent to the inbox of the actor
+// of user with given ID or to the shared inbox. Requests must have an HTTP signature of the actor
+// of the activity. Responds with HTTP 202 when the activity has been handled, see ReceiveActivity.
+func Inbox(w http.ResponseWriter, r *http.Request) {
+	var owner int64
+	if vestigo.Param(r, "id") != "" {
+		user, ok := actorUser(w, r, "Inbox")
+		if !ok {
+			return
+		}
+		owner = user.ID
+	} else {
+		user, err := SiteOwner()
+		if err != nil {
+			logging.Request(r).Error("SiteOwner failed", "route", "Inbox", "error", err)
+			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+			return
+		}
+		owner = user.ID
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		render.R.JSON(w, 413, map[string]interface{}{"error": "Activity is too large."})
+		return
+	}
+	var received activitypub.Activity
+	err = json.Unmarshal(body, &received)
+	if err != nil || received.Type == "" {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Activity must be JSON with type, actor and object."})
+		return
+	}
+	keyID := activitypub.KeyID(r)
+	if keyID == "" {
+		render.R.JSON(w, 401, map[string]interface{}{"error": "Request must have an HTTP signature."})
+		return
+	}
+	key, err := SigningKey(owner)
+	if err != nil {
+		logging.Request(r).Error("SigningKey failed", "route", "Inbox", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	actor, err := activitypub.FetchActor(activitypub.Owner(keyID), key)
+	if err != nil {
+		// deleted accounts announce it after their actor is gone, and nothing is stored of unknown ones
+		if err.Error() == "not found" && received.Type == "Delete" {
+			w.WriteHeader(202)
+			return
+		}
+		logging.Request(r).Warn("could not fetch actor", "route", "Inbox", "key", keyID, "error", err)
+		render.R.JSON(w, 401, map[string]interface{}{"error": "Signature could not be verified."})
+		return
+	}
+	if actor.PublicKey.ID != keyID || activitypub.Verify(r, body, actor.PublicKey.PublicKeyPem) != nil {
+		render.R.JSON(w, 401, map[string]interface{}{"error": "Signature could not be verified."})
+		return
+	}
+	err = ReceiveActivity(actor, received)
+	if err != nil {
+		if err.Error() == "activity invalid" {
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Activity must be made by the signer and have an object."})
+			return
+		}
+		logging.Request(r).Error("ReceiveActivity failed", "route", "Inbox", "type", received.Type, "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	w.WriteHeader(202)
+}
+
+// ReadFollowers is a route which returns ActivityPub followers of the logged in user in order of following.
+// Requires active session cookie.
+func ReadFollowers(w http.ResponseWriter, r *http.Request) {
+	id, _ := SessionGetValue(r, "id")
+	followers, err := Followers(id)
+	if err != nil {
+		logging.Request(r).Error("Followers failed", "route", "ReadFollowers", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, followers)
+}
+
+// DeleteFollower is a route which removes follower with given ID of the logged in user.
+// Requires active session cookie.
+func DeleteFollower(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Follower ID could not be parsed from request URL."})
+		return
+	}
+	owner, _ := SessionGetValue(r, "id")
+	err = Follower{ID: id, Owner: owner}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("follower.Delete failed", "route", "DeleteFollower", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Follower removed"})
+}
+
+// ReadComments is a route which returns comments received from other servers, newest first.
+// Requires admin session cookie.
+func ReadComments(w http.ResponseWriter, r *http.Request) {
+	comments, err := Comments()
+	if err != nil {
+		logging.Request(r).Error("Comments failed", "route", "ReadComments", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, comments)
+}
+
+// DeleteComment is a route which removes comment with given ID.
+// Requires admin session cookie.
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Comment ID could not be parsed from request URL."})
+		return
+	}
+	err = Comment{ID: id}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("comment.Delete failed", "route", "DeleteComment", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Comment deleted"})
+}
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/toldjuuso/vertigo/backup"
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+)
+
+// maxArchiveSize limits the size of uploaded site archives.
+const maxArchiveSize = 256 << 20
+
+// ExportSite is a route which streams an archive of the whole site, see package backup.
+// Password digests, themes and uploaded files are included unless "digests", "themes" or "media" query parameter is false,
+// and the cookie secret only if "cookiehash" is true. The SMTP password, ActivityPub keys, webhook secrets
+// and the outbox are included only if "secrets" is true.
+// Requires admin session cookie.
+func ExportSite(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	options := backup.Options{
+		Digests:    query.Get("digests") != "false",
+		CookieHash: query.Get("cookiehash") == "true",
+		Secrets:    query.Get("secrets") == "true",
+		Themes:     query.Get("themes") != "false",
+		Media:      query.Get("media") != "false",
+	}
+	name := fmt.Sprintf("vertigo-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	_, err := backup.Export(w, options)
+	if err != nil {
+		// headers and part of the archive are already sent, so the archive is left truncated
+		logging.Request(r).Error("backup.Export failed", "route", "ExportSite", "error", err)
+	}
+}
+
+// ImportSite is a route which restores an archive written by ExportSite, sent as the request body.
+// Unless "replace" query parameter is true, the site must not have any users, posts or settings.
+// The session cookie secret stays the same until restart.
+// Requires admin session cookie.
+func ImportSite(w http.ResponseWriter, r *http.Request) {
+	manifest, err := backup.Import(http.MaxBytesReader(w, r.Body, maxArchiveSize), r.URL.Query().Get("replace") == "true")
+	if err != nil {
+		logging.Request(r).Error("backup.Import failed", "route", "ImportSite", "error", err)
+		switch err.Error() {
+		case "archive invalid", "archive manifest invalid", "archive manifest missing", "archive data invalid", "archive data missing":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Archive must be a file written by export."})
+			return
+		case "archive version unsupported", "backup version unsupported":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Archive was written by a newer version of Vertigo."})
+			return
+		case "database not empty":
+			render.R.JSON(w, 409, map[string]interface{}{"error": "Site has data. Set replace to true to overwrite it."})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	if Settings.Theme != "" && Settings.Theme != render.Current().Name {
+		err = render.Load(Settings.Theme)
+		if err != nil {
+			logging.Request(r).Error("render.Load failed", "route", "ImportSite", "error", err)
+		}
+	}
+	render.R.JSON(w, 200, manifest)
+}
@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/mailer"
+	"github.com/toldjuuso/vertigo/render"
+
+	"github.com/husobee/vestigo"
+)
+
+// maxEmailTemplateSize limits the size of email templates sent by admins.
+const maxEmailTemplateSize = 1 << 20
+
+// emailTemplate is an email template with its source, "database" or "theme".
+type emailTemplate struct {
+	mailer.Template
+	Source string `json:"source"`
+}
+
+// ReadEmailTemplates is a route which returns all email templates.
+// Requires admin session cookie.
+func ReadEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	templates := make([]emailTemplate, 0)
+	for _, name := range mailer.Names {
+		template, source, err := GetEmailTemplate(name)
+		if err != nil {
+			logging.Request(r).Error("GetEmailTemplate failed", "route", "ReadEmailTemplates", "error", err)
+			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+			return
+		}
+		templates = append(templates, emailTemplate{template, source})
+	}
+	render.R.JSON(w, 200, templates)
+}
+
+// ReadEmailTemplate is a route which returns email template with given name.
+// Requires admin session cookie.
+func ReadEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	template, source, err := GetEmailTemplate(vestigo.Param(r, "name"))
+	if err != nil {
+		logging.Request(r).Error("GetEmailTemplate failed", "route", "ReadEmailTemplate", "error", err)
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, emailTemplate{template, source})
+}
+
+// readEmailTemplate decodes an email template with given name from JSON request body.
+func readEmailTemplate(w http.ResponseWriter, r *http.Request, name string) (mailer.Template, error) {
+	var template mailer.Template
+	err := json.NewDecoder(io.LimitReader(r.Body, maxEmailTemplateSize)).Decode(&template)
+	template.Name = name
+	return template, err
+}
+
+// UpdateEmailTemplate is a route which saves an edited email template, sent as JSON with
+// "subject", "text" and "html" fields. It is used instead of the template of the theme.
+// Requires admin session cookie.
+func UpdateEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	name := vestigo.Param(r, "name")
+	if !mailer.Known(name) {
+		render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+		return
+	}
+	template, err := readEmailTemplate(w, r, name)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Email template must be JSON with subject, text and html fields."})
+		return
+	}
+	err = template.Parse()
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Email template is invalid: " + err.Error()})
+		return
+	}
+	saved, err := EmailTemplate{Name: name, Subject: template.Subject, Text: template.Text, HTML: template.HTML}.Save()
+	if err != nil {
+		logging.Request(r).Error("emailTemplate.Save failed", "route", "UpdateEmailTemplate", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, saved)
+}
+
+// DeleteEmailTemplate is a route which removes edits of email template with given name,
+// so the template of the theme is used again.
+// Requires admin session cookie.
+func DeleteEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	name := vestigo.Param(r, "name")
+	if !mailer.Known(name) {
+		render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+		return
+	}
+	err := EmailTemplate{Name: name}.Delete()
+	if err != nil {
+		logging.Request(r).Error("emailTemplate.Delete failed", "route", "DeleteEmailTemplate", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Email template was reset to the one of the theme."})
+}
+
+// PreviewEmailTemplate is a route which renders email template with given name with sample data.
+// On POST, a draft of the template sent like to UpdateEmailTemplate is rendered instead.
+// Responds with JSON, or with the HTML or plain text body if "format" query parameter is "html" or "text".
+// Requires admin session cookie.
+func PreviewEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	name := vestigo.Param(r, "name")
+	template, _, err := GetEmailTemplate(name)
+	if err != nil {
+		logging.Request(r).Error("GetEmailTemplate failed", "route", "PreviewEmailTemplate", "error", err)
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	if r.Method == "POST" {
+		template, err = readEmailTemplate(w, r, name)
+		if err != nil {
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Email template must be JSON with subject, text and html fields."})
+			return
+		}
+	}
+	message, err := PreviewEmail(template)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Email template is invalid: " + err.Error()})
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.Write([]byte(message.HTML))
+	case "text":
+		render.R.Text(w, 200, message.Body)
+	default:
+		render.R.JSON(w, 200, map[string]interface{}{
+			"subject": message.Subject,
+			"from":    message.From.String(),
+			"to":      message.To.String(),
+			"text":    message.Body,
+			"html":    message.HTML,
+		})
+	}
+}
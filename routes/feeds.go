@@ -1,11 +1,11 @@
 package routes
 
 import (
-	"log"
 	"net/http"
 	"time"
 
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
 	"github.com/toldjuuso/vertigo/render"
 
 	"github.com/gorilla/feeds"
@@ -26,7 +26,7 @@ func ReadFeed(w http.ResponseWriter, r *http.Request) {
 	var post Post
 	posts, err := post.GetAll()
 	if err != nil {
-		log.Println("route ReadFeed, post.GetAll:", err)
+		logging.Request(r).Error("post.GetAll failed", "route", "ReadFeed", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -37,7 +37,7 @@ func ReadFeed(w http.ResponseWriter, r *http.Request) {
 		user.ID = post.Author
 		user, err := user.Get()
 		if err != nil {
-			log.Println("route ReadFeed, user.Get:", err)
+			logging.Request(r).Error("user.Get failed", "route", "ReadFeed", "error", err)
 			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 			return
 		}
@@ -62,7 +62,7 @@ func ReadFeed(w http.ResponseWriter, r *http.Request) {
 
 	result, err := feed.ToRss()
 	if err != nil {
-		log.Println("route ReadFeed, feed.ToRss:", err)
+		logging.Request(r).Error("feed.ToRss failed", "route", "ReadFeed", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+)
+
+// HealthCheck is a route which reports that the process is alive. It does not touch the database,
+// so a failing database does not get the process restarted.
+func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	render.R.JSON(w, 200, map[string]interface{}{"status": "ok"})
+}
+
+// ReadinessCheck is a route which reports whether the site can serve requests: the database
+// answers, all migrations have been applied, settings have been loaded and the installation wizard
+// has been completed. Responds with 503 and details of failed checks otherwise.
+func ReadinessCheck(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"database":     "ok",
+		"migrations":   "ok",
+		"settings":     "ok",
+		"installation": "ok",
+	}
+	ready := true
+	fail := func(check, reason string) {
+		checks[check] = reason
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	err := Ping(ctx)
+	if err != nil {
+		logging.Request(r).Warn("Ping failed", "route", "ReadinessCheck", "error", err)
+		fail("database", "unavailable")
+		fail("migrations", "unknown")
+	} else {
+		pending, err := Pending()
+		if err != nil {
+			logging.Request(r).Warn("Pending failed", "route", "ReadinessCheck", "error", err)
+			fail("migrations", "unknown")
+		} else if len(pending) > 0 {
+			fail("migrations", fmt.Sprintf("%d pending", len(pending)))
+		}
+	}
+
+	if Settings == nil {
+		fail("settings", "not loaded")
+		fail("installation", "unknown")
+	} else if Settings.Firstrun {
+		fail("installation", "not completed")
+	}
+
+	if !ready {
+		render.R.JSON(w, 503, map[string]interface{}{"status": "unavailable", "checks": checks})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"status": "ready", "checks": checks})
+}
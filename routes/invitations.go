@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+	. "github.com/toldjuuso/vertigo/session"
+
+	"github.com/husobee/vestigo"
+)
+
+// ReadInvitations is a route which returns all invitations, newest first.
+// Requires admin session cookie.
+func ReadInvitations(w http.ResponseWriter, r *http.Request) {
+	invitations, err := Invitations()
+	if err != nil {
+		logging.Request(r).Error("Invitations failed", "route", "ReadInvitations", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, invitations)
+}
+
+// CreateInvitation is a route which creates an invitation, sent as JSON with optional "email",
+// "role", "maxuses" and "expires" fields, and returns it with its registration link.
+// Requires admin session cookie.
+func CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	var invitation Invitation
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&invitation)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Invitation must be JSON with email, role, maxuses and expires fields."})
+		return
+	}
+	invitation.Creator, _ = SessionGetValue(r, "id")
+	invitation, err = invitation.Insert()
+	if err != nil {
+		logging.Request(r).Error("invitation.Insert failed", "route", "CreateInvitation", "error", err)
+		switch err.Error() {
+		case "invitation invalid":
+			render.R.JSON(w, 422, map[string]interface{}{"error": "Role must be admin or author and maxuses must not be negative."})
+			return
+		case "invitation expired":
+			render.R.JSON(w, 422, map[string]interface{}{"error": "Expiration time must be in the future."})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, invitation)
+}
+
+// DeleteInvitation is a route which revokes invitation with given ID.
+// Requires admin session cookie.
+func DeleteInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Invitation ID could not be parsed from request URL."})
+		return
+	}
+	err = Invitation{ID: id}.Delete()
+	if err != nil {
+		logging.Request(r).Error("invitation.Delete failed", "route", "DeleteInvitation", "error", err)
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Invitation revoked"})
+}
@@ -0,0 +1,646 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/toldjuuso/excerpt"
+	"github.com/toldjuuso/vertigo/config"
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/indieauth"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+
+	"github.com/husobee/vestigo"
+)
+
+// MicropubConfig holds settings of the Micropub and media endpoints. It is set on startup.
+var MicropubConfig = config.Default().Micropub
+
+// mediaTypes lists types of files which can be uploaded to the media endpoint and their extensions.
+var mediaTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+	"audio/mpeg": ".mp3",
+}
+
+// mediaName matches names of uploaded files, see saveMedia.
+var mediaName = regexp.MustCompile(`^[0-9a-f]{32}\.[a-z0-9]+$`)
+
+// micropubError responds with an error as described in the Micropub specification.
+func micropubError(w http.ResponseWriter, code int, kind string, description string) {
+	render.R.JSON(w, code, map[string]interface{}{"error": kind, "error_description": description})
+}
+
+// micropubClient is the user a Micropub request is made on behalf of and the scopes it has been given.
+type micropubClient struct {
+	User  User
+	Scope string
+}
+
+// can reports whether client has been given scope. The "post" scope of older clients
+// counts as "create".
+func (client micropubClient) can(scope string) bool {
+	for _, s := range strings.Fields(client.Scope) {
+		if s == scope || (s == "post" && scope == "create") {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the access token of request from Authorization header or from
+// access_token form value.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return r.URL.Query().Get("access_token")
+	}
+	return r.FormValue("access_token")
+}
+
+// micropubAuth authenticates request with an API token, or with an IndieAuth token issued to
+// the address of the site if token endpoint is configured. IndieAuth tokens act on behalf of
+// SiteOwner. Responds with an error and returns false if the request is not allowed.
+func micropubAuth(w http.ResponseWriter, r *http.Request) (micropubClient, bool) {
+	var client micropubClient
+	secret := bearerToken(r)
+	if secret == "" {
+		micropubError(w, 401, "unauthorized", "Access token is missing.")
+		return client, false
+	}
+	token, user, err := Authenticate(secret)
+	switch {
+	case err == nil:
+		client = micropubClient{user, token.Scope}
+	case err.Error() != "not found":
+		logging.Request(r).Error("Authenticate failed", "route", "Micropub", "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+		return client, false
+	case MicropubConfig.TokenEndpoint == "":
+		micropubError(w, 401, "unauthorized", "Access token is invalid.")
+		return client, false
+	default:
+		verified, err := indieauth.Verify(MicropubConfig.TokenEndpoint, secret)
+		if err != nil {
+			if err.Error() == "token invalid" {
+				micropubError(w, 401, "unauthorized", "Access token is invalid.")
+				return client, false
+			}
+			logging.Request(r).Error("indieauth.Verify failed", "route", "Micropub", "error", err)
+			micropubError(w, 502, "server_error", "Access token could not be verified.")
+			return client, false
+		}
+		if !indieauth.SameSite(verified.Me, Settings.Hostname) {
+			micropubError(w, 403, "forbidden", "Access token has been issued to "+verified.Me+", not to this site.")
+			return client, false
+		}
+		user, err = SiteOwner()
+		if err != nil {
+			logging.Request(r).Error("SiteOwner failed", "route", "Micropub", "error", err)
+			micropubError(w, 500, "server_error", "Internal server error")
+			return client, false
+		}
+		client = micropubClient{user, verified.Scope}
+	}
+	if !client.User.Verified {
+		micropubError(w, 403, "forbidden", "Please verify your email address first.")
+		return client, false
+	}
+	return client, true
+}
+
+// micropubRequest is a create, update, delete or undelete request, sent either as JSON or as
+// form values. Form encoded properties are turned into their JSON form.
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	Delete     interface{}              `json:"delete"`
+	// files are photos uploaded with a multipart request.
+	files []*multipart.FileHeader
+}
+
+// parseMicropub reads request r.
+func parseMicropub(r *http.Request) (micropubRequest, error) {
+	var request micropubRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		return request, err
+	}
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(1 << 20)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		return request, err
+	}
+	request.Action = r.PostFormValue("action")
+	request.URL = r.PostFormValue("url")
+	if h := r.PostFormValue("h"); h != "" {
+		request.Type = []string{"h-" + h}
+	}
+	request.Properties = make(map[string][]interface{})
+	for key, values := range r.PostForm {
+		switch key {
+		case "h", "action", "url", "access_token":
+			continue
+		}
+		key = strings.TrimSuffix(key, "[]")
+		for _, value := range values {
+			request.Properties[key] = append(request.Properties[key], value)
+		}
+	}
+	if r.MultipartForm != nil {
+		request.files = append(r.MultipartForm.File["photo"], r.MultipartForm.File["photo[]"]...)
+	}
+	return request, nil
+}
+
+// propertyText returns the first of values as text. Content given as {"html": ...} or
+// {"value": ...} object is also returned as text.
+func propertyText(values []interface{}) string {
+	if len(values) == 0 {
+		return ""
+	}
+	switch v := values[0].(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		for _, key := range []string{"html", "value"} {
+			if s, ok := v[key].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// propertyImages returns photos of values, given as URLs or {"value": ..., "alt": ...} objects,
+// as Markdown images.
+func propertyImages(values []interface{}) string {
+	var images string
+	for _, value := range values {
+		var src, alt string
+		switch v := value.(type) {
+		case string:
+			src = v
+		case map[string]interface{}:
+			src, _ = v["value"].(string)
+			alt, _ = v["alt"].(string)
+		}
+		if src != "" {
+			images += fmt.Sprintf("\n\n![%s](%s)", alt, src)
+		}
+	}
+	return images
+}
+
+// postURL returns the address of post.
+func postURL(post Post) string {
+	return strings.TrimRight(Settings.Hostname, "/") + "/post/" + post.Slug
+}
+
+// slugFromURL returns the slug of post address u, see postURL.
+func slugFromURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	i := strings.Index(parsed.Path, "/post/")
+	if i < 0 {
+		return ""
+	}
+	return strings.Trim(parsed.Path[i+len("/post/"):], "/")
+}
+
+// Micropub is the Micropub endpoint, see https://www.w3.org/TR/micropub/. Entries are created
+// as posts, published unless "post-status" is "draft", and posts can be updated, deleted and
+// undeleted. Requests are authenticated with an API token or an IndieAuth token, see micropubAuth.
+// GET requests answer "config", "source" and "syndicate-to" queries.
+func Micropub(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MicropubConfig.MaxMediaSize+1<<20)
+	client, ok := micropubAuth(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "GET" {
+		micropubQuery(w, r, client)
+		return
+	}
+	request, err := parseMicropub(r)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			micropubError(w, 413, "invalid_request", "Request is too large.")
+			return
+		}
+		micropubError(w, 400, "invalid_request", "Request must be JSON, form encoded or multipart.")
+		return
+	}
+	switch request.Action {
+	case "", "create":
+		micropubCreate(w, r, client, request)
+	case "update":
+		micropubUpdate(w, r, client, request)
+	case "delete", "undelete":
+		micropubDelete(w, r, client, request)
+	default:
+		micropubError(w, 400, "invalid_request", "Action "+request.Action+" is not supported.")
+	}
+}
+
+// micropubCreate creates a post of h-entry.
+func micropubCreate(w http.ResponseWriter, r *http.Request, client micropubClient, request micropubRequest) {
+	if !client.can("create") {
+		micropubError(w, 403, "insufficient_scope", "Access token does not have create scope.")
+		return
+	}
+	if len(request.Type) > 0 && request.Type[0] != "h-entry" {
+		micropubError(w, 400, "invalid_request", "Only h-entry can be created.")
+		return
+	}
+	var post Post
+	post.Title = strings.TrimSpace(propertyText(request.Properties["name"]))
+	post.Markdown = propertyText(request.Properties["content"])
+	post.Markdown += propertyImages(request.Properties["photo"])
+	post.Description = strings.TrimSpace(propertyText(request.Properties["summary"]))
+	post.Image = propertyText(request.Properties["featured"])
+	for _, file := range request.files {
+		src, err := saveMedia(file)
+		if err != nil {
+			mediaError(w, r, "Micropub", err)
+			return
+		}
+		post.Markdown += fmt.Sprintf("\n\n![](%s)", src)
+	}
+	post.Markdown = strings.TrimSpace(post.Markdown)
+	if post.Markdown == "" && post.Title == "" {
+		micropubError(w, 400, "invalid_request", "Entry needs name, content or photo.")
+		return
+	}
+	// notes have no name, so they are titled with the beginning of their content
+	if post.Title == "" {
+		post.Title = excerpt.Make(propertyText(request.Properties["content"]), 8)
+	}
+	if post.Title == "" {
+		post.Title = time.Now().UTC().Format("2 January 2006 15:04")
+	}
+
+	post, err := post.Insert(client.User)
+	if err != nil {
+		logging.Request(r).Error("post.Insert failed", "route", "Micropub", "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+		return
+	}
+	post, err = post.Get()
+	if err != nil {
+		logging.Request(r).Error("post.Get failed", "route", "Micropub", "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+		return
+	}
+	emit(r, "Micropub", EventPostCreated, post)
+
+	if propertyText(request.Properties["post-status"]) != "draft" {
+		entry := post
+		entry.Published = true
+		post, err = post.Update(entry)
+		if err != nil {
+			logging.Request(r).Error("post.Update failed", "route", "Micropub", "error", err)
+			micropubError(w, 500, "server_error", "Internal server error")
+			return
+		}
+		published(r, "Micropub", post)
+	}
+	w.Header().Set("Location", postURL(post))
+	w.WriteHeader(201)
+}
+
+// micropubPost returns the post of request URL written by client. Responds with an error and
+// returns false if there is no such post.
+func micropubPost(w http.ResponseWriter, r *http.Request, client micropubClient, u string) (Post, bool) {
+	post, err := Post{Slug: slugFromURL(u)}.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			micropubError(w, 400, "invalid_request", "Post "+u+" does not exist.")
+			return post, false
+		}
+		logging.Request(r).Error("post.Get failed", "route", "Micropub", "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+		return post, false
+	}
+	if post.Author != client.User.ID {
+		micropubError(w, 403, "forbidden", "Post "+u+" has been written by someone else.")
+		return post, false
+	}
+	return post, true
+}
+
+// micropubUpdate replaces name, content, summary, featured or post-status of a post, or adds photos to it.
+func micropubUpdate(w http.ResponseWriter, r *http.Request, client micropubClient, request micropubRequest) {
+	if !client.can("update") {
+		micropubError(w, 403, "insufficient_scope", "Access token does not have update scope.")
+		return
+	}
+	post, ok := micropubPost(w, r, client, request.URL)
+	if !ok {
+		return
+	}
+	entry := post
+	for key, values := range request.Replace {
+		switch key {
+		case "name":
+			entry.Title = strings.TrimSpace(propertyText(values))
+		case "content":
+			entry.Markdown = propertyText(values)
+		case "summary":
+			entry.Description = strings.TrimSpace(propertyText(values))
+		case "featured":
+			entry.Image = propertyText(values)
+		case "post-status":
+			entry.Published = propertyText(values) != "draft"
+		default:
+			micropubError(w, 400, "invalid_request", "Property "+key+" can not be replaced.")
+			return
+		}
+	}
+	for key, values := range request.Add {
+		if key != "photo" {
+			micropubError(w, 400, "invalid_request", "Property "+key+" can not be added.")
+			return
+		}
+		entry.Markdown += propertyImages(values)
+	}
+	if request.Delete != nil {
+		micropubError(w, 400, "invalid_request", "Properties can not be deleted.")
+		return
+	}
+	if entry.Title == "" {
+		micropubError(w, 400, "invalid_request", "Post needs a name.")
+		return
+	}
+
+	updated, err := post.Update(entry)
+	if err != nil {
+		logging.Request(r).Error("post.Update failed", "route", "Micropub", "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+		return
+	}
+	if updated.Title != post.Title || updated.Markdown != post.Markdown {
+		emit(r, "Micropub", EventPostUpdated, updated)
+	}
+	switch {
+	case updated.Published && !post.Published:
+		published(r, "Micropub", updated)
+	case !updated.Published && post.Published:
+		emit(r, "Micropub", EventPostUnpublished, updated)
+	}
+	// the address of the post changes with its name
+	if updated.Slug != post.Slug {
+		w.Header().Set("Location", postURL(updated))
+		w.WriteHeader(201)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// micropubDelete deletes or undeletes a post.
+func micropubDelete(w http.ResponseWriter, r *http.Request, client micropubClient, request micropubRequest) {
+	if !client.can("delete") && !(request.Action == "undelete" && client.can("undelete")) {
+		micropubError(w, 403, "insufficient_scope", "Access token does not have delete scope.")
+		return
+	}
+	if request.Action == "delete" {
+		post, ok := micropubPost(w, r, client, request.URL)
+		if !ok {
+			return
+		}
+		err := post.Delete()
+		if err != nil {
+			logging.Request(r).Error("post.Delete failed", "route", "Micropub", "error", err)
+			micropubError(w, 500, "server_error", "Internal server error")
+			return
+		}
+		emit(r, "Micropub", EventPostDeleted, post)
+		w.WriteHeader(204)
+		return
+	}
+
+	post, err := Post{Slug: slugFromURL(request.URL), Author: client.User.ID}.Undelete()
+	if err != nil {
+		switch err.Error() {
+		case "not found":
+			micropubError(w, 400, "invalid_request", "Post "+request.URL+" has not been deleted.")
+			return
+		case "post slug exists":
+			micropubError(w, 400, "invalid_request", "Another post has taken the address "+request.URL+".")
+			return
+		}
+		logging.Request(r).Error("post.Undelete failed", "route", "Micropub", "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+		return
+	}
+	emit(r, "Micropub", EventPostCreated, post)
+	if post.Published {
+		emit(r, "Micropub", EventPostPublished, post)
+	}
+	w.WriteHeader(204)
+}
+
+// micropubQuery answers configuration and source queries.
+func micropubQuery(w http.ResponseWriter, r *http.Request, client micropubClient) {
+	query := r.URL.Query()
+	switch query.Get("q") {
+	case "config":
+		render.R.JSON(w, 200, map[string]interface{}{
+			"media-endpoint": strings.TrimRight(Settings.Hostname, "/") + "/micropub/media",
+			"syndicate-to":   []interface{}{},
+			"q":              []string{"config", "source", "syndicate-to"},
+			"post-types": []map[string]string{
+				{"type": "note", "name": "Note"},
+				{"type": "article", "name": "Article"},
+				{"type": "photo", "name": "Photo"},
+			},
+		})
+	case "syndicate-to":
+		render.R.JSON(w, 200, map[string]interface{}{"syndicate-to": []interface{}{}})
+	case "source":
+		post, ok := micropubPost(w, r, client, query.Get("url"))
+		if !ok {
+			return
+		}
+		status := "draft"
+		if post.Published {
+			status = "published"
+		}
+		properties := map[string][]interface{}{
+			"name":        {post.Title},
+			"content":     {post.Markdown},
+			"published":   {time.Unix(post.Created, 0).UTC().Format(time.RFC3339)},
+			"updated":     {time.Unix(post.Updated, 0).UTC().Format(time.RFC3339)},
+			"post-status": {status},
+			"url":         {postURL(post)},
+		}
+		if post.Description != "" {
+			properties["summary"] = []interface{}{post.Description}
+		}
+		if post.Image != "" {
+			properties["featured"] = []interface{}{post.Image}
+		}
+		requested := append(query["properties[]"], query["properties"]...)
+		if len(requested) == 0 {
+			render.R.JSON(w, 200, map[string]interface{}{"type": []string{"h-entry"}, "properties": properties})
+			return
+		}
+		filtered := make(map[string][]interface{})
+		for _, key := range requested {
+			if values, ok := properties[key]; ok {
+				filtered[key] = values
+			}
+		}
+		render.R.JSON(w, 200, map[string]interface{}{"properties": filtered})
+	default:
+		micropubError(w, 400, "invalid_request", "Query must be config, source or syndicate-to.")
+	}
+}
+
+// saveMedia stores uploaded file in the media directory with a random name and returns its address.
+// Returns "media type unsupported" error for files other than the ones in mediaTypes and
+// "media too large" for files larger than MicropubConfig.MaxMediaSize.
+func saveMedia(header *multipart.FileHeader) (string, error) {
+	if header.Size > MicropubConfig.MaxMediaSize {
+		return "", errors.New("media too large")
+	}
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	extension, ok := mediaTypes[http.DetectContentType(head[:n])]
+	if !ok {
+		return "", errors.New("media type unsupported")
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(b) + extension
+	err = os.MkdirAll(MicropubConfig.Media, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(MicropubConfig.Media, name)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, io.LimitReader(file, MicropubConfig.MaxMediaSize))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return strings.TrimRight(Settings.Hostname, "/") + "/media/" + name, nil
+}
+
+// mediaError responds to errors of saveMedia.
+func mediaError(w http.ResponseWriter, r *http.Request, route string, err error) {
+	switch err.Error() {
+	case "media too large":
+		micropubError(w, 413, "invalid_request", "File is too large.")
+	case "media type unsupported":
+		micropubError(w, 415, "invalid_request", "Only JPEG, PNG, GIF and WebP images, MP4 and WebM videos and MP3 audio can be uploaded.")
+	default:
+		logging.Request(r).Error("saveMedia failed", "route", route, "error", err)
+		micropubError(w, 500, "server_error", "Internal server error")
+	}
+}
+
+// MicropubMedia is the Micropub media endpoint, which stores a file uploaded as "file" of
+// a multipart request and responds with its address in Location header.
+// Requires an access token with media or create scope.
+func MicropubMedia(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MicropubConfig.MaxMediaSize+1<<20)
+	client, ok := micropubAuth(w, r)
+	if !ok {
+		return
+	}
+	if !client.can("media") && !client.can("create") {
+		micropubError(w, 403, "insufficient_scope", "Access token does not have media scope.")
+		return
+	}
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			micropubError(w, 413, "invalid_request", "File is too large.")
+			return
+		}
+		micropubError(w, 400, "invalid_request", "File must be sent as file field of a multipart request.")
+		return
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		micropubError(w, 400, "invalid_request", "File must be sent as file field of a multipart request.")
+		return
+	}
+	src, err := saveMedia(files[0])
+	if err != nil {
+		mediaError(w, r, "MicropubMedia", err)
+		return
+	}
+	w.Header().Set("Location", src)
+	w.WriteHeader(201)
+}
+
+// ReadMedia is a route which serves a file uploaded to the media endpoint. Names of the files are
+// random and they are never changed, so they may be cached for a year.
+func ReadMedia(w http.ResponseWriter, r *http.Request) {
+	name := vestigo.Param(r, "name")
+	if !mediaName.MatchString(name) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	path := filepath.Join(MicropubConfig.Media, name)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,196 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+	. "github.com/toldjuuso/vertigo/session"
+
+	"github.com/husobee/vestigo"
+)
+
+// newsletterPage renders the result of a newsletter request on the frontend. If token is
+// given, the page asks for confirmation of unsubscription.
+func newsletterPage(w http.ResponseWriter, code int, message string, token string) {
+	render.R.HTML(w, code, "newsletter", map[string]string{"Message": message, "Unsubscribe": token})
+}
+
+// SubscribeNewsletter is a route which subscribes an email address to new posts, given as "email"
+// parameter, or with "digest" parameter to weekly digests. A confirmation link is sent to the address,
+// and the same response is given whether the address has subscribed before or not.
+func SubscribeNewsletter(w http.ResponseWriter, r *http.Request) {
+	var subscriber Subscriber
+	if Root(r) == "api" {
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&subscriber)
+		if err != nil {
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Subscription must be JSON with email and digest fields."})
+			return
+		}
+	} else {
+		r.ParseForm()
+		subscriber.Email = r.PostFormValue("email")
+		subscriber.Digest = r.PostFormValue("digest") == "true"
+	}
+	err := Subscribe(subscriber.Email, subscriber.Digest)
+	if err != nil {
+		if err.Error() == "subscriber email invalid" {
+			if Root(r) == "api" {
+				render.R.JSON(w, 422, map[string]interface{}{"error": "Email address is invalid."})
+				return
+			}
+			newsletterPage(w, 422, "Email address is invalid.", "")
+			return
+		}
+		logging.Request(r).Error("Subscribe failed", "route", "SubscribeNewsletter", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	message := "Thanks! Please confirm your subscription with the link we've sent to your email."
+	if Root(r) == "api" {
+		render.R.JSON(w, 200, map[string]interface{}{"success": message})
+		return
+	}
+	newsletterPage(w, 200, message, "")
+}
+
+// ConfirmSubscription is a route which confirms subscription with the token of a link dispatched
+// with confirmation emails.
+func ConfirmSubscription(w http.ResponseWriter, r *http.Request) {
+	_, err := Subscriber{Token: vestigo.Param(r, "token")}.Confirm()
+	if err != nil {
+		if err.Error() == "not found" {
+			if Root(r) == "api" {
+				render.R.JSON(w, 404, map[string]interface{}{"error": "Subscription not found. Please subscribe again."})
+				return
+			}
+			newsletterPage(w, 404, "Subscription not found. Please subscribe again.", "")
+			return
+		}
+		logging.Request(r).Error("subscriber.Confirm failed", "route", "ConfirmSubscription", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	message := "Your subscription has been confirmed."
+	if Root(r) == "api" {
+		render.R.JSON(w, 200, map[string]interface{}{"success": message})
+		return
+	}
+	newsletterPage(w, 200, message, "")
+}
+
+// UnsubscribePage is a route which asks for confirmation of unsubscription, so that link
+// checkers of mail servers following the link do not unsubscribe anyone.
+func UnsubscribePage(w http.ResponseWriter, r *http.Request) {
+	subscriber, err := Subscriber{Token: vestigo.Param(r, "token")}.GetByToken()
+	if err != nil {
+		if err.Error() == "not found" {
+			newsletterPage(w, 404, "Subscription not found.", "")
+			return
+		}
+		logging.Request(r).Error("subscriber.GetByToken failed", "route", "UnsubscribePage", "error", err)
+		render.R.HTML(w, 500, "error", "Internal server error")
+		return
+	}
+	if subscriber.Status == SubscriberUnsubscribed {
+		newsletterPage(w, 200, "You have unsubscribed.", "")
+		return
+	}
+	newsletterPage(w, 200, "Unsubscribe "+subscriber.Email+" from new posts?", subscriber.Token)
+}
+
+// UnsubscribeNewsletter is a route which stops newsletters to the subscriber of given token.
+// It is also the target of one-click unsubscription of mail clients, see RFC 8058.
+func UnsubscribeNewsletter(w http.ResponseWriter, r *http.Request) {
+	_, err := Subscriber{Token: vestigo.Param(r, "token")}.Unsubscribe()
+	if err != nil {
+		if err.Error() == "not found" {
+			if Root(r) == "api" {
+				render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+				return
+			}
+			newsletterPage(w, 404, "Subscription not found.", "")
+			return
+		}
+		logging.Request(r).Error("subscriber.Unsubscribe failed", "route", "UnsubscribeNewsletter", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	message := "You have unsubscribed."
+	if Root(r) == "api" {
+		render.R.JSON(w, 200, map[string]interface{}{"success": message})
+		return
+	}
+	newsletterPage(w, 200, message, "")
+}
+
+// ReadSubscribers is a route which returns subscribers, optionally filtered with "status" query parameter.
+// Requires admin session cookie.
+func ReadSubscribers(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", SubscriberPending, SubscriberConfirmed, SubscriberUnsubscribed:
+	default:
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Status must be pending, confirmed or unsubscribed."})
+		return
+	}
+	subscribers, err := Subscribers(status)
+	if err != nil {
+		logging.Request(r).Error("Subscribers failed", "route", "ReadSubscribers", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, subscribers)
+}
+
+// DeleteSubscriber is a route which removes subscriber with given ID.
+// Requires admin session cookie.
+func DeleteSubscriber(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Subscriber ID could not be parsed from request URL."})
+		return
+	}
+	err = Subscriber{ID: id}.Delete()
+	if err != nil {
+		logging.Request(r).Error("subscriber.Delete failed", "route", "DeleteSubscriber", "error", err)
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Subscriber deleted"})
+}
+
+// ReadNewsletters is a route which returns sent newsletters with the number of their messages
+// in the outbox by status.
+// Requires admin session cookie.
+func ReadNewsletters(w http.ResponseWriter, r *http.Request) {
+	newsletters, err := Newsletters()
+	if err != nil {
+		logging.Request(r).Error("Newsletters failed", "route", "ReadNewsletters", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	type newsletterStatus struct {
+		Newsletter
+		Status map[string]int `json:"status"`
+	}
+	result := make([]newsletterStatus, 0, len(newsletters))
+	for _, newsletter := range newsletters {
+		status, err := newsletter.Status()
+		if err != nil {
+			logging.Request(r).Error("newsletter.Status failed", "route", "ReadNewsletters", "error", err)
+			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+			return
+		}
+		result = append(result, newsletterStatus{newsletter, status})
+	}
+	render.R.JSON(w, 200, result)
+}
@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+
+	"github.com/husobee/vestigo"
+)
+
+// ReadOutbox is a route which returns the number of messages in the outbox by status and the messages,
+// optionally filtered with "status" query parameter. Message bodies are left out, since they may contain
+// recovery links.
+// Requires admin session cookie.
+func ReadOutbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", MailPending, MailSent, MailFailed:
+	default:
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Status must be pending, sent or failed."})
+		return
+	}
+	counts, err := OutboxCounts()
+	if err != nil {
+		logging.Request(r).Error("OutboxCounts failed", "route", "ReadOutbox", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	outbox, err := Outbox(status)
+	if err != nil {
+		logging.Request(r).Error("Outbox failed", "route", "ReadOutbox", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"counts": counts, "mail": outbox})
+}
+
+// RetryMail is a route which queues a failed message in the outbox for delivery again.
+// Requires admin session cookie.
+func RetryMail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Mail ID could not be parsed from request URL."})
+		return
+	}
+	mail, err := Mail{ID: id}.Retry()
+	if err != nil {
+		logging.Request(r).Error("mail.Retry failed", "route", "RetryMail", "error", err)
+		switch err.Error() {
+		case "not found":
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		case "mail not failed":
+			render.R.JSON(w, 409, map[string]interface{}{"error": "Only failed mail can be retried."})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, mail)
+}
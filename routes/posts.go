@@ -3,11 +3,12 @@ package routes
 import (
 	"bufio"
 	"errors"
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
 	"github.com/toldjuuso/vertigo/render"
 	. "github.com/toldjuuso/vertigo/session"
 
@@ -44,7 +45,7 @@ func Homepage(w http.ResponseWriter, r *http.Request) {
 	var post Post
 	posts, err := post.GetAll()
 	if err != nil {
-		log.Println("route Homepage, post.GetAll:", err)
+		logging.Request(r).Error("post.GetAll failed", "route", "Homepage", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -116,14 +117,14 @@ func SearchPost(w http.ResponseWriter, r *http.Request) {
 
 	search, err := GetSearch(r)
 	if err != nil {
-		log.Println("route SearchPost, context GetSearch:", err)
+		logging.Request(r).Error("context GetSearch failed", "route", "SearchPost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
 
 	search, err = search.Get()
 	if err != nil {
-		log.Println("route SearchPost, search.Get:", err)
+		logging.Request(r).Error("search.Get failed", "route", "SearchPost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -143,7 +144,7 @@ func CreatePost(w http.ResponseWriter, r *http.Request) {
 
 	post, err := GetPost(r)
 	if err != nil {
-		log.Println("route CreatePost, context GetPost:", err)
+		logging.Request(r).Error("context GetPost failed", "route", "CreatePost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -151,7 +152,7 @@ func CreatePost(w http.ResponseWriter, r *http.Request) {
 	var user User
 	id, ok := SessionGetValue(r, "id")
 	if !ok {
-		log.Println("route CreatePost, SessionGetValue:", ok)
+		logging.Request(r).Warn("session value missing", "route", "CreatePost")
 		SessionDelete(w, r, "id")
 		render.R.HTML(w, 500, "error", "Session could not be fetched. Please log in again.")
 		return
@@ -159,7 +160,7 @@ func CreatePost(w http.ResponseWriter, r *http.Request) {
 	user.ID = id
 	user, err = user.Get()
 	if err != nil {
-		log.Println("route CreatePost, user.Get:", err)
+		logging.Request(r).Error("user.Get failed", "route", "CreatePost", "error", err)
 		SessionDelete(w, r, "id")
 		render.R.HTML(w, 500, "error", err)
 		return
@@ -167,10 +168,11 @@ func CreatePost(w http.ResponseWriter, r *http.Request) {
 
 	post, err = post.Insert(user)
 	if err != nil {
-		log.Println("route CreatePost, post.Insert:", err)
+		logging.Request(r).Error("post.Insert failed", "route", "CreatePost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
+	emit(r, "CreatePost", EventPostCreated, post)
 	switch Root(r) {
 	case "api":
 		render.R.JSON(w, 200, post)
@@ -186,7 +188,7 @@ func ReadPosts(w http.ResponseWriter, r *http.Request) {
 	published := make([]Post, 0)
 	posts, err := post.GetAll()
 	if err != nil {
-		log.Println("route ReadPosts, post.GetAll:", err)
+		logging.Request(r).Error("post.GetAll failed", "route", "ReadPosts", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -201,7 +203,6 @@ func ReadPosts(w http.ResponseWriter, r *http.Request) {
 // ReadPost is a route which returns post with given post.Slug.
 // Returns post data on JSON call and displays a formatted page on frontend.
 func ReadPost(w http.ResponseWriter, r *http.Request) {
-	log.Println("url query:", r.URL.Query())
 	var post Post
 	if vestigo.Param(r, "slug") == "new" {
 		render.R.JSON(w, 400, map[string]interface{}{"error": "There can't be a post called 'new'."})
@@ -210,7 +211,7 @@ func ReadPost(w http.ResponseWriter, r *http.Request) {
 	post.Slug = vestigo.Param(r, "slug")
 	post, err := post.Get()
 	if err != nil {
-		log.Println("route ReadPost, post.Get:", err)
+		logging.Request(r).Error("post.Get failed", "route", "ReadPost", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
 			return
@@ -218,11 +219,15 @@ func ReadPost(w http.ResponseWriter, r *http.Request) {
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
-	go post.Increment()
+	Background(post.Increment)
+	w.Header().Set("Last-Modified", time.Unix(post.Updated, 0).UTC().Format(http.TimeFormat))
 	switch Root(r) {
 	case "api":
 		render.R.JSON(w, 200, post)
 	case "post":
+		if render.Features["webmention"] {
+			w.Header().Set("Link", "<"+webmentionEndpoint()+">; rel=\"webmention\"")
+		}
 		render.R.HTML(w, 200, "post/display", post)
 	}
 }
@@ -235,7 +240,7 @@ func EditPost(w http.ResponseWriter, r *http.Request) {
 	post.Slug = vestigo.Param(r, "slug")
 	post, err := post.Get()
 	if err != nil {
-		log.Println("route EditPost, post.Get:", err)
+		logging.Request(r).Error("post.Get failed", "route", "EditPost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -250,7 +255,7 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 	post.Slug = vestigo.Param(r, "slug")
 	post, err := post.Get()
 	if err != nil {
-		log.Println("route UpdatePost, post.Get:", err)
+		logging.Request(r).Error("post.Get failed", "route", "UpdatePost", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
 			return
@@ -261,30 +266,31 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := SessionGetValue(r, "id")
 	if !ok {
-		log.Println("route UpdatePost, SessionGetValue:", ok)
+		logging.Request(r).Warn("session value missing", "route", "UpdatePost")
 		SessionDelete(w, r, "id")
 		render.R.HTML(w, 500, "error", "Session could not be fetched. Please log in again.")
 		return
 	}
 	if post.Author != id {
-		log.Println("route UpdatePost, post.Author and id mismatch")
+		logging.Request(r).Warn("post.Author and id mismatch", "route", "UpdatePost")
 		render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 		return
 	}
 
 	entry, err := GetPost(r)
 	if err != nil {
-		log.Println("route UpdatePost, context GetPost:", err)
+		logging.Request(r).Error("context GetPost failed", "route", "UpdatePost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
 
 	post, err = post.Update(entry)
 	if err != nil {
-		log.Println("route UpdatePost, post.Update:", err)
+		logging.Request(r).Error("post.Update failed", "route", "UpdatePost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
+	emit(r, "UpdatePost", EventPostUpdated, post)
 
 	switch Root(r) {
 	case "api":
@@ -294,6 +300,17 @@ func UpdatePost(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// published announces post which has been published in the background, see Post.Announce.
+func published(r *http.Request, route string, post Post) {
+	logger := logging.Request(r)
+	Background(func() {
+		_, err := post.Announce(render.Features)
+		if err != nil {
+			logger.Error("post.Announce failed", "route", route, "error", err)
+		}
+	})
+}
+
 // PublishPost is a route which publishes a post and therefore making it appear on frontpage and search.
 // JSON request returns `HTTP 200 {"success": "Post published"}` on success. Frontend call will redirect to
 // published page.
@@ -303,7 +320,7 @@ func PublishPost(w http.ResponseWriter, r *http.Request) {
 	post.Slug = vestigo.Param(r, "slug")
 	post, err := post.Get()
 	if err != nil {
-		log.Println("route PublishPost, post.Get:", err)
+		logging.Request(r).Error("post.Get failed", "route", "PublishPost", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
 			return
@@ -314,13 +331,13 @@ func PublishPost(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := SessionGetValue(r, "id")
 	if !ok {
-		log.Println("route PublishPost, SessionGetValue:", ok)
+		logging.Request(r).Warn("session value missing", "route", "PublishPost")
 		SessionDelete(w, r, "id")
 		render.R.HTML(w, 500, "error", "Session could not be fetched. Please log in again.")
 		return
 	}
 	if post.Author != id {
-		log.Println("route PublishPost, post.Author and id mismatch")
+		logging.Request(r).Warn("post.Author and id mismatch", "route", "PublishPost")
 		render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 		return
 	}
@@ -330,7 +347,7 @@ func PublishPost(w http.ResponseWriter, r *http.Request) {
 	entry.Published = true
 	post, err = post.Update(entry)
 	if err != nil {
-		log.Println("route PublishPost, post.Update:", err)
+		logging.Request(r).Error("post.Update failed", "route", "PublishPost", "error", err)
 		if err.Error() == "unauthorized" {
 			render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 			return
@@ -339,6 +356,8 @@ func PublishPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	published(r, "PublishPost", post)
+
 	switch Root(r) {
 	case "api":
 		render.R.JSON(w, 200, map[string]interface{}{"success": "Post published"})
@@ -357,7 +376,7 @@ func UnpublishPost(w http.ResponseWriter, r *http.Request) {
 	post.Slug = vestigo.Param(r, "slug")
 	post, err := post.Get()
 	if err != nil {
-		log.Println("route UnpublishPost, post.Get:", err)
+		logging.Request(r).Error("post.Get failed", "route", "UnpublishPost", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
 			return
@@ -368,24 +387,26 @@ func UnpublishPost(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := SessionGetValue(r, "id")
 	if !ok {
-		log.Println("route UnpublishPost, SessionGetValue:", ok)
+		logging.Request(r).Warn("session value missing", "route", "UnpublishPost")
 		SessionDelete(w, r, "id")
 		render.R.HTML(w, 500, "error", "Session could not be fetched. Please log in again.")
 		return
 	}
 
 	if post.Author != id {
-		log.Println("route UnpublishPost, author mismatch")
+		logging.Request(r).Warn("author mismatch", "route", "UnpublishPost")
 		render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 		return
 	}
 
 	err = post.Unpublish()
 	if err != nil {
-		log.Println("route UnpublishPost, post.Unpublish:", err)
+		logging.Request(r).Error("post.Unpublish failed", "route", "UnpublishPost", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
+	post.Published = false
+	emit(r, "UnpublishPost", EventPostUnpublished, post)
 
 	switch Root(r) {
 	case "api":
@@ -404,7 +425,7 @@ func DeletePost(w http.ResponseWriter, r *http.Request) {
 	post.Slug = vestigo.Param(r, "slug")
 	post, err := post.Get()
 	if err != nil {
-		log.Println("route DeletePost, post.Get:", err)
+		logging.Request(r).Error("post.Get failed", "route", "DeletePost", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
 			return
@@ -415,20 +436,20 @@ func DeletePost(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := SessionGetValue(r, "id")
 	if !ok {
-		log.Println("route DeletePost, SessionGetValue:", ok)
+		logging.Request(r).Warn("session value missing", "route", "DeletePost")
 		SessionDelete(w, r, "id")
 		render.R.HTML(w, 500, "error", "Session could not be fetched. Please log in again.")
 		return
 	}
 	if post.Author != id {
-		log.Println("route DeletePost, author mismatch")
+		logging.Request(r).Warn("author mismatch", "route", "DeletePost")
 		render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 		return
 	}
 
 	err = post.Delete()
 	if err != nil {
-		log.Println("route DeletePost, post.Delete:", err)
+		logging.Request(r).Error("post.Delete failed", "route", "DeletePost", "error", err)
 		if err.Error() == "unauthorized" {
 			render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 			return
@@ -436,6 +457,8 @@ func DeletePost(w http.ResponseWriter, r *http.Request) {
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
+	emit(r, "DeletePost", EventPostDeleted, post)
+
 	switch Root(r) {
 	case "api":
 		render.R.JSON(w, 200, map[string]interface{}{"success": "Post deleted"})
@@ -2,12 +2,13 @@ package routes
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
 
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
 	"github.com/toldjuuso/vertigo/render"
 	. "github.com/toldjuuso/vertigo/session"
 
@@ -37,12 +38,49 @@ func ReadSettings(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// loadTheme switches to the theme with given name unless it is the current one already.
+// The returned function switches back to the previous theme, for when settings could not be saved.
+func loadTheme(name string) (func(), error) {
+	previous := render.Current().Name
+	if name == previous {
+		return func() {}, nil
+	}
+	err := render.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		err := render.Load(previous)
+		if err != nil {
+			slog.Error("render.Load failed", "theme", previous, "error", err)
+		}
+	}, nil
+}
+
 // UpdateSettings is a route which updates the local .json settings file.
 func UpdateSettings(w http.ResponseWriter, r *http.Request) {
 
 	settings, err := GetSettings(r)
 	if err != nil {
-		log.Println("route UpdateSettings, settings context:", err)
+		logging.Request(r).Error("settings context failed", "route", "UpdateSettings", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+
+	// API clients which do not know about themes keep the current one
+	if settings.Theme == "" {
+		settings.Theme = Settings.Theme
+	}
+	if settings.Theme == "" {
+		settings.Theme = render.DefaultTheme
+	}
+	_, err = render.GetTheme(settings.Theme)
+	if err != nil {
+		logging.Request(r).Error("render.GetTheme failed", "route", "UpdateSettings", "error", err)
+		if err.Error() == "not found" {
+			render.R.JSON(w, 422, map[string]interface{}{"error": "Theme does not exist."})
+			return
+		}
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -52,15 +90,23 @@ func UpdateSettings(w http.ResponseWriter, r *http.Request) {
 		settings.Hostname = strings.TrimRight(settings.Hostname, "/")
 		_, err := url.Parse(settings.Hostname)
 		if err != nil {
-			log.Println("route UpdateSettings, url.Parse:", err)
+			logging.Request(r).Error("url.Parse failed", "route", "UpdateSettings", "error", err)
 			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 			return
 		}
 		settings.AllowRegistrations = true
 
+		revert, err := loadTheme(settings.Theme)
+		if err != nil {
+			logging.Request(r).Error("render.Load failed", "route", "UpdateSettings", "error", err)
+			render.R.JSON(w, 422, map[string]interface{}{"error": "Theme could not be loaded."})
+			return
+		}
+
 		Settings, err = settings.Insert()
 		if err != nil {
-			log.Println("route UpdateSettings, settings.Save:", err)
+			revert()
+			logging.Request(r).Error("settings.Save failed", "route", "UpdateSettings", "error", err)
 			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 			return
 		}
@@ -77,14 +123,22 @@ func UpdateSettings(w http.ResponseWriter, r *http.Request) {
 
 	_, ok := SessionGetValue(r, "id")
 	if !ok {
-		log.Println("route UpdateSettings, SessionGetValue:", ok)
+		logging.Request(r).Warn("session value missing", "route", "UpdateSettings")
 		render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 		return
 	}
 
+	revert, err := loadTheme(settings.Theme)
+	if err != nil {
+		logging.Request(r).Error("render.Load failed", "route", "UpdateSettings", "error", err)
+		render.R.JSON(w, 422, map[string]interface{}{"error": "Theme could not be loaded."})
+		return
+	}
+
 	Settings, err = settings.Update()
 	if err != nil {
-		log.Println("route UpdateSettings, firstrun settings.Save:", err)
+		revert()
+		logging.Request(r).Error("firstrun settings.Save failed", "route", "UpdateSettings", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
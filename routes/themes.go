@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+)
+
+// maxThemeSize limits the size of uploaded theme archives.
+const maxThemeSize = 10 << 20
+
+// ReadThemes is a route which returns all installed themes.
+// Only available on API side.
+func ReadThemes(w http.ResponseWriter, r *http.Request) {
+	themes, err := render.Themes()
+	if err != nil {
+		logging.Request(r).Error("render.Themes failed", "route", "ReadThemes", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, themes)
+}
+
+// InstallTheme is a route which installs a theme from a zip archive sent as the request body.
+// The theme is not activated, for that see UpdateSettings.
+// Requires admin session cookie.
+func InstallTheme(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxThemeSize))
+	if err != nil {
+		logging.Request(r).Error("ioutil.ReadAll failed", "route", "InstallTheme", "error", err)
+		render.R.JSON(w, 413, map[string]interface{}{"error": "Theme archive is too large."})
+		return
+	}
+	theme, err := render.InstallTheme(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		logging.Request(r).Error("render.InstallTheme failed", "route", "InstallTheme", "error", err)
+		switch err.Error() {
+		case "theme archive invalid", "theme metadata missing", "theme metadata invalid", "theme name invalid":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Theme archive must be a zip file with a valid theme.json in its root."})
+			return
+		case "theme archive too large":
+			render.R.JSON(w, 413, map[string]interface{}{"error": "Theme archive is too large."})
+			return
+		case "theme exists":
+			render.R.JSON(w, 422, map[string]interface{}{"error": "Theme with that name is already installed."})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, theme)
+}
@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+	. "github.com/toldjuuso/vertigo/session"
+
+	"github.com/husobee/vestigo"
+)
+
+// ReadTokens is a route which returns API tokens of the logged in user, newest first, without the tokens themselves.
+// Requires active session cookie.
+func ReadTokens(w http.ResponseWriter, r *http.Request) {
+	id, _ := SessionGetValue(r, "id")
+	tokens, err := Tokens(id)
+	if err != nil {
+		logging.Request(r).Error("Tokens failed", "route", "ReadTokens", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, tokens)
+}
+
+// CreateToken is a route which creates an API token for the logged in user, sent as JSON with "name"
+// and optional "scope" fields, and returns it with the token in "secret" field, which is not shown again.
+// Requires active session cookie.
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	var token Token
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&token)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Token must be JSON with name and scope fields."})
+		return
+	}
+	token.Owner, _ = SessionGetValue(r, "id")
+	token, err = token.Insert()
+	if err != nil {
+		if err.Error() == "token invalid" {
+			render.R.JSON(w, 422, map[string]interface{}{"error": "Name is required and scope must be some of " + strings.Join(Scopes, ", ") + "."})
+			return
+		}
+		logging.Request(r).Error("token.Insert failed", "route", "CreateToken", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, token)
+}
+
+// DeleteToken is a route which revokes API token with given ID of the logged in user.
+// Requires active session cookie.
+func DeleteToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Token ID could not be parsed from request URL."})
+		return
+	}
+	owner, _ := SessionGetValue(r, "id")
+	err = Token{ID: id, Owner: owner}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("token.Delete failed", "route", "DeleteToken", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Token revoked"})
+}
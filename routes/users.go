@@ -2,11 +2,11 @@ package routes
 
 import (
 	"errors"
-	"log"
 	"net/http"
 	"strconv"
 
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
 	"github.com/toldjuuso/vertigo/render"
 	. "github.com/toldjuuso/vertigo/session"
 
@@ -23,6 +23,13 @@ func GetUser(r *http.Request) (User, error) {
 	return rv.(User), nil
 }
 
+// invitationErrors maps errors of Invitation.Redeem to messages shown to people registering.
+var invitationErrors = map[string]string{
+	"invitation invalid": "Invitation is invalid.",
+	"invitation expired": "Invitation has expired.",
+	"invitation used":    "Invitation has been used already.",
+}
+
 // CreateUser is a route which creates a new user struct according to posted parameters.
 // Requires session cookie.
 // Returns created user struct for API requests and redirects to "/user" on frontend ones.
@@ -30,13 +37,41 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := GetUser(r)
 	if err != nil {
-		log.Println("route CreateUser, user context:", err)
+		logging.Request(r).Error("user context failed", "route", "CreateUser", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
 
-	if Settings.AllowRegistrations == false {
-		log.Println("Denied a new registration.")
+	// roles are never assigned through registration, and email addresses have to be verified
+	user.Role = ""
+	user.Verified = false
+
+	// invitations let people register while registrations are closed, and decide their role
+	var invitation Invitation
+	if user.Invitation != "" {
+		invitation.Code = user.Invitation
+		invitation, err = invitation.Redeem(user.Email)
+		if err != nil {
+			message, ok := invitationErrors[err.Error()]
+			if !ok {
+				logging.Request(r).Error("invitation.Redeem failed", "route", "CreateUser", "error", err)
+				render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+				return
+			}
+			logging.Request(r).Info("invitation refused", "route", "CreateUser", "error", err)
+			switch Root(r) {
+			case "api":
+				render.R.JSON(w, 403, map[string]interface{}{"error": message})
+				return
+			case "user":
+				render.R.HTML(w, 403, "user/login", message)
+				return
+			}
+		}
+		user.Role = invitation.Role
+		user.Invitation = ""
+	} else if Settings.AllowRegistrations == false {
+		logging.Request(r).Info("registration denied", "route", "CreateUser")
 		switch Root(r) {
 		case "api":
 			render.R.JSON(w, 403, map[string]interface{}{"error": "New registrations are not allowed at this time."})
@@ -48,7 +83,12 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user, err = user.Insert()
 	if err != nil {
-		log.Println("route CreateUser, user.Insert:", err)
+		logging.Request(r).Error("user.Insert failed", "route", "CreateUser", "error", err)
+		if invitation.ID != 0 {
+			if err := invitation.Release(); err != nil {
+				logging.Request(r).Error("invitation.Release failed", "route", "CreateUser", "error", err)
+			}
+		}
 		if err.Error() == "user email exists" {
 			render.R.JSON(w, 422, map[string]interface{}{"error": "Email already in use"})
 			return
@@ -62,11 +102,24 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user, err = user.Login()
 	if err != nil {
-		log.Println("route CreateUser, user.Login:", err)
+		logging.Request(r).Error("user.Login failed", "route", "CreateUser", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
+	// the account works without the email, so registration is not failed
+	if user.Verified {
+		err = user.SendWelcomeEmail()
+		if err != nil {
+			logging.Request(r).Error("user.SendWelcomeEmail failed", "route", "CreateUser", "error", err)
+		}
+	} else {
+		err = user.SendVerificationEmail()
+		if err != nil {
+			logging.Request(r).Error("user.SendVerificationEmail failed", "route", "CreateUser", "error", err)
+		}
+	}
 
+	emit(r, "CreateUser", EventUserCreated, WebhookUser(user))
 	SessionSetValue(w, r, "id", user.ID)
 
 	switch Root(r) {
@@ -115,14 +168,14 @@ func ReadUser(w http.ResponseWriter, r *http.Request) {
 	case "api":
 		id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
 		if err != nil {
-			log.Println("route ReadUser, strconv.Atoi:", err)
+			logging.Request(r).Error("strconv.Atoi failed", "route", "ReadUser", "error", err)
 			render.R.JSON(w, 400, map[string]interface{}{"error": "The user ID could not be parsed from the request URL."})
 			return
 		}
 		user.ID = id
 		user, err := user.Get()
 		if err != nil {
-			log.Println("route ReadUser, user.Get:", err)
+			logging.Request(r).Error("user.Get failed", "route", "ReadUser", "error", err)
 			if err.Error() == "not found" {
 				render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
 				return
@@ -143,7 +196,7 @@ func ReadUser(w http.ResponseWriter, r *http.Request) {
 	case "user":
 		id, ok := SessionGetValue(r, "id")
 		if !ok {
-			log.Println("route ReadUser, SessionGetValue:", ok)
+			logging.Request(r).Warn("session value missing", "route", "ReadUser")
 			SessionDelete(w, r, "id")
 			render.R.HTML(w, 500, "error", "Session could not be fetched. Please log in again.")
 			return
@@ -151,7 +204,7 @@ func ReadUser(w http.ResponseWriter, r *http.Request) {
 		user.ID = id
 		user, err := user.Get()
 		if err != nil {
-			log.Println("route ReadUser, user.Get:", err)
+			logging.Request(r).Error("user.Get failed", "route", "ReadUser", "error", err)
 			SessionDelete(w, r, "id")
 			render.R.HTML(w, 500, "error", err)
 			return
@@ -166,7 +219,7 @@ func ReadUsers(w http.ResponseWriter, r *http.Request) {
 	var user User
 	users, err := user.GetAll()
 	if err != nil {
-		log.Println("route ReadUsers, user.GetAll:", err)
+		logging.Request(r).Error("user.GetAll failed", "route", "ReadUsers", "error", err)
 		render.R.JSON(w, 500, err)
 		return
 	}
@@ -196,7 +249,7 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := GetUser(r)
 	if err != nil {
-		log.Println("route LoginUser, user context:", err)
+		logging.Request(r).Error("user context failed", "route", "LoginUser", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -205,7 +258,7 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 	case "api":
 		user, err := user.Login()
 		if err != nil {
-			log.Println("route LoginUser, user.Login:", err)
+			logging.Request(r).Error("user.Login failed", "route", "LoginUser", "error", err)
 			if err.Error() == "wrong username or password" {
 				render.R.JSON(w, 401, map[string]interface{}{"error": "Wrong username or password."})
 				return
@@ -223,7 +276,7 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 	case "user":
 		user, err := user.Login()
 		if err != nil {
-			log.Println("route LoginUser, user.Login:", err)
+			logging.Request(r).Error("user.Login failed", "route", "LoginUser", "error", err)
 			if err.Error() == "wrong username or password" {
 				render.R.HTML(w, 401, "user/login", "Wrong username or password.")
 				return
@@ -246,18 +299,22 @@ func RecoverUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := GetUser(r)
 	if err != nil {
-		log.Println("route CreateUser, user context:", err)
+		logging.Request(r).Error("user context failed", "route", "CreateUser", "error", err)
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
 
 	err = user.Recover()
 	if err != nil {
-		log.Println("route RecoverUser, user.Recover:", err)
+		logging.Request(r).Error("user.Recover failed", "route", "RecoverUser", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 401, map[string]interface{}{"error": "User with that email does not exist."})
 			return
 		}
+		if err.Error() == "user not verified" {
+			render.R.JSON(w, 403, map[string]interface{}{"error": "Email address of the user has not been verified. Log in to request a new verification link."})
+			return
+		}
 		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 		return
 	}
@@ -269,12 +326,95 @@ func RecoverUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// VerifyUser is a route which verifies the email address of a user with the token of a link
+// dispatched with verification emails, and sends the user a welcome email.
+func VerifyUser(w http.ResponseWriter, r *http.Request) {
+	user, err := VerifyEmail(vestigo.Param(r, "token"))
+	if err != nil {
+		logging.Request(r).Error("VerifyEmail failed", "route", "VerifyUser", "error", err)
+		switch err.Error() {
+		case "verification token invalid":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Verification link is invalid."})
+			return
+		case "verification token expired":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Verification link has expired. Log in to request a new one."})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	err = user.SendWelcomeEmail()
+	if err != nil {
+		logging.Request(r).Error("user.SendWelcomeEmail failed", "route", "VerifyUser", "error", err)
+	}
+	switch Root(r) {
+	case "api":
+		render.R.JSON(w, 200, map[string]interface{}{"success": "Your email address has been verified."})
+	case "user":
+		http.Redirect(w, r, "/user", 302)
+	}
+}
+
+// ResendVerification is a route which sends a new verification link to the logged in user.
+// Links can be requested once in sqlx.VerificationInterval.
+// Requires session cookie.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	id, ok := SessionGetValue(r, "id")
+	if !ok {
+		logging.Request(r).Warn("session value missing", "route", "ResendVerification")
+		render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
+		return
+	}
+	err := User{ID: id}.SendVerificationEmail()
+	if err != nil {
+		logging.Request(r).Error("user.SendVerificationEmail failed", "route", "ResendVerification", "error", err)
+		switch err.Error() {
+		case "user verified":
+			render.R.JSON(w, 409, map[string]interface{}{"error": "Your email address has been verified already."})
+			return
+		case "verification throttled":
+			w.Header().Set("Retry-After", strconv.Itoa(int(VerificationInterval.Seconds())))
+			render.R.JSON(w, 429, map[string]interface{}{"error": "A verification link was sent recently. Please check your email or try again later."})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	switch Root(r) {
+	case "api":
+		render.R.JSON(w, 200, map[string]interface{}{"success": "We've sent you a link to your email which you may use to verify your address."})
+	case "user":
+		http.Redirect(w, r, "/user", 302)
+	}
+}
+
+// VerifyUserByAdmin is a route which marks user with given ID as verified without email.
+// Requires admin session cookie.
+func VerifyUserByAdmin(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "User ID could not be parsed from request URL."})
+		return
+	}
+	user, err := User{ID: id}.Verify()
+	if err != nil {
+		logging.Request(r).Error("user.Verify failed", "route", "VerifyUserByAdmin", "error", err)
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"id": user.ID, "verified": user.Verified})
+}
+
 // ResetUserPassword is a route which is called when accessing the page generated dispatched with
 // account recovery emails.
 func ResetUserPassword(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(vestigo.Param(r, "id"))
 	if err != nil {
-		log.Println("route ResetUserPassword, strconv.Atoi:", err)
+		logging.Request(r).Error("strconv.Atoi failed", "route", "ResetUserPassword", "error", err)
 		render.R.JSON(w, 400, map[string]interface{}{"error": "User ID could not be parsed from request URL."})
 		return
 	}
@@ -284,7 +424,7 @@ func ResetUserPassword(w http.ResponseWriter, r *http.Request) {
 
 	entry, err := user.Get()
 	if err != nil {
-		log.Println("route ResetUserPassword, user.Get:", err)
+		logging.Request(r).Error("user.Get failed", "route", "ResetUserPassword", "error", err)
 		if err.Error() == "not found" {
 			render.R.JSON(w, 400, map[string]interface{}{"error": "User with that ID does not exist."})
 			return
@@ -297,8 +437,7 @@ func ResetUserPassword(w http.ResponseWriter, r *http.Request) {
 	// which would otherwise result in succesful password reset
 	UUID := uuid.Parse(vestigo.Param(r, "recovery"))
 	if UUID == nil {
-		log.Println("route ResetUserPassword, uuid.Parse:", err)
-		log.Println("there was a problem trying to verify password reset UUID for", entry.Email)
+		logging.Request(r).Warn("could not parse password reset UUID", "route", "ResetUserPassword", "email", entry.Email)
 		render.R.JSON(w, 400, map[string]interface{}{"error": "Could not parse UUID from the request."})
 		return
 	}
@@ -307,7 +446,7 @@ func ResetUserPassword(w http.ResponseWriter, r *http.Request) {
 		entry.Password = newpassword
 		_, err = user.PasswordReset(entry)
 		if err != nil {
-			log.Println("route ResetUserPassword, user.PasswordReset:", err)
+			logging.Request(r).Error("user.PasswordReset failed", "route", "ResetUserPassword", "error", err)
 			render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
 			return
 		}
@@ -0,0 +1,230 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+	. "github.com/toldjuuso/vertigo/session"
+
+	"github.com/husobee/vestigo"
+)
+
+// emit queues event with data to webhooks and, for posts, to ActivityPub followers.
+// Failures are only logged, since the change which caused the event has been made already.
+func emit(r *http.Request, route string, event string, data interface{}) {
+	err := Emit(event, data)
+	if err != nil {
+		logging.Request(r).Error("Emit failed", "route", route, "event", event, "error", err)
+	}
+	federate(r, route, event, data)
+}
+
+// webhookID parses webhook ID from request URL. Responds with HTTP 400 if it can not be parsed.
+func webhookID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Webhook ID could not be parsed from request URL."})
+		return 0, false
+	}
+	return id, true
+}
+
+// ReadWebhooks is a route which returns all webhooks. The frontend page also lists
+// latest deliveries of each webhook and lets admins add webhooks and send test events.
+// Requires admin session cookie.
+func ReadWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := Webhooks()
+	if err != nil {
+		logging.Request(r).Error("Webhooks failed", "route", "ReadWebhooks", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	if Root(r) == "api" {
+		render.R.JSON(w, 200, webhooks)
+		return
+	}
+	type webhookDeliveries struct {
+		Webhook
+		Deliveries []Delivery
+	}
+	result := make([]webhookDeliveries, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		deliveries, err := webhook.Deliveries(10)
+		if err != nil {
+			logging.Request(r).Error("webhook.Deliveries failed", "route", "ReadWebhooks", "error", err)
+			render.R.HTML(w, 500, "error", "Internal server error")
+			return
+		}
+		result = append(result, webhookDeliveries{webhook, deliveries})
+	}
+	render.R.HTML(w, 200, "user/webhooks", map[string]interface{}{"Webhooks": result, "Events": Events})
+}
+
+// CreateWebhook is a route which adds a webhook, sent as JSON with "url" and "events" fields,
+// where events is a comma separated list. Frontend form sends each event as its own "events" value.
+// The response contains the secret with which deliveries are signed.
+// Requires admin session cookie.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook Webhook
+	if Root(r) == "api" {
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&webhook)
+		if err != nil {
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Webhook must be JSON with url and events fields."})
+			return
+		}
+	} else {
+		r.ParseForm()
+		webhook.URL = r.PostFormValue("url")
+		webhook.Events = strings.Join(r.PostForm["events"], ",")
+	}
+	webhook, err := webhook.Insert()
+	if err != nil {
+		if err.Error() == "webhook invalid" {
+			render.R.JSON(w, 422, map[string]interface{}{"error": "URL must be an absolute http or https URL and events must be some of " + strings.Join(Events, ", ") + "."})
+			return
+		}
+		logging.Request(r).Error("webhook.Insert failed", "route", "CreateWebhook", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	switch Root(r) {
+	case "api":
+		render.R.JSON(w, 200, webhook)
+	case "user":
+		http.Redirect(w, r, "/user/webhooks", 302)
+	}
+}
+
+// UpdateWebhook is a route which changes "url", "events" and "active" fields of webhook
+// with given ID. Omitted fields keep their values.
+// Requires admin session cookie.
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	webhook, err := Webhook{ID: id}.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("webhook.Get failed", "route", "UpdateWebhook", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	err = json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&webhook)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Webhook must be JSON with url, events and active fields."})
+		return
+	}
+	webhook.ID = id
+	webhook, err = webhook.Update()
+	if err != nil {
+		switch err.Error() {
+		case "webhook invalid":
+			render.R.JSON(w, 422, map[string]interface{}{"error": "URL must be an absolute http or https URL and events must be some of " + strings.Join(Events, ", ") + "."})
+			return
+		case "not found":
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("webhook.Update failed", "route", "UpdateWebhook", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, webhook)
+}
+
+// DeleteWebhook is a route which removes webhook with given ID and its delivery log.
+// Requires admin session cookie.
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	err := Webhook{ID: id}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("webhook.Delete failed", "route", "DeleteWebhook", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	switch Root(r) {
+	case "api":
+		render.R.JSON(w, 200, map[string]interface{}{"success": "Webhook deleted"})
+	case "user":
+		http.Redirect(w, r, "/user/webhooks", 302)
+	}
+}
+
+// ReadDeliveries is a route which returns the latest deliveries of webhook with given ID,
+// newest first. Number of deliveries is given with "limit" query parameter and defaults to 50.
+// Requires admin session cookie.
+func ReadDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Limit must be between 1 and 1000."})
+			return
+		}
+		limit = n
+	}
+	webhook, err := Webhook{ID: id}.Get()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("webhook.Get failed", "route", "ReadDeliveries", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	deliveries, err := webhook.Deliveries(limit)
+	if err != nil {
+		logging.Request(r).Error("webhook.Deliveries failed", "route", "ReadDeliveries", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, deliveries)
+}
+
+// TestWebhook is a route which sends a "ping" event to webhook with given ID.
+// API response contains the queued delivery, whose outcome can be followed with ReadDeliveries.
+// Requires admin session cookie.
+func TestWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	delivery, err := Webhook{ID: id}.Test()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("webhook.Test failed", "route", "TestWebhook", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	switch Root(r) {
+	case "api":
+		render.R.JSON(w, 200, delivery)
+	case "user":
+		http.Redirect(w, r, "/user/webhooks", 302)
+	}
+}
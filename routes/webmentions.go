@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/logging"
+	"github.com/toldjuuso/vertigo/render"
+
+	"github.com/husobee/vestigo"
+)
+
+// webmentionEndpoint returns the address of the Webmention endpoint of the site.
+func webmentionEndpoint() string {
+	return strings.TrimRight(Settings.Hostname, "/") + "/webmention"
+}
+
+// ReceiveWebmention is the Webmention endpoint, see https://www.w3.org/TR/webmention/.
+// Form encoded "source" and "target" are accepted with HTTP 202 and verified in the background,
+// see VerifyWebmentions. Target has to be a published post of the site.
+func ReceiveWebmention(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+	r.ParseForm()
+	_, err := Receive(r.PostFormValue("source"), r.PostFormValue("target"))
+	if err != nil {
+		switch err.Error() {
+		case "webmention invalid":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Source and target must be different absolute http or https URLs."})
+			return
+		case "target not found":
+			render.R.JSON(w, 400, map[string]interface{}{"error": "Target is not a published post of this site."})
+			return
+		}
+		logging.Request(r).Error("Receive failed", "route", "ReceiveWebmention", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 202, map[string]interface{}{"success": "Webmention will be verified"})
+}
+
+// ReadWebmentions is a route which returns received Webmentions, newest first, optionally
+// only those with status given as "status" query parameter.
+// Requires admin session cookie.
+func ReadWebmentions(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", WebmentionPending, WebmentionVerified, WebmentionRejected:
+	default:
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Status must be pending, verified or rejected."})
+		return
+	}
+	mentions, err := Webmentions(status)
+	if err != nil {
+		logging.Request(r).Error("Webmentions failed", "route", "ReadWebmentions", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, mentions)
+}
+
+// DeleteWebmention is a route which removes received Webmention with given ID.
+// Requires admin session cookie.
+func DeleteWebmention(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		render.R.JSON(w, 400, map[string]interface{}{"error": "Webmention ID could not be parsed from request URL."})
+		return
+	}
+	err = Webmention{ID: id}.Delete()
+	if err != nil {
+		if err.Error() == "not found" {
+			render.R.JSON(w, 404, map[string]interface{}{"error": "Not found"})
+			return
+		}
+		logging.Request(r).Error("webmention.Delete failed", "route", "DeleteWebmention", "error", err)
+		render.R.JSON(w, 500, map[string]interface{}{"error": "Internal server error"})
+		return
+	}
+	render.R.JSON(w, 200, map[string]interface{}{"success": "Webmention deleted"})
+}
@@ -0,0 +1,2 @@
+// Package sanitize strips disallowed HTML from rendered post content using allowlist policies.
+package sanitize
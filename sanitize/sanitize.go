@@ -0,0 +1,221 @@
+package sanitize
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Policy is an allowlist of HTML elements, their attributes and URL schemes.
+// Elements not in the list are removed, but their text content is kept unless
+// the element is listed in Drop, in which case the element and everything inside it is removed.
+type Policy struct {
+	// Elements maps allowed element names to their allowed attributes.
+	Elements map[string][]string
+	// Drop lists elements which are removed together with their content.
+	Drop []string
+	// URLAttributes lists attributes which contain URLs and are checked against Schemes.
+	URLAttributes []string
+	// Schemes lists allowed URL schemes. Relative URLs are always allowed.
+	Schemes []string
+}
+
+// Strict is the policy used for regular authors. It allows the markup produced
+// by Markdown and nothing more.
+var Strict = &Policy{
+	Elements: map[string][]string{
+		"a":          {"href", "title"},
+		"abbr":       {"title"},
+		"blockquote": {},
+		"br":         {},
+		"code":       {},
+		"dd":         {},
+		"del":        {},
+		"dl":         {},
+		"dt":         {},
+		"em":         {},
+		"h1":         {"id"},
+		"h2":         {"id"},
+		"h3":         {"id"},
+		"h4":         {"id"},
+		"h5":         {"id"},
+		"h6":         {"id"},
+		"hr":         {},
+		"img":        {"src", "alt", "title"},
+		"li":         {},
+		"ol":         {"start"},
+		"p":          {},
+		"pre":        {},
+		"strong":     {},
+		"sub":        {},
+		"sup":        {},
+		"table":      {},
+		"tbody":      {},
+		"td":         {"align"},
+		"th":         {"align"},
+		"thead":      {},
+		"tr":         {},
+		"ul":         {},
+	},
+	Drop:          []string{"script", "style", "iframe", "object", "embed", "noscript", "template", "textarea", "title", "xmp", "noembed", "noframes", "plaintext"},
+	URLAttributes: []string{"href", "src"},
+	Schemes:       []string{"http", "https", "mailto"},
+}
+
+// Trusted is the policy used for administrators. In addition to Strict it allows
+// embedded media and generic layout elements.
+var Trusted = &Policy{
+	Elements: merge(Strict.Elements, map[string][]string{
+		"audio":      {"src", "controls"},
+		"div":        {"class"},
+		"figcaption": {},
+		"figure":     {},
+		"iframe":     {"src", "width", "height", "frameborder", "allowfullscreen"},
+		"source":     {"src", "type"},
+		"span":       {"class"},
+		"video":      {"src", "controls", "width", "height", "poster"},
+	}),
+	Drop:          []string{"script", "style", "object", "embed", "noscript", "template", "textarea", "title", "xmp", "noembed", "noframes", "plaintext"},
+	URLAttributes: []string{"href", "src", "poster"},
+	Schemes:       []string{"http", "https", "mailto"},
+}
+
+// Policies maps names of the policies, as used in configuration, to the policies.
+var Policies = map[string]*Policy{
+	"strict":  Strict,
+	"trusted": Trusted,
+}
+
+// Roles maps user roles to their sanitization policies. It is set from configuration on startup.
+// Roles which are not listed fall back to Strict.
+var Roles = map[string]*Policy{
+	"admin":  Trusted,
+	"author": Strict,
+}
+
+// ForRole returns the policy of given role or Strict if the role has no policy.
+func ForRole(role string) *Policy {
+	if p, ok := Roles[role]; ok && p != nil {
+		return p
+	}
+	return Strict
+}
+
+func merge(maps ...map[string][]string) map[string][]string {
+	m := make(map[string][]string)
+	for _, elements := range maps {
+		for k, v := range elements {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedURL reports whether s is a relative URL or uses one of the allowed schemes.
+func (p *Policy) allowedURL(s string) bool {
+	s = strings.Map(func(r rune) rune {
+		// browsers ignore whitespace and control characters inside schemes,
+		// so "java\tscript:" has to be treated the same as "javascript:"
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" {
+		return true
+	}
+	return contains(p.Schemes, strings.ToLower(u.Scheme))
+}
+
+// Sanitize returns s with all elements, attributes and URLs not allowed by the policy removed.
+// Markup which passes the policy unchanged is written out as is.
+func (p *Policy) Sanitize(s string) string {
+	var buf bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(s))
+	// name and depth of the element currently being dropped with its content
+	var dropping string
+	var depth int
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return ""
+			}
+			return buf.String()
+		}
+		raw := string(z.Raw())
+		token := z.Token()
+
+		if dropping != "" {
+			switch {
+			case tt == html.StartTagToken && token.Data == dropping:
+				depth++
+			case tt == html.EndTagToken && token.Data == dropping:
+				depth--
+				if depth == 0 {
+					dropping = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			// raw text is kept to preserve entities, unless it contains markup which the
+			// tokenizer treated as text, for example inside <plaintext> or <xmp>
+			if strings.ContainsAny(raw, "<>") {
+				buf.WriteString(html.EscapeString(token.Data))
+				continue
+			}
+			buf.WriteString(raw)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if contains(p.Drop, token.Data) {
+				if tt == html.StartTagToken {
+					dropping = token.Data
+					depth = 1
+				}
+				continue
+			}
+			allowed, ok := p.Elements[token.Data]
+			if !ok {
+				continue
+			}
+			attrs := make([]html.Attribute, 0, len(token.Attr))
+			for _, attr := range token.Attr {
+				if attr.Namespace != "" || !contains(allowed, attr.Key) {
+					continue
+				}
+				if contains(p.URLAttributes, attr.Key) && !p.allowedURL(attr.Val) {
+					continue
+				}
+				attrs = append(attrs, attr)
+			}
+			if len(attrs) == len(token.Attr) && !strings.Contains(raw[1:], "<") {
+				buf.WriteString(raw)
+				continue
+			}
+			token.Attr = attrs
+			buf.WriteString(token.String())
+		case html.EndTagToken:
+			if _, ok := p.Elements[token.Data]; ok {
+				buf.WriteString(token.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/toldjuuso/vertigo/certificate"
+	"github.com/toldjuuso/vertigo/config"
+	"github.com/toldjuuso/vertigo/databases/sqlx"
+)
+
+// newHTTPServer returns a server for handler with limits set according to c.
+func newHTTPServer(c *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              c.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: c.Server.ReadHeaderTimeout,
+		ReadTimeout:       c.Server.ReadTimeout,
+		WriteTimeout:      c.Server.WriteTimeout,
+		IdleTimeout:       c.Server.IdleTimeout,
+		MaxHeaderBytes:    c.Server.MaxHeaderBytes,
+	}
+}
+
+// newTLSConfig returns TLS configuration which serves the certificate of r.
+func newTLSConfig(r *certificate.Reloader) *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// hsts adds Strict-Transport-Security header to all responses according to c.
+func hsts(c config.TLS, next http.Handler) http.Handler {
+	if c.HSTSMaxAge == 0 {
+		return next
+	}
+	value := fmt.Sprintf("max-age=%d", c.HSTSMaxAge)
+	if c.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if c.HSTSPreload {
+		value += "; preload"
+	}
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// redirectHTTPS redirects requests to the same URL on HTTPS listen address.
+func redirectHTTPS(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// serve serves handler according to c until a server fails or the process receives SIGINT or SIGTERM.
+// On a signal new connections are refused, in-flight requests are given c.Server.ShutdownTimeout
+// to finish, after which the background workers are stopped and waited for within the same
+// timeout, and the database connection is closed.
+// When TLS is enabled, SIGHUP reloads the certificate. Email in the outbox is delivered and weekly
+// newsletter digests are sent while serving, as are deliveries to webhooks and ActivityPub inboxes,
+// and received Webmentions are verified.
+func serve(c *config.Config, handler http.Handler) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// registered before anything is started, so a signal during startup is not lost
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	sqlx.Background(func() { sqlx.DeliverMail(ctx, c.Mailer.Interval, c.Mailer.Retention) })
+	sqlx.Background(func() { sqlx.DeliverWebhooks(ctx, time.Minute) })
+	if c.Features.Webmention {
+		sqlx.Background(func() { sqlx.VerifyWebmentions(ctx, time.Minute) })
+	}
+	if c.Features.ActivityPub {
+		sqlx.Background(func() { sqlx.DeliverActivities(ctx, time.Minute) })
+	}
+	if c.Features.Newsletter {
+		sqlx.Background(func() { sqlx.SendDigests(ctx, time.Hour) })
+	}
+
+	var servers []*http.Server
+	var reloader *certificate.Reloader
+	if c.TLS.Enabled() {
+		var err error
+		reloader, err = certificate.New(c.TLS.Cert, c.TLS.Key)
+		if err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+		if c.TLS.ReloadInterval > 0 {
+			go reloader.Watch(ctx, c.TLS.ReloadInterval)
+		}
+		srv := newHTTPServer(c, hsts(c.TLS, handler))
+		srv.TLSConfig = newTLSConfig(reloader)
+		servers = append(servers, srv)
+		if c.TLS.Redirect != "" {
+			redirect := newHTTPServer(c, redirectHTTPS(c.Listen))
+			redirect.Addr = c.TLS.Redirect
+			servers = append(servers, redirect)
+		}
+	} else {
+		servers = append(servers, newHTTPServer(c, handler))
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				slog.Info("listening", "addr", srv.Addr, "tls", true)
+				errs <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			slog.Info("listening", "addr", srv.Addr, "tls", false)
+			errs <- srv.ListenAndServe()
+		}(srv)
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			shutdown(servers, stop, c)
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				slog.Info("shutting down", "signal", sig.String())
+				return shutdown(servers, stop, c)
+			}
+			if reloader == nil {
+				continue
+			}
+			err := reloader.Reload()
+			if err != nil {
+				slog.Error("certificate reload failed", "error", err)
+				continue
+			}
+			slog.Info("certificate reloaded", "file", reloader.CertFile)
+		}
+	}
+}
+
+// shutdown drains servers, stops the background workers with stop and waits for them
+// and other background work before closing the database connection.
+func shutdown(servers []*http.Server, stop context.CancelFunc, c *config.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Server.ShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			slog.Warn("requests still in flight at shutdown", "error", err)
+			srv.Close()
+		}
+	}
+	stop()
+	err := sqlx.Wait(ctx)
+	if err != nil {
+		slog.Warn("background work still running at shutdown", "error", err)
+	}
+	return sqlx.Close()
+}
+
+// healthcheck requests /healthz from the server configured in c. Meant to be used
+// as a container health check, where tools such as curl may not be available.
+func healthcheck(c *config.Config) error {
+	host, port, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	scheme := "http"
+	if c.TLS.Enabled() {
+		scheme = "https"
+		// the certificate is issued for the public hostname, not the loopback address
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	response, err := client.Get(scheme + "://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthcheck: %s", response.Status)
+	}
+	return nil
+}
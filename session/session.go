@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/metrics"
 	"github.com/toldjuuso/vertigo/render"
 
 	"github.com/gorilla/context"
@@ -46,6 +47,9 @@ func SessionSetValue(w http.ResponseWriter, r *http.Request, key string, value i
 	session, _ := store.Get(r, key)
 	session.Values[key] = value
 	session.Save(r, w)
+	if key == "id" {
+		metrics.Sessions.Inc("created")
+	}
 }
 
 func SessionDelete(w http.ResponseWriter, r *http.Request, key string) {
@@ -53,8 +57,11 @@ func SessionDelete(w http.ResponseWriter, r *http.Request, key string) {
 	// panics unless session exists
 	if store != nil {
 		session, _ := store.Get(r, key)
-		session.Options = &sessions.Options{Path: "/", MaxAge: -1, Secure: true, HttpOnly: true}
+		options := *store.Options
+		options.MaxAge = -1
+		session.Options = &options
 		session.Save(r, w)
+		metrics.Sessions.Inc("deleted")
 	}
 }
 
@@ -76,10 +83,53 @@ func SessionRedirect(next http.Handler) http.Handler {
 func ProtectedPage(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		if !sessionIsAlive(r) {
+			metrics.Sessions.Inc("rejected")
+			SessionDelete(w, r, "id")
+			render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// AdminPage makes sure that the user is logged in and has the admin role.
+// Use on pages which change site-wide state, for example installing themes.
+func AdminPage(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id, ok := SessionGetValue(r, "id")
+		if !ok || id < 1 {
+			metrics.Sessions.Inc("rejected")
 			SessionDelete(w, r, "id")
 			render.R.JSON(w, 401, map[string]interface{}{"error": "Unauthorized"})
 			return
 		}
+		var user User
+		user.ID = id
+		role, err := user.GetRole()
+		if err != nil || role != RoleAdmin {
+			render.R.JSON(w, 403, map[string]interface{}{"error": "Forbidden"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// VerifiedPage makes sure that the logged in user has verified their email address.
+// Use after ProtectedPage on pages which publish content, for example creating posts.
+func VerifiedPage(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id, _ := SessionGetValue(r, "id")
+		var user User
+		user.ID = id
+		verified, err := user.GetVerified()
+		if err != nil || !verified {
+			render.R.JSON(w, 403, map[string]interface{}{"error": "Please verify your email address first."})
+			return
+		}
 		next.ServeHTTP(w, r)
 	}
 
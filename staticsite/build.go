@@ -0,0 +1,371 @@
+package staticsite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/toldjuuso/vertigo/databases/sqlx"
+	"github.com/toldjuuso/vertigo/render"
+	"github.com/toldjuuso/vertigo/routes"
+)
+
+// stateFile records what the previous build wrote, relative to the output directory.
+const stateFile = ".vertigo-build.json"
+
+// rootFiles are static files which are served from the root of the site, see NewServer.
+var rootFiles = []string{"apple-touch-icon.png", "browserconfig.xml", "crossdomain.xml", "favicon.ico", "robots.txt", "tile-wide.png", "tile.png"}
+
+// Result tells what a build did.
+type Result struct {
+	// Rendered is the number of pages rendered and Unchanged the number of posts skipped as unchanged.
+	Rendered, Unchanged int
+	// Written is the number of files whose contents changed and Removed the number of files removed.
+	Written, Removed int
+}
+
+type state struct {
+	Fingerprint string `json:"fingerprint"`
+	// Posts holds the revision of each post by slug, see revision.
+	Posts map[string]string `json:"posts"`
+	Files []string          `json:"files"`
+}
+
+type builder struct {
+	dir    string
+	prefix string
+	result *Result
+	files  map[string]bool
+}
+
+// Build renders the site into dir. With force, all posts are rendered even if they are unchanged.
+func Build(dir string, force bool) (*Result, error) {
+	if Settings.Firstrun {
+		return nil, errors.New("site is not installed")
+	}
+	base, err := url.Parse(Settings.Hostname)
+	if err != nil || base.Host == "" {
+		return nil, errors.New("settings hostname should be an absolute URL")
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// search, user accounts, Micropub and federation need the server, so their forms and links are left out
+	for _, feature := range []string{"search", "accounts", "micropub", "webmention", "activitypub"} {
+		enabled := render.Features[feature]
+		render.Features[feature] = false
+		defer func(feature string) { render.Features[feature] = enabled }(feature)
+	}
+
+	b := &builder{
+		dir:    dir,
+		prefix: strings.TrimRight(base.Path, "/"),
+		result: &Result{},
+		files:  make(map[string]bool),
+	}
+	previous := b.readState()
+	current := state{Posts: make(map[string]string)}
+	current.Fingerprint, err = fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	if current.Fingerprint != previous.Fingerprint {
+		force = true
+	}
+
+	var post Post
+	all, err := post.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var posts []Post
+	for _, post := range all {
+		if post.Published {
+			posts = append(posts, post)
+		}
+	}
+
+	for _, post := range posts {
+		name := path.Join("post", post.Slug, "index.html")
+		current.Posts[post.Slug], err = revision(post)
+		if err != nil {
+			return nil, fmt.Errorf("post %s: %v", post.Slug, err)
+		}
+		if rev, ok := previous.Posts[post.Slug]; !force && ok && rev == current.Posts[post.Slug] && b.exists(name) {
+			b.files[name] = true
+			b.result.Unchanged++
+			continue
+		}
+		err = b.page(name, "post/display", post)
+		if err != nil {
+			return nil, fmt.Errorf("post %s: %v", post.Slug, err)
+		}
+	}
+
+	err = b.page("index.html", "home", posts)
+	if err != nil {
+		return nil, err
+	}
+	authors := make(map[int64][]Post)
+	for _, post := range posts {
+		authors[post.Author] = append(authors[post.Author], post)
+	}
+	for id, posts := range authors {
+		err = b.page(path.Join("author", fmt.Sprint(id), "index.html"), "home", posts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if render.Features["feeds"] {
+		err = b.feed(posts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = b.sitemap(posts, authors)
+	if err != nil {
+		return nil, err
+	}
+	err = b.static()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range previous.Files {
+		if !b.files[name] {
+			err = os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			b.result.Removed++
+			removeEmptyParents(dir, path.Dir(name))
+		}
+	}
+	for name := range b.files {
+		current.Files = append(current.Files, name)
+	}
+	sort.Strings(current.Files)
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return b.result, os.WriteFile(filepath.Join(dir, stateFile), data, 0644)
+}
+
+// revision identifies everything the page of post shows besides its view count: the post,
+// the name of its author, and Webmentions and comments under it.
+func revision(post Post) (string, error) {
+	mentions, err := post.Webmentions()
+	if err != nil {
+		return "", err
+	}
+	comments, err := post.Comments()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	err = json.NewEncoder(h).Encode([]interface{}{post.Updated, post.AuthorName, mentions, comments})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprint identifies everything besides posts which affects rendered pages:
+// site settings and templates of the current theme.
+func fingerprint() (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%t\n", Settings.Name, Settings.Description, Settings.Hostname, render.Current().Name, render.Features["feeds"])
+	err := fs.WalkDir(render.Current().Templates(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(render.Current().Templates(), p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", p, len(data))
+		h.Write(data)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (b *builder) readState() state {
+	var s state
+	data, err := os.ReadFile(filepath.Join(b.dir, stateFile))
+	if err == nil {
+		json.Unmarshal(data, &s)
+	}
+	return s
+}
+
+func (b *builder) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(b.dir, filepath.FromSlash(name)))
+	return err == nil
+}
+
+// page renders template with binding into file name.
+func (b *builder) page(name, template string, binding interface{}) error {
+	recorder := httptest.NewRecorder()
+	err := render.R.HTML(recorder, 200, template, binding)
+	if err != nil {
+		return err
+	}
+	b.result.Rendered++
+	return b.write(name, b.rewrite(recorder.Body.Bytes()))
+}
+
+// feed writes the RSS feed of the server as rss.xml, with links pointing to files of the build.
+func (b *builder) feed(posts []Post) error {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/rss", nil)
+	routes.ReadFeed(recorder, request)
+	if recorder.Code != http.StatusOK {
+		return fmt.Errorf("feed: %s", recorder.Body.String())
+	}
+	data := recorder.Body.Bytes()
+	root := strings.TrimRight(Settings.Hostname, "/")
+	for _, post := range posts {
+		link := root + "/post/" + post.Slug
+		data = bytes.ReplaceAll(data, []byte("<link>"+link+"</link>"), []byte("<link>"+link+"/</link>"))
+	}
+	b.result.Rendered++
+	return b.write("rss.xml", data)
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod,omitempty"`
+}
+
+// sitemap writes sitemap.xml listing the homepage, posts and author pages.
+func (b *builder) sitemap(posts []Post, authors map[int64][]Post) error {
+	root := strings.TrimRight(Settings.Hostname, "/")
+	urls := []sitemapURL{{Loc: root + "/"}}
+	for _, post := range posts {
+		urls = append(urls, sitemapURL{Loc: root + "/post/" + url.PathEscape(post.Slug) + "/", Lastmod: time.Unix(post.Updated, 0).UTC().Format("2006-01-02")})
+	}
+	var ids []int64
+	for id := range authors {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		urls = append(urls, sitemapURL{Loc: fmt.Sprintf("%s/author/%d/", root, id)})
+	}
+	set := struct {
+		XMLName xml.Name     `xml:"urlset"`
+		Xmlns   string       `xml:"xmlns,attr"`
+		URLs    []sitemapURL `xml:"url"`
+	}{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9", URLs: urls}
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.write("sitemap.xml", append([]byte(xml.Header), data...))
+}
+
+// static copies static files of the current theme under static/, both by their plain and fingerprinted names,
+// and files served from the root of the site.
+func (b *builder) static() error {
+	files := render.Current().Static()
+	err := fs.WalkDir(files, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(files, p)
+		if err != nil {
+			return err
+		}
+		err = b.write(path.Join("static", p), data)
+		if err != nil {
+			return err
+		}
+		// pages link to fingerprinted names of files given to the asset template helper
+		if url := render.Fingerprint(p); url != "/static/"+p {
+			return b.write(strings.TrimPrefix(url, "/"), data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range rootFiles {
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			continue
+		}
+		err = b.write(name, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes data into file name unless it already has the same contents.
+func (b *builder) write(name string, data []byte) error {
+	b.files[name] = true
+	dst := filepath.Join(b.dir, filepath.FromSlash(name))
+	if existing, err := os.ReadFile(dst); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	b.result.Written++
+	return os.WriteFile(dst, data, 0644)
+}
+
+// links matches root-relative URLs in attributes, but not protocol-relative ones.
+var links = regexp.MustCompile(`(href|src|action)="(/(?:[^/"][^"]*)?)"`)
+
+// postLink matches links to posts.
+var postLink = regexp.MustCompile(`^/post/([^/?#]+)([?#].*)?$`)
+
+// rewrite makes root-relative links of a page point to files of the build.
+func (b *builder) rewrite(page []byte) []byte {
+	return links.ReplaceAllFunc(page, func(match []byte) []byte {
+		m := links.FindSubmatch(match)
+		link := string(m[2])
+		switch {
+		case link == "/rss":
+			link = "/rss.xml"
+		case postLink.MatchString(link):
+			link = postLink.ReplaceAllString(link, "/post/$1/$2")
+		}
+		return []byte(fmt.Sprintf(`%s="%s"`, m[1], b.prefix+link))
+	})
+}
+
+// removeEmptyParents removes dir and its parents under root as long as they are empty.
+func removeEmptyParents(root, dir string) {
+	for dir != "." && dir != "/" {
+		if os.Remove(filepath.Join(root, filepath.FromSlash(dir))) != nil {
+			return
+		}
+		dir = path.Dir(dir)
+	}
+}
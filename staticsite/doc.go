@@ -0,0 +1,13 @@
+// Package staticsite renders the published parts of a site into a directory of files,
+// which can be hosted on a CDN or any static file server.
+//
+// The output contains the homepage, a page for every published post and author, the RSS feed,
+// a sitemap and static files of the current theme. Links are rewritten to work without
+// the server: posts are written as post/<slug>/index.html and linked to with a trailing slash,
+// and root-relative URLs are prefixed with the path of Settings.Hostname, so the site can be
+// hosted in a subdirectory. Features which need the server, such as search, are left out.
+//
+// Builds are incremental. Posts which have not been updated since the previous build are not
+// rendered again, unless settings or the theme have changed, and files are only written
+// when their contents change. Files of posts which have been unpublished or deleted are removed.
+package staticsite
@@ -0,0 +1,4 @@
+// Package webmention discovers Webmention endpoints, sends Webmentions and verifies received ones
+// as described in https://www.w3.org/TR/webmention/. Verification reads the h-entry of the source
+// page to tell likes, reposts and replies apart from plain mentions.
+package webmention
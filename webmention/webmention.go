@@ -0,0 +1,328 @@
+package webmention
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/toldjuuso/vertigo/netguard"
+)
+
+// Kinds of mentions, told apart by the h-entry properties of the source linking to the target.
+const (
+	KindMention = "mention"
+	KindLike    = "like"
+	KindRepost  = "repost"
+	KindReply   = "reply"
+)
+
+// Mention is what a verified source page says about the target.
+type Mention struct {
+	Kind        string
+	AuthorName  string
+	AuthorURL   string
+	AuthorPhoto string
+	// Content is the text of the entry, at most MaxContent characters.
+	Content string
+	// Published is the unix time the entry was published, or 0 if the page does not tell.
+	Published int64
+}
+
+// MaxContent is the number of characters of entry content kept by Verify.
+const MaxContent = 500
+
+// maxBody is the number of bytes of a page which are read.
+const maxBody = 1 << 20
+
+// AllowPrivate allows requests to loopback and private network addresses. Since anyone can make
+// the site fetch a source page, they are refused unless the site is tested locally.
+var AllowPrivate bool
+
+// Client sends requests to endpoints and fetches pages. It refuses to connect to private
+// addresses, see AllowPrivate.
+var Client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: netguard.Control(func() bool { return AllowPrivate }),
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(request *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+// get fetches page at address.
+func get(address string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", "Vertigo-Webmention")
+	request.Header.Set("Accept", "text/html, */*;q=0.5")
+	return Client.Do(request)
+}
+
+// isHTML reports whether response is an HTML page.
+func isHTML(response *http.Response) bool {
+	mediatype, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return err == nil && (mediatype == "text/html" || mediatype == "application/xhtml+xml")
+}
+
+// resolve returns ref as an absolute URL relative to base, or an empty string if it is not
+// an http or https URL.
+func resolve(base *url.URL, ref string) string {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
+
+// same reports whether URLs a and b point to the same page, ignoring the fragment,
+// a trailing slash and letter case of the scheme and host.
+func same(a string, b string) bool {
+	u, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	v, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, v.Scheme) && strings.EqualFold(u.Host, v.Host) &&
+		strings.TrimRight(u.Path, "/") == strings.TrimRight(v.Path, "/") && u.RawQuery == v.RawQuery
+}
+
+// linkHeader returns the first URL of Link header values whose rel includes webmention.
+func linkHeader(values []string) string {
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, rel, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "rel") {
+					continue
+				}
+				for _, r := range strings.Fields(strings.Trim(strings.TrimSpace(rel), `"`)) {
+					if strings.EqualFold(r, "webmention") {
+						return strings.Trim(target, "<>")
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Discover returns the Webmention endpoint of target, advertised with a Link header or
+// a link or a element with rel webmention. Returns "endpoint not found" error if target has none.
+func Discover(target string) (string, error) {
+	response, err := get(target)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("target responded %s", response.Status)
+	}
+	// relative endpoints are relative to the page after redirects
+	base := response.Request.URL
+	if link := linkHeader(response.Header.Values("Link")); link != "" {
+		if endpoint := resolve(base, link); endpoint != "" {
+			return endpoint, nil
+		}
+	}
+	if !isHTML(response) {
+		return "", errors.New("endpoint not found")
+	}
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(response.Body, maxBody))
+	if err != nil {
+		return "", err
+	}
+	endpoint := ""
+	doc.Find("link[rel~=webmention][href], a[rel~=webmention][href]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		endpoint = resolve(base, s.AttrOr("href", ""))
+		return endpoint == ""
+	})
+	if endpoint == "" {
+		return "", errors.New("endpoint not found")
+	}
+	return endpoint, nil
+}
+
+// Send notifies endpoint that source links to target.
+func Send(endpoint string, source string, target string) error {
+	form := url.Values{"source": {source}, "target": {target}}
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("User-Agent", "Vertigo-Webmention")
+	response, err := Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %s", response.Status)
+	}
+	return nil
+}
+
+// Links returns the distinct http and https URLs linked from HTML content, with relative links
+// resolved against base and fragments removed.
+func Links(content string, base string) []string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	var links []string
+	seen := make(map[string]bool)
+	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		link := resolve(b, s.AttrOr("href", ""))
+		if link == "" {
+			return
+		}
+		u, _ := url.Parse(link)
+		u.Fragment = ""
+		link = u.String()
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	})
+	return links
+}
+
+// Verify fetches source and checks that it links to target. Returns "source gone" error if
+// source has been deleted and "target not linked" error if it does not link to target,
+// in which case a mention received earlier should be removed.
+func Verify(source string, target string) (Mention, error) {
+	mention := Mention{Kind: KindMention}
+	response, err := get(source)
+	if err != nil {
+		return mention, err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == 404 || response.StatusCode == 410:
+		return mention, errors.New("source gone")
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return mention, fmt.Errorf("source responded %s", response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBody))
+	if err != nil {
+		return mention, err
+	}
+	if !isHTML(response) {
+		if !bytes.Contains(body, []byte(target)) {
+			return mention, errors.New("target not linked")
+		}
+		return mention, nil
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return mention, err
+	}
+	base := response.Request.URL
+	linked := func(s *goquery.Selection) bool {
+		found := false
+		s.Find("[href], [src]").AddSelection(s.Filter("[href], [src]")).EachWithBreak(func(i int, s *goquery.Selection) bool {
+			ref, ok := s.Attr("href")
+			if !ok {
+				ref = s.AttrOr("src", "")
+			}
+			found = same(resolve(base, ref), target)
+			return !found
+		})
+		return found
+	}
+	if !linked(doc.Selection) {
+		return mention, errors.New("target not linked")
+	}
+	entry := doc.Find(".h-entry").First()
+	if entry.Length() == 0 {
+		return mention, nil
+	}
+	for _, kind := range []struct {
+		class string
+		kind  string
+	}{
+		{".u-like-of", KindLike},
+		{".u-repost-of", KindRepost},
+		{".u-in-reply-to", KindReply},
+	} {
+		if linked(entry.Find(kind.class)) {
+			mention.Kind = kind.kind
+			break
+		}
+	}
+	author := entry.Find(".p-author").First()
+	if author.Length() == 0 {
+		author = doc.Find(".h-card").First()
+	}
+	if author.Length() > 0 {
+		mention.AuthorName = text(author.Find(".p-name").First())
+		if mention.AuthorName == "" {
+			mention.AuthorName = text(author)
+		}
+		mention.AuthorURL = resolve(base, author.Find(".u-url[href]").First().AttrOr("href", author.AttrOr("href", "")))
+		photo := author.Find(".u-photo").AddSelection(author.Filter("img")).First()
+		mention.AuthorPhoto = resolve(base, photo.AttrOr("src", ""))
+	}
+	if mention.Kind == KindReply || mention.Kind == KindMention {
+		content := entry.Find(".e-content, .p-content").First()
+		if content.Length() == 0 {
+			content = entry.Find(".p-name").First()
+		}
+		mention.Content = text(content)
+		if r := []rune(mention.Content); len(r) > MaxContent {
+			mention.Content = string(r[:MaxContent-1]) + "…"
+		}
+	}
+	if published := entry.Find(".dt-published").First(); published.Length() > 0 {
+		mention.Published = parseTime(published.AttrOr("datetime", text(published)))
+	}
+	return mention, nil
+}
+
+// text returns the text of s with whitespace collapsed.
+func text(s *goquery.Selection) string {
+	return strings.Join(strings.Fields(s.Text()), " ")
+}
+
+// parseTime returns unix time of s in one of the formats used for dt-published, or 0.
+func parseTime(s string) int64 {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.Parse(layout, strings.TrimSpace(s))
+		if err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}